@@ -0,0 +1,619 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// token counts bedrock appends to the last chunk of every stream
+type invocationMetrics struct {
+	Metrics *struct {
+		InputTokenCount  int `json:"inputTokenCount"`
+		OutputTokenCount int `json:"outputTokenCount"`
+	} `json:"amazon-bedrock-invocationMetrics"`
+}
+
+// fill token counts from the invocation metrics of a chunk, if present
+func withInvocationMetrics(chunk []byte, out ModelChunk) ModelChunk {
+
+	var metrics invocationMetrics
+
+	if json.Unmarshal(chunk, &metrics) == nil && metrics.Metrics != nil {
+		out.InputTokens = metrics.Metrics.InputTokenCount
+		out.OutputTokens = metrics.Metrics.OutputTokenCount
+	}
+
+	return out
+}
+
+// concatenated text blocks of a message
+func messageText(message Message) string {
+
+	var sb strings.Builder
+
+	for _, content := range message.Content {
+		if content.Type == "text" {
+			sb.WriteString(content.Text)
+		}
+	}
+
+	return sb.String()
+}
+
+// reject image blocks for families whose adapter only sends text
+func textOnly(messages []Message) error {
+	for _, message := range messages {
+		for _, content := range message.Content {
+			if content.Type != "text" {
+				return fmt.Errorf("content type %q is not supported by this model", content.Type)
+			}
+		}
+	}
+	return nil
+}
+
+// anthropic claude3 messages api
+type claude3Adapter struct{}
+
+func (claude3Adapter) Limits() ModelLimits {
+	return ModelLimits{MaxTokens: 4096, MaxTemperature: 1, MaxTopK: 500, MaxStopSequences: 8191}
+}
+
+func (claude3Adapter) BuildRequest(messages []Message, params InferenceParameters) ([]byte, error) {
+	return json.Marshal(RequestBodyClaude3{
+		MaxTokensToSample: params.MaxTokensOrDefault(),
+		AnthropicVersion:  ANTHROPIC_VERSION,
+		Temperature:       params.TemperatureOrDefault(),
+		TopP:              params.TopP,
+		TopK:              params.TopK,
+		StopSequences:     params.StopSequences,
+		System:            params.System,
+		Messages:          messages,
+	})
+}
+
+func (claude3Adapter) ParseChunk(chunk []byte) (ModelChunk, error) {
+
+	var resp ResponseClaude3
+
+	if err := json.Unmarshal(chunk, &resp); err != nil {
+		return ModelChunk{}, err
+	}
+
+	var out ModelChunk
+
+	switch resp.Type {
+	case "message_start":
+		if resp.Message != nil {
+			out.InputTokens = resp.Message.Usage.InputTokens
+		}
+	case "content_block_delta":
+		out.Text = resp.Delta.Text
+	case "message_delta":
+		out.StopReason = resp.Delta.StopReason
+		if resp.Usage != nil {
+			out.OutputTokens = resp.Usage.OutputTokens
+		}
+	case "message_stop":
+		out = withInvocationMetrics(chunk, out)
+	}
+
+	return out, nil
+}
+
+func (claude3Adapter) ParseResponse(body []byte) (ModelChunk, error) {
+
+	var resp ResponseBodyClaude3
+
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return ModelChunk{}, err
+	}
+
+	var sb strings.Builder
+
+	for _, content := range resp.Content {
+		if content.Type == "text" {
+			sb.WriteString(content.Text)
+		}
+	}
+
+	return ModelChunk{
+		Text:         sb.String(),
+		StopReason:   resp.StopReason,
+		InputTokens:  resp.Usage.InputTokens,
+		OutputTokens: resp.Usage.OutputTokens,
+	}, nil
+}
+
+// meta llama3 text completion with the llama3 chat template
+type llamaAdapter struct{}
+
+func (llamaAdapter) Limits() ModelLimits {
+	return ModelLimits{MaxTokens: 2048, MaxTemperature: 1}
+}
+
+func (llamaAdapter) BuildRequest(messages []Message, params InferenceParameters) ([]byte, error) {
+
+	if err := textOnly(messages); err != nil {
+		return nil, err
+	}
+
+	var prompt strings.Builder
+
+	prompt.WriteString("<|begin_of_text|>")
+
+	if params.System != "" {
+		fmt.Fprintf(&prompt, "<|start_header_id|>system<|end_header_id|>\n\n%s<|eot_id|>", params.System)
+	}
+
+	for _, message := range messages {
+		fmt.Fprintf(&prompt, "<|start_header_id|>%s<|end_header_id|>\n\n%s<|eot_id|>", message.Role, messageText(message))
+	}
+
+	prompt.WriteString("<|start_header_id|>assistant<|end_header_id|>\n\n")
+
+	body := map[string]interface{}{
+		"prompt":      prompt.String(),
+		"max_gen_len": params.MaxTokensOrDefault(),
+		"temperature": *params.TemperatureOrDefault(),
+	}
+
+	if params.TopP != nil {
+		body["top_p"] = *params.TopP
+	}
+
+	return json.Marshal(body)
+}
+
+type llamaResponse struct {
+	Generation           string `json:"generation"`
+	PromptTokenCount     int    `json:"prompt_token_count"`
+	GenerationTokenCount int    `json:"generation_token_count"`
+	StopReason           string `json:"stop_reason"`
+}
+
+func (llamaAdapter) ParseChunk(chunk []byte) (ModelChunk, error) {
+
+	var resp llamaResponse
+
+	if err := json.Unmarshal(chunk, &resp); err != nil {
+		return ModelChunk{}, err
+	}
+
+	return withInvocationMetrics(chunk, ModelChunk{
+		Text:         resp.Generation,
+		StopReason:   resp.StopReason,
+		InputTokens:  resp.PromptTokenCount,
+		OutputTokens: resp.GenerationTokenCount,
+	}), nil
+}
+
+func (a llamaAdapter) ParseResponse(body []byte) (ModelChunk, error) {
+	return a.ParseChunk(body)
+}
+
+// mistral text completion with the [INST] instruction template
+type mistralAdapter struct{}
+
+func (mistralAdapter) Limits() ModelLimits {
+	return ModelLimits{MaxTokens: 8192, MaxTemperature: 1, MaxTopK: 200, MaxStopSequences: 10}
+}
+
+func (mistralAdapter) BuildRequest(messages []Message, params InferenceParameters) ([]byte, error) {
+
+	if err := textOnly(messages); err != nil {
+		return nil, err
+	}
+
+	var prompt strings.Builder
+
+	prompt.WriteString("<s>")
+
+	for k, message := range messages {
+		text := messageText(message)
+		switch message.Role {
+		case "user":
+			// mistral has no system role, the system prompt leads the first instruction
+			if k == 0 && params.System != "" {
+				text = params.System + "\n\n" + text
+			}
+			fmt.Fprintf(&prompt, "[INST] %s [/INST]", text)
+		default:
+			fmt.Fprintf(&prompt, "%s</s>", text)
+		}
+	}
+
+	body := map[string]interface{}{
+		"prompt":      prompt.String(),
+		"max_tokens":  params.MaxTokensOrDefault(),
+		"temperature": *params.TemperatureOrDefault(),
+	}
+
+	if params.TopP != nil {
+		body["top_p"] = *params.TopP
+	}
+
+	if params.TopK != nil {
+		body["top_k"] = *params.TopK
+	}
+
+	if len(params.StopSequences) > 0 {
+		body["stop"] = params.StopSequences
+	}
+
+	return json.Marshal(body)
+}
+
+type mistralResponse struct {
+	Outputs []struct {
+		Text       string `json:"text"`
+		StopReason string `json:"stop_reason"`
+	} `json:"outputs"`
+}
+
+func (mistralAdapter) ParseChunk(chunk []byte) (ModelChunk, error) {
+
+	var resp mistralResponse
+
+	if err := json.Unmarshal(chunk, &resp); err != nil {
+		return ModelChunk{}, err
+	}
+
+	var out ModelChunk
+
+	for _, output := range resp.Outputs {
+		out.Text += output.Text
+		if output.StopReason != "" {
+			out.StopReason = output.StopReason
+		}
+	}
+
+	return withInvocationMetrics(chunk, out), nil
+}
+
+func (a mistralAdapter) ParseResponse(body []byte) (ModelChunk, error) {
+	return a.ParseChunk(body)
+}
+
+// amazon titan text generation
+type titanTextAdapter struct{}
+
+func (titanTextAdapter) Limits() ModelLimits {
+	return ModelLimits{MaxTokens: 8192, MaxTemperature: 1, MaxStopSequences: 4}
+}
+
+func (titanTextAdapter) BuildRequest(messages []Message, params InferenceParameters) ([]byte, error) {
+
+	if err := textOnly(messages); err != nil {
+		return nil, err
+	}
+
+	var prompt strings.Builder
+
+	if params.System != "" {
+		prompt.WriteString(params.System + "\n\n")
+	}
+
+	for _, message := range messages {
+		role := "User"
+		if message.Role == "assistant" {
+			role = "Bot"
+		}
+		fmt.Fprintf(&prompt, "%s: %s\n", role, messageText(message))
+	}
+
+	prompt.WriteString("Bot:")
+
+	config := map[string]interface{}{
+		"maxTokenCount": params.MaxTokensOrDefault(),
+		"temperature":   *params.TemperatureOrDefault(),
+	}
+
+	if params.TopP != nil {
+		config["topP"] = *params.TopP
+	}
+
+	if len(params.StopSequences) > 0 {
+		config["stopSequences"] = params.StopSequences
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"inputText":            prompt.String(),
+		"textGenerationConfig": config,
+	})
+}
+
+func (titanTextAdapter) ParseChunk(chunk []byte) (ModelChunk, error) {
+
+	var resp struct {
+		OutputText                string `json:"outputText"`
+		InputTextTokenCount       int    `json:"inputTextTokenCount"`
+		TotalOutputTextTokenCount int    `json:"totalOutputTextTokenCount"`
+		CompletionReason          string `json:"completionReason"`
+	}
+
+	if err := json.Unmarshal(chunk, &resp); err != nil {
+		return ModelChunk{}, err
+	}
+
+	return withInvocationMetrics(chunk, ModelChunk{
+		Text:         resp.OutputText,
+		StopReason:   resp.CompletionReason,
+		InputTokens:  resp.InputTextTokenCount,
+		OutputTokens: resp.TotalOutputTextTokenCount,
+	}), nil
+}
+
+func (titanTextAdapter) ParseResponse(body []byte) (ModelChunk, error) {
+
+	var resp struct {
+		InputTextTokenCount int `json:"inputTextTokenCount"`
+		Results             []struct {
+			TokenCount       int    `json:"tokenCount"`
+			OutputText       string `json:"outputText"`
+			CompletionReason string `json:"completionReason"`
+		} `json:"results"`
+	}
+
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return ModelChunk{}, err
+	}
+
+	out := ModelChunk{InputTokens: resp.InputTextTokenCount}
+
+	for _, result := range resp.Results {
+		out.Text += result.OutputText
+		out.StopReason = result.CompletionReason
+		out.OutputTokens += result.TokenCount
+	}
+
+	return out, nil
+}
+
+// amazon nova messages-v1 schema
+type novaAdapter struct{}
+
+func (novaAdapter) Limits() ModelLimits {
+	return ModelLimits{MaxTokens: 5000, MaxTemperature: 1, MaxTopK: 128, MaxStopSequences: 4}
+}
+
+func (novaAdapter) BuildRequest(messages []Message, params InferenceParameters) ([]byte, error) {
+
+	type novaContent map[string]interface{}
+
+	type novaMessage struct {
+		Role    string        `json:"role"`
+		Content []novaContent `json:"content"`
+	}
+
+	novaMessages := make([]novaMessage, 0, len(messages))
+
+	for _, message := range messages {
+		content := make([]novaContent, 0, len(message.Content))
+		for _, block := range message.Content {
+			switch {
+			case block.Type == "text":
+				content = append(content, novaContent{"text": block.Text})
+			case block.Type == "image" && block.Source != nil:
+				content = append(content, novaContent{"image": map[string]interface{}{
+					"format": strings.TrimPrefix(block.Source.MediaType, "image/"),
+					"source": map[string]string{"bytes": block.Source.Data},
+				}})
+			default:
+				return nil, fmt.Errorf("content type %q is not supported by this model", block.Type)
+			}
+		}
+		novaMessages = append(novaMessages, novaMessage{Role: message.Role, Content: content})
+	}
+
+	inferenceConfig := map[string]interface{}{
+		"maxTokens":   params.MaxTokensOrDefault(),
+		"temperature": *params.TemperatureOrDefault(),
+	}
+
+	if params.TopP != nil {
+		inferenceConfig["topP"] = *params.TopP
+	}
+
+	if params.TopK != nil {
+		inferenceConfig["topK"] = *params.TopK
+	}
+
+	if len(params.StopSequences) > 0 {
+		inferenceConfig["stopSequences"] = params.StopSequences
+	}
+
+	body := map[string]interface{}{
+		"schemaVersion":   "messages-v1",
+		"messages":        novaMessages,
+		"inferenceConfig": inferenceConfig,
+	}
+
+	if params.System != "" {
+		body["system"] = []map[string]string{{"text": params.System}}
+	}
+
+	return json.Marshal(body)
+}
+
+func (novaAdapter) ParseChunk(chunk []byte) (ModelChunk, error) {
+
+	var resp struct {
+		ContentBlockDelta *struct {
+			Delta struct {
+				Text string `json:"text"`
+			} `json:"delta"`
+		} `json:"contentBlockDelta"`
+		MessageStop *struct {
+			StopReason string `json:"stopReason"`
+		} `json:"messageStop"`
+		Metadata *struct {
+			Usage struct {
+				InputTokens  int `json:"inputTokens"`
+				OutputTokens int `json:"outputTokens"`
+			} `json:"usage"`
+		} `json:"metadata"`
+	}
+
+	if err := json.Unmarshal(chunk, &resp); err != nil {
+		return ModelChunk{}, err
+	}
+
+	var out ModelChunk
+
+	if resp.ContentBlockDelta != nil {
+		out.Text = resp.ContentBlockDelta.Delta.Text
+	}
+
+	if resp.MessageStop != nil {
+		out.StopReason = resp.MessageStop.StopReason
+	}
+
+	if resp.Metadata != nil {
+		out.InputTokens = resp.Metadata.Usage.InputTokens
+		out.OutputTokens = resp.Metadata.Usage.OutputTokens
+	}
+
+	return withInvocationMetrics(chunk, out), nil
+}
+
+func (novaAdapter) ParseResponse(body []byte) (ModelChunk, error) {
+
+	var resp struct {
+		Output struct {
+			Message struct {
+				Content []struct {
+					Text string `json:"text"`
+				} `json:"content"`
+			} `json:"message"`
+		} `json:"output"`
+		StopReason string `json:"stopReason"`
+		Usage      struct {
+			InputTokens  int `json:"inputTokens"`
+			OutputTokens int `json:"outputTokens"`
+		} `json:"usage"`
+	}
+
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return ModelChunk{}, err
+	}
+
+	out := ModelChunk{
+		StopReason:   resp.StopReason,
+		InputTokens:  resp.Usage.InputTokens,
+		OutputTokens: resp.Usage.OutputTokens,
+	}
+
+	for _, content := range resp.Output.Message.Content {
+		out.Text += content.Text
+	}
+
+	return out, nil
+}
+
+// cohere command r chat api, the last message is the question and the rest
+// becomes chat_history
+type cohereAdapter struct{}
+
+func (cohereAdapter) Limits() ModelLimits {
+	return ModelLimits{MaxTokens: 4096, MaxTemperature: 1, MaxTopK: 500, MaxStopSequences: 4}
+}
+
+func (cohereAdapter) BuildRequest(messages []Message, params InferenceParameters) ([]byte, error) {
+
+	if err := textOnly(messages); err != nil {
+		return nil, err
+	}
+
+	if len(messages) == 0 {
+		return nil, fmt.Errorf("messages must not be empty")
+	}
+
+	history := make([]map[string]string, 0, len(messages)-1)
+
+	for _, message := range messages[:len(messages)-1] {
+		role := "USER"
+		if message.Role == "assistant" {
+			role = "CHATBOT"
+		}
+		history = append(history, map[string]string{"role": role, "message": messageText(message)})
+	}
+
+	body := map[string]interface{}{
+		"message":      messageText(messages[len(messages)-1]),
+		"chat_history": history,
+		"max_tokens":   params.MaxTokensOrDefault(),
+		"temperature":  *params.TemperatureOrDefault(),
+	}
+
+	if params.System != "" {
+		body["preamble"] = params.System
+	}
+
+	if params.TopP != nil {
+		body["p"] = *params.TopP
+	}
+
+	if params.TopK != nil {
+		body["k"] = *params.TopK
+	}
+
+	if len(params.StopSequences) > 0 {
+		body["stop_sequences"] = params.StopSequences
+	}
+
+	return json.Marshal(body)
+}
+
+func (cohereAdapter) ParseChunk(chunk []byte) (ModelChunk, error) {
+
+	var resp struct {
+		EventType    string `json:"event_type"`
+		Text         string `json:"text"`
+		FinishReason string `json:"finish_reason"`
+	}
+
+	if err := json.Unmarshal(chunk, &resp); err != nil {
+		return ModelChunk{}, err
+	}
+
+	var out ModelChunk
+
+	switch resp.EventType {
+	case "text-generation":
+		out.Text = resp.Text
+	case "stream-end":
+		out.StopReason = resp.FinishReason
+	}
+
+	return withInvocationMetrics(chunk, out), nil
+}
+
+func (cohereAdapter) ParseResponse(body []byte) (ModelChunk, error) {
+
+	var resp struct {
+		Text         string `json:"text"`
+		FinishReason string `json:"finish_reason"`
+		Meta         struct {
+			BilledUnits struct {
+				InputTokens  int `json:"input_tokens"`
+				OutputTokens int `json:"output_tokens"`
+			} `json:"billed_units"`
+		} `json:"meta"`
+	}
+
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return ModelChunk{}, err
+	}
+
+	return ModelChunk{
+		Text:         resp.Text,
+		StopReason:   resp.FinishReason,
+		InputTokens:  resp.Meta.BilledUnits.InputTokens,
+		OutputTokens: resp.Meta.BilledUnits.OutputTokens,
+	}, nil
+}
@@ -0,0 +1,251 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// fail unless got and want hold the same json value
+func jsonEqual(t *testing.T, got []byte, want string) {
+
+	t.Helper()
+
+	var gotValue, wantValue interface{}
+
+	if err := json.Unmarshal(got, &gotValue); err != nil {
+		t.Fatalf("decode %s: %v", got, err)
+	}
+
+	if err := json.Unmarshal([]byte(want), &wantValue); err != nil {
+		t.Fatalf("decode want %s: %v", want, err)
+	}
+
+	if !reflect.DeepEqual(gotValue, wantValue) {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestAdapterBuildRequest(t *testing.T) {
+
+	maxTokens, temperature, topP, topK := 100, 0.2, 0.8, 50
+
+	full := InferenceParameters{
+		System:        "be brief",
+		MaxTokens:     &maxTokens,
+		Temperature:   &temperature,
+		TopP:          &topP,
+		TopK:          &topK,
+		StopSequences: []string{"END"},
+	}
+
+	conversation := []Message{
+		{Role: "user", Content: []Content{{Type: "text", Text: "hi"}}},
+		{Role: "assistant", Content: []Content{{Type: "text", Text: "hello"}}},
+		{Role: "user", Content: []Content{{Type: "text", Text: "how "}, {Type: "text", Text: "are you?"}}},
+	}
+
+	question := []Message{{Role: "user", Content: []Content{{Type: "text", Text: "hi"}}}}
+
+	image := []Message{{Role: "user", Content: []Content{
+		{Type: "image", Source: &ImageSource{Type: "base64", MediaType: "image/png", Data: "iVBORw0KGgo="}},
+		{Type: "text", Text: "what is it?"},
+	}}}
+
+	tests := []struct {
+		name     string
+		adapter  ModelAdapter
+		messages []Message
+		params   InferenceParameters
+		want     string
+		err      string
+	}{
+		{
+			name: "claude3", adapter: claude3Adapter{}, messages: conversation, params: full,
+			want: `{"max_tokens": 100, "temperature": 0.2, "top_p": 0.8, "top_k": 50, "stop_sequences": ["END"], "system": "be brief", "anthropic_version": "bedrock-2023-05-31", "messages": [
+				{"role": "user", "content": [{"type": "text", "text": "hi"}]},
+				{"role": "assistant", "content": [{"type": "text", "text": "hello"}]},
+				{"role": "user", "content": [{"type": "text", "text": "how "}, {"type": "text", "text": "are you?"}]}]}`,
+		},
+		{
+			name: "claude3 defaults", adapter: claude3Adapter{}, messages: question,
+			want: `{"max_tokens": 2048, "temperature": 0.9, "anthropic_version": "bedrock-2023-05-31", "messages": [{"role": "user", "content": [{"type": "text", "text": "hi"}]}]}`,
+		},
+		{
+			name: "claude3 image", adapter: claude3Adapter{}, messages: image,
+			want: `{"max_tokens": 2048, "temperature": 0.9, "anthropic_version": "bedrock-2023-05-31", "messages": [{"role": "user", "content": [
+				{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "iVBORw0KGgo="}},
+				{"type": "text", "text": "what is it?"}]}]}`,
+		},
+		{
+			name: "llama", adapter: llamaAdapter{}, messages: conversation, params: full,
+			want: `{"prompt": "<|begin_of_text|><|start_header_id|>system<|end_header_id|>\n\nbe brief<|eot_id|><|start_header_id|>user<|end_header_id|>\n\nhi<|eot_id|><|start_header_id|>assistant<|end_header_id|>\n\nhello<|eot_id|><|start_header_id|>user<|end_header_id|>\n\nhow are you?<|eot_id|><|start_header_id|>assistant<|end_header_id|>\n\n", "max_gen_len": 100, "temperature": 0.2, "top_p": 0.8}`,
+		},
+		{
+			name: "llama defaults", adapter: llamaAdapter{}, messages: question,
+			want: `{"prompt": "<|begin_of_text|><|start_header_id|>user<|end_header_id|>\n\nhi<|eot_id|><|start_header_id|>assistant<|end_header_id|>\n\n", "max_gen_len": 2048, "temperature": 0.9}`,
+		},
+		{name: "llama image", adapter: llamaAdapter{}, messages: image, err: `content type "image" is not supported by this model`},
+		{
+			name: "mistral", adapter: mistralAdapter{}, messages: conversation, params: full,
+			want: `{"prompt": "<s>[INST] be brief\n\nhi [/INST]hello</s>[INST] how are you? [/INST]", "max_tokens": 100, "temperature": 0.2, "top_p": 0.8, "top_k": 50, "stop": ["END"]}`,
+		},
+		{
+			name: "mistral defaults", adapter: mistralAdapter{}, messages: question,
+			want: `{"prompt": "<s>[INST] hi [/INST]", "max_tokens": 2048, "temperature": 0.9}`,
+		},
+		{name: "mistral image", adapter: mistralAdapter{}, messages: image, err: `content type "image" is not supported by this model`},
+		{
+			name: "titan", adapter: titanTextAdapter{}, messages: conversation, params: full,
+			want: `{"inputText": "be brief\n\nUser: hi\nBot: hello\nUser: how are you?\nBot:", "textGenerationConfig": {"maxTokenCount": 100, "temperature": 0.2, "topP": 0.8, "stopSequences": ["END"]}}`,
+		},
+		{
+			name: "titan defaults", adapter: titanTextAdapter{}, messages: question,
+			want: `{"inputText": "User: hi\nBot:", "textGenerationConfig": {"maxTokenCount": 2048, "temperature": 0.9}}`,
+		},
+		{name: "titan image", adapter: titanTextAdapter{}, messages: image, err: `content type "image" is not supported by this model`},
+		{
+			name: "nova", adapter: novaAdapter{}, messages: conversation, params: full,
+			want: `{"schemaVersion": "messages-v1", "system": [{"text": "be brief"}], "messages": [
+				{"role": "user", "content": [{"text": "hi"}]},
+				{"role": "assistant", "content": [{"text": "hello"}]},
+				{"role": "user", "content": [{"text": "how "}, {"text": "are you?"}]}],
+				"inferenceConfig": {"maxTokens": 100, "temperature": 0.2, "topP": 0.8, "topK": 50, "stopSequences": ["END"]}}`,
+		},
+		{
+			name: "nova image", adapter: novaAdapter{}, messages: image,
+			want: `{"schemaVersion": "messages-v1", "messages": [{"role": "user", "content": [
+				{"image": {"format": "png", "source": {"bytes": "iVBORw0KGgo="}}},
+				{"text": "what is it?"}]}],
+				"inferenceConfig": {"maxTokens": 2048, "temperature": 0.9}}`,
+		},
+		{
+			name: "nova document", adapter: novaAdapter{}, messages: []Message{{Role: "user", Content: []Content{{Type: "document"}}}},
+			err: `content type "document" is not supported by this model`,
+		},
+		{
+			name: "cohere", adapter: cohereAdapter{}, messages: conversation, params: full,
+			want: `{"message": "how are you?", "chat_history": [{"role": "USER", "message": "hi"}, {"role": "CHATBOT", "message": "hello"}], "preamble": "be brief", "max_tokens": 100, "temperature": 0.2, "p": 0.8, "k": 50, "stop_sequences": ["END"]}`,
+		},
+		{
+			name: "cohere defaults", adapter: cohereAdapter{}, messages: question,
+			want: `{"message": "hi", "chat_history": [], "max_tokens": 2048, "temperature": 0.9}`,
+		},
+		{name: "cohere image", adapter: cohereAdapter{}, messages: image, err: `content type "image" is not supported by this model`},
+		{name: "cohere no messages", adapter: cohereAdapter{}, err: "messages must not be empty"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			body, err := test.adapter.BuildRequest(test.messages, test.params)
+
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			jsonEqual(t, body, test.want)
+		})
+	}
+}
+
+func TestAdapterParseChunk(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		adapter ModelAdapter
+		chunk   string
+		want    ModelChunk
+	}{
+		{"claude3 message start", claude3Adapter{}, `{"type": "message_start", "message": {"id": "msg_1", "usage": {"input_tokens": 12, "output_tokens": 1}}}`, ModelChunk{InputTokens: 12}},
+		{"claude3 block start", claude3Adapter{}, `{"type": "content_block_start", "index": 0, "content_block": {"type": "text", "text": ""}}`, ModelChunk{}},
+		{"claude3 text", claude3Adapter{}, `{"type": "content_block_delta", "index": 0, "delta": {"type": "text_delta", "text": "Hi"}}`, ModelChunk{Text: "Hi"}},
+		{"claude3 tool input", claude3Adapter{}, `{"type": "content_block_delta", "index": 1, "delta": {"type": "input_json_delta", "partial_json": "{\"a\""}}`, ModelChunk{}},
+		{"claude3 message delta", claude3Adapter{}, `{"type": "message_delta", "delta": {"stop_reason": "end_turn"}, "usage": {"output_tokens": 5}}`, ModelChunk{StopReason: "end_turn", OutputTokens: 5}},
+		{"claude3 message stop", claude3Adapter{}, `{"type": "message_stop", "amazon-bedrock-invocationMetrics": {"inputTokenCount": 12, "outputTokenCount": 5}}`, ModelChunk{InputTokens: 12, OutputTokens: 5}},
+
+		{"llama text", llamaAdapter{}, `{"generation": "Hi", "prompt_token_count": 7, "generation_token_count": 1, "stop_reason": null}`, ModelChunk{Text: "Hi", InputTokens: 7, OutputTokens: 1}},
+		{"llama last", llamaAdapter{}, `{"generation": "", "prompt_token_count": null, "generation_token_count": 3, "stop_reason": "stop", "amazon-bedrock-invocationMetrics": {"inputTokenCount": 7, "outputTokenCount": 3}}`, ModelChunk{StopReason: "stop", InputTokens: 7, OutputTokens: 3}},
+
+		{"mistral text", mistralAdapter{}, `{"outputs": [{"text": "Hi", "stop_reason": null}]}`, ModelChunk{Text: "Hi"}},
+		{"mistral last", mistralAdapter{}, `{"outputs": [{"text": "!", "stop_reason": "stop"}], "amazon-bedrock-invocationMetrics": {"inputTokenCount": 9, "outputTokenCount": 2}}`, ModelChunk{Text: "!", StopReason: "stop", InputTokens: 9, OutputTokens: 2}},
+
+		{"titan text", titanTextAdapter{}, `{"outputText": "Hi", "index": 0, "totalOutputTextTokenCount": 1, "completionReason": null, "inputTextTokenCount": 4}`, ModelChunk{Text: "Hi", InputTokens: 4, OutputTokens: 1}},
+		{"titan last", titanTextAdapter{}, `{"outputText": "", "index": 0, "totalOutputTextTokenCount": 2, "completionReason": "FINISH", "inputTextTokenCount": null}`, ModelChunk{StopReason: "FINISH", OutputTokens: 2}},
+
+		{"nova text", novaAdapter{}, `{"contentBlockDelta": {"delta": {"text": "Hi"}, "contentBlockIndex": 0}}`, ModelChunk{Text: "Hi"}},
+		{"nova stop", novaAdapter{}, `{"messageStop": {"stopReason": "end_turn"}}`, ModelChunk{StopReason: "end_turn"}},
+		{"nova metadata", novaAdapter{}, `{"metadata": {"usage": {"inputTokens": 4, "outputTokens": 2}}}`, ModelChunk{InputTokens: 4, OutputTokens: 2}},
+		{"nova message start", novaAdapter{}, `{"messageStart": {"role": "assistant"}}`, ModelChunk{}},
+
+		{"cohere start", cohereAdapter{}, `{"event_type": "stream-start", "generation_id": "g1"}`, ModelChunk{}},
+		{"cohere text", cohereAdapter{}, `{"event_type": "text-generation", "text": "Hi"}`, ModelChunk{Text: "Hi"}},
+		{"cohere end", cohereAdapter{}, `{"event_type": "stream-end", "finish_reason": "COMPLETE", "amazon-bedrock-invocationMetrics": {"inputTokenCount": 4, "outputTokenCount": 2}}`, ModelChunk{StopReason: "COMPLETE", InputTokens: 4, OutputTokens: 2}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			got, err := test.adapter.ParseChunk([]byte(test.chunk))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAdapterParseResponse(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		adapter ModelAdapter
+		body    string
+		want    ModelChunk
+	}{
+		{"claude3", claude3Adapter{}, `{"id": "msg_1", "content": [{"type": "text", "text": "Hi"}, {"type": "tool_use", "id": "t1", "name": "calculator", "input": {}}, {"type": "text", "text": " there"}], "stop_reason": "end_turn", "usage": {"input_tokens": 3, "output_tokens": 2}}`, ModelChunk{Text: "Hi there", StopReason: "end_turn", InputTokens: 3, OutputTokens: 2}},
+		{"llama", llamaAdapter{}, `{"generation": "Hi there", "prompt_token_count": 7, "generation_token_count": 2, "stop_reason": "stop"}`, ModelChunk{Text: "Hi there", StopReason: "stop", InputTokens: 7, OutputTokens: 2}},
+		{"mistral", mistralAdapter{}, `{"outputs": [{"text": "Hi there", "stop_reason": "length"}]}`, ModelChunk{Text: "Hi there", StopReason: "length"}},
+		{"titan", titanTextAdapter{}, `{"inputTextTokenCount": 4, "results": [{"tokenCount": 2, "outputText": "Hi there", "completionReason": "FINISH"}]}`, ModelChunk{Text: "Hi there", StopReason: "FINISH", InputTokens: 4, OutputTokens: 2}},
+		{"nova", novaAdapter{}, `{"output": {"message": {"role": "assistant", "content": [{"text": "Hi"}, {"text": " there"}]}}, "stopReason": "max_tokens", "usage": {"inputTokens": 4, "outputTokens": 2}}`, ModelChunk{Text: "Hi there", StopReason: "max_tokens", InputTokens: 4, OutputTokens: 2}},
+		{"cohere", cohereAdapter{}, `{"text": "Hi there", "finish_reason": "COMPLETE", "meta": {"billed_units": {"input_tokens": 4, "output_tokens": 2}}}`, ModelChunk{Text: "Hi there", StopReason: "COMPLETE", InputTokens: 4, OutputTokens: 2}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			got, err := test.adapter.ParseResponse([]byte(test.body))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+
+			// a body which is not json is an error
+			if _, err := test.adapter.ParseResponse([]byte(`{`)); err == nil {
+				t.Error("no error for a truncated body")
+			}
+
+			if _, err := test.adapter.ParseChunk([]byte(`{`)); err == nil {
+				t.Error("no error for a truncated chunk")
+			}
+		})
+	}
+}
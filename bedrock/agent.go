@@ -0,0 +1,304 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// server-sent event names of the agent steps
+const (
+	EventToolUse    = "tool_use"
+	EventToolResult = "tool_result"
+)
+
+// sse data of the tool_use event
+type ToolUseEvent struct {
+	ID    string          `json:"id"`
+	Name  string          `json:"name"`
+	Input json.RawMessage `json:"input"`
+}
+
+// sse data of the tool_result event
+type ToolResultEvent struct {
+	ToolUseID string `json:"tool_use_id"`
+	Content   string `json:"content"`
+	IsError   bool   `json:"is_error"`
+}
+
+// receive the steps of an agent run as they happen, a returned error stops
+// the run
+type AgentObserver interface {
+	Text(text string) error
+	ToolUse(call Content) error
+	ToolResult(result Content) error
+}
+
+// a claude3 agent which calls tools until the model gives a final answer
+type Agent struct {
+	Client        ModelInvoker
+	ModelID       string
+	Tools         []Tool
+	MaxIterations int
+}
+
+// run the agent loop on a conversation: stream the model answer, run the
+// tool_use blocks it asks for and feed the tool_result blocks back, at most
+// MaxIterations times
+//
+// the returned chunk has the final stop reason and the usage summed over all
+// iterations, the messages are the conversation with every step appended
+func (a *Agent) Run(ctx context.Context, messages []Message, params InferenceParameters, observer AgentObserver) (ModelChunk, []Message, error) {
+
+	var total ModelChunk
+
+	for iteration := 0; iteration < a.MaxIterations; iteration++ {
+
+		blocks, chunk, err := a.turn(ctx, messages, params, observer)
+
+		total.Text += chunk.Text
+		total.StopReason = chunk.StopReason
+		total.InputTokens += chunk.InputTokens
+		total.OutputTokens += chunk.OutputTokens
+
+		if err != nil {
+			return total, messages, err
+		}
+
+		messages = append(messages, Message{Role: "assistant", Content: blocks})
+
+		if chunk.StopReason != "tool_use" {
+			return total, messages, nil
+		}
+
+		var results []Content
+
+		for _, block := range blocks {
+
+			if block.Type != "tool_use" {
+				continue
+			}
+
+			if err := observer.ToolUse(block); err != nil {
+				return total, messages, err
+			}
+
+			result := a.runTool(ctx, block)
+
+			if err := observer.ToolResult(result); err != nil {
+				return total, messages, err
+			}
+
+			results = append(results, result)
+		}
+
+		messages = append(messages, Message{Role: "user", Content: results})
+	}
+
+	return total, messages, fmt.Errorf("agent stopped after %d iterations without a final answer", a.MaxIterations)
+}
+
+// run one tool_use block, failures are reported to the model as an error
+// result so it can recover
+func (a *Agent) runTool(ctx context.Context, call Content) Content {
+
+	result := Content{Type: "tool_result", ToolUseID: call.ID}
+
+	var tool Tool
+
+	for _, t := range a.Tools {
+		if t.Name() == call.Name {
+			tool = t
+		}
+	}
+
+	if tool == nil {
+		result.Content = fmt.Sprintf("tool %q is not available", call.Name)
+		result.IsError = true
+		return result
+	}
+
+	output, err := tool.Run(ctx, call.Input)
+
+	if err != nil {
+		result.Content = err.Error()
+		result.IsError = true
+		return result
+	}
+
+	result.Content = output
+
+	return result
+}
+
+// stream one model turn and return its content blocks, text deltas are
+// passed to the observer as they arrive
+func (a *Agent) turn(ctx context.Context, messages []Message, params InferenceParameters, observer AgentObserver) ([]Content, ModelChunk, error) {
+
+	payloadBytes, err := json.Marshal(RequestBodyClaude3{
+		MaxTokensToSample: params.MaxTokensOrDefault(),
+		AnthropicVersion:  ANTHROPIC_VERSION,
+		Temperature:       params.TemperatureOrDefault(),
+		TopP:              params.TopP,
+		TopK:              params.TopK,
+		StopSequences:     params.StopSequences,
+		System:            params.System,
+		Messages:          messages,
+		Tools:             ToolDefinitions(a.Tools),
+	})
+
+	if err != nil {
+		return nil, ModelChunk{}, err
+	}
+
+	stream, err := a.Client.InvokeModelWithResponseStream(
+		ctx,
+		&bedrockruntime.InvokeModelWithResponseStreamInput{
+			Body:        payloadBytes,
+			ModelId:     aws.String(a.ModelID),
+			ContentType: aws.String("application/json"),
+			Accept:      aws.String("application/json"),
+		},
+	)
+
+	if err != nil {
+		return nil, ModelChunk{}, err
+	}
+
+	defer stream.Close()
+
+	var out ModelChunk
+	var blocks []Content
+	var inputs []string
+
+	for event := range stream.Events() {
+
+		v, ok := event.(*types.ResponseStreamMemberChunk)
+
+		if !ok {
+			continue
+		}
+
+		var resp ResponseClaude3
+
+		if err := json.Unmarshal(v.Value.Bytes, &resp); err != nil {
+			return nil, out, err
+		}
+
+		// blocks are numbered in order, an index may only open the next block
+		if (resp.Type == "content_block_start" || resp.Type == "content_block_delta") && (resp.Index < 0 || resp.Index > len(blocks)) {
+			return nil, out, fmt.Errorf("%s: content block index %d out of range", resp.Type, resp.Index)
+		}
+
+		switch resp.Type {
+		case "message_start":
+			if resp.Message != nil {
+				out.InputTokens = resp.Message.Usage.InputTokens
+			}
+
+		case "content_block_start":
+			if resp.Index == len(blocks) {
+				blocks = append(blocks, Content{})
+				inputs = append(inputs, "")
+			}
+			if resp.ContentBlock != nil {
+				blocks[resp.Index] = *resp.ContentBlock
+				blocks[resp.Index].Input = nil
+			}
+
+		case "content_block_delta":
+			// a delta without content_block_start opens a text block
+			if resp.Index == len(blocks) {
+				blocks = append(blocks, Content{Type: "text"})
+				inputs = append(inputs, "")
+			}
+			switch resp.Delta.Type {
+			case "text_delta":
+				blocks[resp.Index].Text += resp.Delta.Text
+				out.Text += resp.Delta.Text
+				if err := observer.Text(resp.Delta.Text); err != nil {
+					return nil, out, err
+				}
+			case "input_json_delta":
+				inputs[resp.Index] += resp.Delta.PartialJSON
+			}
+
+		case "message_delta":
+			out.StopReason = resp.Delta.StopReason
+			if resp.Usage != nil {
+				out.OutputTokens = resp.Usage.OutputTokens
+			}
+		}
+	}
+
+	if err := stream.Err(); err != nil {
+		return nil, out, err
+	}
+
+	// tool inputs arrive as partial json, an empty input is an empty object,
+	// and empty text blocks are dropped as claude3 rejects them
+	content := make([]Content, 0, len(blocks))
+
+	for k, block := range blocks {
+		switch block.Type {
+		case "tool_use":
+			input := strings.TrimSpace(inputs[k])
+			if input == "" {
+				input = "{}"
+			}
+			if !json.Valid([]byte(input)) {
+				return nil, out, fmt.Errorf("tool %s: invalid input %q", block.Name, input)
+			}
+			block.Input = json.RawMessage(input)
+		case "text":
+			if block.Text == "" {
+				continue
+			}
+		}
+		content = append(content, block)
+	}
+
+	return content, out, nil
+}
+
+// write agent steps as server-sent events
+type sseAgentObserver struct {
+	sse *SSEWriter
+}
+
+func (o sseAgentObserver) Text(text string) error {
+	return o.sse.Event(EventContentBlockDelta, ContentBlockDeltaEvent{Text: text})
+}
+
+func (o sseAgentObserver) ToolUse(call Content) error {
+	return o.sse.Event(EventToolUse, ToolUseEvent{ID: call.ID, Name: call.Name, Input: call.Input})
+}
+
+func (o sseAgentObserver) ToolResult(result Content) error {
+	return o.sse.Event(EventToolResult, ToolResultEvent{ToolUseID: result.ToolUseID, Content: result.Content, IsError: result.IsError})
+}
+
+// write only the text of the agent to a plain text stream
+type textAgentObserver struct {
+	out StreamWriter
+}
+
+func (o textAgentObserver) Text(text string) error {
+	return o.out.WriteDelta(text)
+}
+
+func (o textAgentObserver) ToolUse(call Content) error {
+	return nil
+}
+
+func (o textAgentObserver) ToolResult(result Content) error {
+	return nil
+}
@@ -0,0 +1,249 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// the steps an agent reported, in order
+type recordingObserver struct {
+	steps []string
+}
+
+func (o *recordingObserver) Text(text string) error {
+	o.steps = append(o.steps, "text "+text)
+	return nil
+}
+
+func (o *recordingObserver) ToolUse(call Content) error {
+	o.steps = append(o.steps, fmt.Sprintf("tool_use %s %s %s", call.ID, call.Name, call.Input))
+	return nil
+}
+
+func (o *recordingObserver) ToolResult(result Content) error {
+	o.steps = append(o.steps, fmt.Sprintf("tool_result %s %q %v", result.ToolUseID, result.Content, result.IsError))
+	return nil
+}
+
+// a claude3 turn of one text block answering with text
+func textTurn(text string) []ResponseClaude3 {
+	return []ResponseClaude3{
+		{Type: "message_start", Message: &MessageClaude3{Usage: Usage{InputTokens: 10}}},
+		{Type: "content_block_start", Index: 0, ContentBlock: &Content{Type: "text"}},
+		{Type: "content_block_delta", Index: 0, Delta: Delta{Type: "text_delta", Text: text}},
+		{Type: "message_delta", Delta: Delta{StopReason: "end_turn"}, Usage: &Usage{OutputTokens: 1}},
+	}
+}
+
+// a claude3 turn of a short text followed by a tool_use block whose input
+// arrives in the given pieces
+func toolTurn(id, name string, pieces ...string) []ResponseClaude3 {
+
+	turn := []ResponseClaude3{
+		{Type: "message_start", Message: &MessageClaude3{Usage: Usage{InputTokens: 10}}},
+		{Type: "content_block_start", Index: 0, ContentBlock: &Content{Type: "text"}},
+		{Type: "content_block_delta", Index: 0, Delta: Delta{Type: "text_delta", Text: "let me check"}},
+		{Type: "content_block_start", Index: 1, ContentBlock: &Content{Type: "tool_use", ID: id, Name: name, Input: json.RawMessage(`{}`)}},
+	}
+
+	for _, piece := range pieces {
+		turn = append(turn, ResponseClaude3{Type: "content_block_delta", Index: 1, Delta: Delta{Type: "input_json_delta", PartialJSON: piece}})
+	}
+
+	return append(turn, ResponseClaude3{Type: "message_delta", Delta: Delta{StopReason: "tool_use"}, Usage: &Usage{OutputTokens: 2}})
+}
+
+func TestAgentRun(t *testing.T) {
+
+	question := []Message{{Role: "user", Content: []Content{{Type: "text", Text: "what is 2 + 2?"}}}}
+
+	add := toolTurn("t1", "calculator", `{"operation": "add",`, ` "a": 2, "b"`, `: 2}`)
+
+	tests := []struct {
+		name          string
+		turns         [][]ResponseClaude3
+		maxIterations int
+		steps         []string
+		results       []Content
+		text          string
+		stopReason    string
+		err           string
+	}{
+		{
+			name:       "final answer",
+			turns:      [][]ResponseClaude3{textTurn("4")},
+			steps:      []string{"text 4"},
+			text:       "4",
+			stopReason: "end_turn",
+		},
+		{
+			name:  "tool round trip",
+			turns: [][]ResponseClaude3{add, textTurn("it is 4")},
+			steps: []string{
+				"text let me check",
+				`tool_use t1 calculator {"operation": "add", "a": 2, "b": 2}`,
+				`tool_result t1 "4" false`,
+				"text it is 4",
+			},
+			results:    []Content{{Type: "tool_result", ToolUseID: "t1", Content: "4"}},
+			text:       "let me checkit is 4",
+			stopReason: "end_turn",
+		},
+		{
+			name:  "unknown tool",
+			turns: [][]ResponseClaude3{toolTurn("t1", "weather", `{"city": "Paris"}`), textTurn("sorry")},
+			steps: []string{
+				"text let me check",
+				`tool_use t1 weather {"city": "Paris"}`,
+				`tool_result t1 "tool \"weather\" is not available" true`,
+				"text sorry",
+			},
+			results:    []Content{{Type: "tool_result", ToolUseID: "t1", Content: `tool "weather" is not available`, IsError: true}},
+			text:       "let me checksorry",
+			stopReason: "end_turn",
+		},
+		{
+			name:  "failing tool",
+			turns: [][]ResponseClaude3{toolTurn("t1", "calculator", `{"operation": "divide", "a": 1, "b": 0}`), textTurn("undefined")},
+			steps: []string{
+				"text let me check",
+				`tool_use t1 calculator {"operation": "divide", "a": 1, "b": 0}`,
+				`tool_result t1 "division by zero" true`,
+				"text undefined",
+			},
+			results:    []Content{{Type: "tool_result", ToolUseID: "t1", Content: "division by zero", IsError: true}},
+			text:       "let me checkundefined",
+			stopReason: "end_turn",
+		},
+		{
+			name:  "no input is an empty object",
+			turns: [][]ResponseClaude3{toolTurn("t1", "calculator"), textTurn("?")},
+			steps: []string{
+				"text let me check",
+				"tool_use t1 calculator {}",
+				`tool_result t1 "a and b are required" true`,
+				"text ?",
+			},
+			results:    []Content{{Type: "tool_result", ToolUseID: "t1", Content: "a and b are required", IsError: true}},
+			text:       "let me check?",
+			stopReason: "end_turn",
+		},
+		{
+			name:  "invalid input",
+			turns: [][]ResponseClaude3{toolTurn("t1", "calculator", `{"a": `)},
+			steps: []string{"text let me check"},
+			err:   `tool calculator: invalid input "{\"a\":"`,
+		},
+		{
+			name:          "max iterations",
+			turns:         [][]ResponseClaude3{add, add, add},
+			maxIterations: 2,
+			steps: []string{
+				"text let me check", `tool_use t1 calculator {"operation": "add", "a": 2, "b": 2}`, `tool_result t1 "4" false`,
+				"text let me check", `tool_use t1 calculator {"operation": "add", "a": 2, "b": 2}`, `tool_result t1 "4" false`,
+			},
+			err: "agent stopped after 2 iterations without a final answer",
+		},
+		{
+			name:  "negative index",
+			turns: [][]ResponseClaude3{{{Type: "content_block_delta", Index: -1, Delta: Delta{Type: "text_delta", Text: "x"}}}},
+			err:   "content_block_delta: content block index -1 out of range",
+		},
+		{
+			name:  "index out of range",
+			turns: [][]ResponseClaude3{{{Type: "content_block_start", Index: 0, ContentBlock: &Content{Type: "text"}}, {Type: "content_block_start", Index: 5, ContentBlock: &Content{Type: "text"}}}},
+			err:   "content_block_start: content block index 5 out of range",
+		},
+		{
+			name:       "delta opens a text block",
+			turns:      [][]ResponseClaude3{textTurn("4")[2:]},
+			steps:      []string{"text 4"},
+			text:       "4",
+			stopReason: "end_turn",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			client := &FakeModelInvoker{Turns: test.turns}
+
+			maxIterations := test.maxIterations
+			if maxIterations == 0 {
+				maxIterations = 5
+			}
+
+			agent := &Agent{Client: client, ModelID: DefaultConfig().ModelID, Tools: []Tool{CalculatorTool{}}, MaxIterations: maxIterations}
+			observer := &recordingObserver{}
+
+			total, messages, err := agent.Run(context.Background(), question, InferenceParameters{}, observer)
+
+			if !reflect.DeepEqual(observer.steps, test.steps) {
+				t.Errorf("got steps\n%q\nwant\n%q", observer.steps, test.steps)
+			}
+
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if total.Text != test.text || total.StopReason != test.stopReason {
+				t.Errorf("got text %q, stop reason %q, want %q, %q", total.Text, total.StopReason, test.text, test.stopReason)
+			}
+
+			// usage is summed over the turns
+			var usage Usage
+			for _, turn := range test.turns[:len(client.Bodies())] {
+				for _, resp := range turn {
+					if resp.Message != nil {
+						usage.InputTokens += resp.Message.Usage.InputTokens
+					}
+					if resp.Usage != nil {
+						usage.OutputTokens += resp.Usage.OutputTokens
+					}
+				}
+			}
+
+			if total.InputTokens != usage.InputTokens || total.OutputTokens != usage.OutputTokens {
+				t.Errorf("got usage %+v, want %+v", total, usage)
+			}
+
+			// the question, then an assistant turn per request with the
+			// tool results in between
+			if want := 2*len(client.Bodies()) - 1 + len(question); len(messages) != want {
+				t.Fatalf("got %d messages, want %d: %+v", len(messages), want, messages)
+			}
+
+			if test.results != nil {
+
+				if !reflect.DeepEqual(messages[2], Message{Role: "user", Content: test.results}) {
+					t.Errorf("got tool results %+v, want %+v", messages[2], test.results)
+				}
+
+				// the second request carries the tool_use and its result
+				var request RequestBodyClaude3
+				decodeBody(t, client.Bodies()[1], &request)
+
+				if len(request.Messages) != 3 || request.Messages[1].Content[1].Type != "tool_use" || request.Messages[2].Content[0].Type != "tool_result" {
+					t.Errorf("second request messages %+v", request.Messages)
+				}
+
+				if len(request.Tools) != 1 || request.Tools[0].Name != "calculator" {
+					t.Errorf("second request tools %+v", request.Tools)
+				}
+			}
+		})
+	}
+}
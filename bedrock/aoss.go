@@ -4,21 +4,21 @@
 package bedrock
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
 	"net/http"
 	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
-	opensearch "github.com/opensearch-project/opensearch-go/v2"
 	"github.com/opensearch-project/opensearch-go/v2/opensearchapi"
 )
 
 type IndexItem struct {
+	ID    string `json:"id,omitempty"`
 	Title string `json:"title"`
 	Link  string `json:"link"`
 	Text  string `json:"text"`
@@ -28,20 +28,58 @@ type EmbedResponse struct {
 	Embedding []float64 `json:"embedding"`
 }
 
+// the hits of a search response, Total is exact or a lower bound when its
+// relation is gte
 type Hits struct {
-	Hits []map[string]interface{} `json:"hits"`
+	Total struct {
+		Value    int    `json:"value"`
+		Relation string `json:"relation"`
+	} `json:"total"`
+	Hits []AossHit `json:"hits"`
+}
+
+// a document found by a search, Sort holds its sort values when the search
+// is sorted and Highlight the fragments of its matching text
+type AossHit struct {
+	ID        string              `json:"_id"`
+	Score     float64             `json:"_score"`
+	Source    IndexDocument       `json:"_source"`
+	Highlight map[string][]string `json:"highlight,omitempty"`
+	Sort      []interface{}       `json:"sort,omitempty"`
 }
 
 type AossResponse struct {
 	Hits Hits `json:"hits"`
 }
 
-func GetEmbedVector(question string, BedrockClient *bedrockruntime.Client) ([]float64, error) {
+// embed text with the embedding model of the config, the vector must fit
+// the dimension of the note index
+func EmbedText(ctx context.Context, text string, BedrockClient ModelInvoker, cfg *Config) ([]float64, error) {
+
+	vec, err := embedVector(ctx, text, BedrockClient, cfg.EmbeddingModelID, cfg.EmbeddingDimensions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(vec) != cfg.VectorDimension() {
+		return nil, fmt.Errorf("%s returned %d dimensions, the index expects %d", cfg.EmbeddingModelID, len(vec), cfg.VectorDimension())
+	}
+
+	return vec, nil
+}
+
+func embedVector(ctx context.Context, question string, BedrockClient ModelInvoker, modelID string, dimensions int) ([]float64, error) {
 
 	// create request body to titan model
 	body := map[string]interface{}{
 		"inputText": question,
 	}
+
+	if dimensions > 0 {
+		body["dimensions"] = dimensions
+	}
+
 	bodyJson, err := json.Marshal(body)
 
 	if err != nil {
@@ -51,10 +89,10 @@ func GetEmbedVector(question string, BedrockClient *bedrockruntime.Client) ([]fl
 
 	// invoke bedrock titan model to convert string to embedding vector
 	response, error := BedrockClient.InvokeModel(
-		context.Background(),
+		ctx,
 		&bedrockruntime.InvokeModelInput{
 			Body:        []byte(bodyJson),
-			ModelId:     aws.String("amazon.titan-embed-text-v1"),
+			ModelId:     aws.String(modelID),
 			ContentType: aws.String("application/json"),
 		},
 	)
@@ -79,6 +117,7 @@ func GetEmbedVector(question string, BedrockClient *bedrockruntime.Client) ([]fl
 
 	if !ok {
 		fmt.Println(ok)
+		return nil, fmt.Errorf("embedding response has no embedding array")
 	}
 
 	// assert to array of float64
@@ -91,196 +130,286 @@ func GetEmbedVector(question string, BedrockClient *bedrockruntime.Client) ([]fl
 	return values, nil
 }
 
-func QueryAOSSByVector(vec []float64, AOSSClient *opensearch.Client) (*opensearchapi.Response, error) {
+func QueryAOSSByVector(ctx context.Context, vec []float64, AOSSClient VectorStore, indexName string) (*opensearchapi.Response, error) {
 
-	vecStr := make([]string, len(vec))
+	// create knn search request body
+	content, error := jsonBody(SearchBody{
+		Size:   intPtr(5),
+		Query:  KnnVectorQuery(VectorField, vec, 5),
+		Source: excludeVector(),
+	})
 
-	// convert array float to string
-	for k, v := range vec {
-		if k < len(vec)-1 {
-			vecStr[k] = fmt.Sprint(v) + ","
-		} else {
-			vecStr[k] = fmt.Sprint(v)
-		}
+	if error != nil {
+		return nil, error
 	}
 
-	// create request body to titan model
-	content := strings.NewReader(fmt.Sprintf(`{
-		"size": 5,
-		"query": {
-			"knn": {
-				"vector_field": {
-					"vector": %s,
-					"k": 5
-				}
-			}
-		}
-	}`, vecStr))
-
 	search := opensearchapi.SearchRequest{
-		Index: []string{AOSS_NOTE_APP_INDEX_NAME},
+		Index: []string{indexName},
 		Body:  content,
 	}
 
-	response, error := search.Do(context.Background(), AOSSClient)
+	response, error := search.Do(ctx, AOSSClient)
 
 	if error != nil {
-		log.Fatal(error)
+		fmt.Println(error)
+		return nil, error
 	}
 
 	return response, nil
 
 }
 
-func HandleAOSSQueryByVector(w http.ResponseWriter, r *http.Request, AOSSClient *opensearch.Client, BedrockClient *bedrockruntime.Client) {
+// search the notes closest in meaning to a query, or with id instead of a
+// query, the notes closest to a document of the index, leaving out the
+// document and the other chunks of its note
+//
+//	POST /aoss-vector-search  {"query": "...", "k": 50, "size": 5, "filter": {"link": ["...", "..."]}}
+//	POST /aoss-vector-search  {"id": "...", "size": 5}
+//
+// k nearest neighbours are ranked, those matching the filter when given,
+// and a page of them is answered
+func HandleAOSSQueryByVector(w http.ResponseWriter, r *http.Request, AOSSClient VectorStore, BedrockClient ModelInvoker, cfg *Config) {
 
 	// data struct of request
 	var request struct {
-		Query string `json:"query"`
+		Query         string                 `json:"query"`
+		ID            string                 `json:"id"`
+		K             int                    `json:"k"`
+		Filter        map[string]interface{} `json:"filter"`
+		GroupByParent bool                   `json:"groupByParent"`
+		SearchPage
 	}
 
 	// parse user query from request
-	var query string
-	error := json.NewDecoder(r.Body).Decode(&request)
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	if error != nil {
-		fmt.Println(error)
+	if (request.Query == "") == (request.ID == "") {
+		http.Error(w, "either query or id is required", http.StatusBadRequest)
+		return
 	}
 
-	query = request.Query
+	if request.K < 0 || request.K > maxVectorSearchK {
+		http.Error(w, fmt.Sprintf("k must be between 0 and %d (0 for the default), got %d", maxVectorSearchK, request.K), http.StatusBadRequest)
+		return
+	}
 
-	// convert query to embedding vector
-	vec, error := GetEmbedVector(query, BedrockClient)
+	page, err := request.SearchPage.withSize(5)
 
-	if error != nil {
-		fmt.Println(error)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// query opensearch
-	response, error := QueryAOSSByVector(vec, AOSSClient)
+	var vec []float64
+	var exclude []SearchQuery
 
-	if error != nil {
-		fmt.Println(error)
+	if request.ID != "" {
+
+		// reuse the stored vector of the document
+		document, err := documentVector(r.Context(), AOSSClient, cfg, request.ID)
+
+		if errors.Is(err, ErrDocumentNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		vec = document.Vector
+		exclude = append(exclude, SearchQuery{IDs: &IDsQuery{Values: []string{request.ID}}})
+
+		if document.ParentID != "" {
+			exclude = append(exclude, TermQuery("parent_id", document.ParentID))
+		}
+
+	} else {
+
+		// convert query to embedding vector
+		vec, err = EmbedText(r.Context(), request.Query, BedrockClient, cfg)
+
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
 	}
 
-	respBytes, err := io.ReadAll(response.Body)
+	filter, err := knnFilter(request.Filter, exclude...)
+
 	if err != nil {
-		panic(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// write answer to response
-	json.NewEncoder(w).Encode(map[string]interface{}{"Result": string(respBytes)})
+	// query opensearch
+	writeSearchResults(w, r, AOSSClient, cfg, vectorSearchBody(vec, request.Query, page, request.K, filter), page, request.GroupByParent)
 }
 
-func QueryOpenSearchByTitle(AOSSClient *opensearch.Client, title string) (*opensearchapi.Response, error) {
+// run a search of the note index and write a page of its hits, or the notes
+// of its chunks when grouped by parent
+func writeSearchResults(w http.ResponseWriter, r *http.Request, AOSSClient VectorStore, cfg *Config, body SearchBody, page SearchPage, groupByParent bool) {
+
+	data, err := searchNotes(r.Context(), AOSSClient, cfg, body)
 
-	content := strings.NewReader(fmt.Sprintf(`{
-		"size": 10,
-		"query": {
-			"multi_match": {
-				"query": "%s",
-				"fields": ["title"]
-			}
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
 	}
-}`, title))
 
-	search := opensearchapi.SearchRequest{
-		Index: []string{AOSS_NOTE_APP_INDEX_NAME},
-		Body:  content,
+	w.Header().Set("Content-Type", "application/json")
+
+	// write the chunks grouped by note to response
+	if groupByParent {
+		writeDocuments(w, data)
+		return
 	}
 
-	response, error := search.Do(context.Background(), AOSSClient)
+	results, err := DecodeSearchResults(bytes.NewReader(data), page)
 
-	if error != nil {
-		fmt.Println(error)
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
 	}
 
-	return response, nil
+	json.NewEncoder(w).Encode(results)
+}
+
+// write the hits of a search response as the notes they were cut from
+func writeDocuments(w http.ResponseWriter, body []byte) {
+
+	hits, err := DecodeChunkHits(bytes.NewReader(body))
 
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"Documents": GroupByParent(hits)})
 }
 
-func HandleAOSSQueryByTitle(w http.ResponseWriter, r *http.Request, AOSSClient *opensearch.Client, BedrockClient *bedrockruntime.Client) {
+func HandleAOSSQueryByTitle(w http.ResponseWriter, r *http.Request, AOSSClient VectorStore, BedrockClient ModelInvoker, cfg *Config) {
 
 	// data struct of request
 	var request struct {
-		Query string `json:"query"`
+		Query         string `json:"query"`
+		GroupByParent bool   `json:"groupByParent"`
+		SearchPage
 	}
 
 	// parse user query from request
-	var query string
-	error := json.NewDecoder(r.Body).Decode(&request)
-
-	if error != nil {
-		fmt.Println(error)
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	query = request.Query
-
-	// query opensearh match by title
-	response, error := QueryOpenSearchByTitle(AOSSClient, query)
-
-	if error != nil {
-		fmt.Println(error)
+	if request.Query == "" {
+		http.Error(w, "query is required", http.StatusBadRequest)
+		return
 	}
 
-	respBytes, err := io.ReadAll(response.Body)
+	page, err := request.SearchPage.withSize(10)
+
 	if err != nil {
-		panic(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	// write answer to response
-	json.NewEncoder(w).Encode(map[string]interface{}{"Result": string(respBytes)})
+	// query opensearh match by title
+	writeSearchResults(w, r, AOSSClient, cfg, titleSearchBody(request.Query, page), page, request.GroupByParent)
 }
 
-func IndexVectorOpenSearch(AOSSClient *opensearch.Client, BedrockClient *bedrockruntime.Client, item IndexItem) (*opensearchapi.Response, error) {
+// the chunks of a note written by IndexVectorOpenSearch, IDs are the ids
+// aoss assigned them in chunk order
+type IndexResult struct {
+	Chunks int      `json:"chunks"`
+	IDs    []string `json:"ids"`
+}
 
-	// get embedding vector
-	vec, error := GetEmbedVector(item.Text, BedrockClient)
+// split a note into chunks, embed them and write them with one _bulk
+// request, an error unless every chunk is indexed
+func IndexVectorOpenSearch(ctx context.Context, AOSSClient VectorStore, BedrockClient ModelInvoker, item IndexItem, cfg *Config) (IndexResult, error) {
 
-	if error != nil {
-		fmt.Println(error)
+	// split the note into chunks
+	documents := ChunkItem(item, cfg.ChunkOptions())
+
+	if len(documents) == 0 {
+		return IndexResult{}, fmt.Errorf("text is required")
 	}
 
-	// convert vector of number to string
-	vecStr := make([]string, len(vec))
+	// get embedding vector of each chunk
+	for k := range documents {
 
-	// convert array float to string
-	for k, v := range vec {
+		vec, err := EmbedText(ctx, embeddingText(documents[k]), BedrockClient, cfg)
 
-		if k < len(vec)-1 {
-			vecStr[k] = fmt.Sprint(v) + ","
-		} else {
-			vecStr[k] = fmt.Sprint(v)
+		if err != nil {
+			return IndexResult{}, err
 		}
+
+		documents[k].Vector = vec
 	}
 
-	// body request for indexing opensearch
-	body := strings.NewReader(fmt.Sprintf(`{
-		"title": "%s",
-		"link": "%s",
-		"text": "%s",
-		"vector_field": %s
-	}`, item.Title, item.Link, item.Text, vecStr))
+	// body request for indexing the chunks into opensearch
+	body, err := bulkBody(documents)
 
-	index := opensearchapi.IndexRequest{
-		Index: AOSS_NOTE_APP_INDEX_NAME,
+	if err != nil {
+		return IndexResult{}, err
+	}
+
+	bulk := opensearchapi.BulkRequest{
+		Index: cfg.AOSSNoteAppIndexName,
 		Body:  body,
 	}
 
 	// index into opensearch
-	response, error := index.Do(context.Background(), AOSSClient)
+	response, err := bulk.Do(ctx, AOSSClient)
 
-	if error != nil {
-		fmt.Println(error)
+	if err != nil {
+		return IndexResult{}, err
 	}
 
-	fmt.Println(response)
+	defer response.Body.Close()
 
-	return response, nil
+	outcomes, err := bulkOutcomes(response, cfg.AOSSNoteAppIndexName, len(documents))
 
+	if err != nil {
+		return IndexResult{}, err
+	}
+
+	result := IndexResult{Chunks: len(documents)}
+
+	var failed []string
+
+	for _, outcome := range outcomes {
+		if outcome.indexed() {
+			result.IDs = append(result.IDs, outcome.ID)
+		} else {
+			failed = append(failed, fmt.Sprintf("%d %s", outcome.Status, outcome.Error))
+		}
+	}
+
+	if len(failed) > 0 {
+		return result, fmt.Errorf("bulk index %s: %d of %d chunks not indexed: %s", cfg.AOSSNoteAppIndexName, len(failed), len(documents), strings.Join(failed, "; "))
+	}
+
+	return result, nil
 }
 
-func HandleAOSSIndex(w http.ResponseWriter, r *http.Request, AOSSClient *opensearch.Client, BedrockClient *bedrockruntime.Client) {
+// index one note
+//
+//	POST /aoss-index-backend  {"title": "...", "link": "...", "text": "..."}
+//
+// the response counts the chunks of the note and lists their ids
+func HandleAOSSIndex(w http.ResponseWriter, r *http.Request, AOSSClient VectorStore, BedrockClient ModelInvoker, cfg *Config) {
 
 	// data struct of request
 	var request struct {
@@ -290,26 +419,26 @@ func HandleAOSSIndex(w http.ResponseWriter, r *http.Request, AOSSClient *opensea
 	}
 
 	// parse request
-	error := json.NewDecoder(r.Body).Decode(&request)
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	if error != nil {
-		fmt.Println(error)
+	if strings.TrimSpace(request.Text) == "" {
+		http.Error(w, "text is required", http.StatusBadRequest)
+		return
 	}
 
 	// index into opensearch
-	response, error := IndexVectorOpenSearch(AOSSClient, BedrockClient, IndexItem{Title: request.Title, Link: request.Link, Text: request.Text})
+	result, err := IndexVectorOpenSearch(r.Context(), AOSSClient, BedrockClient, IndexItem{Title: request.Title, Link: request.Link, Text: request.Text}, cfg)
 
-	if error != nil {
-		fmt.Println(error)
-	}
-
-	//
-	respBytes, err := io.ReadAll(response.Body)
 	if err != nil {
-		panic(err)
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
 	}
 
 	// write json encoding to response
-	json.NewEncoder(w).Encode(map[string]interface{}{"Result": string(respBytes)})
-
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
 }
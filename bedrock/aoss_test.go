@@ -0,0 +1,62 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestEmbedTextContext(t *testing.T) {
+
+	cfg := DefaultConfig()
+
+	invoker := &FakeModelInvoker{Embedding: make([]float64, cfg.VectorDimension())}
+
+	vec, err := EmbedText(context.Background(), "lambda", invoker, &cfg)
+
+	if err != nil || len(vec) != cfg.VectorDimension() {
+		t.Fatalf("got %d dimensions, error %v", len(vec), err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := EmbedText(cancelled, "lambda", invoker, &cfg); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+
+	if len(invoker.Bodies()) != 1 {
+		t.Errorf("got %d invocations, want 1", len(invoker.Bodies()))
+	}
+}
+
+func TestAOSSSearchToolContext(t *testing.T) {
+
+	cfg := DefaultConfig()
+
+	invoker := &FakeModelInvoker{Embedding: make([]float64, cfg.VectorDimension())}
+	store := &FakeVectorStore{Body: `{"hits": {"hits": []}}`}
+
+	tool := &AOSSSearchTool{AOSSClient: store, BedrockClient: invoker, Config: &cfg}
+
+	input := json.RawMessage(`{"query": "lambda"}`)
+
+	if _, err := tool.Run(context.Background(), input); err != nil {
+		t.Fatal(err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := tool.Run(cancelled, input); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want context.Canceled", err)
+	}
+
+	if len(invoker.Bodies()) != 1 || len(store.Requests()) != 1 {
+		t.Errorf("got %d invocations and %d searches, want 1 and 1", len(invoker.Bodies()), len(store.Requests()))
+	}
+}
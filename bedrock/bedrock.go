@@ -4,11 +4,10 @@
 package bedrock
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"html/template"
 	"net/http"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -21,10 +20,28 @@ const MAX_TOKENS_TO_SAMPLE = 2048
 const ANTHROPIC_VERSION = "bedrock-2023-05-31"
 const TEMPERATURE = 0.9
 
-// claude3 request data type
+// claude3 request data type, Source is set on image and document blocks,
+// documents are only sent through the converse api and need a Name
+//
+// tool_use blocks carry ID, Name and Input, tool_result blocks carry
+// ToolUseID, Content and IsError
 type Content struct {
-	Type string `json:"type"`
-	Text string `json:"text"`
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Source    *ImageSource    `json:"source,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   string          `json:"content,omitempty"`
+	IsError   bool            `json:"is_error,omitempty"`
+}
+
+// base64 source of an image or document
+type ImageSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
 }
 
 type Message struct {
@@ -33,27 +50,64 @@ type Message struct {
 }
 
 type RequestBodyClaude3 struct {
-	MaxTokensToSample int       `json:"max_tokens"`
-	Temperature       float64   `json:"temperature,omitempty"`
-	AnthropicVersion  string    `json:"anthropic_version"`
-	Messages          []Message `json:"messages"`
+	MaxTokensToSample int              `json:"max_tokens"`
+	Temperature       *float64         `json:"temperature,omitempty"`
+	TopP              *float64         `json:"top_p,omitempty"`
+	TopK              *int             `json:"top_k,omitempty"`
+	StopSequences     []string         `json:"stop_sequences,omitempty"`
+	System            string           `json:"system,omitempty"`
+	AnthropicVersion  string           `json:"anthropic_version"`
+	Messages          []Message        `json:"messages"`
+	Tools             []ToolDefinition `json:"tools,omitempty"`
 }
 
 // frontend request data type
 type FrontEndRequest struct {
-	Messages []Message `json:"messages"`
+	Model     string    `json:"model,omitempty"`
+	Messages  []Message `json:"messages"`
+	Tools     []string  `json:"tools,omitempty"`
+	SessionID string    `json:"sessionId,omitempty"`
+	InferenceParameters
 }
 
 // claude3 response data type
+type ResponseBodyClaude3 struct {
+	ID           string    `json:"id"`
+	Model        string    `json:"model"`
+	Content      []Content `json:"content"`
+	StopReason   string    `json:"stop_reason"`
+	StopSequence string    `json:"stop_sequence"`
+	Usage        Usage     `json:"usage"`
+}
+
 type Delta struct {
-	Type string `json:"type"`
-	Text string `json:"text"`
+	Type         string `json:"type"`
+	Text         string `json:"text"`
+	PartialJSON  string `json:"partial_json,omitempty"`
+	StopReason   string `json:"stop_reason,omitempty"`
+	StopSequence string `json:"stop_sequence,omitempty"`
+}
+
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type MessageClaude3 struct {
+	ID    string `json:"id"`
+	Model string `json:"model"`
+	Usage Usage  `json:"usage"`
 }
 
+// a streamed chunk, Message is set on message_start, ContentBlock on
+// content_block_start and Usage on message_delta
 type ResponseClaude3 struct {
-	Type  string `json:"type"`
-	Index int    `json:"index"`
-	Delta Delta  `json:"delta"`
+	Type         string          `json:"type"`
+	Index        int             `json:"index"`
+	Delta        Delta           `json:"delta"`
+	Message      *MessageClaude3 `json:"message,omitempty"`
+	ContentBlock *Content        `json:"content_block,omitempty"`
+	Usage        *Usage          `json:"usage,omitempty"`
 }
 
 type Response struct {
@@ -64,158 +118,442 @@ type Query struct {
 	Topic string `json:"topic"`
 }
 
-func HandleChat(w http.ResponseWriter, r *http.Request, BedrockClient *bedrockruntime.Client) {
+// stream a chat answer, requests naming tools run the agent loop with the
+// tools of the registry
+//
+// a request with a sessionId only carries the new turn, it is answered with
+// the history of the conversation and appended to it once the answer is
+// complete; the conversation must have been made with the client token of
+// the request
+func HandleChat(w http.ResponseWriter, r *http.Request, BedrockClient ModelInvoker, cfg *Config, tools *ToolRegistry, conversations ConversationStore) {
 
 	var request FrontEndRequest
 
 	error := json.NewDecoder(r.Body).Decode(&request)
 
 	if error != nil {
-		panic(error)
+		http.Error(w, error.Error(), http.StatusBadRequest)
+		return
 	}
 
-	messages := request.Messages
+	fmt.Println(request.Messages)
 
-	fmt.Println(messages)
+	turn := request.Messages
 
-	payload := RequestBodyClaude3{
-		MaxTokensToSample: MAX_TOKENS_TO_SAMPLE,
-		AnthropicVersion:  ANTHROPIC_VERSION,
-		Temperature:       TEMPERATURE,
-		Messages:          messages,
+	if request.SessionID != "" {
+
+		if conversations == nil {
+			http.Error(w, "sessions are not enabled", http.StatusBadRequest)
+			return
+		}
+
+		owner, error := ConversationOwner(r)
+
+		if error != nil {
+			http.Error(w, error.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		conversation, error := OwnedConversation(r.Context(), conversations, owner, request.SessionID)
+
+		if error != nil {
+			http.Error(w, error.Error(), conversationErrorStatus(error))
+			return
+		}
+
+		request.Messages = append(conversation.Messages, turn...)
+		w.Header().Set("X-Session-Id", conversation.ID)
 	}
 
-	payloadBytes, error := json.Marshal(payload)
+	// the chat page renders text with textContent, so no escaping
+	answer, error := streamChat(w, r, BedrockClient, cfg, tools, request, false)
 
-	if error != nil {
-		fmt.Println(error)
+	if error != nil || request.SessionID == "" || answer.Text == "" {
+		return
 	}
 
-	output, error := BedrockClient.InvokeModelWithResponseStream(
-		context.Background(),
-		&bedrockruntime.InvokeModelWithResponseStreamInput{
-			Body:        payloadBytes,
-			ModelId:     aws.String(MODEL_ID),
-			ContentType: aws.String("application/json"),
-			Accept:      aws.String("application/json"),
-		},
-	)
+	turn = append(turn, Message{Role: "assistant", Content: []Content{{Type: "text", Text: answer.Text}}})
 
-	if error != nil {
+	if error := conversations.Append(context.Background(), request.SessionID, turn...); error != nil {
 		fmt.Println(error)
 	}
+}
 
-	for event := range output.GetStream().Events() {
-		switch v := event.(type) {
-		case *types.ResponseStreamMemberChunk:
+func HandleImageAnalyzer(w http.ResponseWriter, r *http.Request, BedrockClient ModelInvoker, cfg *Config) {
 
-			var resp ResponseClaude3
-			err := json.NewDecoder(bytes.NewReader(v.Value.Bytes)).Decode(&resp)
-			if err != nil {
-				fmt.Println(error)
-			}
+	// allow cros
+	// w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// w.Header().Set("Access-Control-Allow-Origin", "*")
 
-			var tpl = template.Must(template.New("tpl").Parse(resp.Delta.Text))
-			tpl.Execute(w, nil)
+	var request FrontEndRequest
 
-			if f, ok := w.(http.Flusher); ok {
-				f.Flush()
-			} else {
-				fmt.Println("Damn, no flush")
-			}
+	error := json.NewDecoder(r.Body).Decode(&request)
 
-		case *types.UnknownUnionMember:
-			fmt.Println("unknown tag:", v.Tag)
+	if error != nil {
+		http.Error(w, error.Error(), http.StatusBadRequest)
+		return
+	}
 
-		default:
-			fmt.Println("union is nil or unknown type")
-		}
+	// the default model may not accept images
+	if request.Model == "" && cfg.ImageModelID != "" {
+		request.Model = cfg.ImageModelID
 	}
+
+	// the image page renders text with innerText, so no escaping
+	streamChat(w, r, BedrockClient, cfg, nil, request, false)
 }
 
-func HandleImageAnalyzer(w http.ResponseWriter, r *http.Request, BedrockClient *bedrockruntime.Client) {
+// invoke the model selected by a request and stream its answer, as text or
+// as server-sent events when the client accepts text/event-stream
+//
+// errors are reported to the client and returned so that callers know the
+// answer is incomplete
+func streamChat(w http.ResponseWriter, r *http.Request, BedrockClient ModelInvoker, cfg *Config, tools *ToolRegistry, request FrontEndRequest, escapeHTML bool) (ModelChunk, error) {
 
-	// allow cros
-	// w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	// w.Header().Set("Access-Control-Allow-Origin", "*")
+	info, adapter, err := cfg.ResolveModel(request.Model)
 
-	type Message struct {
-		Role    string        `json:"role"`
-		Content []interface{} `json:"content"`
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return ModelChunk{}, err
 	}
 
-	type Request struct {
-		Messages []Message `json:"messages"`
+	if err := request.Validate(LimitsForModel(info.ID)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return ModelChunk{}, err
 	}
 
-	type RequestBodyClaude3 struct {
-		MaxTokensToSample int       `json:"max_tokens"`
-		Temperature       float64   `json:"temperature,omitempty"`
-		AnthropicVersion  string    `json:"anthropic_version"`
-		Messages          []Message `json:"messages"`
+	if !info.Vision && hasImage(request.Messages) {
+		err := fmt.Errorf("model %s does not accept images", info.ID)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return ModelChunk{}, err
 	}
 
-	var request Request
-	error := json.NewDecoder(r.Body).Decode(&request)
+	// leave out the oldest turns which do not fit the context window
+	var summarize Summarizer
+	if cfg.HistoryStrategy == HistorySummarize {
+		summarize = modelSummarizer(BedrockClient, info, adapter)
+	}
 
-	if error != nil {
-		panic(error)
+	budget := cfg.InputBudget(info, request.InferenceParameters)
+
+	messages, params, report, err := TrimHistory(r.Context(), request.Messages, request.InferenceParameters, budget, summarize)
+
+	if errors.Is(err, ErrContextExceeded) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return ModelChunk{}, err
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return ModelChunk{}, err
 	}
 
-	messages := request.Messages
+	request.Messages, request.InferenceParameters = messages, params
 
-	payload := RequestBodyClaude3{
-		MaxTokensToSample: MAX_TOKENS_TO_SAMPLE,
-		AnthropicVersion:  ANTHROPIC_VERSION,
-		Temperature:       TEMPERATURE,
-		Messages:          messages,
+	start := MessageStartEvent{Model: info.ID}
+
+	if report.Trimmed() {
+		fmt.Printf("context: dropped %d messages, summarized %d\n", report.DroppedMessages, report.SummarizedMessages)
+		setTrimHeaders(w.Header(), report)
+		start.Context = &report
 	}
 
-	payloadBytes, error := json.Marshal(payload)
+	if len(request.Tools) > 0 {
+		return runAgent(w, r, BedrockClient, cfg, tools, info, request, start, escapeHTML)
+	}
 
-	if error != nil {
-		fmt.Println(error)
+	// converse models share one request shape, other models need their adapter
+	var converse ConverseRequest
+	var payloadBytes []byte
+
+	if info.Converse {
+		converse, err = NewConverseRequest(info.ID, request.Messages, request.InferenceParameters)
+	} else {
+		payloadBytes, err = adapter.BuildRequest(request.Messages, request.InferenceParameters)
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return ModelChunk{}, err
+	}
+
+	// stream typed events when the client accepts text/event-stream
+	var sse *SSEWriter
+	if WantsEventStream(r) {
+		sse = NewSSEWriter(w)
 	}
 
-	output, error := BedrockClient.InvokeModelWithResponseStream(
-		context.Background(),
+	chunks, closeStream, err := invokeStream(r.Context(), BedrockClient, info, adapter, converse, payloadBytes)
+
+	if err != nil {
+		fmt.Println(err)
+		if sse != nil {
+			sse.Error(err)
+		} else {
+			http.Error(w, err.Error(), invokeErrorStatus(err))
+		}
+		return ModelChunk{}, err
+	}
+
+	defer closeStream()
+
+	if sse != nil {
+		return StreamEvents(sse, chunks, start)
+	}
+
+	out := NewTextStreamWriter(w, escapeHTML)
+
+	answer, err := StreamText(out, chunks)
+
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	return answer, err
+}
+
+// start streaming the answer to a request built by NewConverseRequest or by
+// the adapter of the model
+func invokeStream(ctx context.Context, BedrockClient ModelInvoker, info ModelInfo, adapter ModelAdapter, converse ConverseRequest, payloadBytes []byte) (ChunkReader, func() error, error) {
+
+	if info.Converse {
+		return ConverseStream(ctx, BedrockClient, info.ID, converse)
+	}
+
+	stream, err := BedrockClient.InvokeModelWithResponseStream(
+		ctx,
 		&bedrockruntime.InvokeModelWithResponseStreamInput{
 			Body:        payloadBytes,
-			ModelId:     aws.String(MODEL_ID),
+			ModelId:     aws.String(info.ID),
 			ContentType: aws.String("application/json"),
 			Accept:      aws.String("application/json"),
 		},
 	)
 
-	if error != nil {
-		fmt.Println(error)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return AdapterChunks(stream, adapter), stream.Close, nil
+}
+
+// answer a chat request with the agent loop and the requested tools
+func runAgent(w http.ResponseWriter, r *http.Request, BedrockClient ModelInvoker, cfg *Config, tools *ToolRegistry, info ModelInfo, request FrontEndRequest, start MessageStartEvent, escapeHTML bool) (ModelChunk, error) {
+
+	if tools == nil {
+		err := errors.New("tools are not enabled")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return ModelChunk{}, err
+	}
+
+	if info.Family != "anthropic" || info.Converse {
+		err := fmt.Errorf("tools require a claude model invoked with InvokeModel, got %s", info.ID)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return ModelChunk{}, err
+	}
+
+	selected, err := tools.Select(request.Tools)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return ModelChunk{}, err
+	}
+
+	agent := &Agent{
+		Client:        BedrockClient,
+		ModelID:       info.ID,
+		Tools:         selected,
+		MaxIterations: cfg.MaxToolIterations,
+	}
+
+	if WantsEventStream(r) {
+
+		sse := NewSSEWriter(w)
+		sse.Event(EventMessageStart, start)
+
+		total, _, err := agent.Run(r.Context(), request.Messages, request.InferenceParameters, sseAgentObserver{sse})
+
+		if err != nil {
+			fmt.Println(err)
+			sse.Error(err)
+			return total, err
+		}
+
+		sse.Event(EventMessageDelta, MessageDeltaEvent{
+			StopReason: total.StopReason,
+			Usage:      Usage{InputTokens: total.InputTokens, OutputTokens: total.OutputTokens},
+		})
+
+		return total, sse.Event(EventDone, struct{}{})
 	}
 
-	for event := range output.GetStream().Events() {
-		switch v := event.(type) {
-		case *types.ResponseStreamMemberChunk:
+	out := NewTextStreamWriter(w, escapeHTML)
 
-			var resp ResponseClaude3
-			err := json.NewDecoder(bytes.NewReader(v.Value.Bytes)).Decode(&resp)
-			if err != nil {
-				fmt.Println(err)
+	total, _, err := agent.Run(r.Context(), request.Messages, request.InferenceParameters, textAgentObserver{out})
+
+	if err != nil {
+		fmt.Println(err)
+		if total.Text == "" {
+			http.Error(w, err.Error(), invokeErrorStatus(err))
+		}
+		return total, err
+	}
+
+	if err := out.Close(); err != nil {
+		fmt.Println(err)
+		return total, err
+	}
+
+	return total, nil
+}
+
+// a request bedrock rejects as invalid, for example one exceeding the
+// context window, is the client's error
+func invokeErrorStatus(err error) int {
+
+	var validation *types.ValidationException
+
+	if errors.As(err, &validation) {
+		return http.StatusBadRequest
+	}
+
+	return http.StatusBadGateway
+}
+
+func hasImage(messages []Message) bool {
+	for _, message := range messages {
+		for _, content := range message.Content {
+			if content.Type == "image" {
+				return true
 			}
+		}
+	}
+	return false
+}
+
+// read model chunks one by one until yield returns false or the stream ends
+type ChunkReader func(yield func(ModelChunk) bool) error
+
+// read the chunks of an InvokeModelWithResponseStream stream with the adapter
+// of the model
+func AdapterChunks(stream bedrockruntime.ResponseStreamReader, adapter ModelAdapter) ChunkReader {
 
-			fmt.Println(resp.Delta.Text)
-			var tpl = template.Must(template.New("tpl").Parse(resp.Delta.Text))
-			tpl.Execute(w, nil)
+	return func(yield func(ModelChunk) bool) error {
 
-			if f, ok := w.(http.Flusher); ok {
-				f.Flush()
-			} else {
-				fmt.Print("Damn, no flush")
+		for event := range stream.Events() {
+			switch v := event.(type) {
+			case *types.ResponseStreamMemberChunk:
+
+				chunk, err := adapter.ParseChunk(v.Value.Bytes)
+				if err != nil {
+					return err
+				}
+
+				if !yield(chunk) {
+					return nil
+				}
+
+			case *types.UnknownUnionMember:
+				fmt.Println("unknown tag:", v.Tag)
+
+			default:
+				fmt.Println("union is nil or unknown type")
 			}
+		}
+
+		return stream.Err()
+	}
+}
+
+// write the text of each chunk to out, stopping at the first write error so
+// a disconnected client does not keep the loop busy, and return the chunks
+// merged into one
+func StreamText(out StreamWriter, chunks ChunkReader) (ModelChunk, error) {
+
+	var total ModelChunk
+	var writeErr error
+
+	err := chunks(func(chunk ModelChunk) bool {
+		total = mergeChunk(total, chunk)
+		if chunk.Text == "" {
+			return true
+		}
+		writeErr = out.WriteDelta(chunk.Text)
+		return writeErr == nil
+	})
+
+	if err != nil {
+		return total, err
+	}
+
+	if writeErr != nil {
+		return total, writeErr
+	}
+
+	return total, out.Close()
+}
+
+// translate model chunks into server-sent events: message_start with the
+// first chunk, one content_block_delta per text and message_delta with the
+// stop reason and usage once the stream ends, then done
+//
+// the chunks are returned merged into one, with the error that ended the
+// stream or the write error of a disconnected client
+func StreamEvents(sse *SSEWriter, chunks ChunkReader, start MessageStartEvent) (ModelChunk, error) {
 
-		case *types.UnknownUnionMember:
-			fmt.Println("unknown tag:", v.Tag)
+	var total ModelChunk
+	started := false
 
-		default:
-			fmt.Println("union is nil or unknown type")
+	err := chunks(func(chunk ModelChunk) bool {
+
+		total = mergeChunk(total, chunk)
+
+		if !started {
+			started = true
+			start.Usage.InputTokens = chunk.InputTokens
+			if sse.Event(EventMessageStart, start) != nil {
+				return false
+			}
+		}
+
+		if chunk.Text != "" {
+			return sse.Event(EventContentBlockDelta, ContentBlockDeltaEvent{Text: chunk.Text}) == nil
 		}
+
+		return true
+	})
+
+	if err != nil {
+		fmt.Println(err)
+		sse.Error(err)
+		return total, err
 	}
+
+	sse.Event(EventMessageDelta, MessageDeltaEvent{
+		StopReason: total.StopReason,
+		Usage:      Usage{InputTokens: total.InputTokens, OutputTokens: total.OutputTokens},
+	})
+
+	return total, sse.Event(EventDone, struct{}{})
+}
+
+// accumulate text and keep the latest stop reason and token counts reported
+func mergeChunk(total ModelChunk, chunk ModelChunk) ModelChunk {
+
+	total.Text += chunk.Text
+
+	if chunk.StopReason != "" {
+		total.StopReason = chunk.StopReason
+	}
+
+	if chunk.InputTokens > 0 {
+		total.InputTokens = chunk.InputTokens
+	}
+
+	if chunk.OutputTokens > 0 {
+		total.OutputTokens = chunk.OutputTokens
+	}
+
+	return total
 }
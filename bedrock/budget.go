@@ -0,0 +1,214 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// rough token costs, bedrock does not expose a tokenizer so counts are
+// estimated from the length of the text
+const (
+	charsPerToken        = 4
+	messageOverhead      = 4
+	imageTokens          = 1600
+	summaryMaxTokens     = 512
+	summarySystemPrompt  = "You summarize conversations. Keep names, numbers, decisions and open questions. Answer with the summary only."
+	summaryPromptPrefix  = "Summarize the following conversation in a few sentences.\n\n"
+	summarySystemHeading = "Summary of the earlier conversation:\n"
+)
+
+var ErrContextExceeded = errors.New("conversation exceeds the context window")
+
+// history strategies of the config
+const (
+	HistoryDrop      = "drop"
+	HistorySummarize = "summarize"
+)
+
+// what was removed from a conversation to fit the context window
+type TrimReport struct {
+	// estimated input tokens before and after trimming, and the budget
+	EstimatedTokens int `json:"estimatedTokens"`
+	RemainingTokens int `json:"remainingTokens"`
+	Budget          int `json:"budget"`
+
+	// oldest messages left out, SummarizedMessages of them are replaced by
+	// a summary appended to the system prompt
+	DroppedMessages    int `json:"droppedMessages"`
+	SummarizedMessages int `json:"summarizedMessages"`
+}
+
+// report whether anything was removed
+func (t TrimReport) Trimmed() bool {
+	return t.DroppedMessages > 0
+}
+
+// estimated token count of a text
+func EstimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + charsPerToken - 1) / charsPerToken
+}
+
+// estimated token count of a message
+func EstimateMessageTokens(message Message) int {
+
+	tokens := messageOverhead
+
+	for _, content := range message.Content {
+		switch content.Type {
+		case "image":
+			tokens += imageTokens
+		case "document":
+			if content.Source != nil {
+				// base64 holds 3 bytes in 4 characters
+				tokens += len(content.Source.Data) * 3 / 4 / charsPerToken
+			}
+		default:
+			tokens += EstimateTokens(content.Text) + EstimateTokens(content.Content) + EstimateTokens(string(content.Input))
+		}
+	}
+
+	return tokens
+}
+
+// estimated input token count of a system prompt and messages
+func EstimateMessagesTokens(system string, messages []Message) int {
+
+	tokens := EstimateTokens(system)
+
+	for _, message := range messages {
+		tokens += EstimateMessageTokens(message)
+	}
+
+	return tokens
+}
+
+// input token budget of a request: the context window of the model, or
+// cfg.ContextBudget when set, less the tokens reserved for the answer
+func (c *Config) InputBudget(info ModelInfo, params InferenceParameters) int {
+
+	budget := info.MaxContext
+
+	if c.ContextBudget > 0 {
+		budget = c.ContextBudget
+	}
+
+	return budget - params.MaxTokensOrDefault()
+}
+
+// summarize messages into a short text
+type Summarizer func(ctx context.Context, messages []Message) (string, error)
+
+// drop the oldest turns until the system prompt and messages fit the budget
+//
+// the system prompt and the latest message are always kept, and the kept
+// messages start with a user turn as the models require, with a summarizer
+// the dropped turns are summarized into the system prompt
+func TrimHistory(ctx context.Context, messages []Message, params InferenceParameters, budget int, summarize Summarizer) ([]Message, InferenceParameters, TrimReport, error) {
+
+	report := TrimReport{
+		EstimatedTokens: EstimateMessagesTokens(params.System, messages),
+		Budget:          budget,
+	}
+
+	report.RemainingTokens = report.EstimatedTokens
+
+	if report.EstimatedTokens <= budget || len(messages) == 0 {
+		return messages, params, report, nil
+	}
+
+	keep := dropOldest(params.System, messages, budget)
+
+	if summarize != nil && keep > 0 {
+
+		summary, err := summarize(ctx, messages[:keep])
+
+		if err != nil {
+			return nil, params, report, fmt.Errorf("summarize history: %w", err)
+		}
+
+		if summary = strings.TrimSpace(summary); summary != "" {
+
+			if params.System != "" {
+				params.System += "\n\n"
+			}
+
+			params.System += summarySystemHeading + summary
+
+			report.SummarizedMessages = keep
+
+			// the summary takes room too, drop more turns if needed
+			if more := dropOldest(params.System, messages[keep:], budget); more > 0 {
+				keep += more
+			}
+		}
+	}
+
+	messages = messages[keep:]
+
+	report.DroppedMessages = keep
+	report.RemainingTokens = EstimateMessagesTokens(params.System, messages)
+
+	if report.RemainingTokens > budget {
+		return nil, params, report, fmt.Errorf("%w: the latest message needs about %d tokens, more than the %d tokens available", ErrContextExceeded, report.RemainingTokens, budget)
+	}
+
+	return messages, params, report, nil
+}
+
+// number of leading messages to drop so the rest fits the budget, never
+// dropping the last message and never keeping a leading assistant turn
+func dropOldest(system string, messages []Message, budget int) int {
+
+	tokens := EstimateMessagesTokens(system, messages)
+	drop := 0
+
+	for drop < len(messages)-1 && (tokens > budget || messages[drop].Role != "user") {
+		tokens -= EstimateMessageTokens(messages[drop])
+		drop++
+	}
+
+	return drop
+}
+
+// the messages as a plain transcript for the summarization prompt
+func transcript(messages []Message) string {
+
+	var sb strings.Builder
+
+	for _, message := range messages {
+		if text := strings.TrimSpace(messageText(message)); text != "" {
+			fmt.Fprintf(&sb, "%s: %s\n\n", message.Role, text)
+		}
+	}
+
+	return sb.String()
+}
+
+// a summarizer which asks the model of the request
+func modelSummarizer(client ModelInvoker, info ModelInfo, adapter ModelAdapter) Summarizer {
+
+	return func(ctx context.Context, messages []Message) (string, error) {
+
+		maxTokens := summaryMaxTokens
+		prompt := []Message{{Role: "user", Content: []Content{{Type: "text", Text: summaryPromptPrefix + transcript(messages)}}}}
+		params := InferenceParameters{System: summarySystemPrompt, MaxTokens: &maxTokens}
+
+		answer, err := generate(ctx, client, info, adapter, prompt, params)
+
+		return answer.Text, err
+	}
+}
+
+// headers reporting what was trimmed, for clients of plain text streams
+func setTrimHeaders(h http.Header, report TrimReport) {
+	h.Set("X-Context-Dropped-Messages", strconv.Itoa(report.DroppedMessages))
+	h.Set("X-Context-Summarized-Messages", strconv.Itoa(report.SummarizedMessages))
+}
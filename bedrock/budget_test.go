@@ -0,0 +1,198 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestEstimateTokens(t *testing.T) {
+
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"a", 1},
+		{"abcd", 1},
+		{"abcde", 2},
+		{strings.Repeat("é", 8), 2},
+	}
+
+	for _, test := range tests {
+		if got := EstimateTokens(test.text); got != test.want {
+			t.Errorf("EstimateTokens(%q) = %d, want %d", test.text, got, test.want)
+		}
+	}
+
+	image := Message{Role: "user", Content: []Content{{Type: "image"}, {Type: "text", Text: "abcd"}}}
+
+	if got, want := EstimateMessageTokens(image), messageOverhead+imageTokens+1; got != want {
+		t.Errorf("EstimateMessageTokens of an image = %d, want %d", got, want)
+	}
+}
+
+// a conversation of alternating turns starting with the user, each turn
+// estimated at 14 tokens
+func turns(n int) []Message {
+
+	messages := make([]Message, n)
+
+	for k := range messages {
+		role := "user"
+		if k%2 == 1 {
+			role = "assistant"
+		}
+		messages[k] = textMessage(role, strings.Repeat(string(rune('a'+k)), 40))
+	}
+
+	return messages
+}
+
+func TestTrimHistory(t *testing.T) {
+
+	// 10 tokens
+	system := strings.Repeat("s", 40)
+
+	// a summarizer answering with text, recording how many messages it got
+	var summarized int
+	summarizer := func(text string, err error) Summarizer {
+		return func(ctx context.Context, messages []Message) (string, error) {
+			summarized = len(messages)
+			return text, err
+		}
+	}
+
+	tests := []struct {
+		name       string
+		messages   []Message
+		system     string
+		budget     int
+		summarize  Summarizer
+		dropped    int
+		summarized int
+		given      int // messages given to the summarizer, summarized when 0
+		wantSystem string
+		err        string
+	}{
+		{name: "fits", messages: turns(5), budget: 70},
+		{name: "no messages", budget: 5},
+		{name: "drops the oldest", messages: turns(5), budget: 45, dropped: 2},
+		{name: "never starts with an assistant turn", messages: turns(5), budget: 56, dropped: 2},
+		{name: "keeps the latest user turn", messages: turns(5), budget: 15, dropped: 4},
+		{name: "counts the system prompt", messages: turns(5), system: system, budget: 45, dropped: 4, wantSystem: system},
+		{name: "latest turn too long", messages: turns(5), budget: 13, err: "conversation exceeds the context window: the latest message needs about 14 tokens, more than the 13 tokens available"},
+		{name: "system prompt too long", messages: turns(1), system: system, budget: 20, err: "conversation exceeds the context window: the latest message needs about 24 tokens, more than the 20 tokens available"},
+		{
+			name: "summary in the system prompt", messages: turns(5), budget: 56, summarize: summarizer(" they said hi ", nil),
+			dropped: 2, summarized: 2, wantSystem: summarySystemHeading + "they said hi",
+		},
+		{
+			name: "summary after the system prompt", messages: turns(5), system: "be", budget: 56, summarize: summarizer("hi", nil),
+			dropped: 2, summarized: 2, wantSystem: "be\n\n" + summarySystemHeading + "hi",
+		},
+		{
+			// the summary needs room as well
+			name: "long summary drops more turns", messages: turns(5), budget: 45, summarize: summarizer(strings.Repeat("x", 40), nil),
+			dropped: 4, summarized: 2, wantSystem: summarySystemHeading + strings.Repeat("x", 40),
+		},
+		{name: "empty summary", messages: turns(5), system: system, budget: 45, summarize: summarizer("  ", nil), dropped: 4, given: 4, wantSystem: system},
+		{name: "failing summarizer", messages: turns(5), budget: 45, summarize: summarizer("", errors.New("throttled")), err: "summarize history: throttled"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			summarized = 0
+
+			messages, params, report, err := TrimHistory(context.Background(), test.messages, InferenceParameters{System: test.system}, test.budget, test.summarize)
+
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				if strings.HasPrefix(test.err, ErrContextExceeded.Error()) && !errors.Is(err, ErrContextExceeded) {
+					t.Errorf("error %v is not ErrContextExceeded", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			given := test.given
+			if given == 0 {
+				given = test.summarized
+			}
+
+			if report.DroppedMessages != test.dropped || report.SummarizedMessages != test.summarized || summarized != given {
+				t.Errorf("dropped %d, summarized %d of %d given to the summarizer, want %d, %d and %d", report.DroppedMessages, report.SummarizedMessages, summarized, test.dropped, test.summarized, given)
+			}
+
+			if report.Trimmed() != (test.dropped > 0) {
+				t.Errorf("trimmed %v with %d dropped", report.Trimmed(), test.dropped)
+			}
+
+			if want := test.messages[test.dropped:]; len(messages) != len(want) || len(messages) > 0 && &messages[0] != &want[0] {
+				t.Errorf("kept %d messages, want the last %d", len(messages), len(want))
+			}
+
+			if len(messages) > 0 && messages[0].Role != "user" {
+				t.Errorf("kept messages start with %s", messages[0].Role)
+			}
+
+			wantSystem := test.wantSystem
+			if wantSystem == "" {
+				wantSystem = test.system
+			}
+
+			if params.System != wantSystem {
+				t.Errorf("got system %q, want %q", params.System, wantSystem)
+			}
+
+			if report.Budget != test.budget || report.EstimatedTokens != EstimateMessagesTokens(test.system, test.messages) || report.RemainingTokens != EstimateMessagesTokens(params.System, messages) || report.RemainingTokens > test.budget {
+				t.Errorf("got report %+v", report)
+			}
+		})
+	}
+}
+
+func TestModelSummarizer(t *testing.T) {
+
+	cfg := DefaultConfig()
+
+	info, adapter, err := cfg.ResolveModel("")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &FakeModelInvoker{Deltas: []string{"they said", " hi"}}
+
+	summary, err := modelSummarizer(client, info, adapter)(context.Background(), []Message{
+		textMessage("user", "hello"),
+		{Role: "assistant", Content: []Content{{Type: "text", Text: " hi "}, {Type: "tool_use", Name: "calculator"}}},
+		textMessage("user", "  "),
+	})
+
+	if err != nil || summary != "they said hi" {
+		t.Fatalf("got summary %q, %v", summary, err)
+	}
+
+	var request RequestBodyClaude3
+	decodeBody(t, client.Bodies()[0], &request)
+
+	if request.System != summarySystemPrompt || request.MaxTokensToSample != summaryMaxTokens {
+		t.Errorf("got system %q and max tokens %d", request.System, request.MaxTokensToSample)
+	}
+
+	// empty turns are left out of the transcript
+	if want := summaryPromptPrefix + "user: hello\n\nassistant: hi\n\n"; len(request.Messages) != 1 || request.Messages[0].Content[0].Text != want {
+		t.Errorf("got messages %+v, want one with %q", request.Messages, want)
+	}
+}
@@ -0,0 +1,541 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// chunking strategies of the config
+const (
+	// the whole text as one chunk
+	ChunkNone = "none"
+
+	// windows of chunkSize characters overlapping by chunkOverlap, cut
+	// between words
+	ChunkFixed = "fixed"
+
+	// whole sentences packed up to chunkSize characters, ending chunks at
+	// paragraph breaks when they are at least half full
+	ChunkSentence = "sentence"
+
+	// the sentence strategy within the sections of markdown headings, each
+	// chunk keeps the path of its headings
+	ChunkMarkdown = "markdown"
+)
+
+// how texts are split before they are embedded, Size and Overlap count
+// characters
+type ChunkOptions struct {
+	Strategy string
+	Size     int
+	Overlap  int
+}
+
+func (c *Config) ChunkOptions() ChunkOptions {
+	return ChunkOptions{Strategy: c.ChunkStrategy, Size: c.ChunkSize, Overlap: c.ChunkOverlap}
+}
+
+// a part of a text, Start and End are character offsets in the text and End
+// is exclusive
+type Chunk struct {
+	Index   int    `json:"index"`
+	Start   int    `json:"start"`
+	End     int    `json:"end"`
+	Heading string `json:"heading,omitempty"`
+	Text    string `json:"text"`
+}
+
+// a run of characters, offsets into the runes of a text
+type runeSpan struct {
+	start int
+	end   int
+
+	// the span ends a paragraph
+	paragraph bool
+}
+
+// split a text into chunks, leading and trailing white space of each chunk
+// is left out
+func ChunkText(text string, options ChunkOptions) []Chunk {
+
+	runes := []rune(text)
+
+	var spans []runeSpan
+	headings := map[int]string{}
+
+	switch options.Strategy {
+	case ChunkFixed:
+		spans = fixedSpans(runes, 0, len(runes), options.Size, options.Overlap)
+	case ChunkSentence:
+		spans = packSpans(runes, sentenceSpans(runes, 0, len(runes)), options.Size, options.Overlap)
+	case ChunkMarkdown:
+		for _, section := range markdownSections(runes) {
+			// a heading followed by another heading has no text of its own
+			if strings.TrimSpace(string(runes[section.body:section.end])) == "" {
+				continue
+			}
+			for _, span := range packSpans(runes, sentenceSpans(runes, section.start, section.end), options.Size, options.Overlap) {
+				headings[len(spans)] = section.heading
+				spans = append(spans, span)
+			}
+		}
+	default:
+		spans = []runeSpan{{start: 0, end: len(runes)}}
+	}
+
+	chunks := []Chunk{}
+
+	for k, span := range spans {
+		span = trimSpan(runes, span)
+		if span.start == span.end {
+			continue
+		}
+		chunks = append(chunks, Chunk{
+			Index:   len(chunks),
+			Start:   span.start,
+			End:     span.end,
+			Heading: headings[k],
+			Text:    string(runes[span.start:span.end]),
+		})
+	}
+
+	return chunks
+}
+
+func trimSpan(runes []rune, span runeSpan) runeSpan {
+	for span.start < span.end && unicode.IsSpace(runes[span.start]) {
+		span.start++
+	}
+	for span.end > span.start && unicode.IsSpace(runes[span.end-1]) {
+		span.end--
+	}
+	return span
+}
+
+// windows of size runes from start to end, each starting overlap runes
+// before the end of the previous one; windows end at white space in their
+// second half when there is some
+func fixedSpans(runes []rune, start int, end int, size int, overlap int) []runeSpan {
+
+	var spans []runeSpan
+
+	for start < end {
+
+		for start < end && unicode.IsSpace(runes[start]) {
+			start++
+		}
+
+		if start == end {
+			break
+		}
+
+		stop := min(start+size, end)
+
+		if stop < end {
+			for k := stop; k > start+size/2; k-- {
+				if unicode.IsSpace(runes[k]) {
+					stop = k
+					break
+				}
+			}
+		}
+
+		spans = append(spans, runeSpan{start: start, end: stop})
+
+		if stop == end {
+			break
+		}
+
+		// start the next window at a word within the overlap
+		next := stop - overlap
+		for next < stop && next > start && !unicode.IsSpace(runes[next-1]) {
+			next++
+		}
+
+		if next <= start {
+			next = stop
+		}
+
+		start = next
+	}
+
+	return spans
+}
+
+// the sentences of a text, a sentence ends with . ! or ? before white space
+// or with a blank line, which also ends its paragraph
+func sentenceSpans(runes []rune, start int, end int) []runeSpan {
+
+	var spans []runeSpan
+
+	from := start
+
+	for k := start; k < end; k++ {
+
+		r := runes[k]
+
+		switch {
+		case r == '\n' && blankLineAfter(runes, k+1, end):
+			spans = append(spans, runeSpan{start: from, end: k + 1, paragraph: true})
+			from = k + 1
+		case (r == '.' || r == '!' || r == '?') && (k+1 == end || unicode.IsSpace(runes[k+1])):
+			spans = append(spans, runeSpan{start: from, end: k + 1})
+			from = k + 1
+		case r == '。' || r == '！' || r == '？':
+			spans = append(spans, runeSpan{start: from, end: k + 1})
+			from = k + 1
+		}
+	}
+
+	if from < end {
+		spans = append(spans, runeSpan{start: from, end: end, paragraph: true})
+	}
+
+	// drop the white space between sentences
+	var sentences []runeSpan
+
+	for _, span := range spans {
+		paragraph := span.paragraph
+		if span = trimSpan(runes, span); span.start < span.end {
+			span.paragraph = paragraph
+			sentences = append(sentences, span)
+		} else if paragraph && len(sentences) > 0 {
+			sentences[len(sentences)-1].paragraph = true
+		}
+	}
+
+	return sentences
+}
+
+// the line from k to the next newline is blank
+func blankLineAfter(runes []rune, k int, end int) bool {
+	for ; k < end; k++ {
+		switch {
+		case runes[k] == '\n':
+			return true
+		case !unicode.IsSpace(runes[k]):
+			return false
+		}
+	}
+	return false
+}
+
+// pack sentences into chunks of at most size runes, repeating up to overlap
+// runes of the last sentences of a chunk at the start of the next; longer
+// sentences are cut into fixed windows
+func packSpans(runes []rune, sentences []runeSpan, size int, overlap int) []runeSpan {
+
+	var spans []runeSpan
+	var current []runeSpan
+
+	// current holds sentences not yet in a chunk
+	fresh := false
+
+	flush := func() {
+
+		if !fresh {
+			return
+		}
+
+		spans = append(spans, runeSpan{start: current[0].start, end: current[len(current)-1].end})
+		fresh = false
+
+		// keep the last sentences fitting in the overlap, but never all
+		kept, length := 0, 0
+		for k := len(current) - 1; k > 0; k-- {
+			length += current[k].end - current[k].start
+			if length > overlap {
+				break
+			}
+			kept++
+		}
+
+		current = append([]runeSpan(nil), current[len(current)-kept:]...)
+	}
+
+	for _, sentence := range sentences {
+
+		if sentence.end-sentence.start > size {
+			flush()
+			current, fresh = nil, false
+			spans = append(spans, fixedSpans(runes, sentence.start, sentence.end, size, overlap)...)
+			continue
+		}
+
+		if len(current) > 0 && sentence.end-current[0].start > size {
+			flush()
+			for len(current) > 0 && sentence.end-current[0].start > size {
+				current = current[1:]
+			}
+		}
+
+		current = append(current, sentence)
+		fresh = true
+
+		if sentence.paragraph && sentence.end-current[0].start >= size/2 {
+			flush()
+		}
+	}
+
+	flush()
+
+	return spans
+}
+
+// a markdown heading line outside code fences
+var markdownHeading = regexp.MustCompile(`^(#{1,6})[ \t]+(.*?)[ \t#]*$`)
+
+// the text under a markdown heading up to the next heading, heading is the
+// path of headings it is under
+type markdownSection struct {
+	start   int
+	body    int
+	end     int
+	heading string
+}
+
+// split a markdown text at its headings, text before the first heading is a
+// section without heading
+func markdownSections(runes []rune) []markdownSection {
+
+	var sections []markdownSection
+	var path []string
+
+	current := markdownSection{}
+	fence := ""
+
+	for start := 0; start < len(runes); {
+
+		end := start
+		for end < len(runes) && runes[end] != '\n' {
+			end++
+		}
+
+		line := strings.TrimRight(string(runes[start:end]), "\r")
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case fence != "":
+			if strings.HasPrefix(trimmed, fence) {
+				fence = ""
+			}
+		case strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~"):
+			fence = trimmed[:3]
+		default:
+			if match := markdownHeading.FindStringSubmatch(line); match != nil {
+
+				current.end = start
+				sections = append(sections, current)
+
+				level := len(match[1])
+				if level <= len(path) {
+					path = path[:level-1]
+				}
+				for len(path) < level-1 {
+					path = append(path, "")
+				}
+				path = append(path, match[2])
+
+				current = markdownSection{start: start, body: min(end+1, len(runes)), heading: joinHeadings(path)}
+			}
+		}
+
+		start = end + 1
+	}
+
+	current.end = len(runes)
+	sections = append(sections, current)
+
+	return sections
+}
+
+func joinHeadings(path []string) string {
+
+	var headings []string
+
+	for _, heading := range path {
+		if heading != "" {
+			headings = append(headings, heading)
+		}
+	}
+
+	return strings.Join(headings, " > ")
+}
+
+// the id of a document, ID when set, else a hash of its link or, without a
+// link, of its title and text
+func DocumentID(item IndexItem) string {
+
+	if item.ID != "" {
+		return item.ID
+	}
+
+	key := item.Link
+
+	if key == "" {
+		key = item.Title + "\x00" + item.Text
+	}
+
+	sum := sha256.Sum256([]byte(key))
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// the index documents of the chunks of an item, without vectors
+func ChunkItem(item IndexItem, options ChunkOptions) []IndexDocument {
+
+	id := DocumentID(item)
+
+	var documents []IndexDocument
+
+	for _, chunk := range ChunkText(item.Text, options) {
+		documents = append(documents, IndexDocument{
+			Title:      item.Title,
+			Link:       item.Link,
+			Text:       chunk.Text,
+			ParentID:   id,
+			ChunkIndex: chunk.Index,
+			Start:      chunk.Start,
+			End:        chunk.End,
+			Heading:    chunk.Heading,
+		})
+	}
+
+	return documents
+}
+
+// the text embedded for a chunk, its headings give it the context of the
+// section it was cut from
+func embeddingText(document IndexDocument) string {
+
+	if document.Heading == "" {
+		return document.Text
+	}
+
+	return document.Heading + "\n\n" + document.Text
+}
+
+// the items of indexed chunks, the text of each item is put together from
+// the offsets of its chunks; documents indexed before chunking are items of
+// their own
+func JoinChunks(documents []IndexDocument) []IndexItem {
+
+	var items []IndexItem
+	parents := map[string]int{}
+	chunks := map[string][]IndexDocument{}
+
+	for _, document := range documents {
+
+		if document.ParentID == "" {
+			items = append(items, IndexItem{Title: document.Title, Link: document.Link, Text: document.Text})
+			continue
+		}
+
+		if _, ok := parents[document.ParentID]; !ok {
+			parents[document.ParentID] = len(items)
+			items = append(items, IndexItem{ID: document.ParentID, Title: document.Title, Link: document.Link})
+		}
+
+		chunks[document.ParentID] = append(chunks[document.ParentID], document)
+	}
+
+	for id, k := range parents {
+
+		length := 0
+		for _, chunk := range chunks[id] {
+			length = max(length, chunk.End)
+		}
+
+		// white space left out between chunks becomes spaces
+		text := []rune(strings.Repeat(" ", length))
+		for _, chunk := range chunks[id] {
+			copy(text[chunk.Start:], []rune(chunk.Text))
+		}
+
+		items[k].Text = string(text)
+	}
+
+	return items
+}
+
+// a chunk found by a search and its score
+type ChunkHit struct {
+	ID    string  `json:"id"`
+	Score float64 `json:"score"`
+	IndexDocument
+}
+
+// the chunks of a search response, without their vectors
+func DecodeChunkHits(body io.Reader) ([]ChunkHit, error) {
+
+	var result AossResponse
+
+	if err := json.NewDecoder(body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	hits := []ChunkHit{}
+
+	for _, hit := range result.Hits.Hits {
+		hit.Source.Vector = nil
+		hits = append(hits, ChunkHit{ID: hit.ID, Score: hit.Score, IndexDocument: hit.Source})
+	}
+
+	return hits, nil
+}
+
+// a document of chunks found by a search, Score is the best of its chunks
+type ParentDocument struct {
+	ID     string     `json:"id"`
+	Title  string     `json:"title"`
+	Link   string     `json:"link"`
+	Score  float64    `json:"score"`
+	Chunks []ChunkHit `json:"chunks"`
+}
+
+// group the chunks of a search by the document they were cut from, the best
+// scoring document first and the chunks of each in text order
+func GroupByParent(hits []ChunkHit) []ParentDocument {
+
+	documents := []ParentDocument{}
+	parents := map[string]int{}
+
+	for _, hit := range hits {
+
+		// documents indexed before chunking are their own parent
+		id := hit.ParentID
+		if id == "" {
+			id = hit.ID
+		}
+
+		k, ok := parents[id]
+
+		if !ok {
+			k = len(documents)
+			parents[id] = k
+			documents = append(documents, ParentDocument{ID: id, Title: hit.Title, Link: hit.Link, Score: hit.Score})
+		}
+
+		documents[k].Score = max(documents[k].Score, hit.Score)
+		documents[k].Chunks = append(documents[k].Chunks, hit)
+	}
+
+	for _, document := range documents {
+		sort.SliceStable(document.Chunks, func(i, j int) bool {
+			return document.Chunks[i].ChunkIndex < document.Chunks[j].ChunkIndex
+		})
+	}
+
+	sort.SliceStable(documents, func(i, j int) bool { return documents[i].Score > documents[j].Score })
+
+	return documents
+}
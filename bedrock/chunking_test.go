@@ -0,0 +1,311 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode"
+)
+
+// texts and headings of chunks, for comparing
+func chunkTexts(chunks []Chunk) ([]string, []string) {
+
+	texts := make([]string, len(chunks))
+	headings := make([]string, len(chunks))
+
+	for k, chunk := range chunks {
+		texts[k] = chunk.Text
+		headings[k] = chunk.Heading
+	}
+
+	return texts, headings
+}
+
+// the chunks are numbered in order, cut from the text at their offsets and
+// trimmed
+func checkChunks(t *testing.T, text string, chunks []Chunk) {
+
+	t.Helper()
+
+	runes := []rune(text)
+
+	for k, chunk := range chunks {
+
+		if chunk.Index != k {
+			t.Errorf("chunk %d has index %d", k, chunk.Index)
+		}
+
+		if chunk.Start < 0 || chunk.End > len(runes) || chunk.Start >= chunk.End || string(runes[chunk.Start:chunk.End]) != chunk.Text {
+			t.Errorf("chunk %d at %d-%d is not %q of the text", k, chunk.Start, chunk.End, chunk.Text)
+			continue
+		}
+
+		if strings.TrimSpace(chunk.Text) != chunk.Text {
+			t.Errorf("chunk %d %q is not trimmed", k, chunk.Text)
+		}
+	}
+}
+
+func TestChunkText(t *testing.T) {
+
+	markdown := "intro text\n# A\nalpha.\n## B\nbeta.\n# C\n## D\ndelta.\n```\n# not a heading\n```\n### Deep\ngamma."
+
+	tests := []struct {
+		name     string
+		strategy string
+		text     string
+		size     int
+		overlap  int
+		want     []string
+		headings []string
+	}{
+		{name: "none", strategy: ChunkNone, text: "  one two three  ", size: 3, want: []string{"one two three"}},
+		{name: "unknown strategy", strategy: "", text: "one two three", size: 3, want: []string{"one two three"}},
+		{name: "empty", strategy: ChunkNone, text: " \n\t ", size: 10, want: []string{}},
+
+		{name: "fixed between words", strategy: ChunkFixed, text: "one two three four five six", size: 10, want: []string{"one two", "three four", "five six"}},
+		{name: "fixed overlap", strategy: ChunkFixed, text: "one two three four five six", size: 10, overlap: 5, want: []string{"one two", "two three", "three four", "four five", "five six"}},
+		{name: "fixed long word", strategy: ChunkFixed, text: "abcdefghijkl", size: 5, want: []string{"abcde", "fghij", "kl"}},
+		{name: "fixed overlap of a long word", strategy: ChunkFixed, text: "abcdefghijkl", size: 5, overlap: 2, want: []string{"abcde", "fghij", "kl"}},
+		{name: "fixed multibyte", strategy: ChunkFixed, text: "héllo wörld ünïcödé", size: 8, want: []string{"héllo", "wörld", "ünïcödé"}},
+		{name: "fixed emoji", strategy: ChunkFixed, text: "😀😀😀😀😀😀", size: 4, want: []string{"😀😀😀😀", "😀😀"}},
+
+		{name: "sentence", strategy: ChunkSentence, text: "One. Two! Three? Four.", size: 10, want: []string{"One. Two!", "Three?", "Four."}},
+		{name: "sentence overlap", strategy: ChunkSentence, text: "One. Two! Three? Four.", size: 12, overlap: 5, want: []string{"One. Two!", "Two! Three?", "Four."}},
+		{name: "sentences fit", strategy: ChunkSentence, text: "One. Two! Three? Four.", size: 100, want: []string{"One. Two! Three? Four."}},
+		{name: "not a sentence end", strategy: ChunkSentence, text: "Version 1.5 is out. Get it.", size: 20, want: []string{"Version 1.5 is out.", "Get it."}},
+		{name: "paragraph half full", strategy: ChunkSentence, text: "First one.\n\nSecond one.", size: 20, want: []string{"First one.", "Second one."}},
+		{name: "paragraph too short", strategy: ChunkSentence, text: "First one.\n\nSecond one.", size: 100, want: []string{"First one.\n\nSecond one."}},
+		{name: "long sentence", strategy: ChunkSentence, text: "Short. This sentence is far too long.", size: 14, want: []string{"Short.", "This sentence", "is far too", "long."}},
+		{name: "cjk sentences", strategy: ChunkSentence, text: "一二三。四五六！七八九？", size: 4, want: []string{"一二三。", "四五六！", "七八九？"}},
+
+		{
+			name: "markdown", strategy: ChunkMarkdown, text: markdown, size: 100,
+			want:     []string{"intro text", "# A\nalpha.", "## B\nbeta.", "## D\ndelta.\n```\n# not a heading\n```", "### Deep\ngamma."},
+			headings: []string{"", "A", "A > B", "C > D", "C > D > Deep"},
+		},
+		{
+			name: "markdown skipped levels", strategy: ChunkMarkdown, text: "### Deep\ntext.\n# Top\nmore.", size: 100,
+			want:     []string{"### Deep\ntext.", "# Top\nmore."},
+			headings: []string{"Deep", "Top"},
+		},
+		{
+			name: "markdown heading in every chunk", strategy: ChunkMarkdown, text: "# Guide\nOne two. Three four. Five six.", size: 20,
+			want:     []string{"# Guide\nOne two.", "Three four.", "Five six."},
+			headings: []string{"Guide", "Guide", "Guide"},
+		},
+		{
+			name: "markdown closing hashes", strategy: ChunkMarkdown, text: "## Setup ##\nInstall it.", size: 100,
+			want:     []string{"## Setup ##\nInstall it."},
+			headings: []string{"Setup"},
+		},
+		{name: "markdown without headings", strategy: ChunkMarkdown, text: "#hashtag is not a heading.", size: 100, want: []string{"#hashtag is not a heading."}, headings: []string{""}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			chunks := ChunkText(test.text, ChunkOptions{Strategy: test.strategy, Size: test.size, Overlap: test.overlap})
+
+			checkChunks(t, test.text, chunks)
+
+			texts, headings := chunkTexts(chunks)
+
+			if !reflect.DeepEqual(texts, test.want) {
+				t.Errorf("got chunks %q, want %q", texts, test.want)
+			}
+
+			if test.headings == nil {
+				test.headings = make([]string, len(test.want))
+			}
+
+			if !reflect.DeepEqual(headings, test.headings) {
+				t.Errorf("got headings %q, want %q", headings, test.headings)
+			}
+		})
+	}
+}
+
+// chunks of the fixed and sentence strategies keep to the size and overlap,
+// and every character of the text is in a chunk
+func TestChunkTextLimits(t *testing.T) {
+
+	var text strings.Builder
+
+	words := []string{"lambda", "functions", "scale", "to", "zero", "héllo", "wörld", "😀", "一二三", "supercalifragilisticexpialidocious"}
+
+	for k := 0; k < 400; k++ {
+		text.WriteString(words[k*7%len(words)])
+		switch {
+		case k%53 == 52:
+			text.WriteString(".\n\n")
+		case k%11 == 10:
+			text.WriteString(". ")
+		default:
+			text.WriteString(" ")
+		}
+	}
+
+	runes := []rune(text.String())
+
+	for _, strategy := range []string{ChunkFixed, ChunkSentence} {
+		for _, size := range []int{40, 100, 500} {
+			for _, overlap := range []int{0, 10, 30} {
+				t.Run(fmt.Sprintf("%s %d %d", strategy, size, overlap), func(t *testing.T) {
+
+					chunks := ChunkText(text.String(), ChunkOptions{Strategy: strategy, Size: size, Overlap: overlap})
+
+					checkChunks(t, text.String(), chunks)
+
+					covered := make([]bool, len(runes))
+
+					for k, chunk := range chunks {
+
+						if chunk.End-chunk.Start > size {
+							t.Errorf("chunk %d has %d characters, more than %d", k, chunk.End-chunk.Start, size)
+						}
+
+						if k > 0 && chunk.Start <= chunks[k-1].Start {
+							t.Errorf("chunk %d starts at %d, not after chunk %d at %d", k, chunk.Start, k-1, chunks[k-1].Start)
+						}
+
+						if k > 0 && strategy == ChunkFixed && chunks[k-1].End-chunk.Start > overlap {
+							t.Errorf("chunk %d overlaps the previous one by %d characters, more than %d", k, chunks[k-1].End-chunk.Start, overlap)
+						}
+
+						for i := chunk.Start; i < chunk.End; i++ {
+							covered[i] = true
+						}
+					}
+
+					for i, r := range runes {
+						if !covered[i] && !unicode.IsSpace(r) {
+							t.Fatalf("character %d %q is in no chunk", i, r)
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+func TestChunkItem(t *testing.T) {
+
+	item := IndexItem{Title: "Guide", Link: "https://example.com/guide", Text: "# Setup\nInstall it.\n# Use\nRun it."}
+
+	documents := ChunkItem(item, ChunkOptions{Strategy: ChunkMarkdown, Size: 100})
+
+	if len(documents) != 2 {
+		t.Fatalf("got %d documents, want 2", len(documents))
+	}
+
+	for k, document := range documents {
+		if document.Title != item.Title || document.Link != item.Link || document.ParentID != DocumentID(item) || document.ChunkIndex != k || document.Vector != nil {
+			t.Errorf("got document %+v", document)
+		}
+	}
+
+	if got, want := embeddingText(documents[1]), "Use\n\n# Use\nRun it."; got != want {
+		t.Errorf("got embedding text %q, want %q", got, want)
+	}
+
+	if got := embeddingText(IndexDocument{Text: "plain"}); got != "plain" {
+		t.Errorf("got embedding text %q without a heading", got)
+	}
+
+	// the id is kept, else the link, else the title and text are hashed
+	tests := []struct {
+		a, b IndexItem
+		same bool
+	}{
+		{IndexItem{ID: "x", Text: "a"}, IndexItem{ID: "x", Text: "b"}, true},
+		{IndexItem{Link: "l", Text: "a"}, IndexItem{Link: "l", Text: "b"}, true},
+		{IndexItem{Title: "t", Text: "a"}, IndexItem{Title: "t", Text: "b"}, false},
+		{IndexItem{Title: "ab", Text: "c"}, IndexItem{Title: "a", Text: "bc"}, false},
+	}
+
+	for _, test := range tests {
+		if same := DocumentID(test.a) == DocumentID(test.b); same != test.same {
+			t.Errorf("ids of %+v and %+v are the same: %v", test.a, test.b, same)
+		}
+	}
+
+	if id := DocumentID(IndexItem{ID: "x"}); id != "x" {
+		t.Errorf("got id %q", id)
+	}
+}
+
+func TestJoinChunks(t *testing.T) {
+
+	fixed := IndexItem{Title: "fixed", Text: "one two three four five six"}
+	paragraphs := IndexItem{Title: "paragraphs", Text: "\nFirst one.\n\nSecond one.\n"}
+
+	documents := append(ChunkItem(fixed, ChunkOptions{Strategy: ChunkFixed, Size: 10, Overlap: 5}), ChunkItem(paragraphs, ChunkOptions{Strategy: ChunkSentence, Size: 20})...)
+
+	// chunks come back in any order, mixed with notes indexed before chunking
+	documents = append([]IndexDocument{documents[3], {Title: "legacy", Text: "whole note"}}, append(documents[:3], documents[4:]...)...)
+
+	got := JoinChunks(documents)
+
+	want := []IndexItem{
+		{ID: DocumentID(fixed), Title: "fixed", Text: "one two three four five six"},
+		{Title: "legacy", Text: "whole note"},
+		{ID: DocumentID(paragraphs), Title: "paragraphs", Text: " First one.  Second one."},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if got := JoinChunks(nil); got != nil {
+		t.Errorf("got %+v without documents", got)
+	}
+}
+
+func TestGroupByParent(t *testing.T) {
+
+	hit := func(id, parent string, index int, score float64) ChunkHit {
+		return ChunkHit{ID: id, Score: score, IndexDocument: IndexDocument{Title: "title " + parent, ParentID: parent, ChunkIndex: index}}
+	}
+
+	hits := []ChunkHit{
+		hit("a2", "a", 2, 0.5),
+		hit("b0", "b", 0, 0.7),
+		hit("legacy", "", 0, 0.8),
+		hit("a0", "a", 0, 0.9),
+		hit("c1", "c", 1, 0.7),
+		hit("a1", "a", 1, 0.2),
+	}
+
+	documents := GroupByParent(hits)
+
+	var got []string
+
+	for _, document := range documents {
+		var ids []string
+		for _, chunk := range document.Chunks {
+			ids = append(ids, chunk.ID)
+		}
+		got = append(got, fmt.Sprintf("%s %.1f %s", document.ID, document.Score, strings.Join(ids, ",")))
+	}
+
+	// the best scoring document first, equal scores in search order, and
+	// the chunks of each in text order
+	want := []string{"a 0.9 a0,a1,a2", "legacy 0.8 legacy", "b 0.7 b0", "c 0.7 c1"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if documents[0].Title != "title a" {
+		t.Errorf("got title %q", documents[0].Title)
+	}
+
+	if got := GroupByParent(nil); got == nil || len(got) != 0 {
+		t.Errorf("got %+v without hits, want an empty list", got)
+	}
+}
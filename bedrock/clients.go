@@ -0,0 +1,139 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	opensearch "github.com/opensearch-project/opensearch-go/v2"
+	requestsigner "github.com/opensearch-project/opensearch-go/v2/signer/awsv2"
+)
+
+// the subset of the bedrock runtime used by the chat, image and embedding code
+//
+// the sdk does not let callers build an InvokeModelWithResponseStreamOutput or
+// a ConverseStreamOutput, so the streaming calls return the event stream
+// readers directly
+type ModelInvoker interface {
+	InvokeModel(ctx context.Context, params *bedrockruntime.InvokeModelInput, optFns ...func(*bedrockruntime.Options)) (*bedrockruntime.InvokeModelOutput, error)
+	InvokeModelWithResponseStream(ctx context.Context, params *bedrockruntime.InvokeModelWithResponseStreamInput, optFns ...func(*bedrockruntime.Options)) (bedrockruntime.ResponseStreamReader, error)
+	Converse(ctx context.Context, params *bedrockruntime.ConverseInput, optFns ...func(*bedrockruntime.Options)) (*bedrockruntime.ConverseOutput, error)
+	ConverseStream(ctx context.Context, params *bedrockruntime.ConverseStreamInput, optFns ...func(*bedrockruntime.Options)) (bedrockruntime.ConverseStreamOutputReader, error)
+}
+
+// the subset of the bedrock agent runtime used by the knowledge base handlers,
+// *bedrockagentruntime.Client implements it as is
+type KnowledgeBaseClient interface {
+	Retrieve(ctx context.Context, params *bedrockagentruntime.RetrieveInput, optFns ...func(*bedrockagentruntime.Options)) (*bedrockagentruntime.RetrieveOutput, error)
+	RetrieveAndGenerate(ctx context.Context, params *bedrockagentruntime.RetrieveAndGenerateInput, optFns ...func(*bedrockagentruntime.Options)) (*bedrockagentruntime.RetrieveAndGenerateOutput, error)
+}
+
+// the transport used to search and index the opensearch vector store,
+// *opensearch.Client implements it as is and opensearchapi requests accept it
+type VectorStore interface {
+	Perform(req *http.Request) (*http.Response, error)
+}
+
+// the aws clients of the server and of cmd/ingest
+type AWSClients struct {
+	AOSS          *opensearch.Client
+	Bedrock       *bedrockruntime.Client
+	KnowledgeBase *bedrockagentruntime.Client
+}
+
+// create the aws clients in the regions of the config with the default
+// credentials, the bedrock runtime client calls bedrockEndpoint when set,
+// such as the local emulator in cmd/fakebedrock
+func NewAWSClients(ctx context.Context, cfg *Config) (*AWSClients, error) {
+
+	bedrockCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(cfg.BedrockRegion))
+
+	if err != nil {
+		return nil, err
+	}
+
+	aossCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(cfg.AOSSRegion))
+
+	if err != nil {
+		return nil, err
+	}
+
+	knowledgeBaseCfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(cfg.KnowledgeBaseRegion))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// aoss requests are signed for the aoss service
+	signer, err := requestsigner.NewSignerWithService(aossCfg, "aoss")
+
+	if err != nil {
+		return nil, err
+	}
+
+	AOSSClient, err := opensearch.NewClient(opensearch.Config{
+		Addresses: []string{cfg.AOSSEndpoint},
+		Signer:    signer,
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	BedrockClient := bedrockruntime.NewFromConfig(bedrockCfg, func(o *bedrockruntime.Options) {
+		if cfg.BedrockEndpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.BedrockEndpoint)
+		}
+	})
+
+	return &AWSClients{
+		AOSS:          AOSSClient,
+		Bedrock:       BedrockClient,
+		KnowledgeBase: bedrockagentruntime.NewFromConfig(knowledgeBaseCfg),
+	}, nil
+}
+
+// adapt a bedrock runtime client to the ModelInvoker interface
+type BedrockRuntime struct {
+	Client *bedrockruntime.Client
+}
+
+func NewModelInvoker(client *bedrockruntime.Client) *BedrockRuntime {
+	return &BedrockRuntime{Client: client}
+}
+
+func (b *BedrockRuntime) InvokeModel(ctx context.Context, params *bedrockruntime.InvokeModelInput, optFns ...func(*bedrockruntime.Options)) (*bedrockruntime.InvokeModelOutput, error) {
+	return b.Client.InvokeModel(ctx, params, optFns...)
+}
+
+func (b *BedrockRuntime) InvokeModelWithResponseStream(ctx context.Context, params *bedrockruntime.InvokeModelWithResponseStreamInput, optFns ...func(*bedrockruntime.Options)) (bedrockruntime.ResponseStreamReader, error) {
+
+	output, err := b.Client.InvokeModelWithResponseStream(ctx, params, optFns...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return output.GetStream(), nil
+}
+
+func (b *BedrockRuntime) Converse(ctx context.Context, params *bedrockruntime.ConverseInput, optFns ...func(*bedrockruntime.Options)) (*bedrockruntime.ConverseOutput, error) {
+	return b.Client.Converse(ctx, params, optFns...)
+}
+
+func (b *BedrockRuntime) ConverseStream(ctx context.Context, params *bedrockruntime.ConverseStreamInput, optFns ...func(*bedrockruntime.Options)) (bedrockruntime.ConverseStreamOutputReader, error) {
+
+	output, err := b.Client.ConverseStream(ctx, params, optFns...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return output.GetStream(), nil
+}
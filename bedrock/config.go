@@ -0,0 +1,454 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// runtime configuration of the application
+//
+// values are resolved with the following precedence, lowest first:
+// built-in defaults, config file (yaml or json), environment variables
+// and command-line flags
+type Config struct {
+	BedrockRegion               string   `json:"bedrockRegion" yaml:"bedrockRegion"`
+	AOSSRegion                  string   `json:"aossRegion" yaml:"aossRegion"`
+	KnowledgeBaseRegion         string   `json:"knowledgeBaseRegion" yaml:"knowledgeBaseRegion"`
+	KnowledgeBaseID             string   `json:"knowledgeBaseId" yaml:"knowledgeBaseId"`
+	KnowledgeBaseModelID        string   `json:"knowledgeBaseModelId" yaml:"knowledgeBaseModelId"`
+	KnowledgeBaseNumberOfResult int      `json:"knowledgeBaseNumberOfResult" yaml:"knowledgeBaseNumberOfResult"`
+	AOSSEndpoint                string   `json:"aossEndpoint" yaml:"aossEndpoint"`
+	AOSSNoteAppIndexName        string   `json:"aossNoteAppIndexName" yaml:"aossNoteAppIndexName"`
+	ModelID                     string   `json:"modelId" yaml:"modelId"`
+	ImageModelID                string   `json:"imageModelId" yaml:"imageModelId"`
+	BedrockEndpoint             string   `json:"bedrockEndpoint" yaml:"bedrockEndpoint"`
+	Models                      []string `json:"models" yaml:"models"`
+	ConverseModels              []string `json:"converseModels" yaml:"converseModels"`
+	MaxToolIterations           int      `json:"maxToolIterations" yaml:"maxToolIterations"`
+	ConversationStore           string   `json:"conversationStore" yaml:"conversationStore"`
+	ConversationPath            string   `json:"conversationPath" yaml:"conversationPath"`
+	HistoryStrategy             string   `json:"historyStrategy" yaml:"historyStrategy"`
+	ContextBudget               int      `json:"contextBudget" yaml:"contextBudget"`
+	KnowledgeBasePromptTemplate string   `json:"knowledgeBasePromptTemplate" yaml:"knowledgeBasePromptTemplate"`
+	KnowledgeBaseRouter         string   `json:"knowledgeBaseRouter" yaml:"knowledgeBaseRouter"`
+	EmbeddingModelID            string   `json:"embeddingModelId" yaml:"embeddingModelId"`
+	EmbeddingDimensions         int      `json:"embeddingDimensions" yaml:"embeddingDimensions"`
+	IndexEngine                 string   `json:"indexEngine" yaml:"indexEngine"`
+	IndexSpaceType              string   `json:"indexSpaceType" yaml:"indexSpaceType"`
+	CreateIndex                 bool     `json:"createIndex" yaml:"createIndex"`
+	AdminToken                  string   `json:"adminToken" yaml:"adminToken"`
+	IngestWorkers               int      `json:"ingestWorkers" yaml:"ingestWorkers"`
+	IngestBatchSize             int      `json:"ingestBatchSize" yaml:"ingestBatchSize"`
+	IngestMaxRetries            int      `json:"ingestMaxRetries" yaml:"ingestMaxRetries"`
+	ChunkStrategy               string   `json:"chunkStrategy" yaml:"chunkStrategy"`
+	ChunkSize                   int      `json:"chunkSize" yaml:"chunkSize"`
+	ChunkOverlap                int      `json:"chunkOverlap" yaml:"chunkOverlap"`
+	HybridFusion                string   `json:"hybridFusion" yaml:"hybridFusion"`
+	HybridVectorWeight          float64  `json:"hybridVectorWeight" yaml:"hybridVectorWeight"`
+	HybridFields                []string `json:"hybridFields" yaml:"hybridFields"`
+	HybridRankConstant          int      `json:"hybridRankConstant" yaml:"hybridRankConstant"`
+
+	// named knowledge bases besides knowledgeBaseId, only set by the config file
+	KnowledgeBases map[string]KnowledgeBase `json:"knowledgeBases" yaml:"knowledgeBases"`
+
+	// named knowledge base prompts, only set by the config file
+	PromptTemplates map[string]PromptTemplate `json:"promptTemplates" yaml:"promptTemplates"`
+}
+
+// default values, please replace the following with yours or
+// override them by config file, environment variables or flags
+func DefaultConfig() Config {
+	return Config{
+		BedrockRegion:               "us-west-2",
+		AOSSRegion:                  "us-west-2",
+		KnowledgeBaseRegion:         "us-west-2",
+		KnowledgeBaseID:             "X3CHIODXQZ",
+		KnowledgeBaseModelID:        "anthropic.claude-3-haiku-20240307-v1:0",
+		KnowledgeBaseNumberOfResult: 6,
+		AOSSEndpoint:                "https://yvp6plo4ijurgy8ymhdg.us-east-1.aoss.amazonaws.com",
+		AOSSNoteAppIndexName:        "demo",
+		ModelID:                     "anthropic.claude-3-5-haiku-20241022-v1:0",
+		ImageModelID:                "anthropic.claude-3-haiku-20240307-v1:0",
+		MaxToolIterations:           5,
+		ConversationStore:           "memory",
+		ConversationPath:            "conversations.db",
+		HistoryStrategy:             HistoryDrop,
+		EmbeddingModelID:            DefaultEmbeddingModel,
+		IndexEngine:                 EngineFaiss,
+		IndexSpaceType:              SpaceL2,
+		IngestWorkers:               4,
+		IngestBatchSize:             50,
+		IngestMaxRetries:            3,
+		ChunkStrategy:               ChunkSentence,
+		ChunkSize:                   1000,
+		ChunkOverlap:                100,
+		HybridFusion:                FusionRRF,
+		HybridVectorWeight:          0.5,
+		HybridFields:                []string{"title", "text"},
+		HybridRankConstant:          60,
+	}
+}
+
+// a config field which can be set from an environment variable or a flag
+type configField struct {
+	env   string
+	flag  string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+func setString(field func(c *Config) *string) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+func setStrings(field func(c *Config) *[]string) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		var values []string
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		*field(c) = values
+		return nil
+	}
+}
+
+func setInt(field func(c *Config) *int) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func setFloat(field func(c *Config) *float64) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		*field(c) = f
+		return nil
+	}
+}
+
+func setBool(field func(c *Config) *bool) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+var configFields = []configField{
+	{"BEDROCK_REGION", "bedrock-region", "region of the bedrock runtime", setString(func(c *Config) *string { return &c.BedrockRegion })},
+	{"AOSS_REGION", "aoss-region", "region of the opensearch serverless collection", setString(func(c *Config) *string { return &c.AOSSRegion })},
+	{"KNOWLEDGE_BASE_REGION", "knowledge-base-region", "region of the knowledge base", setString(func(c *Config) *string { return &c.KnowledgeBaseRegion })},
+	{"KNOWLEDGE_BASE_ID", "knowledge-base-id", "id of the knowledge base", setString(func(c *Config) *string { return &c.KnowledgeBaseID })},
+	{"KNOWLEDGE_BASE_MODEL_ID", "knowledge-base-model-id", "model used to generate knowledge base answers", setString(func(c *Config) *string { return &c.KnowledgeBaseModelID })},
+	{"KNOWLEDGE_BASE_NUMBER_OF_RESULT", "knowledge-base-number-of-result", "number of chunks retrieved from the knowledge base", setInt(func(c *Config) *int { return &c.KnowledgeBaseNumberOfResult })},
+	{"KNOWLEDGE_BASE_PROMPT_TEMPLATE", "knowledge-base-prompt-template", "prompt template of knowledge base answers when requests name none", setString(func(c *Config) *string { return &c.KnowledgeBasePromptTemplate })},
+	{"KNOWLEDGE_BASE_ROUTER", "knowledge-base-router", "how requests naming no knowledge base are routed, keyword or model, empty for the default knowledge base", setString(func(c *Config) *string { return &c.KnowledgeBaseRouter })},
+	{"AOSS_ENDPOINT", "aoss-endpoint", "url of the opensearch serverless collection", setString(func(c *Config) *string { return &c.AOSSEndpoint })},
+	{"AOSS_NOTE_APP_INDEX_NAME", "aoss-note-app-index-name", "name of the note index", setString(func(c *Config) *string { return &c.AOSSNoteAppIndexName })},
+	{"EMBEDDING_MODEL_ID", "embedding-model-id", "model embedding the notes of the index", setString(func(c *Config) *string { return &c.EmbeddingModelID })},
+	{"EMBEDDING_DIMENSIONS", "embedding-dimensions", "size of the note embeddings, 0 uses the default size of the embedding model", setInt(func(c *Config) *int { return &c.EmbeddingDimensions })},
+	{"INDEX_ENGINE", "index-engine", "knn engine of the note index, faiss or nmslib", setString(func(c *Config) *string { return &c.IndexEngine })},
+	{"INDEX_SPACE_TYPE", "index-space-type", "distance of the note index, l2, cosinesimil or innerproduct", setString(func(c *Config) *string { return &c.IndexSpaceType })},
+	{"CREATE_INDEX", "create-index", "create the note index at startup when it does not exist", setBool(func(c *Config) *bool { return &c.CreateIndex })},
+	{"ADMIN_TOKEN", "admin-token", "bearer token of the admin endpoints, they are off when empty", setString(func(c *Config) *string { return &c.AdminToken })},
+	{"INGEST_WORKERS", "ingest-workers", "concurrent embedding requests of a bulk ingestion", setInt(func(c *Config) *int { return &c.IngestWorkers })},
+	{"INGEST_BATCH_SIZE", "ingest-batch-size", "documents per _bulk request of a bulk ingestion", setInt(func(c *Config) *int { return &c.IngestBatchSize })},
+	{"INGEST_MAX_RETRIES", "ingest-max-retries", "times throttled documents of a bulk ingestion are sent again", setInt(func(c *Config) *int { return &c.IngestMaxRetries })},
+	{"CHUNK_STRATEGY", "chunk-strategy", "how notes are split before they are embedded, none, fixed, sentence or markdown", setString(func(c *Config) *string { return &c.ChunkStrategy })},
+	{"CHUNK_SIZE", "chunk-size", "largest chunk of a note in characters", setInt(func(c *Config) *int { return &c.ChunkSize })},
+	{"CHUNK_OVERLAP", "chunk-overlap", "characters repeated at the start of the next chunk", setInt(func(c *Config) *int { return &c.ChunkOverlap })},
+	{"HYBRID_FUSION", "hybrid-fusion", "how hybrid search fuses its vector and lexical hits, rrf or weighted", setString(func(c *Config) *string { return &c.HybridFusion })},
+	{"HYBRID_VECTOR_WEIGHT", "hybrid-vector-weight", "weight of the vector hits of hybrid search from 0 to 1, the lexical hits weigh the rest", setFloat(func(c *Config) *float64 { return &c.HybridVectorWeight })},
+	{"HYBRID_FIELDS", "hybrid-fields", "comma separated fields of the lexical search of hybrid search, for example title^2,text", setStrings(func(c *Config) *[]string { return &c.HybridFields })},
+	{"HYBRID_RANK_CONSTANT", "hybrid-rank-constant", "rank constant of reciprocal rank fusion", setInt(func(c *Config) *int { return &c.HybridRankConstant })},
+	{"MODEL_ID", "model-id", "model used by the chat handler", setString(func(c *Config) *string { return &c.ModelID })},
+	{"IMAGE_MODEL_ID", "image-model-id", "model with vision used by the image handler, the model id when empty", setString(func(c *Config) *string { return &c.ImageModelID })},
+	{"MODELS", "models", "comma separated models selectable by the model field of requests, besides the model id", setStrings(func(c *Config) *[]string { return &c.Models })},
+	{"CONVERSE_MODELS", "converse-models", "comma separated models invoked through the converse api instead of invoke model", setStrings(func(c *Config) *[]string { return &c.ConverseModels })},
+	{"MAX_TOOL_ITERATIONS", "max-tool-iterations", "maximum number of model calls of a chat request using tools", setInt(func(c *Config) *int { return &c.MaxToolIterations })},
+	{"CONVERSATION_STORE", "conversation-store", "where chat sessions are kept, memory or bolt", setString(func(c *Config) *string { return &c.ConversationStore })},
+	{"CONVERSATION_PATH", "conversation-path", "file of the bolt conversation store", setString(func(c *Config) *string { return &c.ConversationPath })},
+	{"HISTORY_STRATEGY", "history-strategy", "how turns beyond the context window are handled, drop or summarize", setString(func(c *Config) *string { return &c.HistoryStrategy })},
+	{"CONTEXT_BUDGET", "context-budget", "tokens of the context window, 0 uses the context window of the model", setInt(func(c *Config) *int { return &c.ContextBudget })},
+	{"BEDROCK_ENDPOINT", "bedrock-endpoint", "optional bedrock runtime url, for example a local fakebedrock", setString(func(c *Config) *string { return &c.BedrockEndpoint })},
+}
+
+// load config from defaults, config file, environment variables and flags
+//
+// the config file is given by the -config flag or the CONFIG_FILE
+// environment variable, it may be written in yaml or json
+func LoadConfig(args []string) (Config, error) {
+
+	fs := flag.NewFlagSet("gobedrock", flag.ContinueOnError)
+
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a yaml or json config file")
+
+	// register one string flag per field, values are applied only when set
+	flagValues := make(map[string]*string, len(configFields))
+	for _, field := range configFields {
+		flagValues[field.flag] = fs.String(field.flag, "", fmt.Sprintf("%s (env %s)", field.usage, field.env))
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	cfg := DefaultConfig()
+
+	// config file
+	if *configFile != "" {
+		if err := cfg.loadFile(*configFile); err != nil {
+			return Config{}, err
+		}
+	}
+
+	var errs []error
+
+	// environment variables
+	for _, field := range configFields {
+		if value, ok := os.LookupEnv(field.env); ok {
+			if err := field.set(&cfg, value); err != nil {
+				errs = append(errs, fmt.Errorf("env %s: %w", field.env, err))
+			}
+		}
+	}
+
+	// command-line flags
+	fs.Visit(func(f *flag.Flag) {
+		for _, field := range configFields {
+			if field.flag == f.Name {
+				if err := field.set(&cfg, *flagValues[f.Name]); err != nil {
+					errs = append(errs, fmt.Errorf("flag -%s: %w", f.Name, err))
+				}
+			}
+		}
+	})
+
+	if len(errs) > 0 {
+		return Config{}, errors.Join(errs...)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, err
+	}
+
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+
+	// json is a subset of yaml, so the yaml decoder handles both formats
+	// but we still reject unknown keys to catch typos early
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("parse config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// check that every field is set and well formed
+func (c *Config) Validate() error {
+
+	var errs []error
+
+	required := []struct {
+		name  string
+		value string
+	}{
+		{"bedrockRegion", c.BedrockRegion},
+		{"aossRegion", c.AOSSRegion},
+		{"knowledgeBaseRegion", c.KnowledgeBaseRegion},
+		{"knowledgeBaseId", c.KnowledgeBaseID},
+		{"knowledgeBaseModelId", c.KnowledgeBaseModelID},
+		{"aossEndpoint", c.AOSSEndpoint},
+		{"aossNoteAppIndexName", c.AOSSNoteAppIndexName},
+		{"modelId", c.ModelID},
+	}
+
+	for _, field := range required {
+		if strings.TrimSpace(field.value) == "" {
+			errs = append(errs, fmt.Errorf("config %s is required", field.name))
+		}
+	}
+
+	if c.KnowledgeBaseNumberOfResult < 1 || c.KnowledgeBaseNumberOfResult > 100 {
+		errs = append(errs, fmt.Errorf("config knowledgeBaseNumberOfResult must be between 1 and 100, got %d", c.KnowledgeBaseNumberOfResult))
+	}
+
+	if c.MaxToolIterations < 1 || c.MaxToolIterations > 20 {
+		errs = append(errs, fmt.Errorf("config maxToolIterations must be between 1 and 20, got %d", c.MaxToolIterations))
+	}
+
+	switch c.ConversationStore {
+	case "memory":
+	case "bolt":
+		if strings.TrimSpace(c.ConversationPath) == "" {
+			errs = append(errs, errors.New("config conversationPath is required by the bolt conversation store"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("config conversationStore must be memory or bolt, got %q", c.ConversationStore))
+	}
+
+	if c.HistoryStrategy != HistoryDrop && c.HistoryStrategy != HistorySummarize {
+		errs = append(errs, fmt.Errorf("config historyStrategy must be %s or %s, got %q", HistoryDrop, HistorySummarize, c.HistoryStrategy))
+	}
+
+	if c.ContextBudget < 0 {
+		errs = append(errs, fmt.Errorf("config contextBudget must not be negative, got %d", c.ContextBudget))
+	}
+
+	for name, base := range c.KnowledgeBases {
+		switch {
+		case strings.TrimSpace(name) == "":
+			errs = append(errs, errors.New("config knowledgeBases: names must not be blank"))
+		case name == DefaultKnowledgeBase:
+			errs = append(errs, fmt.Errorf("config knowledgeBases: %s is the name of knowledgeBaseId", DefaultKnowledgeBase))
+		case strings.TrimSpace(base.ID) == "":
+			errs = append(errs, fmt.Errorf("config knowledgeBases %s: id is required", name))
+		}
+	}
+
+	switch c.KnowledgeBaseRouter {
+	case "", RouterKeyword, RouterModel:
+	default:
+		errs = append(errs, fmt.Errorf("config knowledgeBaseRouter must be empty, %s or %s, got %q", RouterKeyword, RouterModel, c.KnowledgeBaseRouter))
+	}
+
+	for name, template := range c.PromptTemplates {
+		if strings.TrimSpace(name) == "" {
+			errs = append(errs, errors.New("config promptTemplates: names must not be blank"))
+		} else if err := template.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("config promptTemplates %s: %w", name, err))
+		}
+	}
+
+	if _, ok := c.PromptTemplates[c.KnowledgeBasePromptTemplate]; c.KnowledgeBasePromptTemplate != "" && !ok {
+		errs = append(errs, fmt.Errorf("config knowledgeBasePromptTemplate: %q is not in promptTemplates", c.KnowledgeBasePromptTemplate))
+	}
+
+	if c.IngestWorkers < 1 || c.IngestWorkers > 32 {
+		errs = append(errs, fmt.Errorf("config ingestWorkers must be between 1 and 32, got %d", c.IngestWorkers))
+	}
+
+	if c.IngestBatchSize < 1 || c.IngestBatchSize > 1000 {
+		errs = append(errs, fmt.Errorf("config ingestBatchSize must be between 1 and 1000, got %d", c.IngestBatchSize))
+	}
+
+	if c.IngestMaxRetries < 0 || c.IngestMaxRetries > 10 {
+		errs = append(errs, fmt.Errorf("config ingestMaxRetries must be between 0 and 10, got %d", c.IngestMaxRetries))
+	}
+
+	switch c.ChunkStrategy {
+	case ChunkNone, ChunkFixed, ChunkSentence, ChunkMarkdown:
+	default:
+		errs = append(errs, fmt.Errorf("config chunkStrategy must be %s, %s, %s or %s, got %q", ChunkNone, ChunkFixed, ChunkSentence, ChunkMarkdown, c.ChunkStrategy))
+	}
+
+	// titan embeddings take about 8000 tokens
+	if c.ChunkSize < 100 || c.ChunkSize > 20000 {
+		errs = append(errs, fmt.Errorf("config chunkSize must be between 100 and 20000, got %d", c.ChunkSize))
+	}
+
+	if c.ChunkOverlap < 0 || c.ChunkOverlap > c.ChunkSize/2 {
+		errs = append(errs, fmt.Errorf("config chunkOverlap must be between 0 and half of chunkSize, got %d", c.ChunkOverlap))
+	}
+
+	if c.HybridFusion != FusionRRF && c.HybridFusion != FusionWeighted {
+		errs = append(errs, fmt.Errorf("config hybridFusion must be %s or %s, got %q", FusionRRF, FusionWeighted, c.HybridFusion))
+	}
+
+	if c.HybridVectorWeight < 0 || c.HybridVectorWeight > 1 {
+		errs = append(errs, fmt.Errorf("config hybridVectorWeight must be between 0 and 1, got %g", c.HybridVectorWeight))
+	}
+
+	if len(c.HybridFields) == 0 {
+		errs = append(errs, errors.New("config hybridFields is required"))
+	}
+
+	for _, field := range c.HybridFields {
+		if !hybridField.MatchString(field) {
+			errs = append(errs, fmt.Errorf("config hybridFields: %q is not title, text or heading, with an optional ^boost", field))
+		}
+	}
+
+	if c.HybridRankConstant < 1 {
+		errs = append(errs, fmt.Errorf("config hybridRankConstant must be at least 1, got %d", c.HybridRankConstant))
+	}
+
+	if err := c.validateIndex(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.AOSSEndpoint != "" {
+		u, err := url.Parse(c.AOSSEndpoint)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("config aossEndpoint must be an http(s) url, got %q", c.AOSSEndpoint))
+		}
+	}
+
+	// converse models need no adapter, the converse api is the same for all
+	for _, modelID := range append([]string{c.ModelID, c.ImageModelID}, c.Models...) {
+		if _, err := AdapterForModel(modelID); modelID != "" && err != nil && !c.UsesConverse(modelID) {
+			errs = append(errs, fmt.Errorf("config models: %w", err))
+		}
+	}
+
+	for _, modelID := range c.ConverseModels {
+		if modelID != c.ModelID && modelID != c.ImageModelID && !containsString(c.Models, modelID) {
+			errs = append(errs, fmt.Errorf("config converseModels: %q is neither modelId, imageModelId nor in models", modelID))
+		}
+	}
+
+	if c.ImageModelID != "" && !ModelInfoFor(c.ImageModelID).Vision {
+		errs = append(errs, fmt.Errorf("config imageModelId: %s does not accept images", c.ImageModelID))
+	}
+
+	if c.BedrockEndpoint != "" {
+		u, err := url.Parse(c.BedrockEndpoint)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("config bedrockEndpoint must be an http(s) url, got %q", c.BedrockEndpoint))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %w", errors.Join(errs...))
+	}
+
+	return nil
+}
@@ -0,0 +1,228 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// unset the environment variables of the config for the rest of a test
+func clearConfigEnv(t *testing.T) {
+
+	for _, name := range append([]string{"CONFIG_FILE"}, configEnvNames()...) {
+		if value, ok := os.LookupEnv(name); ok {
+			t.Setenv(name, value)
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func configEnvNames() []string {
+	names := make([]string, len(configFields))
+	for k, field := range configFields {
+		names[k] = field.env
+	}
+	return names
+}
+
+// write a config file into a temporary folder
+func writeConfigFile(t *testing.T, name, content string) string {
+
+	path := filepath.Join(t.TempDir(), name)
+
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+
+	clearConfigEnv(t)
+
+	cfg, err := LoadConfig(nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := DefaultConfig(); !reflect.DeepEqual(cfg, want) {
+		t.Errorf("config %+v, want the defaults %+v", cfg, want)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+
+	clearConfigEnv(t)
+
+	file := writeConfigFile(t, "config.yaml", `
+aossNoteAppIndexName: from-file
+chunkSize: 2000
+ingestWorkers: 8
+models:
+  - amazon.nova-lite-v1:0
+`)
+
+	// the file sets all four, env three and the flag one of them
+	t.Setenv("AOSS_NOTE_APP_INDEX_NAME", "from-env")
+	t.Setenv("CHUNK_SIZE", "3000")
+	t.Setenv("MODELS", "meta.llama3-8b-instruct-v1:0, mistral.mistral-7b-instruct-v0:2")
+
+	cfg, err := LoadConfig([]string{"-config", file, "-chunk-size", "4000"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"default", cfg.BedrockRegion, DefaultConfig().BedrockRegion},
+		{"file", cfg.IngestWorkers, 8},
+		{"env over file", cfg.AOSSNoteAppIndexName, "from-env"},
+		{"env list over file", cfg.Models, []string{"meta.llama3-8b-instruct-v1:0", "mistral.mistral-7b-instruct-v0:2"}},
+		{"flag over env", cfg.ChunkSize, 4000},
+	}
+
+	for _, test := range tests {
+		if !reflect.DeepEqual(test.got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, test.got, test.want)
+		}
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		err     string
+	}{
+		{"json", "config.json", `{"aossNoteAppIndexName": "notes", "chunkSize": 500}`, ""},
+		{"yaml typo", "config.yaml", "aossNoteAppIndexNam: notes\n", "field aossNoteAppIndexNam not found"},
+		{"json typo", "config.json", `{"chunkSise": 500}`, "field chunkSise not found"},
+		{"wrong type", "config.yaml", "chunkSize: large\n", "parse config file"},
+		{"invalid value", "config.yaml", "chunkStrategy: words\n", "config chunkStrategy must be"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			clearConfigEnv(t)
+
+			cfg, err := LoadConfig([]string{"-config", writeConfigFile(t, test.file, test.content)})
+
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if cfg.AOSSNoteAppIndexName != "notes" || cfg.ChunkSize != 500 {
+					t.Errorf("config %+v", cfg)
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error %v, want %q", err, test.err)
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+
+		clearConfigEnv(t)
+
+		if _, err := LoadConfig([]string{"-config", filepath.Join(t.TempDir(), "nope.yaml")}); err == nil || !strings.Contains(err.Error(), "read config file") {
+			t.Errorf("error %v", err)
+		}
+	})
+
+	t.Run("file from env", func(t *testing.T) {
+
+		clearConfigEnv(t)
+		t.Setenv("CONFIG_FILE", writeConfigFile(t, "config.yaml", "aossNoteAppIndexName: notes\n"))
+
+		cfg, err := LoadConfig(nil)
+
+		if err != nil || cfg.AOSSNoteAppIndexName != "notes" {
+			t.Errorf("index %q, error %v", cfg.AOSSNoteAppIndexName, err)
+		}
+	})
+}
+
+func TestLoadConfigBadValues(t *testing.T) {
+
+	clearConfigEnv(t)
+	t.Setenv("CHUNK_SIZE", "large")
+	t.Setenv("CREATE_INDEX", "maybe")
+
+	_, err := LoadConfig([]string{"-hybrid-vector-weight", "half"})
+
+	if err == nil {
+		t.Fatal("no error")
+	}
+
+	// every bad value is reported at once
+	for _, want := range []string{`env CHUNK_SIZE: invalid integer "large"`, `env CREATE_INDEX: invalid boolean "maybe"`, `flag -hybrid-vector-weight: invalid number "half"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %v, want %q in it", err, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+
+	cfg := DefaultConfig()
+
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("defaults: %v", err)
+	}
+
+	cfg.ModelID = ""
+	cfg.KnowledgeBaseNumberOfResult = 0
+	cfg.ConversationStore = "redis"
+	cfg.ChunkOverlap = cfg.ChunkSize
+	cfg.HybridVectorWeight = 2
+	cfg.HybridFields = []string{"title", "body"}
+	cfg.AOSSEndpoint = "ftp://example.com"
+	cfg.ImageModelID = "mistral.mistral-7b-instruct-v0:2"
+	cfg.ConverseModels = []string{"amazon.nova-pro-v1:0"}
+
+	err := cfg.Validate()
+
+	if err == nil {
+		t.Fatal("no error")
+	}
+
+	want := []string{
+		"config modelId is required",
+		"config knowledgeBaseNumberOfResult must be between 1 and 100, got 0",
+		`config conversationStore must be memory or bolt, got "redis"`,
+		"config chunkOverlap must be between 0 and half of chunkSize",
+		"config hybridVectorWeight must be between 0 and 1, got 2",
+		`config hybridFields: "body" is not title, text or heading`,
+		`config aossEndpoint must be an http(s) url, got "ftp://example.com"`,
+		"config imageModelId: mistral.mistral-7b-instruct-v0:2 does not accept images",
+		`config converseModels: "amazon.nova-pro-v1:0" is neither modelId, imageModelId nor in models`,
+	}
+
+	for _, message := range want {
+		if !strings.Contains(err.Error(), message) {
+			t.Errorf("error does not say %q:\n%v", message, err)
+		}
+	}
+
+	// one line per problem after the prefix
+	if lines := strings.Split(strings.TrimPrefix(err.Error(), "invalid config: "), "\n"); len(lines) != len(want) {
+		t.Errorf("%d errors, want %d:\n%v", len(lines), len(want), err)
+	}
+}
@@ -1,15 +0,0 @@
-// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
-// SPDX-License-Identifier: MIT-0
-
-// please replace the following with your
-package bedrock
-
-const BEDROCK_REGION = "us-west-2"
-const AOSS_REGION = "us-west-2"
-const KNOWLEDGE_BASE_REGION = "us-west-2"
-const KNOWLEDGE_BASE_ID = "X3CHIODXQZ"
-const KNOWLEDGE_BASE_MODEL_ID = "anthropic.claude-3-haiku-20240307-v1:0"
-const KNOWLEDGE_BASE_NUMBER_OF_RESULT = 6
-const AOSS_ENDPOINT = "https://yvp6plo4ijurgy8ymhdg.us-east-1.aoss.amazonaws.com"
-const AOSS_NOTE_APP_INDEX_NAME = "demo"
-const MODEL_ID = "anthropic.claude-3-5-haiku-20241022-v1:0"
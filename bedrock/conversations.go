@@ -0,0 +1,494 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	ErrConversationNotFound = errors.New("conversation not found")
+	ErrNoClientToken        = errors.New(ClientTokenHeader + " header of at least 16 characters is required")
+)
+
+// header carrying the secret a client makes its conversations with, only
+// requests with the same token see them
+const ClientTokenHeader = "X-Client-Token"
+
+// a chat session, Messages is empty when conversations are listed; Owner is
+// the hash of the client token it was made with and is never sent to clients
+type Conversation struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Messages  []Message `json:"messages,omitempty"`
+	Owner     string    `json:"-"`
+}
+
+// persistent chat history keyed by session id, missing ids give
+// ErrConversationNotFound
+type ConversationStore interface {
+	Create(ctx context.Context, owner string, title string) (Conversation, error)
+	Get(ctx context.Context, id string) (Conversation, error)
+
+	// conversations of an owner without their messages, most recently
+	// updated first
+	List(ctx context.Context, owner string) ([]Conversation, error)
+
+	Append(ctx context.Context, id string, messages ...Message) error
+	Rename(ctx context.Context, id string, title string) error
+	Delete(ctx context.Context, id string) error
+}
+
+// open the conversation store selected by the config
+func OpenConversationStore(cfg *Config) (ConversationStore, error) {
+	switch cfg.ConversationStore {
+	case "memory":
+		return NewMemoryConversationStore(), nil
+	case "bolt":
+		return OpenBoltConversationStore(cfg.ConversationPath)
+	default:
+		return nil, fmt.Errorf("unknown conversation store %q", cfg.ConversationStore)
+	}
+}
+
+func newConversation(owner string, title string) Conversation {
+
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	now := time.Now().UTC()
+
+	return Conversation{ID: hex.EncodeToString(b), Title: title, CreatedAt: now, UpdatedAt: now, Owner: owner}
+}
+
+// the owner of the conversations of a request, the hash of its client token
+func ConversationOwner(r *http.Request) (string, error) {
+
+	token := r.Header.Get(ClientTokenHeader)
+
+	if len(token) < 16 {
+		return "", ErrNoClientToken
+	}
+
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// a conversation of owner, the conversations of others are not found
+func OwnedConversation(ctx context.Context, store ConversationStore, owner string, id string) (Conversation, error) {
+
+	conversation, err := store.Get(ctx, id)
+
+	if err != nil {
+		return Conversation{}, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(conversation.Owner), []byte(owner)) != 1 {
+		return Conversation{}, ErrConversationNotFound
+	}
+
+	return conversation, nil
+}
+
+// append messages to a conversation, an untitled conversation is named
+// after its first user message
+func (c *Conversation) append(messages []Message) {
+
+	c.Messages = append(c.Messages, messages...)
+	c.UpdatedAt = time.Now().UTC()
+
+	if c.Title != "" {
+		return
+	}
+
+	for _, message := range c.Messages {
+		if text := strings.TrimSpace(messageText(message)); message.Role == "user" && text != "" {
+			c.Title = truncateTitle(text)
+			return
+		}
+	}
+}
+
+func truncateTitle(text string) string {
+
+	const maxTitle = 60
+
+	text = strings.Join(strings.Fields(text), " ")
+	runes := []rune(text)
+
+	if len(runes) <= maxTitle {
+		return text
+	}
+
+	return string(runes[:maxTitle]) + "…"
+}
+
+func sortConversations(conversations []Conversation) {
+	sort.Slice(conversations, func(i, j int) bool {
+		return conversations[i].UpdatedAt.After(conversations[j].UpdatedAt)
+	})
+}
+
+// in memory ConversationStore, history is lost on restart
+type MemoryConversationStore struct {
+	mu            sync.Mutex
+	conversations map[string]Conversation
+}
+
+func NewMemoryConversationStore() *MemoryConversationStore {
+	return &MemoryConversationStore{conversations: map[string]Conversation{}}
+}
+
+func (s *MemoryConversationStore) Create(ctx context.Context, owner string, title string) (Conversation, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conversation := newConversation(owner, title)
+	s.conversations[conversation.ID] = conversation
+
+	return conversation, nil
+}
+
+func (s *MemoryConversationStore) Get(ctx context.Context, id string) (Conversation, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conversation, ok := s.conversations[id]
+
+	if !ok {
+		return Conversation{}, ErrConversationNotFound
+	}
+
+	conversation.Messages = append([]Message(nil), conversation.Messages...)
+
+	return conversation, nil
+}
+
+func (s *MemoryConversationStore) List(ctx context.Context, owner string) ([]Conversation, error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conversations := []Conversation{}
+
+	for _, conversation := range s.conversations {
+		if conversation.Owner != owner {
+			continue
+		}
+		conversation.Messages = nil
+		conversations = append(conversations, conversation)
+	}
+
+	sortConversations(conversations)
+
+	return conversations, nil
+}
+
+func (s *MemoryConversationStore) Append(ctx context.Context, id string, messages ...Message) error {
+	return s.update(id, func(c *Conversation) { c.append(messages) })
+}
+
+func (s *MemoryConversationStore) Rename(ctx context.Context, id string, title string) error {
+	return s.update(id, func(c *Conversation) {
+		c.Title = title
+		c.UpdatedAt = time.Now().UTC()
+	})
+}
+
+func (s *MemoryConversationStore) Delete(ctx context.Context, id string) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.conversations[id]; !ok {
+		return ErrConversationNotFound
+	}
+
+	delete(s.conversations, id)
+
+	return nil
+}
+
+func (s *MemoryConversationStore) update(id string, fn func(c *Conversation)) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	conversation, ok := s.conversations[id]
+
+	if !ok {
+		return ErrConversationNotFound
+	}
+
+	// copy so that conversations returned by Get are not changed
+	conversation.Messages = append([]Message(nil), conversation.Messages...)
+	fn(&conversation)
+	s.conversations[id] = conversation
+
+	return nil
+}
+
+var conversationsBucket = []byte("conversations")
+
+// ConversationStore in a bbolt file, each conversation is a json value
+type BoltConversationStore struct {
+	db *bolt.DB
+}
+
+// a conversation as stored, with its owner
+type storedConversation struct {
+	Conversation
+	Owner string `json:"owner"`
+}
+
+// open or create the bbolt file at path
+func OpenBoltConversationStore(path string) (*BoltConversationStore, error) {
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+
+	if err != nil {
+		return nil, fmt.Errorf("open conversation store %s: %w", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(conversationsBucket)
+		return err
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltConversationStore{db: db}, nil
+}
+
+func (s *BoltConversationStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *BoltConversationStore) Create(ctx context.Context, owner string, title string) (Conversation, error) {
+
+	conversation := newConversation(owner, title)
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return putConversation(tx, conversation)
+	})
+
+	return conversation, err
+}
+
+func (s *BoltConversationStore) Get(ctx context.Context, id string) (Conversation, error) {
+
+	var conversation Conversation
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		conversation, err = getConversation(tx, id)
+		return err
+	})
+
+	return conversation, err
+}
+
+func (s *BoltConversationStore) List(ctx context.Context, owner string) ([]Conversation, error) {
+
+	conversations := []Conversation{}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(conversationsBucket).ForEach(func(k, v []byte) error {
+			var stored storedConversation
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return err
+			}
+			if stored.Owner != owner {
+				return nil
+			}
+			stored.Conversation.Messages = nil
+			conversations = append(conversations, stored.Conversation)
+			return nil
+		})
+	})
+
+	sortConversations(conversations)
+
+	return conversations, err
+}
+
+func (s *BoltConversationStore) Append(ctx context.Context, id string, messages ...Message) error {
+	return s.update(id, func(c *Conversation) { c.append(messages) })
+}
+
+func (s *BoltConversationStore) Rename(ctx context.Context, id string, title string) error {
+	return s.update(id, func(c *Conversation) {
+		c.Title = title
+		c.UpdatedAt = time.Now().UTC()
+	})
+}
+
+func (s *BoltConversationStore) Delete(ctx context.Context, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(conversationsBucket)
+		if bucket.Get([]byte(id)) == nil {
+			return ErrConversationNotFound
+		}
+		return bucket.Delete([]byte(id))
+	})
+}
+
+func (s *BoltConversationStore) update(id string, fn func(c *Conversation)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		conversation, err := getConversation(tx, id)
+		if err != nil {
+			return err
+		}
+		fn(&conversation)
+		return putConversation(tx, conversation)
+	})
+}
+
+func getConversation(tx *bolt.Tx, id string) (Conversation, error) {
+
+	value := tx.Bucket(conversationsBucket).Get([]byte(id))
+
+	if value == nil {
+		return Conversation{}, ErrConversationNotFound
+	}
+
+	var stored storedConversation
+
+	err := json.Unmarshal(value, &stored)
+	stored.Conversation.Owner = stored.Owner
+
+	return stored.Conversation, err
+}
+
+func putConversation(tx *bolt.Tx, conversation Conversation) error {
+
+	value, err := json.Marshal(storedConversation{Conversation: conversation, Owner: conversation.Owner})
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(conversationsBucket).Put([]byte(conversation.ID), value)
+}
+
+// status of a conversation store error
+func conversationErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrConversationNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrNoClientToken):
+		return http.StatusUnauthorized
+	}
+	return http.StatusInternalServerError
+}
+
+// list, create, fetch, rename and delete the conversations of the client
+// token of a request, those of other tokens are not found
+//
+//	GET    /conversations       list conversations without their messages
+//	POST   /conversations       create a conversation, {"title": "..."} is optional
+//	GET    /conversations/{id}  fetch a conversation with its messages
+//	PATCH  /conversations/{id}  rename a conversation, {"title": "..."}
+//	DELETE /conversations/{id}  delete a conversation
+func HandleConversations(w http.ResponseWriter, r *http.Request, store ConversationStore) {
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/conversations"), "/")
+
+	owner, err := ConversationOwner(r)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var request struct {
+		Title string `json:"title"`
+	}
+
+	if r.Method == http.MethodPost || r.Method == http.MethodPatch {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !(r.Method == http.MethodPost && errors.Is(err, io.EOF)) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var result interface{}
+
+	// the conversation must be the client's before it is read or changed
+	if id != "" {
+		if _, err := OwnedConversation(r.Context(), store, owner, id); err != nil {
+			http.Error(w, err.Error(), conversationErrorStatus(err))
+			return
+		}
+	}
+
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		var conversations []Conversation
+		conversations, err = store.List(r.Context(), owner)
+		result = map[string]interface{}{"conversations": conversations}
+
+	case id == "" && r.Method == http.MethodPost:
+		result, err = store.Create(r.Context(), owner, strings.TrimSpace(request.Title))
+
+	case id != "" && r.Method == http.MethodGet:
+		result, err = store.Get(r.Context(), id)
+
+	case id != "" && r.Method == http.MethodPatch:
+		if strings.TrimSpace(request.Title) == "" {
+			http.Error(w, "title is required", http.StatusBadRequest)
+			return
+		}
+		if err = store.Rename(r.Context(), id, strings.TrimSpace(request.Title)); err == nil {
+			result, err = store.Get(r.Context(), id)
+		}
+
+	case id != "" && r.Method == http.MethodDelete:
+		if err = store.Delete(r.Context(), id); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), conversationErrorStatus(err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.Method == http.MethodPost {
+		w.WriteHeader(http.StatusCreated)
+	}
+
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,268 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// every ConversationStore, a bolt store in a temporary folder
+func conversationStores(t *testing.T) map[string]func(t *testing.T) ConversationStore {
+	return map[string]func(t *testing.T) ConversationStore{
+		"memory": func(t *testing.T) ConversationStore {
+			return NewMemoryConversationStore()
+		},
+		"bolt": func(t *testing.T) ConversationStore {
+			store, err := OpenBoltConversationStore(filepath.Join(t.TempDir(), "conversations.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { store.Close() })
+			return store
+		},
+	}
+}
+
+func textMessage(role, text string) Message {
+	return Message{Role: role, Content: []Content{{Type: "text", Text: text}}}
+}
+
+// ids of conversations in order
+func conversationIDs(conversations []Conversation) []string {
+	ids := make([]string, 0, len(conversations))
+	for _, conversation := range conversations {
+		ids = append(ids, conversation.ID)
+	}
+	return ids
+}
+
+func TestConversationStore(t *testing.T) {
+
+	ctx := context.Background()
+
+	for name, open := range conversationStores(t) {
+		t.Run(name, func(t *testing.T) {
+
+			store := open(t)
+
+			first, err := store.Create(ctx, "alice", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			second, _ := store.Create(ctx, "alice", "trip")
+			other, _ := store.Create(ctx, "bob", "bob's")
+
+			if first.ID == "" || first.ID == second.ID || first.Owner != "alice" || first.CreatedAt.IsZero() || !first.UpdatedAt.Equal(first.CreatedAt) {
+				t.Fatalf("created %+v and %+v", first, second)
+			}
+
+			// most recently updated first
+			if list, _ := store.List(ctx, "alice"); strings.Join(conversationIDs(list), ",") != second.ID+","+first.ID {
+				t.Errorf("listed %q, want the second then the first", conversationIDs(list))
+			}
+
+			// an untitled conversation is named after its first user message
+			long := strings.Repeat("é", 70)
+			if err := store.Append(ctx, first.ID, textMessage("assistant", "hello"), textMessage("user", "  "+long+"  ")); err != nil {
+				t.Fatal(err)
+			}
+			store.Append(ctx, first.ID, textMessage("user", "later"))
+
+			got, err := store.Get(ctx, first.ID)
+
+			if err != nil || got.Owner != "alice" || len(got.Messages) != 3 || got.Messages[2].Content[0].Text != "later" || !got.UpdatedAt.After(first.UpdatedAt) {
+				t.Fatalf("got %+v, %v", got, err)
+			}
+
+			if want := strings.Repeat("é", 60) + "…"; got.Title != want {
+				t.Errorf("got title %q, want %q", got.Title, want)
+			}
+
+			// appending moved the first conversation to the top, without
+			// messages in the list
+			list, _ := store.List(ctx, "alice")
+			if strings.Join(conversationIDs(list), ",") != first.ID+","+second.ID || list[0].Messages != nil {
+				t.Errorf("listed %+v, want the first then the second without messages", list)
+			}
+
+			if err := store.Rename(ctx, second.ID, "holiday"); err != nil {
+				t.Fatal(err)
+			}
+
+			if got, _ := store.Get(ctx, second.ID); got.Title != "holiday" {
+				t.Errorf("got title %q after rename", got.Title)
+			}
+
+			// renaming is an update too
+			if list, _ := store.List(ctx, "alice"); strings.Join(conversationIDs(list), ",") != second.ID+","+first.ID {
+				t.Errorf("listed %q after rename, want the second then the first", conversationIDs(list))
+			}
+
+			// a titled conversation keeps its title
+			store.Append(ctx, second.ID, textMessage("user", "where to?"))
+			if got, _ := store.Get(ctx, second.ID); got.Title != "holiday" {
+				t.Errorf("got title %q after append", got.Title)
+			}
+
+			if err := store.Delete(ctx, first.ID); err != nil {
+				t.Fatal(err)
+			}
+
+			if list, _ := store.List(ctx, "alice"); strings.Join(conversationIDs(list), ",") != second.ID {
+				t.Errorf("listed %q after delete", conversationIDs(list))
+			}
+
+			if list, _ := store.List(ctx, "bob"); len(list) != 1 || list[0].ID != other.ID {
+				t.Errorf("bob listed %+v", list)
+			}
+
+			if list, err := store.List(ctx, "carol"); err != nil || list == nil || len(list) != 0 {
+				t.Errorf("carol listed %+v, %v, want an empty list", list, err)
+			}
+
+			// a missing conversation is not found by any method
+			if _, err := store.Get(ctx, first.ID); !errors.Is(err, ErrConversationNotFound) {
+				t.Errorf("Get after delete: %v", err)
+			}
+			if err := store.Append(ctx, first.ID, textMessage("user", "hi")); !errors.Is(err, ErrConversationNotFound) {
+				t.Errorf("Append after delete: %v", err)
+			}
+			if err := store.Rename(ctx, first.ID, "x"); !errors.Is(err, ErrConversationNotFound) {
+				t.Errorf("Rename after delete: %v", err)
+			}
+			if err := store.Delete(ctx, first.ID); !errors.Is(err, ErrConversationNotFound) {
+				t.Errorf("Delete after delete: %v", err)
+			}
+		})
+	}
+}
+
+// messages of a conversation returned by Get are not changed by later appends
+func TestConversationStoreCopies(t *testing.T) {
+
+	ctx := context.Background()
+
+	for name, open := range conversationStores(t) {
+		t.Run(name, func(t *testing.T) {
+
+			store := open(t)
+
+			conversation, _ := store.Create(ctx, "alice", "copies")
+			store.Append(ctx, conversation.ID, textMessage("user", "one"))
+
+			got, _ := store.Get(ctx, conversation.ID)
+			store.Append(ctx, conversation.ID, textMessage("user", "two"))
+
+			if len(got.Messages) != 1 {
+				t.Errorf("got %d messages, want the 1 of the time of Get", len(got.Messages))
+			}
+		})
+	}
+}
+
+func TestBoltConversationStoreReopen(t *testing.T) {
+
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "conversations.db")
+
+	store, err := OpenBoltConversationStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conversation, _ := store.Create(ctx, "alice", "kept")
+	store.Append(ctx, conversation.ID, textMessage("user", "hi"))
+	store.Close()
+
+	store, err = OpenBoltConversationStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	got, err := OwnedConversation(ctx, store, "alice", conversation.ID)
+
+	if err != nil || got.Title != "kept" || len(got.Messages) != 1 {
+		t.Errorf("got %+v, %v after reopening", got, err)
+	}
+}
+
+// one client token never reads, renames or deletes the conversations of another
+func TestConversationsOtherToken(t *testing.T) {
+
+	const otherToken = "fedcba9876543210fedc"
+
+	for name, open := range conversationStores(t) {
+		t.Run(name, func(t *testing.T) {
+
+			store := open(t)
+
+			serve := func(method, path, token, body string) *httptest.ResponseRecorder {
+				request := httptest.NewRequest(method, path, strings.NewReader(body))
+				request.Header.Set(ClientTokenHeader, token)
+				response := httptest.NewRecorder()
+				HandleConversations(response, request, store)
+				return response
+			}
+
+			created := serve("POST", "/conversations", clientToken, `{"title": "mine"}`)
+
+			if created.Code != http.StatusCreated {
+				t.Fatalf("create: %d %s", created.Code, created.Body)
+			}
+
+			var conversation Conversation
+			decodeBody(t, created.Body.Bytes(), &conversation)
+
+			path := "/conversations/" + conversation.ID
+
+			tests := []struct {
+				method string
+				body   string
+			}{
+				{"GET", ""},
+				{"PATCH", `{"title": "theirs"}`},
+				{"DELETE", ""},
+			}
+
+			for _, test := range tests {
+				response := serve(test.method, path, otherToken, test.body)
+				if response.Code != http.StatusNotFound || strings.TrimSpace(response.Body.String()) != ErrConversationNotFound.Error() {
+					t.Errorf("%s by another token: %d %s", test.method, response.Code, response.Body)
+				}
+			}
+
+			var list struct {
+				Conversations []Conversation `json:"conversations"`
+			}
+
+			decodeBody(t, serve("GET", "/conversations", otherToken, "").Body.Bytes(), &list)
+
+			if len(list.Conversations) != 0 {
+				t.Errorf("another token listed %+v", list.Conversations)
+			}
+
+			// the conversation is untouched for its own token
+			response := serve("GET", path, clientToken, "")
+
+			var got Conversation
+			decodeBody(t, response.Body.Bytes(), &got)
+
+			if response.Code != http.StatusOK || got.Title != "mine" {
+				t.Errorf("own token got %d %+v", response.Code, got)
+			}
+
+			if response := serve("GET", path, "short", ""); response.Code != http.StatusUnauthorized {
+				t.Errorf("short token got %d", response.Code)
+			}
+		})
+	}
+}
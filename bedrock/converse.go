@@ -0,0 +1,261 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/document"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// converse document formats by media type
+var converseDocumentFormats = map[string]types.DocumentFormat{
+	"application/pdf":    types.DocumentFormatPdf,
+	"text/csv":           types.DocumentFormatCsv,
+	"application/msword": types.DocumentFormatDoc,
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": types.DocumentFormatDocx,
+	"application/vnd.ms-excel": types.DocumentFormatXls,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet": types.DocumentFormatXlsx,
+	"text/html":     types.DocumentFormatHtml,
+	"text/plain":    types.DocumentFormatTxt,
+	"text/markdown": types.DocumentFormatMd,
+}
+
+// a converse request built from our messages and inference parameters
+type ConverseRequest struct {
+	Messages                     []types.Message
+	System                       []types.SystemContentBlock
+	InferenceConfig              *types.InferenceConfiguration
+	AdditionalModelRequestFields document.Interface
+}
+
+// map messages and inference parameters to converse blocks
+//
+// top_k has no converse field, it is passed as an additional model request
+// field named after the family of the model
+func NewConverseRequest(modelID string, messages []Message, params InferenceParameters) (ConverseRequest, error) {
+
+	request := ConverseRequest{
+		InferenceConfig: &types.InferenceConfiguration{
+			MaxTokens:     aws.Int32(int32(params.MaxTokensOrDefault())),
+			StopSequences: params.StopSequences,
+		},
+	}
+
+	if temperature := params.TemperatureOrDefault(); temperature != nil {
+		request.InferenceConfig.Temperature = aws.Float32(float32(*temperature))
+	}
+
+	if params.TopP != nil {
+		request.InferenceConfig.TopP = aws.Float32(float32(*params.TopP))
+	}
+
+	if params.TopK != nil {
+		request.AdditionalModelRequestFields = converseTopK(ModelFamily(modelID), *params.TopK)
+	}
+
+	if params.System != "" {
+		request.System = []types.SystemContentBlock{&types.SystemContentBlockMemberText{Value: params.System}}
+	}
+
+	for _, message := range messages {
+
+		blocks := make([]types.ContentBlock, 0, len(message.Content))
+
+		for _, content := range message.Content {
+			block, err := converseBlock(content)
+			if err != nil {
+				return ConverseRequest{}, err
+			}
+			blocks = append(blocks, block)
+		}
+
+		request.Messages = append(request.Messages, types.Message{Role: types.ConversationRole(message.Role), Content: blocks})
+	}
+
+	return request, nil
+}
+
+func converseBlock(content Content) (types.ContentBlock, error) {
+
+	switch content.Type {
+	case "text":
+		return &types.ContentBlockMemberText{Value: content.Text}, nil
+
+	case "image":
+		data, mediaType, err := decodeSource(content)
+		if err != nil {
+			return nil, err
+		}
+		format, ok := strings.CutPrefix(mediaType, "image/")
+		if !ok {
+			return nil, fmt.Errorf("image media type %q is not supported", mediaType)
+		}
+		return &types.ContentBlockMemberImage{Value: types.ImageBlock{
+			Format: types.ImageFormat(format),
+			Source: &types.ImageSourceMemberBytes{Value: data},
+		}}, nil
+
+	case "document":
+		data, mediaType, err := decodeSource(content)
+		if err != nil {
+			return nil, err
+		}
+		format, ok := converseDocumentFormats[mediaType]
+		if !ok {
+			return nil, fmt.Errorf("document media type %q is not supported", mediaType)
+		}
+		if content.Name == "" {
+			return nil, fmt.Errorf("document name is required")
+		}
+		return &types.ContentBlockMemberDocument{Value: types.DocumentBlock{
+			Format: format,
+			Name:   aws.String(content.Name),
+			Source: &types.DocumentSourceMemberBytes{Value: data},
+		}}, nil
+
+	default:
+		return nil, fmt.Errorf("content type %q is not supported", content.Type)
+	}
+}
+
+func decodeSource(content Content) ([]byte, string, error) {
+
+	if content.Source == nil || content.Source.Type != "base64" {
+		return nil, "", fmt.Errorf("%s content needs a base64 source", content.Type)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(content.Source.Data)
+
+	if err != nil {
+		return nil, "", fmt.Errorf("%s content: %w", content.Type, err)
+	}
+
+	return data, content.Source.MediaType, nil
+}
+
+func converseTopK(family string, topK int) document.Interface {
+	switch family {
+	case "amazon.nova":
+		return document.NewLazyDocument(map[string]interface{}{"inferenceConfig": map[string]interface{}{"topK": topK}})
+	case "cohere":
+		return document.NewLazyDocument(map[string]interface{}{"k": topK})
+	default:
+		return document.NewLazyDocument(map[string]interface{}{"top_k": topK})
+	}
+}
+
+// converse with a model and return its answer as a single chunk
+func Converse(ctx context.Context, client ModelInvoker, modelID string, request ConverseRequest) (ModelChunk, error) {
+
+	output, err := client.Converse(
+		ctx,
+		&bedrockruntime.ConverseInput{
+			ModelId:                      aws.String(modelID),
+			Messages:                     request.Messages,
+			System:                       request.System,
+			InferenceConfig:              request.InferenceConfig,
+			AdditionalModelRequestFields: request.AdditionalModelRequestFields,
+		},
+	)
+
+	if err != nil {
+		return ModelChunk{}, err
+	}
+
+	chunk := converseUsage(output.Usage)
+	chunk.StopReason = string(output.StopReason)
+
+	if message, ok := output.Output.(*types.ConverseOutputMemberMessage); ok {
+		for _, block := range message.Value.Content {
+			if text, ok := block.(*types.ContentBlockMemberText); ok {
+				chunk.Text += text.Value
+			}
+		}
+	}
+
+	return chunk, nil
+}
+
+// converse with a model and read its stream as chunks
+func ConverseStream(ctx context.Context, client ModelInvoker, modelID string, request ConverseRequest) (ChunkReader, func() error, error) {
+
+	stream, err := client.ConverseStream(
+		ctx,
+		&bedrockruntime.ConverseStreamInput{
+			ModelId:                      aws.String(modelID),
+			Messages:                     request.Messages,
+			System:                       request.System,
+			InferenceConfig:              request.InferenceConfig,
+			AdditionalModelRequestFields: request.AdditionalModelRequestFields,
+		},
+	)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return ConverseChunks(stream), stream.Close, nil
+}
+
+// read the events of a converse stream as chunks: messageStart and each text
+// delta give one chunk, messageStop the stop reason and metadata the usage
+func ConverseChunks(stream bedrockruntime.ConverseStreamOutputReader) ChunkReader {
+
+	return func(yield func(ModelChunk) bool) error {
+
+		for event := range stream.Events() {
+
+			var chunk ModelChunk
+
+			switch v := event.(type) {
+			case *types.ConverseStreamOutputMemberMessageStart:
+
+			case *types.ConverseStreamOutputMemberContentBlockDelta:
+				text, ok := v.Value.Delta.(*types.ContentBlockDeltaMemberText)
+				if !ok {
+					continue
+				}
+				chunk.Text = text.Value
+
+			case *types.ConverseStreamOutputMemberMessageStop:
+				chunk.StopReason = string(v.Value.StopReason)
+
+			case *types.ConverseStreamOutputMemberMetadata:
+				chunk = converseUsage(v.Value.Usage)
+
+			case *types.UnknownUnionMember:
+				fmt.Println("unknown tag:", v.Tag)
+				continue
+
+			default:
+				continue
+			}
+
+			if !yield(chunk) {
+				return nil
+			}
+		}
+
+		return stream.Err()
+	}
+}
+
+func converseUsage(usage *types.TokenUsage) ModelChunk {
+
+	if usage == nil {
+		return ModelChunk{}
+	}
+
+	return ModelChunk{
+		InputTokens:  int(aws.ToInt32(usage.InputTokens)),
+		OutputTokens: int(aws.ToInt32(usage.OutputTokens)),
+	}
+}
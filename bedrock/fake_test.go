@@ -0,0 +1,428 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// in memory ModelInvoker for tests
+//
+// InvokeModel returns Embedding for titan embedding models, Deltas joined as a
+// claude3 message for other models, and
+// InvokeModelWithResponseStream streams Deltas as claude3 content_block_delta
+// chunks between message_start, content_block_start and message_delta, Converse and ConverseStream
+// answer with Deltas in the same way, Err is returned by every call when set;
+// InvokeModel fails without recording the body once its ctx is done
+//
+// Turns scripts the claude3 chunks of the streams instead, the n-th call of
+// InvokeModelWithResponseStream streams Turns[n], for example the tool_use
+// blocks of an agent
+type FakeModelInvoker struct {
+	Embedding []float64
+	Deltas    []string
+	Turns     [][]ResponseClaude3
+	Err       error
+
+	mu       sync.Mutex
+	bodies   [][]byte
+	streams  int
+	converse []FakeConverseRequest
+}
+
+// a request received by the Converse or ConverseStream of FakeModelInvoker
+type FakeConverseRequest struct {
+	ModelID         string
+	Messages        []types.Message
+	System          []types.SystemContentBlock
+	InferenceConfig *types.InferenceConfiguration
+}
+
+// Converse and ConverseStream requests received so far, in call order
+func (f *FakeModelInvoker) ConverseRequests() []FakeConverseRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FakeConverseRequest(nil), f.converse...)
+}
+
+func (f *FakeModelInvoker) recordConverse(request FakeConverseRequest) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.converse = append(f.converse, request)
+}
+
+// request bodies received so far, in call order
+func (f *FakeModelInvoker) Bodies() [][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]byte(nil), f.bodies...)
+}
+
+func (f *FakeModelInvoker) record(body []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.bodies = append(f.bodies, body)
+}
+
+func (f *FakeModelInvoker) InvokeModel(ctx context.Context, params *bedrockruntime.InvokeModelInput, optFns ...func(*bedrockruntime.Options)) (*bedrockruntime.InvokeModelOutput, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	f.record(params.Body)
+
+	if f.Err != nil {
+		return nil, f.Err
+	}
+
+	var response interface{} = EmbedResponse{Embedding: f.Embedding}
+
+	// anything but an embedding model answers like claude3
+	if !strings.HasPrefix(aws.ToString(params.ModelId), "amazon.titan-embed") {
+		response = ResponseBodyClaude3{
+			ID:         "msg_fake",
+			Model:      aws.ToString(params.ModelId),
+			Content:    []Content{{Type: "text", Text: strings.Join(f.Deltas, "")}},
+			StopReason: "end_turn",
+			Usage:      Usage{InputTokens: len(params.Body), OutputTokens: len(f.Deltas)},
+		}
+	}
+
+	body, err := json.Marshal(response)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &bedrockruntime.InvokeModelOutput{
+		Body:        body,
+		ContentType: params.ContentType,
+	}, nil
+}
+
+func (f *FakeModelInvoker) InvokeModelWithResponseStream(ctx context.Context, params *bedrockruntime.InvokeModelWithResponseStreamInput, optFns ...func(*bedrockruntime.Options)) (bedrockruntime.ResponseStreamReader, error) {
+
+	f.record(params.Body)
+
+	if f.Err != nil {
+		return nil, f.Err
+	}
+
+	if turn, ok := f.nextTurn(); ok {
+		return fakeClaude3Stream(turn)
+	}
+
+	// message_start, content_block_start, one content_block_delta per delta,
+	// message_delta
+	responses := []ResponseClaude3{
+		{Type: "message_start", Message: &MessageClaude3{ID: "msg_fake", Usage: Usage{InputTokens: len(params.Body)}}},
+		{Type: "content_block_start", ContentBlock: &Content{Type: "text"}},
+	}
+
+	for _, text := range f.Deltas {
+		responses = append(responses, ResponseClaude3{Type: "content_block_delta", Delta: Delta{Type: "text_delta", Text: text}})
+	}
+
+	responses = append(responses, ResponseClaude3{Type: "message_delta", Delta: Delta{StopReason: "end_turn"}, Usage: &Usage{OutputTokens: len(f.Deltas)}})
+
+	return fakeClaude3Stream(responses)
+}
+
+// the scripted turn of the next stream, if any
+func (f *FakeModelInvoker) nextTurn() ([]ResponseClaude3, bool) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := f.streams
+	f.streams++
+
+	if n >= len(f.Turns) {
+		return nil, false
+	}
+
+	return f.Turns[n], true
+}
+
+// a stream of claude3 chunks
+func fakeClaude3Stream(responses []ResponseClaude3) (bedrockruntime.ResponseStreamReader, error) {
+
+	chunks := make([][]byte, 0, len(responses))
+
+	for _, resp := range responses {
+		chunk, err := json.Marshal(resp)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	return NewFakeResponseStream(chunks...), nil
+}
+
+func (f *FakeModelInvoker) Converse(ctx context.Context, params *bedrockruntime.ConverseInput, optFns ...func(*bedrockruntime.Options)) (*bedrockruntime.ConverseOutput, error) {
+
+	f.recordConverse(FakeConverseRequest{aws.ToString(params.ModelId), params.Messages, params.System, params.InferenceConfig})
+
+	if f.Err != nil {
+		return nil, f.Err
+	}
+
+	return &bedrockruntime.ConverseOutput{
+		Output: &types.ConverseOutputMemberMessage{Value: types.Message{
+			Role:    types.ConversationRoleAssistant,
+			Content: []types.ContentBlock{&types.ContentBlockMemberText{Value: strings.Join(f.Deltas, "")}},
+		}},
+		StopReason: types.StopReasonEndTurn,
+		Usage:      f.usage(params.Messages),
+	}, nil
+}
+
+func (f *FakeModelInvoker) ConverseStream(ctx context.Context, params *bedrockruntime.ConverseStreamInput, optFns ...func(*bedrockruntime.Options)) (bedrockruntime.ConverseStreamOutputReader, error) {
+
+	f.recordConverse(FakeConverseRequest{aws.ToString(params.ModelId), params.Messages, params.System, params.InferenceConfig})
+
+	if f.Err != nil {
+		return nil, f.Err
+	}
+
+	// messageStart, one contentBlockDelta per delta, messageStop, metadata
+	events := []types.ConverseStreamOutput{&types.ConverseStreamOutputMemberMessageStart{Value: types.MessageStartEvent{Role: types.ConversationRoleAssistant}}}
+
+	for _, text := range f.Deltas {
+		events = append(events, &types.ConverseStreamOutputMemberContentBlockDelta{Value: types.ContentBlockDeltaEvent{
+			ContentBlockIndex: aws.Int32(0),
+			Delta:             &types.ContentBlockDeltaMemberText{Value: text},
+		}})
+	}
+
+	events = append(events,
+		&types.ConverseStreamOutputMemberMessageStop{Value: types.MessageStopEvent{StopReason: types.StopReasonEndTurn}},
+		&types.ConverseStreamOutputMemberMetadata{Value: types.ConverseStreamMetadataEvent{Usage: f.usage(params.Messages)}},
+	)
+
+	return NewFakeConverseStream(events...), nil
+}
+
+// token usage counting one input token per message and one output token per delta
+func (f *FakeModelInvoker) usage(messages []types.Message) *types.TokenUsage {
+	input, output := int32(len(messages)), int32(len(f.Deltas))
+	return &types.TokenUsage{InputTokens: aws.Int32(input), OutputTokens: aws.Int32(output), TotalTokens: aws.Int32(input + output)}
+}
+
+// a ResponseStreamReader which emits the given chunk payloads then closes
+type FakeResponseStream struct {
+	events chan types.ResponseStream
+	err    error
+	once   sync.Once
+	done   chan struct{}
+}
+
+func NewFakeResponseStream(chunks ...[]byte) *FakeResponseStream {
+
+	stream := &FakeResponseStream{
+		events: make(chan types.ResponseStream),
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(stream.events)
+		for _, chunk := range chunks {
+			select {
+			case stream.events <- &types.ResponseStreamMemberChunk{Value: types.PayloadPart{Bytes: chunk}}:
+			case <-stream.done:
+				return
+			}
+		}
+	}()
+
+	return stream
+}
+
+func (s *FakeResponseStream) Events() <-chan types.ResponseStream {
+	return s.events
+}
+
+func (s *FakeResponseStream) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
+
+func (s *FakeResponseStream) Err() error {
+	return s.err
+}
+
+// a ConverseStreamOutputReader which emits the given events then closes
+type FakeConverseStream struct {
+	events chan types.ConverseStreamOutput
+	err    error
+	once   sync.Once
+	done   chan struct{}
+}
+
+func NewFakeConverseStream(events ...types.ConverseStreamOutput) *FakeConverseStream {
+
+	stream := &FakeConverseStream{
+		events: make(chan types.ConverseStreamOutput),
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(stream.events)
+		for _, event := range events {
+			select {
+			case stream.events <- event:
+			case <-stream.done:
+				return
+			}
+		}
+	}()
+
+	return stream
+}
+
+func (s *FakeConverseStream) Events() <-chan types.ConverseStreamOutput {
+	return s.events
+}
+
+func (s *FakeConverseStream) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
+
+func (s *FakeConverseStream) Err() error {
+	return s.err
+}
+
+// in memory KnowledgeBaseClient returning canned outputs
+type FakeKnowledgeBase struct {
+	RetrieveOutput            *bedrockagentruntime.RetrieveOutput
+	RetrieveAndGenerateOutput *bedrockagentruntime.RetrieveAndGenerateOutput
+	Err                       error
+
+	mu                        sync.Mutex
+	retrieveInputs            []*bedrockagentruntime.RetrieveInput
+	retrieveAndGenerateInputs []*bedrockagentruntime.RetrieveAndGenerateInput
+}
+
+// Retrieve inputs received so far, in call order
+func (f *FakeKnowledgeBase) RetrieveInputs() []*bedrockagentruntime.RetrieveInput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*bedrockagentruntime.RetrieveInput(nil), f.retrieveInputs...)
+}
+
+// RetrieveAndGenerate inputs received so far, in call order
+func (f *FakeKnowledgeBase) RetrieveAndGenerateInputs() []*bedrockagentruntime.RetrieveAndGenerateInput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*bedrockagentruntime.RetrieveAndGenerateInput(nil), f.retrieveAndGenerateInputs...)
+}
+
+func (f *FakeKnowledgeBase) Retrieve(ctx context.Context, params *bedrockagentruntime.RetrieveInput, optFns ...func(*bedrockagentruntime.Options)) (*bedrockagentruntime.RetrieveOutput, error) {
+
+	f.mu.Lock()
+	f.retrieveInputs = append(f.retrieveInputs, params)
+	f.mu.Unlock()
+
+	if f.Err != nil {
+		return nil, f.Err
+	}
+
+	if f.RetrieveOutput == nil {
+		return &bedrockagentruntime.RetrieveOutput{}, nil
+	}
+
+	return f.RetrieveOutput, nil
+}
+
+func (f *FakeKnowledgeBase) RetrieveAndGenerate(ctx context.Context, params *bedrockagentruntime.RetrieveAndGenerateInput, optFns ...func(*bedrockagentruntime.Options)) (*bedrockagentruntime.RetrieveAndGenerateOutput, error) {
+
+	f.mu.Lock()
+	f.retrieveAndGenerateInputs = append(f.retrieveAndGenerateInputs, params)
+	f.mu.Unlock()
+
+	if f.Err != nil {
+		return nil, f.Err
+	}
+
+	if f.RetrieveAndGenerateOutput == nil {
+		return &bedrockagentruntime.RetrieveAndGenerateOutput{}, nil
+	}
+
+	return f.RetrieveAndGenerateOutput, nil
+}
+
+// a request received by FakeVectorStore
+type FakeVectorStoreRequest struct {
+	Method string
+	Path   string
+	Body   string
+}
+
+// in memory VectorStore answering every request with Body and StatusCode,
+// StatusCode defaults to 200, a request whose ctx is done is not recorded
+type FakeVectorStore struct {
+	StatusCode int
+	Body       string
+	Err        error
+
+	mu       sync.Mutex
+	requests []FakeVectorStoreRequest
+}
+
+// requests received so far, in call order
+func (f *FakeVectorStore) Requests() []FakeVectorStoreRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FakeVectorStoreRequest(nil), f.requests...)
+}
+
+func (f *FakeVectorStore) Perform(req *http.Request) (*http.Response, error) {
+
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+
+	var body []byte
+
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	f.mu.Lock()
+	f.requests = append(f.requests, FakeVectorStoreRequest{Method: req.Method, Path: req.URL.Path, Body: string(body)})
+	f.mu.Unlock()
+
+	if f.Err != nil {
+		return nil, f.Err
+	}
+
+	status := f.StatusCode
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader([]byte(f.Body))),
+	}, nil
+}
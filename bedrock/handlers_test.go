@@ -0,0 +1,459 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
+)
+
+// a search response of one chunk
+const searchResponse = `{"hits": {"total": {"value": 1}, "hits": [{"_id": "a1", "_score": 1.5, "_source": {"title": "Lambda", "link": "https://example.com", "text": "cold starts", "parent_id": "p1", "chunk_index": 0, "start_offset": 0, "end_offset": 11}, "sort": [1.5, "p1", 0]}]}}`
+
+// a bulk response indexing one chunk
+const bulkResponse = `{"items": [{"index": {"_id": "a1", "status": 201}}]}`
+
+// a client token of the conversations
+const clientToken = "0123456789abcdef0123"
+
+// the fakes behind the routes of a test
+type testClients struct {
+	models         *FakeModelInvoker
+	knowledgeBases *FakeKnowledgeBase
+	notes          *FakeVectorStore
+	conversations  ConversationStore
+}
+
+// the routes of the server on fake clients
+func newTestServer(cfg *Config, clients testClients) http.Handler {
+	return NewServeMux(Routes{
+		AOSSClient:          clients.notes,
+		BedrockClient:       clients.models,
+		KnowledgeBaseClient: clients.knowledgeBases,
+		KnowledgeBaseRouter: NewKnowledgeBaseRouter(cfg, clients.models),
+		Tools:               NewToolRegistry(CalculatorTool{}, &AOSSSearchTool{AOSSClient: clients.notes, BedrockClient: clients.models, Config: cfg}),
+		Conversations:       clients.conversations,
+		Config:              cfg,
+		StaticDir:           "../static",
+	})
+}
+
+// decode a json response body into v
+func decodeBody(t *testing.T, body []byte, v interface{}) {
+
+	t.Helper()
+
+	if err := json.Unmarshal(body, v); err != nil {
+		t.Fatalf("decode %s: %v", body, err)
+	}
+}
+
+// a page of the static folder
+func staticPage(t *testing.T, name string) string {
+
+	t.Helper()
+
+	content, err := os.ReadFile("../static/" + name)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(content)
+}
+
+// a multipart upload of files by name
+func uploadBody(t *testing.T, files map[string]string) (string, string) {
+
+	var body bytes.Buffer
+
+	writer := multipart.NewWriter(&body)
+
+	for name, content := range files {
+		part, err := writer.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(content))
+	}
+
+	writer.Close()
+
+	return body.String(), writer.FormDataContentType()
+}
+
+func TestHandlers(t *testing.T) {
+
+	upload, uploadType := uploadBody(t, map[string]string{"faq.txt": "How do cold starts work?"})
+
+	question := `{"messages": [{"role": "user", "content": [{"type": "text", "text": "what is lambda?"}]}]}`
+	token := map[string]string{ClientTokenHeader: clientToken}
+	admin := map[string]string{"Authorization": "Bearer admin-secret"}
+
+	// the page of the static folder as is
+	page := func(name string) func(t *testing.T, body []byte, clients testClients) {
+		return func(t *testing.T, body []byte, clients testClients) {
+			if string(body) != staticPage(t, name) {
+				t.Errorf("body is not %s", name)
+			}
+		}
+	}
+
+	// the text of a plain error
+	text := func(want string) func(t *testing.T, body []byte, clients testClients) {
+		return func(t *testing.T, body []byte, clients testClients) {
+			if got := strings.TrimSpace(string(body)); got != want {
+				t.Errorf("body %q, want %q", got, want)
+			}
+		}
+	}
+
+	// the single hit of searchResponse
+	searchHit := func(t *testing.T, body []byte, clients testClients) {
+		var results SearchResults
+		decodeBody(t, body, &results)
+		if results.Total != 1 || len(results.Hits) != 1 || results.Hits[0].ID != "a1" || results.Hits[0].Title != "Lambda" || results.Hits[0].Link != "https://example.com" {
+			t.Errorf("results %+v", results)
+		}
+	}
+
+	// an ingestion of one note
+	ingested := func(t *testing.T, body []byte, clients testClients) {
+		var report IngestReport
+		decodeBody(t, body, &report)
+		if report.Total != 1 || report.Indexed != 1 || report.Failed != 0 || len(report.Items) != 1 || !report.Items[0].Indexed {
+			t.Errorf("report %+v", report)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		header  map[string]string
+		body    string
+		notes   string // body of every vector store response
+		invoker error  // returned by every model call
+		setup   func(t *testing.T, clients testClients)
+		status  int
+		check   func(t *testing.T, body []byte, clients testClients)
+	}{
+		{name: "chat page", method: "GET", path: "/", status: 200, check: page("chat.html")},
+		{name: "image page", method: "GET", path: "/image", status: 200, check: page("image.html")},
+		{name: "mirror page", method: "GET", path: "/mirror", status: 200, check: page("mirror.html")},
+		{name: "retrieve page", method: "GET", path: "/retrieve", status: 200, check: page("retrieve.html")},
+		{name: "retrieve and generate page", method: "GET", path: "/retrieve-generate", status: 200, check: page("retrieve-and-generate.html")},
+		{name: "aoss index page", method: "GET", path: "/aoss-index", status: 200, check: page("aoss-index.html")},
+		{name: "aoss query page", method: "GET", path: "/aoss-query", status: 200, check: page("aoss-query.html")},
+
+		{name: "chat", method: "POST", path: "/bedrock-haiku", body: question, status: 200, check: func(t *testing.T, body []byte, clients testClients) {
+			if string(body) != "Hello world" {
+				t.Errorf("answer %q", body)
+			}
+			if bodies := clients.models.Bodies(); len(bodies) != 1 || !strings.Contains(string(bodies[0]), "what is lambda?") {
+				t.Errorf("model requests %s", bodies)
+			}
+		}},
+		{name: "chat bad body", method: "POST", path: "/bedrock-haiku", body: `{`, status: 400, check: text("unexpected EOF")},
+		{name: "chat unknown model", method: "POST", path: "/bedrock-haiku", body: `{"model": "nope", "messages": [{"role": "user", "content": [{"type": "text", "text": "hi"}]}]}`, status: 400},
+		{name: "chat unknown session", method: "POST", path: "/bedrock-haiku", header: token, body: `{"sessionId": "nope", "messages": [{"role": "user", "content": [{"type": "text", "text": "hi"}]}]}`, status: 404, check: text(ErrConversationNotFound.Error())},
+		{name: "chat session", method: "POST", path: "/bedrock-haiku", header: token, body: `{"sessionId": "SESSION", "messages": [{"role": "user", "content": [{"type": "text", "text": "and now?"}]}]}`, setup: func(t *testing.T, clients testClients) {
+			createConversation(t, clients, "SESSION")
+		}, status: 200, check: func(t *testing.T, body []byte, clients testClients) {
+			conversations, _ := clients.conversations.List(context.Background(), ownerOf(clientToken))
+			conversation, _ := clients.conversations.Get(context.Background(), conversations[0].ID)
+			if len(conversation.Messages) != 2 || messageText(conversation.Messages[0]) != "and now?" || messageText(conversation.Messages[1]) != "Hello world" {
+				t.Errorf("messages %+v", conversation.Messages)
+			}
+		}},
+		{name: "chat model fails", method: "POST", path: "/bedrock-haiku", body: question, invoker: errors.New("throttled"), status: 502, check: text("throttled")},
+
+		{name: "conversations without token", method: "GET", path: "/conversations", status: 401, check: text(ErrNoClientToken.Error())},
+		{name: "list conversations", method: "GET", path: "/conversations", header: token, setup: func(t *testing.T, clients testClients) {
+			createConversation(t, clients, "lambda")
+		}, status: 200, check: func(t *testing.T, body []byte, clients testClients) {
+			var result struct {
+				Conversations []Conversation `json:"conversations"`
+			}
+			decodeBody(t, body, &result)
+			if len(result.Conversations) != 1 || result.Conversations[0].Title != "lambda" {
+				t.Errorf("conversations %+v", result.Conversations)
+			}
+		}},
+		{name: "create conversation", method: "POST", path: "/conversations", header: token, body: `{"title": "lambda"}`, status: 201, check: func(t *testing.T, body []byte, clients testClients) {
+			var conversation Conversation
+			decodeBody(t, body, &conversation)
+			if conversation.ID == "" || conversation.Title != "lambda" {
+				t.Errorf("conversation %+v", conversation)
+			}
+		}},
+		{name: "unknown conversation", method: "GET", path: "/conversations/nope", header: token, status: 404, check: text(ErrConversationNotFound.Error())},
+
+		{name: "openai completions", method: "POST", path: "/v1/chat/completions", body: `{"model": "gpt-4o", "messages": [{"role": "user", "content": "hi"}]}`, status: 200, check: func(t *testing.T, body []byte, clients testClients) {
+			var response OpenAIChatResponse
+			decodeBody(t, body, &response)
+			if response.Object != "chat.completion" || response.Model != DefaultConfig().ModelID || len(response.Choices) != 1 || response.Choices[0].Message.Content != "Hello world" {
+				t.Errorf("response %+v", response)
+			}
+		}},
+		{name: "openai bad body", method: "POST", path: "/v1/chat/completions", body: `{`, status: 400, check: func(t *testing.T, body []byte, clients testClients) {
+			var response OpenAIError
+			decodeBody(t, body, &response)
+			if response.Error.Type != "invalid_request_error" {
+				t.Errorf("error %+v", response.Error)
+			}
+		}},
+
+		{name: "models", method: "GET", path: "/models", status: 200, check: func(t *testing.T, body []byte, clients testClients) {
+			var result struct {
+				Models []ModelInfo `json:"models"`
+			}
+			decodeBody(t, body, &result)
+			if len(result.Models) != 2 || result.Models[0].ID != DefaultConfig().ModelID || !result.Models[0].Default || result.Models[1].ID != DefaultConfig().ImageModelID || !result.Models[1].Vision {
+				t.Errorf("models %+v", result.Models)
+			}
+		}},
+
+		{name: "image", method: "POST", path: "/claude-haiku-image", body: `{"messages": [{"role": "user", "content": [{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "iVBORw0KGgo="}}, {"type": "text", "text": "what is it?"}]}]}`, status: 200, check: func(t *testing.T, body []byte, clients testClients) {
+			if string(body) != "Hello world" {
+				t.Errorf("answer %q", body)
+			}
+			if bodies := clients.models.Bodies(); len(bodies) != 1 || !strings.Contains(string(bodies[0]), `"media_type":"image/png"`) {
+				t.Errorf("model requests %s", bodies)
+			}
+		}},
+		{name: "image bad body", method: "POST", path: "/claude-haiku-image", body: `{`, status: 400, check: text("unexpected EOF")},
+
+		{name: "retrieve", method: "POST", path: "/knowledge-base-retrieve", body: question, status: 200, check: func(t *testing.T, body []byte, clients testClients) {
+			var output bedrockagentruntime.RetrieveOutput
+			decodeBody(t, body, &output)
+			if len(output.RetrievalResults) != 1 || aws.ToString(output.RetrievalResults[0].Content.Text) != "lambda is serverless" {
+				t.Errorf("output %s", body)
+			}
+			if inputs := clients.knowledgeBases.RetrieveInputs(); len(inputs) != 1 || aws.ToString(inputs[0].RetrievalQuery.Text) != "what is lambda?" {
+				t.Errorf("retrieve inputs %+v", inputs)
+			}
+		}},
+		{name: "retrieve without question", method: "POST", path: "/knowledge-base-retrieve", body: `{"messages": []}`, status: 400, check: text("the last message must have a question")},
+		{name: "retrieve and generate", method: "POST", path: "/knowledge-base-retrieve-and-generate", body: question, status: 200, check: func(t *testing.T, body []byte, clients testClients) {
+			var output struct {
+				Output    struct{ Text string }
+				SessionId string
+			}
+			decodeBody(t, body, &output)
+			if output.Output.Text != "a serverless compute service" || output.SessionId != "session-1" {
+				t.Errorf("output %s", body)
+			}
+		}},
+		{name: "retrieve and generate bad body", method: "POST", path: "/knowledge-base-retrieve-and-generate", body: `{`, status: 400, check: text("unexpected EOF")},
+
+		{name: "prompt templates", method: "GET", path: "/prompt-templates", status: 200, check: func(t *testing.T, body []byte, clients testClients) {
+			var result struct {
+				Templates []NamedPromptTemplate `json:"templates"`
+			}
+			decodeBody(t, body, &result)
+			if result.Templates == nil || len(result.Templates) != 0 {
+				t.Errorf("templates %s", body)
+			}
+		}},
+		{name: "prompt template preview", method: "POST", path: "/prompt-templates/preview", body: `{"query": "what is lambda?", "searchResults": ["lambda is serverless"]}`, status: 200, check: func(t *testing.T, body []byte, clients testClients) {
+			var result struct {
+				Prompt string `json:"prompt"`
+			}
+			decodeBody(t, body, &result)
+			if !strings.Contains(result.Prompt, "what is lambda?") || !strings.Contains(result.Prompt, "[1] \nlambda is serverless") {
+				t.Errorf("prompt %q", result.Prompt)
+			}
+		}},
+		{name: "unknown prompt template path", method: "GET", path: "/prompt-templates/nope", status: 404, check: text("not found")},
+
+		{name: "index", method: "POST", path: "/aoss-index-backend", body: `{"title": "Lambda", "link": "https://example.com", "text": "cold starts"}`, notes: bulkResponse, status: 200, check: func(t *testing.T, body []byte, clients testClients) {
+			var result IndexResult
+			decodeBody(t, body, &result)
+			if result.Chunks != 1 || len(result.IDs) != 1 || result.IDs[0] != "a1" {
+				t.Errorf("result %+v", result)
+			}
+		}},
+		{name: "index bad body", method: "POST", path: "/aoss-index-backend", body: `{`, status: 400, check: text("unexpected EOF")},
+		{name: "index without text", method: "POST", path: "/aoss-index-backend", body: `{"title": "Lambda"}`, status: 400, check: text("text is required")},
+		{name: "bulk index", method: "POST", path: "/aoss-bulk-index", body: `{"title": "Lambda", "link": "https://example.com", "text": "cold starts"}`, notes: bulkResponse, status: 200, check: ingested},
+		{name: "bulk index nothing", method: "POST", path: "/aoss-bulk-index", body: "\n", status: 400, check: text("no notes to index")},
+		{name: "upload", method: "POST", path: "/aoss-upload", header: map[string]string{"Content-Type": uploadType}, body: upload, notes: bulkResponse, status: 200, check: func(t *testing.T, body []byte, clients testClients) {
+			var result struct {
+				Files  []UploadedFile `json:"files"`
+				Report IngestReport   `json:"report"`
+			}
+			decodeBody(t, body, &result)
+			if len(result.Files) != 1 || result.Files[0].Name != "faq.txt" || result.Files[0].Error != "" || result.Report.Indexed != 1 {
+				t.Errorf("result %s", body)
+			}
+		}},
+		{name: "upload without file", method: "POST", path: "/aoss-upload", body: `{}`, status: 400},
+
+		{name: "hybrid search", method: "POST", path: "/aoss-hybrid-search", body: `{"query": "cold starts"}`, notes: searchResponse, status: 200, check: func(t *testing.T, body []byte, clients testClients) {
+			var results struct {
+				Hits     []SearchHit `json:"hits"`
+				Degraded bool        `json:"degraded"`
+			}
+			decodeBody(t, body, &results)
+			if len(results.Hits) != 1 || results.Hits[0].ID != "a1" || results.Hits[0].Title != "Lambda" || results.Degraded {
+				t.Errorf("results %s", body)
+			}
+		}},
+		{name: "hybrid search bad body", method: "POST", path: "/aoss-hybrid-search", body: `{`, status: 400, check: text("unexpected EOF")},
+		{name: "vector search", method: "POST", path: "/aoss-vector-search", body: `{"query": "cold starts", "size": 5}`, notes: searchResponse, status: 200, check: searchHit},
+		{name: "vector search bad k", method: "POST", path: "/aoss-vector-search", body: `{"query": "cold starts", "k": -1}`, status: 400, check: text("k must be between 0 and 10000 (0 for the default), got -1")},
+		{name: "title search", method: "POST", path: "/aoss-query-backend", body: `{"query": "lambda"}`, notes: searchResponse, status: 200, check: searchHit},
+		{name: "title search bad body", method: "POST", path: "/aoss-query-backend", body: `{`, status: 400, check: text("unexpected EOF")},
+
+		{name: "index admin without token", method: "GET", path: "/admin/index", status: 401, check: text("unauthorized")},
+		{name: "delete index", method: "DELETE", path: "/admin/index", header: admin, notes: `{"acknowledged": true}`, status: 200, check: func(t *testing.T, body []byte, clients testClients) {
+			var result struct {
+				Index   string `json:"index"`
+				Deleted bool   `json:"deleted"`
+			}
+			decodeBody(t, body, &result)
+			if result.Index != "demo" || !result.Deleted {
+				t.Errorf("result %s", body)
+			}
+			if requests := clients.notes.Requests(); len(requests) != 1 || requests[0].Method != "DELETE" || requests[0].Path != "/demo" {
+				t.Errorf("requests %+v", requests)
+			}
+		}},
+		{name: "index admin unknown path", method: "GET", path: "/admin/index/nope", header: admin, status: 404, check: text("not found")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			cfg := DefaultConfig()
+			cfg.AdminToken = "admin-secret"
+
+			clients := testClients{
+				models: &FakeModelInvoker{
+					Embedding: make([]float64, cfg.VectorDimension()),
+					Deltas:    []string{"Hello", " world"},
+					Err:       test.invoker,
+				},
+				knowledgeBases: &FakeKnowledgeBase{
+					RetrieveOutput: &bedrockagentruntime.RetrieveOutput{
+						RetrievalResults: []types.KnowledgeBaseRetrievalResult{{Content: &types.RetrievalResultContent{Text: aws.String("lambda is serverless")}}},
+					},
+					RetrieveAndGenerateOutput: &bedrockagentruntime.RetrieveAndGenerateOutput{
+						Output:    &types.RetrieveAndGenerateOutput{Text: aws.String("a serverless compute service")},
+						SessionId: aws.String("session-1"),
+					},
+				},
+				notes:         &FakeVectorStore{Body: test.notes},
+				conversations: NewMemoryConversationStore(),
+			}
+
+			body := test.body
+
+			if test.setup != nil {
+				test.setup(t, clients)
+				// the id of the conversation made by setup
+				if conversations, _ := clients.conversations.List(context.Background(), ownerOf(clientToken)); len(conversations) > 0 {
+					body = strings.ReplaceAll(body, "SESSION", conversations[0].ID)
+				}
+			}
+
+			request := httptest.NewRequest(test.method, test.path, strings.NewReader(body))
+
+			for key, value := range test.header {
+				request.Header.Set(key, value)
+			}
+
+			response := httptest.NewRecorder()
+			newTestServer(&cfg, clients).ServeHTTP(response, request)
+
+			if response.Code != test.status {
+				t.Fatalf("status %d, want %d: %s", response.Code, test.status, response.Body)
+			}
+
+			if test.check != nil {
+				test.check(t, response.Body.Bytes(), clients)
+			}
+		})
+	}
+}
+
+// the owner of the conversations of a client token
+func ownerOf(token string) string {
+	request := httptest.NewRequest("GET", "/", nil)
+	request.Header.Set(ClientTokenHeader, token)
+	owner, _ := ConversationOwner(request)
+	return owner
+}
+
+// a conversation of clientToken
+func createConversation(t *testing.T, clients testClients, title string) Conversation {
+
+	t.Helper()
+
+	conversation, err := clients.conversations.Create(context.Background(), ownerOf(clientToken), title)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conversation
+}
+
+// every route of the server has a handler of its own rather than falling
+// through to the chat page
+func TestRoutes(t *testing.T) {
+
+	cfg := DefaultConfig()
+	mux := NewServeMux(Routes{Config: &cfg})
+
+	routes := []string{
+		"/", "/image", "/mirror", "/retrieve", "/retrieve-generate", "/aoss-index", "/aoss-query",
+		"/bedrock-haiku", "/conversations", "/conversations/", "/v1/chat/completions", "/models",
+		"/claude-haiku-image", "/knowledge-base-retrieve", "/knowledge-base-retrieve-and-generate",
+		"/prompt-templates", "/prompt-templates/", "/aoss-index-backend", "/aoss-bulk-index", "/aoss-upload",
+		"/aoss-hybrid-search", "/aoss-vector-search", "/aoss-query-backend", "/admin/index", "/admin/index/",
+	}
+
+	for _, route := range routes {
+		if _, pattern := mux.Handler(httptest.NewRequest("GET", route, nil)); pattern != route {
+			t.Errorf("%s is handled by %q", route, pattern)
+		}
+	}
+}
+
+// a handler which only answers POST leaves other methods unanswered
+func TestHandlersIgnoreOtherMethods(t *testing.T) {
+
+	cfg := DefaultConfig()
+	models := &FakeModelInvoker{Deltas: []string{"Hello"}}
+
+	clients := testClients{models: models, knowledgeBases: &FakeKnowledgeBase{}, notes: &FakeVectorStore{}, conversations: NewMemoryConversationStore()}
+
+	for _, path := range []string{"/bedrock-haiku", "/v1/chat/completions", "/claude-haiku-image", "/knowledge-base-retrieve", "/knowledge-base-retrieve-and-generate", "/aoss-index-backend", "/aoss-bulk-index", "/aoss-upload", "/aoss-hybrid-search", "/aoss-vector-search", "/aoss-query-backend"} {
+
+		response := httptest.NewRecorder()
+		newTestServer(&cfg, clients).ServeHTTP(response, httptest.NewRequest("GET", path, nil))
+
+		if response.Code != http.StatusOK || response.Body.Len() != 0 {
+			t.Errorf("GET %s answered %d %s", path, response.Code, response.Body)
+		}
+	}
+
+	if len(models.Bodies()) != 0 || len(models.ConverseRequests()) != 0 || len(clients.notes.Requests()) != 0 {
+		t.Error("a GET called a client")
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// fusions of hybrid search
+const (
+	// reciprocal rank fusion, each search adds weight / (hybridRankConstant + rank)
+	FusionRRF = "rrf"
+
+	// the weighted sum of the scores of each search, scaled to 0..1
+	FusionWeighted = "weighted"
+)
+
+const (
+	// hits each search contributes at least, more than asked for so that
+	// hits found by both are likely to be fused
+	hybridCandidates = 50
+
+	// largest number of hybrid results
+	maxHybridSize = 100
+)
+
+// text fields of the note index, optionally boosted as in title^2
+var hybridField = regexp.MustCompile(`^(title|text|heading)(\^\d+(\.\d+)?)?$`)
+
+// options of a hybrid search, zero values use the config
+type HybridOptions struct {
+	Fusion       string   `json:"fusion,omitempty"`
+	VectorWeight *float64 `json:"vectorWeight,omitempty"`
+	Fields       []string `json:"fields,omitempty"`
+	Size         int      `json:"size,omitempty"`
+}
+
+// the options with the config filling those not set, checked
+func (c *Config) HybridOptions(options HybridOptions) (HybridOptions, error) {
+
+	if options.Fusion == "" {
+		options.Fusion = c.HybridFusion
+	}
+
+	if options.VectorWeight == nil {
+		weight := c.HybridVectorWeight
+		options.VectorWeight = &weight
+	}
+
+	if len(options.Fields) == 0 {
+		options.Fields = c.HybridFields
+	}
+
+	if options.Size == 0 {
+		options.Size = 10
+	}
+
+	return options, options.validate()
+}
+
+func (o HybridOptions) validate() error {
+
+	var errs []error
+
+	if o.Fusion != FusionRRF && o.Fusion != FusionWeighted {
+		errs = append(errs, fmt.Errorf("fusion must be %s or %s, got %q", FusionRRF, FusionWeighted, o.Fusion))
+	}
+
+	if o.VectorWeight != nil && (*o.VectorWeight < 0 || *o.VectorWeight > 1) {
+		errs = append(errs, fmt.Errorf("vectorWeight must be between 0 and 1, got %g", *o.VectorWeight))
+	}
+
+	for _, field := range o.Fields {
+		if !hybridField.MatchString(field) {
+			errs = append(errs, fmt.Errorf("field %q is not title, text or heading, with an optional ^boost", field))
+		}
+	}
+
+	if o.Size < 1 || o.Size > maxHybridSize {
+		errs = append(errs, fmt.Errorf("size must be between 1 and %d, got %d", maxHybridSize, o.Size))
+	}
+
+	return errors.Join(errs...)
+}
+
+// a chunk found by a hybrid search, Score is the fused score and the ranks
+// and scores of the searches which found it are kept, ranks count from 1
+type HybridHit struct {
+	ChunkHit
+	VectorScore  *float64 `json:"vectorScore,omitempty"`
+	VectorRank   int      `json:"vectorRank,omitempty"`
+	LexicalScore *float64 `json:"lexicalScore,omitempty"`
+	LexicalRank  int      `json:"lexicalRank,omitempty"`
+}
+
+// the hits of a hybrid search, Degraded when one search failed and the hits
+// are of the other alone, Warnings holds the error of the failed search
+type HybridResult struct {
+	Hits     []HybridHit `json:"hits"`
+	Degraded bool        `json:"degraded"`
+	Warnings []string    `json:"warnings,omitempty"`
+}
+
+// search the note index by meaning with knn and by words with bm25 over the
+// fields of the options, and fuse the two hit lists; a failing search is
+// left out unless both fail
+func HybridSearch(ctx context.Context, AOSSClient VectorStore, BedrockClient ModelInvoker, cfg *Config, query string, options HybridOptions) (HybridResult, error) {
+
+	candidates := max(options.Size, hybridCandidates)
+
+	var vectorHits, lexicalHits []ChunkHit
+	var vectorErr, lexicalErr error
+
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		vec, err := EmbedText(ctx, query, BedrockClient, cfg)
+		if err != nil {
+			vectorErr = err
+			return
+		}
+		vectorHits, vectorErr = searchChunks(ctx, AOSSClient, cfg, SearchBody{
+			Size:   intPtr(candidates),
+			Query:  KnnVectorQuery(VectorField, vec, candidates),
+			Source: excludeVector(),
+		})
+	}()
+
+	go func() {
+		defer wg.Done()
+		lexicalHits, lexicalErr = searchChunks(ctx, AOSSClient, cfg, SearchBody{
+			Size:   intPtr(candidates),
+			Query:  MultiMatch(query, options.Fields...),
+			Source: excludeVector(),
+		})
+	}()
+
+	wg.Wait()
+
+	if vectorErr != nil && lexicalErr != nil {
+		return HybridResult{}, errors.Join(fmt.Errorf("vector search: %w", vectorErr), fmt.Errorf("lexical search: %w", lexicalErr))
+	}
+
+	var result HybridResult
+
+	if vectorErr != nil {
+		fmt.Printf("hybrid search without vectors: %v\n", vectorErr)
+		result.Degraded = true
+		result.Warnings = append(result.Warnings, fmt.Sprintf("vector search: %v", vectorErr))
+	}
+
+	if lexicalErr != nil {
+		fmt.Printf("hybrid search without words: %v\n", lexicalErr)
+		result.Degraded = true
+		result.Warnings = append(result.Warnings, fmt.Sprintf("lexical search: %v", lexicalErr))
+	}
+
+	result.Hits = FuseHits(vectorHits, lexicalHits, options.Fusion, *options.VectorWeight, cfg.HybridRankConstant)
+
+	if len(result.Hits) > options.Size {
+		result.Hits = result.Hits[:options.Size]
+	}
+
+	return result, nil
+}
+
+// fuse the hits of a vector and a lexical search by their ids, the best
+// first; vectorWeight weighs the vector search and 1 - vectorWeight the
+// lexical one
+func FuseHits(vectorHits []ChunkHit, lexicalHits []ChunkHit, fusion string, vectorWeight float64, rankConstant int) []HybridHit {
+
+	fused := []HybridHit{}
+	byID := map[string]int{}
+
+	add := func(hits []ChunkHit, weight float64, set func(hit *HybridHit, rank int, score float64)) {
+
+		normalized := normalizeScores(hits)
+
+		for k, hit := range hits {
+
+			i, ok := byID[hit.ID]
+
+			if !ok {
+				i = len(fused)
+				byID[hit.ID] = i
+				fused = append(fused, HybridHit{ChunkHit: hit})
+				fused[i].Score = 0
+			}
+
+			score := hit.Score
+			set(&fused[i], k+1, score)
+
+			if fusion == FusionWeighted {
+				fused[i].Score += weight * normalized[k]
+			} else {
+				fused[i].Score += weight / float64(rankConstant+k+1)
+			}
+		}
+	}
+
+	add(vectorHits, vectorWeight, func(hit *HybridHit, rank int, score float64) {
+		hit.VectorRank, hit.VectorScore = rank, &score
+	})
+
+	add(lexicalHits, 1-vectorWeight, func(hit *HybridHit, rank int, score float64) {
+		hit.LexicalRank, hit.LexicalScore = rank, &score
+	})
+
+	sort.SliceStable(fused, func(i, j int) bool { return fused[i].Score > fused[j].Score })
+
+	return fused
+}
+
+// scores scaled to 0..1 by the lowest and highest of the list, equal scores
+// are all 1
+func normalizeScores(hits []ChunkHit) []float64 {
+
+	normalized := make([]float64, len(hits))
+
+	if len(hits) == 0 {
+		return normalized
+	}
+
+	low, high := hits[0].Score, hits[0].Score
+
+	for _, hit := range hits {
+		low, high = min(low, hit.Score), max(high, hit.Score)
+	}
+
+	for k, hit := range hits {
+		if high == low {
+			normalized[k] = 1
+		} else {
+			normalized[k] = (hit.Score - low) / (high - low)
+		}
+	}
+
+	return normalized
+}
+
+// run a search of the note index and decode its hits
+func searchChunks(ctx context.Context, AOSSClient VectorStore, cfg *Config, body SearchBody) ([]ChunkHit, error) {
+
+	data, err := searchNotes(ctx, AOSSClient, cfg, body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return DecodeChunkHits(bytes.NewReader(data))
+}
+
+// search the notes by meaning and by words at once
+//
+//	POST /aoss-hybrid-search  {"query": "...", "fusion": "weighted", "vectorWeight": 0.7, "fields": ["title^2", "text"], "size": 10}
+//
+// the fields of the request default to the config, degraded is true when
+// one search failed and warnings says why
+func HandleAOSSHybridSearch(w http.ResponseWriter, r *http.Request, AOSSClient VectorStore, BedrockClient ModelInvoker, cfg *Config) {
+
+	var request struct {
+		Query string `json:"query"`
+		HybridOptions
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if request.Query == "" {
+		http.Error(w, "query is required", http.StatusBadRequest)
+		return
+	}
+
+	options, err := cfg.HybridOptions(request.HybridOptions)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := HybridSearch(r.Context(), AOSSClient, BedrockClient, cfg, request.Query, options)
+
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Fusion string `json:"fusion"`
+		HybridResult
+	}{options.Fusion, result})
+}
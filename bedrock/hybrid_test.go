@@ -0,0 +1,317 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// hybrid hits as id, fused score and the rank and score of each search, for
+// comparing
+func hybridHitStrings(hits []HybridHit) []string {
+
+	score := func(score *float64) string {
+		if score == nil {
+			return "-"
+		}
+		return fmt.Sprint(*score)
+	}
+
+	strs := make([]string, len(hits))
+
+	for k, hit := range hits {
+		strs[k] = fmt.Sprintf("%s %.4f v%d:%s l%d:%s", hit.ID, hit.Score, hit.VectorRank, score(hit.VectorScore), hit.LexicalRank, score(hit.LexicalScore))
+	}
+
+	return strs
+}
+
+func chunkHit(id string, score float64) ChunkHit {
+	return ChunkHit{ID: id, Score: score, IndexDocument: IndexDocument{Title: "title " + id}}
+}
+
+func TestFuseHits(t *testing.T) {
+
+	vector := []ChunkHit{chunkHit("a", 0.9), chunkHit("b", 0.8)}
+	lexical := []ChunkHit{chunkHit("b", 12), chunkHit("c", 5)}
+
+	tests := []struct {
+		name    string
+		vector  []ChunkHit
+		lexical []ChunkHit
+		fusion  string
+		weight  float64
+		want    []string
+	}{
+		{name: "nothing", fusion: FusionRRF, weight: 0.5, want: []string{}},
+		{
+			// 0.5/61, 0.5/62 + 0.5/61 and 0.5/62
+			name: "rrf overlapping", vector: vector, lexical: lexical, fusion: FusionRRF, weight: 0.5,
+			want: []string{"b 0.0163 v2:0.8 l1:12", "a 0.0082 v1:0.9 l0:-", "c 0.0081 v0:- l2:5"},
+		},
+		{
+			name: "rrf disjoint", vector: []ChunkHit{chunkHit("a", 0.9)}, lexical: []ChunkHit{chunkHit("c", 5)}, fusion: FusionRRF, weight: 0.5,
+			want: []string{"a 0.0082 v1:0.9 l0:-", "c 0.0082 v0:- l1:5"},
+		},
+		{
+			name: "rrf vectors only", vector: vector, lexical: lexical, fusion: FusionRRF, weight: 1,
+			want: []string{"a 0.0164 v1:0.9 l0:-", "b 0.0161 v2:0.8 l1:12", "c 0.0000 v0:- l2:5"},
+		},
+		{
+			name: "rrf words only", vector: vector, lexical: lexical, fusion: FusionRRF, weight: 0,
+			want: []string{"b 0.0164 v2:0.8 l1:12", "c 0.0161 v0:- l2:5", "a 0.0000 v1:0.9 l0:-"},
+		},
+		{
+			// a and b tie at 0.5 and keep the order of the vector search
+			name: "weighted overlapping", vector: vector, lexical: lexical, fusion: FusionWeighted, weight: 0.5,
+			want: []string{"a 0.5000 v1:0.9 l0:-", "b 0.5000 v2:0.8 l1:12", "c 0.0000 v0:- l2:5"},
+		},
+		{
+			name: "weighted leaning on vectors", vector: vector, lexical: lexical, fusion: FusionWeighted, weight: 0.7,
+			want: []string{"a 0.7000 v1:0.9 l0:-", "b 0.3000 v2:0.8 l1:12", "c 0.0000 v0:- l2:5"},
+		},
+		{
+			name: "weighted disjoint", vector: []ChunkHit{chunkHit("a", 0.9), chunkHit("d", 0.1)}, lexical: []ChunkHit{chunkHit("c", 5)}, fusion: FusionWeighted, weight: 0.25,
+			want: []string{"c 0.7500 v0:- l1:5", "a 0.2500 v1:0.9 l0:-", "d 0.0000 v2:0.1 l0:-"},
+		},
+		{
+			// equal scores all scale to 1
+			name: "weighted equal scores", vector: []ChunkHit{chunkHit("a", 0.5), chunkHit("b", 0.5)}, lexical: []ChunkHit{chunkHit("b", 3)}, fusion: FusionWeighted, weight: 0.5,
+			want: []string{"b 1.0000 v2:0.5 l1:3", "a 0.5000 v1:0.5 l0:-"},
+		},
+		{
+			name: "weighted vectors only", vector: vector, lexical: lexical, fusion: FusionWeighted, weight: 1,
+			want: []string{"a 1.0000 v1:0.9 l0:-", "b 0.0000 v2:0.8 l1:12", "c 0.0000 v0:- l2:5"},
+		},
+		{
+			name: "weighted words only", vector: vector, lexical: lexical, fusion: FusionWeighted, weight: 0,
+			want: []string{"b 1.0000 v2:0.8 l1:12", "a 0.0000 v1:0.9 l0:-", "c 0.0000 v0:- l2:5"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			hits := FuseHits(test.vector, test.lexical, test.fusion, test.weight, 60)
+
+			if got := hybridHitStrings(hits); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+
+			for _, hit := range hits {
+				if hit.Title != "title "+hit.ID {
+					t.Errorf("hit %s has title %q", hit.ID, hit.Title)
+				}
+			}
+		})
+	}
+}
+
+func TestNormalizeScores(t *testing.T) {
+
+	tests := []struct {
+		scores []float64
+		want   []float64
+	}{
+		{nil, []float64{}},
+		{[]float64{3}, []float64{1}},
+		{[]float64{2, 2, 2}, []float64{1, 1, 1}},
+		{[]float64{1, 3, 2}, []float64{0, 1, 0.5}},
+		{[]float64{-1, 1, 0}, []float64{0, 1, 0.5}},
+	}
+
+	for _, test := range tests {
+
+		hits := make([]ChunkHit, len(test.scores))
+
+		for k, score := range test.scores {
+			hits[k] = chunkHit(fmt.Sprint(k), score)
+		}
+
+		if got := normalizeScores(hits); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("normalizeScores(%v) = %v, want %v", test.scores, got, test.want)
+		}
+	}
+}
+
+func TestHybridOptions(t *testing.T) {
+
+	cfg := DefaultConfig()
+	cfg.HybridFusion = FusionRRF
+	cfg.HybridVectorWeight = 0.6
+	cfg.HybridFields = []string{"title^2", "text"}
+
+	weight := func(weight float64) *float64 { return &weight }
+
+	tests := []struct {
+		name    string
+		options HybridOptions
+		want    HybridOptions
+		err     string
+	}{
+		{name: "defaults", want: HybridOptions{Fusion: FusionRRF, VectorWeight: weight(0.6), Fields: []string{"title^2", "text"}, Size: 10}},
+		{
+			name:    "options",
+			options: HybridOptions{Fusion: FusionWeighted, VectorWeight: weight(0), Fields: []string{"heading^1.5"}, Size: 100},
+			want:    HybridOptions{Fusion: FusionWeighted, VectorWeight: weight(0), Fields: []string{"heading^1.5"}, Size: 100},
+		},
+		{name: "vectors only", options: HybridOptions{VectorWeight: weight(1), Size: 1}, want: HybridOptions{Fusion: FusionRRF, VectorWeight: weight(1), Fields: []string{"title^2", "text"}, Size: 1}},
+		{name: "fusion", options: HybridOptions{Fusion: "sum"}, err: `fusion must be rrf or weighted, got "sum"`},
+		{name: "negative weight", options: HybridOptions{VectorWeight: weight(-0.1)}, err: "vectorWeight must be between 0 and 1, got -0.1"},
+		{name: "weight above 1", options: HybridOptions{VectorWeight: weight(1.5)}, err: "vectorWeight must be between 0 and 1, got 1.5"},
+		{name: "unknown field", options: HybridOptions{Fields: []string{"body"}}, err: `field "body" is not title, text or heading, with an optional ^boost`},
+		{name: "empty boost", options: HybridOptions{Fields: []string{"title^"}}, err: `field "title^" is not title, text or heading, with an optional ^boost`},
+		{name: "bad boost", options: HybridOptions{Fields: []string{"text^-1"}}, err: `field "text^-1" is not title, text or heading, with an optional ^boost`},
+		{name: "field prefix", options: HybridOptions{Fields: []string{"subtitle"}}, err: `field "subtitle" is not title, text or heading, with an optional ^boost`},
+		{name: "negative size", options: HybridOptions{Size: -1}, err: "size must be between 1 and 100, got -1"},
+		{name: "size above 100", options: HybridOptions{Size: 101}, err: "size must be between 1 and 100, got 101"},
+		{
+			name:    "every error",
+			options: HybridOptions{Fusion: "sum", VectorWeight: weight(2), Fields: []string{"text", "body"}, Size: 101},
+			err:     "fusion must be rrf or weighted, got \"sum\"\nvectorWeight must be between 0 and 1, got 2\nfield \"body\" is not title, text or heading, with an optional ^boost\nsize must be between 1 and 100, got 101",
+		},
+	}
+
+	for _, test := range tests {
+
+		got, err := cfg.HybridOptions(test.options)
+
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, %v, want %+v", test.name, got, err, test.want)
+		}
+	}
+}
+
+// VectorStore answering knn searches with vector and other searches with
+// lexical, a body of "" fails the search with a 500
+type hybridStore struct {
+	vector  string
+	lexical string
+}
+
+func (s *hybridStore) Perform(req *http.Request) (*http.Response, error) {
+
+	query, err := io.ReadAll(req.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	body := s.lexical
+
+	if bytes.Contains(query, []byte(`"knn"`)) {
+		body = s.vector
+	}
+
+	status := http.StatusOK
+
+	if body == "" {
+		status, body = http.StatusInternalServerError, `{"error": "down"}`
+	}
+
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}, nil
+}
+
+// a search response of hits of ids and scores
+func hitsResponse(hits ...ChunkHit) string {
+
+	var items []string
+
+	for _, hit := range hits {
+		items = append(items, fmt.Sprintf(`{"_id": %q, "_score": %g, "_source": {"title": %q, "text": "text", "vector_field": [0.1]}}`, hit.ID, hit.Score, hit.Title))
+	}
+
+	return `{"hits": {"hits": [` + strings.Join(items, ", ") + `]}}`
+}
+
+func TestHybridSearch(t *testing.T) {
+
+	vector := hitsResponse(chunkHit("a", 0.9), chunkHit("b", 0.8))
+	lexical := hitsResponse(chunkHit("b", 12), chunkHit("c", 5))
+
+	tests := []struct {
+		name     string
+		store    hybridStore
+		embedErr error
+		size     int
+		want     []string
+		warnings []string
+		err      string
+	}{
+		{name: "both", store: hybridStore{vector, lexical}, size: 10, want: []string{"b", "a", "c"}},
+		{name: "size", store: hybridStore{vector, lexical}, size: 2, want: []string{"b", "a"}},
+		{name: "vector search fails", store: hybridStore{"", lexical}, size: 10, want: []string{"b", "c"}, warnings: []string{`vector search: search demo: 500 Internal Server Error {"error": "down"}`}},
+		{name: "embedding fails", store: hybridStore{vector, lexical}, embedErr: errors.New("throttled"), size: 10, want: []string{"b", "c"}, warnings: []string{"vector search: throttled"}},
+		{name: "lexical search fails", store: hybridStore{vector, ""}, size: 10, want: []string{"a", "b"}, warnings: []string{`lexical search: search demo: 500 Internal Server Error {"error": "down"}`}},
+		{
+			name: "both fail", store: hybridStore{"", ""}, embedErr: errors.New("throttled"), size: 10,
+			err: "vector search: throttled\nlexical search: search demo: 500 Internal Server Error {\"error\": \"down\"}",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			cfg := DefaultConfig()
+			cfg.AOSSNoteAppIndexName = "demo"
+
+			options, err := cfg.HybridOptions(HybridOptions{Fusion: FusionRRF, Size: test.size})
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			invoker := &FakeModelInvoker{Embedding: make([]float64, cfg.VectorDimension()), Err: test.embedErr}
+
+			result, err := HybridSearch(context.Background(), &test.store, invoker, &cfg, "cold starts", options)
+
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ids []string
+
+			for _, hit := range result.Hits {
+				ids = append(ids, hit.ID)
+				if hit.Vector != nil {
+					t.Errorf("hit %s has a vector", hit.ID)
+				}
+			}
+
+			if !reflect.DeepEqual(ids, test.want) {
+				t.Errorf("got hits %q, want %q", ids, test.want)
+			}
+
+			if result.Degraded != (test.warnings != nil) || !reflect.DeepEqual(result.Warnings, test.warnings) {
+				t.Errorf("got degraded %v with warnings %q, want %q", result.Degraded, result.Warnings, test.warnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,558 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/opensearch-project/opensearch-go/v2/opensearchapi"
+)
+
+// embedding model of the note index unless the config names another
+const DefaultEmbeddingModel = "amazon.titan-embed-text-v1"
+
+// knn engines and space types of the note index
+const (
+	EngineFaiss  = "faiss"
+	EngineNmslib = "nmslib"
+
+	SpaceL2           = "l2"
+	SpaceCosine       = "cosinesimil"
+	SpaceInnerProduct = "innerproduct"
+)
+
+// aoss has no scroll or _reindex, a reindex reads the notes with one search
+// which returns at most this many documents
+const maxReindexDocuments = 10000
+
+var (
+	ErrIndexNotFound = errors.New("index does not exist")
+	ErrIndexExists   = errors.New("index already exists")
+	ErrIndexMapping  = errors.New("index mapping does not match the config")
+)
+
+// an embedding model and the sizes of its vectors, Dimensions lists the
+// sizes it can be asked for besides Dimension
+type EmbeddingModel struct {
+	Dimension  int
+	Dimensions []int
+}
+
+var embeddingModels = map[string]EmbeddingModel{
+	"amazon.titan-embed-text-v1":    {Dimension: 1536},
+	"amazon.titan-embed-g1-text-02": {Dimension: 1536},
+	"amazon.titan-embed-text-v2:0":  {Dimension: 1024, Dimensions: []int{256, 512, 1024}},
+}
+
+// size of the note embeddings, embeddingDimensions or the default size of
+// the embedding model
+func (c *Config) VectorDimension() int {
+
+	if c.EmbeddingDimensions > 0 {
+		return c.EmbeddingDimensions
+	}
+
+	return embeddingModels[c.EmbeddingModelID].Dimension
+}
+
+func (c *Config) validateIndex() error {
+
+	var errs []error
+
+	model, ok := embeddingModels[c.EmbeddingModelID]
+
+	if !ok {
+		errs = append(errs, fmt.Errorf("config embeddingModelId: unsupported embedding model %q", c.EmbeddingModelID))
+	}
+
+	if ok && c.EmbeddingDimensions != 0 && !containsInt(model.Dimensions, c.EmbeddingDimensions) {
+		errs = append(errs, fmt.Errorf("config embeddingDimensions: %s does not support %d dimensions", c.EmbeddingModelID, c.EmbeddingDimensions))
+	}
+
+	if c.IndexEngine != EngineFaiss && c.IndexEngine != EngineNmslib {
+		errs = append(errs, fmt.Errorf("config indexEngine must be %s or %s, got %q", EngineFaiss, EngineNmslib, c.IndexEngine))
+	}
+
+	switch c.IndexSpaceType {
+	case SpaceL2, SpaceCosine, SpaceInnerProduct:
+	default:
+		errs = append(errs, fmt.Errorf("config indexSpaceType must be %s, %s or %s, got %q", SpaceL2, SpaceCosine, SpaceInnerProduct, c.IndexSpaceType))
+	}
+
+	return errors.Join(errs...)
+}
+
+func containsInt(values []int, n int) bool {
+	for _, v := range values {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+// the body of an index creation request
+type IndexBody struct {
+	Settings IndexSettings `json:"settings"`
+	Mappings IndexMappings `json:"mappings"`
+}
+
+type IndexSettings struct {
+	Knn bool `json:"index.knn"`
+}
+
+type IndexMappings struct {
+	Properties map[string]FieldMapping `json:"properties"`
+}
+
+// the mapping of a field, Dimension and Method are set for knn vectors only
+type FieldMapping struct {
+	Type      string     `json:"type"`
+	Dimension int        `json:"dimension,omitempty"`
+	Method    *KnnMethod `json:"method,omitempty"`
+}
+
+type KnnMethod struct {
+	Name      string `json:"name"`
+	Engine    string `json:"engine"`
+	SpaceType string `json:"space_type"`
+}
+
+// the settings and mapping of the note index for the embedding model,
+// engine and space type of the config
+func IndexMapping(cfg *Config) IndexBody {
+	return IndexBody{
+		Settings: IndexSettings{Knn: true},
+		Mappings: IndexMappings{Properties: map[string]FieldMapping{
+			"title": {Type: "text"},
+			"link":  {Type: "keyword"},
+			"text":  {Type: "text"},
+
+			// where a chunk was cut from its note
+			"parent_id":    {Type: "keyword"},
+			"chunk_index":  {Type: "integer"},
+			"start_offset": {Type: "integer"},
+			"end_offset":   {Type: "integer"},
+			"heading":      {Type: "text"},
+
+			VectorField: {
+				Type:      "knn_vector",
+				Dimension: cfg.VectorDimension(),
+				Method:    &KnnMethod{Name: "hnsw", Engine: cfg.IndexEngine, SpaceType: cfg.IndexSpaceType},
+			},
+		}},
+	}
+}
+
+// create the note index, ErrIndexExists when it already exists
+func CreateIndex(ctx context.Context, AOSSClient VectorStore, cfg *Config) error {
+
+	body, err := jsonBody(IndexMapping(cfg))
+
+	if err != nil {
+		return err
+	}
+
+	response, err := opensearchapi.IndicesCreateRequest{Index: cfg.AOSSNoteAppIndexName, Body: body}.Do(ctx, AOSSClient)
+
+	if err != nil {
+		return err
+	}
+
+	return responseError("create index "+cfg.AOSSNoteAppIndexName, response)
+}
+
+// delete the note index and its documents, ErrIndexNotFound when there is
+// no index
+func DeleteIndex(ctx context.Context, AOSSClient VectorStore, cfg *Config) error {
+
+	response, err := opensearchapi.IndicesDeleteRequest{Index: []string{cfg.AOSSNoteAppIndexName}}.Do(ctx, AOSSClient)
+
+	if err != nil {
+		return err
+	}
+
+	return responseError("delete index "+cfg.AOSSNoteAppIndexName, response)
+}
+
+// the mapping of the note index
+func GetIndexMapping(ctx context.Context, AOSSClient VectorStore, cfg *Config) (IndexMappings, error) {
+
+	response, err := opensearchapi.IndicesGetMappingRequest{Index: []string{cfg.AOSSNoteAppIndexName}}.Do(ctx, AOSSClient)
+
+	if err != nil {
+		return IndexMappings{}, err
+	}
+
+	defer response.Body.Close()
+
+	if err := responseError("get mapping of "+cfg.AOSSNoteAppIndexName, response); err != nil {
+		return IndexMappings{}, err
+	}
+
+	var indices map[string]struct {
+		Mappings IndexMappings `json:"mappings"`
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&indices); err != nil {
+		return IndexMappings{}, fmt.Errorf("get mapping of %s: %w", cfg.AOSSNoteAppIndexName, err)
+	}
+
+	index, ok := indices[cfg.AOSSNoteAppIndexName]
+
+	if !ok {
+		return IndexMappings{}, fmt.Errorf("index %s: %w", cfg.AOSSNoteAppIndexName, ErrIndexNotFound)
+	}
+
+	return index.Mappings, nil
+}
+
+// check that the note index maps vector_field as the config expects, the
+// error wraps ErrIndexNotFound or ErrIndexMapping
+func CheckIndexMapping(ctx context.Context, AOSSClient VectorStore, cfg *Config) error {
+
+	mappings, err := GetIndexMapping(ctx, AOSSClient, cfg)
+
+	if err != nil {
+		return err
+	}
+
+	return compareMapping(mappings, IndexMapping(cfg).Mappings, cfg.AOSSNoteAppIndexName)
+}
+
+// differences of the vector field from the expected one, a method the index
+// does not report is not compared
+func compareMapping(actual IndexMappings, expected IndexMappings, index string) error {
+
+	field, ok := actual.Properties[VectorField]
+	want := expected.Properties[VectorField]
+
+	var problems []string
+
+	switch {
+	case !ok:
+		problems = append(problems, VectorField+" is not mapped")
+	case field.Type != want.Type:
+		problems = append(problems, fmt.Sprintf("%s is %s, not %s", VectorField, field.Type, want.Type))
+	default:
+		if field.Dimension != want.Dimension {
+			problems = append(problems, fmt.Sprintf("dimension is %d, the embedding model gives %d", field.Dimension, want.Dimension))
+		}
+		if field.Method != nil && field.Method.Engine != "" && field.Method.Engine != want.Method.Engine {
+			problems = append(problems, fmt.Sprintf("engine is %s, not %s", field.Method.Engine, want.Method.Engine))
+		}
+		if field.Method != nil && field.Method.SpaceType != "" && field.Method.SpaceType != want.Method.SpaceType {
+			problems = append(problems, fmt.Sprintf("space type is %s, not %s", field.Method.SpaceType, want.Method.SpaceType))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("index %s: %w: %s", index, ErrIndexMapping, strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+// check the note index at startup, creating it when it does not exist and
+// createIndex is set
+func EnsureIndex(ctx context.Context, AOSSClient VectorStore, cfg *Config) error {
+
+	err := CheckIndexMapping(ctx, AOSSClient, cfg)
+
+	if errors.Is(err, ErrIndexNotFound) && cfg.CreateIndex {
+		fmt.Printf("create index %s with %d dimensions\n", cfg.AOSSNoteAppIndexName, cfg.VectorDimension())
+		return CreateIndex(ctx, AOSSClient, cfg)
+	}
+
+	return err
+}
+
+// statistics of the note index
+type IndexStats struct {
+	Index            string `json:"index"`
+	Documents        int    `json:"documents"`
+	EmbeddingModelID string `json:"embeddingModelId"`
+	Dimension        int    `json:"dimension"`
+	Engine           string `json:"engine"`
+	SpaceType        string `json:"spaceType"`
+	Compatible       bool   `json:"compatible"`
+	Problem          string `json:"problem,omitempty"`
+}
+
+// count the documents of the note index and check its mapping, aoss has no
+// _stats api
+func GetIndexStats(ctx context.Context, AOSSClient VectorStore, cfg *Config) (IndexStats, error) {
+
+	mappings, err := GetIndexMapping(ctx, AOSSClient, cfg)
+
+	if err != nil {
+		return IndexStats{}, err
+	}
+
+	stats := IndexStats{Index: cfg.AOSSNoteAppIndexName, EmbeddingModelID: cfg.EmbeddingModelID, Compatible: true}
+
+	if field, ok := mappings.Properties[VectorField]; ok {
+		stats.Dimension = field.Dimension
+		if field.Method != nil {
+			stats.Engine, stats.SpaceType = field.Method.Engine, field.Method.SpaceType
+		}
+	}
+
+	if err := compareMapping(mappings, IndexMapping(cfg).Mappings, cfg.AOSSNoteAppIndexName); err != nil {
+		stats.Compatible, stats.Problem = false, err.Error()
+	}
+
+	response, err := opensearchapi.CountRequest{Index: []string{cfg.AOSSNoteAppIndexName}}.Do(ctx, AOSSClient)
+
+	if err != nil {
+		return IndexStats{}, err
+	}
+
+	defer response.Body.Close()
+
+	if err := responseError("count "+cfg.AOSSNoteAppIndexName, response); err != nil {
+		return IndexStats{}, err
+	}
+
+	var count struct {
+		Count int `json:"count"`
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&count); err != nil {
+		return IndexStats{}, fmt.Errorf("count %s: %w", cfg.AOSSNoteAppIndexName, err)
+	}
+
+	stats.Documents = count.Count
+
+	return stats, nil
+}
+
+// outcome of a reindex, Failed holds the titles of notes not indexed again
+type ReindexReport struct {
+	Documents int      `json:"documents"`
+	Indexed   int      `json:"indexed"`
+	Failed    []string `json:"failed,omitempty"`
+}
+
+// recreate the note index with the mapping of the config and embed every
+// note again, for example after the embedding model changed
+//
+// the notes are read and embedded again before the index is deleted, so an
+// index of more than maxReindexDocuments notes, or one whose notes cannot
+// all be embedded, is left untouched; aoss has no aliases to swap, so a
+// cancelled ctx or a failed write after the delete still loses notes, and
+// ctx should not be the context of the request
+func Reindex(ctx context.Context, AOSSClient VectorStore, BedrockClient ModelInvoker, cfg *Config) (ReindexReport, error) {
+
+	items, err := readNotes(ctx, AOSSClient, cfg)
+
+	if err != nil {
+		return ReindexReport{}, err
+	}
+
+	ingestion := newIngestion(cfg, items)
+
+	var embedded []embeddedItem
+
+	for item := range ingestion.embed(ctx, BedrockClient, cfg) {
+		embedded = append(embedded, item)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return ReindexReport{}, fmt.Errorf("reindex %s: %w", cfg.AOSSNoteAppIndexName, err)
+	}
+
+	if failed := len(ingestion.chunks) - len(embedded); failed > 0 {
+
+		var problem string
+
+		for _, result := range ingestion.results {
+			if result.Error != "" {
+				problem = result.Error
+				break
+			}
+		}
+
+		return ReindexReport{}, fmt.Errorf("reindex %s: %d of %d chunks not embedded, the index is left as it is: %s", cfg.AOSSNoteAppIndexName, failed, len(ingestion.chunks), problem)
+	}
+
+	if err := DeleteIndex(ctx, AOSSClient, cfg); err != nil {
+		return ReindexReport{}, err
+	}
+
+	if err := CreateIndex(ctx, AOSSClient, cfg); err != nil {
+		return ReindexReport{}, err
+	}
+
+	ready := make(chan embeddedItem, len(embedded))
+
+	for _, item := range embedded {
+		ready <- item
+	}
+
+	close(ready)
+
+	ingestion.write(ctx, AOSSClient, cfg, ready)
+
+	ingest := ingestion.report(ctx)
+
+	report := ReindexReport{Documents: len(items), Indexed: ingest.Indexed}
+
+	for _, item := range ingest.Items {
+		if !item.Indexed {
+			report.Failed = append(report.Failed, item.Title)
+		}
+	}
+
+	return report, nil
+}
+
+// every note of the index without its vector
+func readNotes(ctx context.Context, AOSSClient VectorStore, cfg *Config) ([]IndexItem, error) {
+
+	body, err := jsonBody(SearchBody{
+		Size:   intPtr(maxReindexDocuments),
+		Query:  SearchQuery{MatchAll: &struct{}{}},
+		Source: map[string][]string{"excludes": {VectorField}},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := opensearchapi.SearchRequest{Index: []string{cfg.AOSSNoteAppIndexName}, Body: body}.Do(ctx, AOSSClient)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+
+	if err := responseError("read "+cfg.AOSSNoteAppIndexName, response); err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Hits struct {
+			Total struct {
+				Value int `json:"value"`
+			} `json:"total"`
+			Hits []struct {
+				Source IndexDocument `json:"_source"`
+			} `json:"hits"`
+		} `json:"hits"`
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("read %s: %w", cfg.AOSSNoteAppIndexName, err)
+	}
+
+	if result.Hits.Total.Value > len(result.Hits.Hits) {
+		return nil, fmt.Errorf("index %s has %d documents, a reindex reads at most %d", cfg.AOSSNoteAppIndexName, result.Hits.Total.Value, maxReindexDocuments)
+	}
+
+	documents := make([]IndexDocument, len(result.Hits.Hits))
+
+	for k, hit := range result.Hits.Hits {
+		documents[k] = hit.Source
+	}
+
+	return JoinChunks(documents), nil
+}
+
+// nil for a successful response, else an error with its status and body
+// wrapping ErrIndexNotFound or ErrIndexExists when it says so
+func responseError(operation string, response *opensearchapi.Response) error {
+
+	if !response.IsError() {
+		return nil
+	}
+
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+
+	err := fmt.Errorf("%s: %s %s", operation, response.Status(), strings.TrimSpace(string(body)))
+
+	switch {
+	case response.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%w: %w", err, ErrIndexNotFound)
+	case strings.Contains(string(body), "resource_already_exists_exception"):
+		return fmt.Errorf("%w: %w", err, ErrIndexExists)
+	}
+
+	return err
+}
+
+// manage the note index, the endpoints are off unless adminToken is set and
+// requests must send it as a bearer token
+//
+//	GET    /admin/index          document count and mapping check
+//	PUT    /admin/index          create the index with the mapping of the config
+//	DELETE /admin/index          delete the index
+//	POST   /admin/index/reindex  recreate the index and embed every note again
+func HandleIndexAdmin(w http.ResponseWriter, r *http.Request, AOSSClient VectorStore, BedrockClient ModelInvoker, cfg *Config) {
+
+	if cfg.AdminToken == "" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/index"), "/")
+
+	var result interface{}
+	var err error
+
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		result, err = GetIndexStats(r.Context(), AOSSClient, cfg)
+
+	case path == "" && r.Method == http.MethodPut:
+		err = CreateIndex(r.Context(), AOSSClient, cfg)
+		result = map[string]interface{}{"index": cfg.AOSSNoteAppIndexName, "mappings": IndexMapping(cfg).Mappings}
+
+	case path == "" && r.Method == http.MethodDelete:
+		err = DeleteIndex(r.Context(), AOSSClient, cfg)
+		result = map[string]interface{}{"index": cfg.AOSSNoteAppIndexName, "deleted": true}
+
+	case path == "reindex" && r.Method == http.MethodPost:
+		// a client that hangs up must not stop a reindex between the delete
+		// and the last write
+		result, err = Reindex(context.WithoutCancel(r.Context()), AOSSClient, BedrockClient, cfg)
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		switch {
+		case errors.Is(err, ErrIndexNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, ErrIndexExists):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,115 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// a note index holding one note, recording the method and path of each
+// request
+type reindexStore struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (s *reindexStore) Perform(req *http.Request) (*http.Response, error) {
+
+	s.mu.Lock()
+	s.requests = append(s.requests, req.Method+" "+req.URL.Path)
+	s.mu.Unlock()
+
+	body := `{}`
+
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/_search"):
+		body = `{"hits": {"total": {"value": 1}, "hits": [{"_source": {"title": "note", "link": "https://example.com", "text": "some text", "parent_id": "p1", "chunk_index": 0, "start_offset": 0, "end_offset": 9}}]}}`
+	case strings.HasSuffix(req.URL.Path, "/_bulk"):
+		body = `{"items": [{"index": {"status": 201}}]}`
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(bytes.NewReader([]byte(body))),
+	}, nil
+}
+
+func (s *reindexStore) methods() []string {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	methods := make([]string, len(s.requests))
+	for k, request := range s.requests {
+		methods[k] = strings.Fields(request)[0]
+	}
+
+	return methods
+}
+
+func TestReindex(t *testing.T) {
+
+	cfg := DefaultConfig()
+	cfg.ChunkStrategy = "none"
+
+	store := &reindexStore{}
+	invoker := &FakeModelInvoker{Embedding: make([]float64, cfg.VectorDimension())}
+
+	report, err := Reindex(context.Background(), store, invoker, &cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Documents != 1 || report.Indexed != 1 || len(report.Failed) != 0 {
+		t.Errorf("report %+v, want one note indexed", report)
+	}
+
+	// read, delete, create, write
+	if got, want := strings.Join(store.methods(), " "), "POST DELETE PUT POST"; got != want {
+		t.Errorf("requests %s, want %s", got, want)
+	}
+}
+
+func TestReindexKeepsIndex(t *testing.T) {
+
+	cfg := DefaultConfig()
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		invoker *FakeModelInvoker
+	}{
+		{"embedding fails", context.Background(), &FakeModelInvoker{Err: errors.New("throttled")}},
+		{"cancelled", cancelled, &FakeModelInvoker{Embedding: make([]float64, cfg.VectorDimension())}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			store := &reindexStore{}
+
+			if _, err := Reindex(test.ctx, store, test.invoker, &cfg); err == nil {
+				t.Fatal("no error")
+			}
+
+			for _, method := range store.methods() {
+				if method == http.MethodDelete {
+					t.Fatalf("index deleted: %v", store.requests)
+				}
+			}
+		})
+	}
+}
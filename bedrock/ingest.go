@@ -0,0 +1,489 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opensearch-project/opensearch-go/v2/opensearchapi"
+)
+
+// formats of bulk ingestion input
+const (
+	FormatJSONL = "jsonl"
+	FormatCSV   = "csv"
+)
+
+// largest bulk ingestion request body
+const maxIngestBody = 32 << 20
+
+// wait before the first retry of throttled items, doubled on each retry
+var ingestBackoff = 500 * time.Millisecond
+
+// the format of a file name or content type, jsonl unless it names csv
+func IngestFormat(name string) string {
+	if strings.HasSuffix(strings.ToLower(name), ".csv") || strings.Contains(name, "text/csv") {
+		return FormatCSV
+	}
+	return FormatJSONL
+}
+
+// read index items from json lines or from csv with a header naming the
+// title, link and text columns, blank lines are skipped
+func ReadIndexItems(r io.Reader, format string) ([]IndexItem, error) {
+	switch format {
+	case FormatJSONL:
+		return readJSONL(r)
+	case FormatCSV:
+		return readCSV(r)
+	default:
+		return nil, fmt.Errorf("unknown format %q, want %s or %s", format, FormatJSONL, FormatCSV)
+	}
+}
+
+func readJSONL(r io.Reader) ([]IndexItem, error) {
+
+	var items []IndexItem
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxIngestBody)
+
+	for line := 1; scanner.Scan(); line++ {
+
+		text := bytes.TrimSpace(scanner.Bytes())
+
+		if len(text) == 0 {
+			continue
+		}
+
+		var item IndexItem
+
+		if err := json.Unmarshal(text, &item); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		items = append(items, item)
+	}
+
+	return items, scanner.Err()
+}
+
+func readCSV(r io.Reader) ([]IndexItem, error) {
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+
+	if err != nil {
+		return nil, fmt.Errorf("csv header: %w", err)
+	}
+
+	columns := map[string]int{}
+
+	for k, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = k
+	}
+
+	if _, ok := columns["text"]; !ok {
+		return nil, errors.New("csv header: a text column is required")
+	}
+
+	field := func(record []string, name string) string {
+		if k, ok := columns[name]; ok && k < len(record) {
+			return record[k]
+		}
+		return ""
+	}
+
+	var items []IndexItem
+
+	for {
+		record, err := reader.Read()
+
+		if err == io.EOF {
+			return items, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, IndexItem{Title: field(record, "title"), Link: field(record, "link"), Text: field(record, "text")})
+	}
+}
+
+// outcome of a bulk ingestion, Items is in input order
+type IngestReport struct {
+	Total   int          `json:"total"`
+	Indexed int          `json:"indexed"`
+	Failed  int          `json:"failed"`
+	Items   []IngestItem `json:"items"`
+}
+
+// outcome of one input item, Attempts counts the bulk requests its chunks
+// were sent in, at most
+type IngestItem struct {
+	Index    int    `json:"index"`
+	ID       string `json:"id,omitempty"`
+	Title    string `json:"title"`
+	Chunks   int    `json:"chunks"`
+	Indexed  bool   `json:"indexed"`
+	Attempts int    `json:"attempts,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// a chunk and its embedding, waiting to be written; index is the position
+// of the chunk in the ingestion
+type embeddedItem struct {
+	index    int
+	document IndexDocument
+}
+
+// split the items into chunks, embed the chunks with ingestWorkers
+// concurrent requests and write them to the note index with _bulk requests
+// of ingestBatchSize chunks, retrying throttled chunks up to
+// ingestMaxRetries times; an item is indexed when all its chunks are
+func Ingest(ctx context.Context, AOSSClient VectorStore, BedrockClient ModelInvoker, cfg *Config, items []IndexItem) IngestReport {
+
+	ingestion := newIngestion(cfg, items)
+	ingestion.write(ctx, AOSSClient, cfg, ingestion.embed(ctx, BedrockClient, cfg))
+
+	return ingestion.report(ctx)
+}
+
+// the chunks of an ingestion and the outcome of each, results[k] is the
+// outcome of chunks[k]
+type ingestion struct {
+	items   []IndexItem
+	chunks  []IndexDocument
+	results []IngestItem
+}
+
+// split the items into chunks
+func newIngestion(cfg *Config, items []IndexItem) *ingestion {
+
+	ingestion := &ingestion{items: items}
+
+	for k, item := range items {
+		for _, chunk := range ChunkItem(item, cfg.ChunkOptions()) {
+			ingestion.chunks = append(ingestion.chunks, chunk)
+			ingestion.results = append(ingestion.results, IngestItem{Index: k})
+		}
+	}
+
+	return ingestion
+}
+
+// embed the chunks with ingestWorkers concurrent requests, the embedded
+// chunks are sent on the returned channel, which is closed when all are done
+func (in *ingestion) embed(ctx context.Context, BedrockClient ModelInvoker, cfg *Config) <-chan embeddedItem {
+
+	jobs := make(chan int)
+	embedded := make(chan embeddedItem)
+
+	var wg sync.WaitGroup
+
+	// each worker writes only the results of its own chunks
+	for w := 0; w < cfg.IngestWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for k := range jobs {
+				vec, err := EmbedText(ctx, embeddingText(in.chunks[k]), BedrockClient, cfg)
+				if err != nil {
+					in.results[k].Error = err.Error()
+					continue
+				}
+				document := in.chunks[k]
+				document.Vector = vec
+				embedded <- embeddedItem{index: k, document: document}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(jobs)
+		for k := range in.chunks {
+			select {
+			case jobs <- k:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(embedded)
+	}()
+
+	return embedded
+}
+
+// write the embedded chunks in batches of ingestBatchSize until the channel
+// is closed
+func (in *ingestion) write(ctx context.Context, AOSSClient VectorStore, cfg *Config, embedded <-chan embeddedItem) {
+
+	var batch []embeddedItem
+
+	for item := range embedded {
+		batch = append(batch, item)
+		if len(batch) == cfg.IngestBatchSize {
+			writeBatch(ctx, AOSSClient, cfg, batch, in.results)
+			batch = nil
+		}
+	}
+
+	if len(batch) > 0 {
+		writeBatch(ctx, AOSSClient, cfg, batch, in.results)
+	}
+}
+
+// the outcome of each item from the outcomes of its chunks
+func (in *ingestion) report(ctx context.Context) IngestReport {
+
+	report := IngestReport{Total: len(in.items), Items: make([]IngestItem, len(in.items))}
+
+	for k, item := range in.items {
+		report.Items[k] = IngestItem{Index: k, ID: DocumentID(item), Title: item.Title}
+	}
+
+	for _, result := range in.results {
+
+		item := &report.Items[result.Index]
+		item.Chunks++
+		item.Attempts = max(item.Attempts, result.Attempts)
+
+		if !result.Indexed && item.Error == "" {
+			item.Error = result.Error
+			// left out when the request was cancelled
+			if item.Error == "" && ctx.Err() != nil {
+				item.Error = ctx.Err().Error()
+			}
+			if item.Error == "" {
+				item.Error = "not indexed"
+			}
+		}
+	}
+
+	for k := range report.Items {
+		item := &report.Items[k]
+		switch {
+		case item.Chunks == 0:
+			item.Error = "text is required"
+			report.Failed++
+		case item.Error == "":
+			item.Indexed = true
+			report.Indexed++
+		default:
+			report.Failed++
+		}
+	}
+
+	return report
+}
+
+// write a batch with _bulk, resending throttled documents after a backoff
+func writeBatch(ctx context.Context, AOSSClient VectorStore, cfg *Config, batch []embeddedItem, results []IngestItem) {
+
+	backoff := ingestBackoff
+
+	for attempt := 0; len(batch) > 0; attempt++ {
+
+		throttled, err := bulkIndex(ctx, AOSSClient, cfg, batch, results)
+
+		if err != nil {
+			for _, item := range batch {
+				results[item.index].Error = err.Error()
+			}
+			return
+		}
+
+		if len(throttled) == 0 || attempt == cfg.IngestMaxRetries {
+			return
+		}
+
+		fmt.Printf("retry %d throttled documents in %s\n", len(throttled), backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+
+		backoff *= 2
+		batch = throttled
+	}
+}
+
+// send one _bulk request and record the outcome of each document, the
+// throttled documents are returned to be sent again
+func bulkIndex(ctx context.Context, AOSSClient VectorStore, cfg *Config, batch []embeddedItem, results []IngestItem) ([]embeddedItem, error) {
+
+	documents := make([]IndexDocument, len(batch))
+
+	for k, item := range batch {
+		documents[k] = item.document
+		results[item.index].Attempts++
+	}
+
+	body, err := bulkBody(documents)
+
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := opensearchapi.BulkRequest{Index: cfg.AOSSNoteAppIndexName, Body: body}.Do(ctx, AOSSClient)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+
+	// the whole request was throttled
+	if response.StatusCode == http.StatusTooManyRequests {
+		for _, item := range batch {
+			results[item.index].Error = response.Status()
+		}
+		return batch, nil
+	}
+
+	outcomes, err := bulkOutcomes(response, cfg.AOSSNoteAppIndexName, len(batch))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var throttled []embeddedItem
+
+	for k, outcome := range outcomes {
+
+		item := batch[k]
+
+		switch {
+		case outcome.indexed():
+			results[item.index].Indexed = true
+			results[item.index].Error = ""
+		case outcome.Status == http.StatusTooManyRequests:
+			results[item.index].Error = string(outcome.Error)
+			throttled = append(throttled, item)
+		default:
+			results[item.index].Error = string(outcome.Error)
+		}
+	}
+
+	return throttled, nil
+}
+
+// the outcome of one document of a _bulk request, ID is the id aoss
+// assigned it
+type bulkOutcome struct {
+	ID     string          `json:"_id"`
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+func (o bulkOutcome) indexed() bool {
+	return o.Status >= 200 && o.Status < 300
+}
+
+// the outcome of each of the count documents of a _bulk request to index,
+// in request order
+func bulkOutcomes(response *opensearchapi.Response, index string, count int) ([]bulkOutcome, error) {
+
+	if err := responseError("bulk index "+index, response); err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Items []map[string]bulkOutcome `json:"items"`
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("bulk index %s: %w", index, err)
+	}
+
+	if len(result.Items) != count {
+		return nil, fmt.Errorf("bulk index %s: %d results for %d documents", index, len(result.Items), count)
+	}
+
+	outcomes := make([]bulkOutcome, count)
+
+	// each item holds the one action of its document
+	for k, item := range result.Items {
+		for _, outcome := range item {
+			outcomes[k] = outcome
+		}
+	}
+
+	return outcomes, nil
+}
+
+// the json lines of a _bulk request indexing documents, aoss vector
+// collections assign the document ids
+func bulkBody(documents []IndexDocument) (io.Reader, error) {
+
+	var body bytes.Buffer
+
+	encoder := json.NewEncoder(&body)
+
+	for _, document := range documents {
+		if err := encoder.Encode(map[string]struct{}{"index": {}}); err != nil {
+			return nil, err
+		}
+		if err := encoder.Encode(document); err != nil {
+			return nil, err
+		}
+	}
+
+	return &body, nil
+}
+
+// index many notes in one request, the body is json lines or csv as given by
+// the format query parameter or the content type
+//
+//	POST /aoss-bulk-index?format=csv
+//
+// the report lists the outcome of every note, large files are better
+// ingested with cmd/ingest as the server times out after 30 seconds
+func HandleAOSSBulkIndex(w http.ResponseWriter, r *http.Request, AOSSClient VectorStore, BedrockClient ModelInvoker, cfg *Config) {
+
+	format := r.URL.Query().Get("format")
+
+	if format == "" {
+		format = IngestFormat(r.Header.Get("Content-Type"))
+	}
+
+	items, err := ReadIndexItems(http.MaxBytesReader(w, r.Body, maxIngestBody), format)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(items) == 0 {
+		http.Error(w, "no notes to index", http.StatusBadRequest)
+		return
+	}
+
+	report := Ingest(r.Context(), AOSSClient, BedrockClient, cfg, items)
+
+	fmt.Printf("bulk index: %d indexed, %d failed\n", report.Indexed, report.Failed)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
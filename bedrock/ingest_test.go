@@ -0,0 +1,350 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a response of bulkStore
+type bulkStoreResponse struct {
+	status int
+	body   string
+}
+
+// VectorStore answering the n-th _bulk request with responses[n], the last
+// response repeats; documents counts the documents of each request and
+// cancel, when set, is called on the first request
+type bulkStore struct {
+	responses []bulkStoreResponse
+	cancel    context.CancelFunc
+
+	mu        sync.Mutex
+	documents []int
+}
+
+func (s *bulkStore) Perform(req *http.Request) (*http.Response, error) {
+
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(req.Body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	n := len(s.documents)
+	// an action line and a document line per document
+	s.documents = append(s.documents, bytes.Count(body, []byte("\n"))/2)
+	s.mu.Unlock()
+
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	response := s.responses[min(n, len(s.responses)-1)]
+
+	return &http.Response{
+		StatusCode: response.status,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(response.body)),
+	}, nil
+}
+
+func (s *bulkStore) requests() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int(nil), s.documents...)
+}
+
+// a _bulk response of 200 with one item per status, failed items have an error
+func bulkItems(statuses ...int) bulkStoreResponse {
+
+	items := make([]string, len(statuses))
+
+	for k, status := range statuses {
+		switch {
+		case status == http.StatusTooManyRequests:
+			items[k] = `{"index": {"status": 429, "error": {"type": "throttled"}}}`
+		case status >= 300:
+			items[k] = `{"index": {"status": 400, "error": {"type": "mapper_parsing_exception"}}}`
+		default:
+			items[k] = `{"index": {"_id": "a1", "status": 201}}`
+		}
+	}
+
+	return bulkStoreResponse{http.StatusOK, `{"items": [` + strings.Join(items, ", ") + `]}`}
+}
+
+func TestIngest(t *testing.T) {
+
+	defer func(backoff time.Duration) { ingestBackoff = backoff }(ingestBackoff)
+	ingestBackoff = time.Millisecond
+
+	throttled := bulkStoreResponse{http.StatusTooManyRequests, `{"message": "slow down"}`}
+
+	one := []IndexItem{{Title: "one", Text: "first note"}}
+	two := []IndexItem{{Title: "one", Text: "first note"}, {Title: "two", Text: "second note"}}
+
+	// 3 chunks of 10 characters with the fixed strategy
+	long := []IndexItem{{Title: "long", Text: "aaaaaaaaa bbbbbbbbb ccccccccc"}}
+
+	tests := []struct {
+		name      string
+		strategy  string
+		items     []IndexItem
+		responses []bulkStoreResponse
+		want      []IngestItem
+		requests  []int
+	}{
+		{
+			name:      "indexed",
+			items:     two,
+			responses: []bulkStoreResponse{bulkItems(201, 201)},
+			want:      []IngestItem{{Index: 0, Chunks: 1, Indexed: true, Attempts: 1}, {Index: 1, Chunks: 1, Indexed: true, Attempts: 1}},
+			requests:  []int{2},
+		},
+		{
+			name:      "throttled request",
+			items:     two,
+			responses: []bulkStoreResponse{throttled, bulkItems(201, 201)},
+			want:      []IngestItem{{Index: 0, Chunks: 1, Indexed: true, Attempts: 2}, {Index: 1, Chunks: 1, Indexed: true, Attempts: 2}},
+			requests:  []int{2, 2},
+		},
+		{
+			name:      "request throttled on every retry",
+			items:     one,
+			responses: []bulkStoreResponse{throttled},
+			want:      []IngestItem{{Index: 0, Chunks: 1, Attempts: 3, Error: "429 Too Many Requests"}},
+			requests:  []int{1, 1, 1},
+		},
+		{
+			name:      "throttled item",
+			items:     two,
+			responses: []bulkStoreResponse{bulkItems(201, 429), bulkItems(201)},
+			want:      []IngestItem{{Index: 0, Chunks: 1, Indexed: true, Attempts: 1}, {Index: 1, Chunks: 1, Indexed: true, Attempts: 2}},
+			requests:  []int{2, 1},
+		},
+		{
+			name:      "item throttled on every retry",
+			items:     two,
+			responses: []bulkStoreResponse{bulkItems(429, 201), bulkItems(429)},
+			want:      []IngestItem{{Index: 0, Chunks: 1, Attempts: 3, Error: `{"type": "throttled"}`}, {Index: 1, Chunks: 1, Indexed: true, Attempts: 1}},
+			requests:  []int{2, 1, 1},
+		},
+		{
+			name:      "failed item",
+			items:     two,
+			responses: []bulkStoreResponse{bulkItems(400, 201)},
+			want:      []IngestItem{{Index: 0, Chunks: 1, Attempts: 1, Error: `{"type": "mapper_parsing_exception"}`}, {Index: 1, Chunks: 1, Indexed: true, Attempts: 1}},
+			requests:  []int{2},
+		},
+		{
+			name:      "item partly indexed",
+			strategy:  ChunkFixed,
+			items:     long,
+			responses: []bulkStoreResponse{bulkItems(201, 400, 201)},
+			want:      []IngestItem{{Index: 0, Chunks: 3, Attempts: 1, Error: `{"type": "mapper_parsing_exception"}`}},
+			requests:  []int{3},
+		},
+		{
+			name:      "item partly throttled",
+			strategy:  ChunkFixed,
+			items:     long,
+			responses: []bulkStoreResponse{bulkItems(201, 429, 201), bulkItems(201)},
+			want:      []IngestItem{{Index: 0, Chunks: 3, Indexed: true, Attempts: 2}},
+			requests:  []int{3, 1},
+		},
+		{
+			name:      "mismatched item count",
+			items:     two,
+			responses: []bulkStoreResponse{bulkItems(201)},
+			want:      []IngestItem{{Index: 0, Chunks: 1, Attempts: 1, Error: "bulk index demo: 1 results for 2 documents"}, {Index: 1, Chunks: 1, Attempts: 1, Error: "bulk index demo: 1 results for 2 documents"}},
+			requests:  []int{2},
+		},
+		{
+			name:      "failed request",
+			items:     one,
+			responses: []bulkStoreResponse{{http.StatusBadRequest, `{"error": "bad"}`}},
+			want:      []IngestItem{{Index: 0, Chunks: 1, Attempts: 1, Error: `bulk index demo: 400 Bad Request {"error": "bad"}`}},
+			requests:  []int{1},
+		},
+		{
+			name:      "no text",
+			items:     []IndexItem{{Title: "empty", Text: " "}, {Title: "one", Text: "first note"}},
+			responses: []bulkStoreResponse{bulkItems(201)},
+			want:      []IngestItem{{Index: 0, Error: "text is required"}, {Index: 1, Chunks: 1, Indexed: true, Attempts: 1}},
+			requests:  []int{1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			cfg := DefaultConfig()
+			cfg.AOSSNoteAppIndexName = "demo"
+			cfg.IngestWorkers = 1
+			cfg.IngestMaxRetries = 2
+			cfg.ChunkStrategy = ChunkNone
+
+			if test.strategy != "" {
+				cfg.ChunkStrategy, cfg.ChunkSize, cfg.ChunkOverlap = test.strategy, 10, 0
+			}
+
+			store := &bulkStore{responses: test.responses}
+			invoker := &FakeModelInvoker{Embedding: make([]float64, cfg.VectorDimension())}
+
+			report := Ingest(context.Background(), store, invoker, &cfg, test.items)
+
+			indexed := 0
+
+			for k := range report.Items {
+				if report.Items[k].Title != test.items[k].Title || report.Items[k].ID != DocumentID(test.items[k]) {
+					t.Errorf("item %d: got title %q and id %q", k, report.Items[k].Title, report.Items[k].ID)
+				}
+				report.Items[k].Title, report.Items[k].ID = "", ""
+				if report.Items[k].Indexed {
+					indexed++
+				}
+			}
+
+			if !reflect.DeepEqual(report.Items, test.want) {
+				t.Errorf("got items %+v, want %+v", report.Items, test.want)
+			}
+
+			if report.Total != len(test.items) || report.Indexed != indexed || report.Failed != len(test.items)-indexed {
+				t.Errorf("got report %d total, %d indexed, %d failed", report.Total, report.Indexed, report.Failed)
+			}
+
+			if got := store.requests(); !reflect.DeepEqual(got, test.requests) {
+				t.Errorf("got documents per request %v, want %v", got, test.requests)
+			}
+		})
+	}
+}
+
+func TestIngestCancelled(t *testing.T) {
+
+	defer func(backoff time.Duration) { ingestBackoff = backoff }(ingestBackoff)
+	ingestBackoff = time.Hour
+
+	cfg := DefaultConfig()
+	cfg.ChunkStrategy = ChunkNone
+	cfg.IngestWorkers = 1
+
+	items := []IndexItem{{Title: "one", Text: "first note"}, {Title: "two", Text: "second note"}}
+	invoker := &FakeModelInvoker{Embedding: make([]float64, cfg.VectorDimension())}
+
+	// cancelled before anything is embedded
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	store := &bulkStore{responses: []bulkStoreResponse{bulkItems(201, 201)}}
+	report := Ingest(cancelled, store, invoker, &cfg, items)
+
+	if report.Indexed != 0 || report.Failed != 2 || report.Items[0].Error != "context canceled" || report.Items[1].Error != "context canceled" || len(store.requests()) != 0 {
+		t.Errorf("got report %+v and %d requests", report, len(store.requests()))
+	}
+
+	// cancelled while waiting to retry a throttled request, without
+	// waiting for the backoff
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store = &bulkStore{responses: []bulkStoreResponse{{http.StatusTooManyRequests, `{}`}}, cancel: cancel}
+
+	done := make(chan IngestReport)
+	go func() { done <- Ingest(ctx, store, invoker, &cfg, items) }()
+
+	select {
+	case report = <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("ingest waited for the backoff after it was cancelled")
+	}
+
+	if report.Failed != 2 || report.Items[0].Attempts != 1 || report.Items[0].Error != "429 Too Many Requests" || len(store.requests()) != 1 {
+		t.Errorf("got report %+v and %d requests", report, len(store.requests()))
+	}
+}
+
+func TestReadIndexItems(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		format string
+		input  string
+		want   []IndexItem
+		err    string
+	}{
+		{
+			name:   "jsonl",
+			format: FormatJSONL,
+			input:  "{\"title\": \"one\", \"text\": \"first\"}\n\n  \n{\"title\": \"two\", \"link\": \"https://example.com\", \"text\": \"second\"}",
+			want:   []IndexItem{{Title: "one", Text: "first"}, {Title: "two", Link: "https://example.com", Text: "second"}},
+		},
+		{name: "empty jsonl", format: FormatJSONL, input: "\n\n"},
+		// blank lines count towards the line number
+		{name: "bad line", format: FormatJSONL, input: "{\"text\": \"first\"}\n\n{\"text\": 1}\n", err: "line 3: json: cannot unmarshal number into Go struct field IndexItem.text of type string"},
+		{name: "not json", format: FormatJSONL, input: "{\"text\": \"first\"}\nnope", err: "line 2: invalid character 'o' in literal null (expecting 'u')"},
+		{
+			name:   "csv",
+			format: FormatCSV,
+			input:  " Text ,TITLE,link\n\"first, with a comma\",one,https://example.com\nsecond,two\n",
+			want:   []IndexItem{{Title: "one", Link: "https://example.com", Text: "first, with a comma"}, {Title: "two", Text: "second"}},
+		},
+		{name: "csv header only", format: FormatCSV, input: "title,text\n"},
+		{name: "csv without a text column", format: FormatCSV, input: "title,body\none,first\n", err: "csv header: a text column is required"},
+		{name: "empty csv", format: FormatCSV, input: "", err: "csv header: EOF"},
+		{name: "bad csv", format: FormatCSV, input: "text\n\"first\n", err: `parse error on line 2, column 8: extraneous or missing " in quoted-field`},
+		{name: "unknown format", format: "xml", input: "<notes/>", err: `unknown format "xml", want jsonl or csv`},
+	}
+
+	for _, test := range tests {
+
+		got, err := ReadIndexItems(strings.NewReader(test.input), test.format)
+
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, %v, want %+v", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestIngestFormat(t *testing.T) {
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"notes.csv", FormatCSV},
+		{"NOTES.CSV", FormatCSV},
+		{"text/csv; charset=utf-8", FormatCSV},
+		{"notes.jsonl", FormatJSONL},
+		{"application/json", FormatJSONL},
+		{"", FormatJSONL},
+	}
+
+	for _, test := range tests {
+		if got := IngestFormat(test.name); got != test.want {
+			t.Errorf("IngestFormat(%q) = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
@@ -6,124 +6,277 @@ package bedrock
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
 )
 
-func HandleRetrieve(w http.ResponseWriter, r *http.Request, client *bedrockagentruntime.Client) {
+// retrieve the chunks answering the last question from the requested
+// knowledge base, or from those picked by the router
+func HandleRetrieve(w http.ResponseWriter, r *http.Request, client KnowledgeBaseClient, router KnowledgeBaseRouter, cfg *Config) {
 
 	// parse user messages
-	type Content struct {
-		Type string `json:"type"`
-		Text string `json:"text"`
-	}
-
-	type Message struct {
-		Role    string    `json:"role"`
-		Content []Content `json:"content"`
-	}
-
 	var request struct {
-		Messages []Message `json:"messages"`
+		Messages      []Message `json:"messages"`
+		KnowledgeBase string    `json:"knowledgeBase"`
+		RetrievalOptions
 	}
 
 	error := json.NewDecoder(r.Body).Decode(&request)
 
 	if error != nil {
 		fmt.Println(error)
+		http.Error(w, error.Error(), http.StatusBadRequest)
+		return
 	}
 
 	messages := request.Messages
 
+	if len(messages) == 0 || strings.TrimSpace(messageText(messages[len(messages)-1])) == "" {
+		http.Error(w, "the last message must have a question", http.StatusBadRequest)
+		return
+	}
+
+	retrieval, error := retrievalConfiguration(cfg, request.RetrievalOptions)
+
+	if error != nil {
+		http.Error(w, error.Error(), http.StatusBadRequest)
+		return
+	}
+
 	// pop the last message as user question
-	userQuestion := messages[len(messages)-1].Content[0].Text
+	userQuestion := messageText(messages[len(messages)-1])
 
-	// invoke bedrock agent runtime to retreive opensearch
-	output, error := client.Retrieve(
-		context.TODO(),
-		&bedrockagentruntime.RetrieveInput{
-			KnowledgeBaseId: aws.String(KNOWLEDGE_BASE_ID),
-			RetrievalQuery: &types.KnowledgeBaseQuery{
-				Text: aws.String(userQuestion),
-			},
-			RetrievalConfiguration: &types.KnowledgeBaseRetrievalConfiguration{
-				VectorSearchConfiguration: &types.KnowledgeBaseVectorSearchConfiguration{
-					NumberOfResults: aws.Int32(KNOWLEDGE_BASE_NUMBER_OF_RESULT),
-				},
-			},
-		},
-	)
+	bases, error := SelectKnowledgeBases(r.Context(), cfg, router, request.KnowledgeBase, userQuestion)
 
 	if error != nil {
-		fmt.Println(error)
+		http.Error(w, error.Error(), http.StatusBadRequest)
+		return
 	}
 
+	// invoke bedrock agent runtime to retreive opensearch
+	output, error := RetrieveFromKnowledgeBases(r.Context(), client, cfg, bases, userQuestion, retrieval)
+
 	if error != nil {
 		fmt.Println(error)
+		http.Error(w, error.Error(), http.StatusBadGateway)
+		return
 	}
 
+	w.Header().Set("X-Knowledge-Bases", strings.Join(bases, ","))
 	json.NewEncoder(w).Encode(output)
 }
 
-func HandleRetrieveAndGenerate(w http.ResponseWriter, r *http.Request, client *bedrockagentruntime.Client) {
+// the conversation of a retrieve and generate request, SessionID continues a
+// bedrock session returned by an earlier answer
+type RetrieveAndGenerateRequest struct {
+	Messages       []Message `json:"messages"`
+	SessionID      string    `json:"sessionId,omitempty"`
+	KnowledgeBase  string    `json:"knowledgeBase,omitempty"`
+	PromptTemplate string    `json:"promptTemplate,omitempty"`
+	RetrievalOptions
+	InferenceParameters
+}
 
-	// parse user messages
-	type Content struct {
-		Type string `json:"type"`
-		Text string `json:"text"`
+// prior messages used to rewrite a follow-up question and the rewrite prompt
+const (
+	rewriteHistoryMessages = 6
+	rewriteMaxTokens       = 256
+	rewriteSystemPrompt    = "You rewrite follow-up questions into standalone search questions. Resolve references such as \"it\" or \"the second one\" from the conversation. Answer with the question only."
+)
+
+// answer the last question of a conversation from the knowledge base, as
+// server-sent events with citations when the client accepts text/event-stream
+//
+// bedrock keeps the conversation of a session, so a request with a sessionId
+// sends only the question; without a session, or when bedrock no longer knows
+// it, a follow-up question is first rewritten into a standalone question from
+// the prior turns. The session id of the answer is in SessionId and the
+// X-Session-Id header. promptTemplate selects a template of the config and
+// the inference parameters of the request override those of the template.
+func HandleRetrieveAndGenerate(w http.ResponseWriter, r *http.Request, client KnowledgeBaseClient, BedrockClient ModelInvoker, router KnowledgeBaseRouter, cfg *Config) {
+
+	var request RetrieveAndGenerateRequest
+
+	err := json.NewDecoder(r.Body).Decode(&request)
+
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	type Message struct {
-		Role    string    `json:"role"`
-		Content []Content `json:"content"`
+	messages := request.Messages
+
+	if len(messages) == 0 || strings.TrimSpace(messageText(messages[len(messages)-1])) == "" {
+		http.Error(w, "the last message must have a question", http.StatusBadRequest)
+		return
 	}
 
-	var request struct {
-		Messages []Message `json:"messages"`
+	retrieval, err := retrievalConfiguration(cfg, request.RetrievalOptions)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	error := json.NewDecoder(r.Body).Decode(&request)
+	template, found, err := cfg.PromptTemplateFor(request.PromptTemplate)
 
-	if error != nil {
-		fmt.Println(error)
+	if err == nil {
+		info, _ := KnowledgeBaseModel(cfg)
+		err = validateKnowledgeBaseParameters(request.InferenceParameters, info.ID)
 	}
 
-	messages := request.Messages
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// pop the last message as user question
-	userQuestion := messages[len(messages)-1].Content[0].Text
+	params := template.Parameters(request.InferenceParameters)
+
+	// stream the answer with citations when the client accepts text/event-stream,
+	// which sends the prior turns to the model instead of a bedrock session
+	if WantsEventStream(r) {
+		if request.SessionID != "" {
+			http.Error(w, "sessionId is not supported for streamed answers, send the prior turns in messages", http.StatusBadRequest)
+			return
+		}
+		text := template.Template
+		if !found {
+			text = defaultPromptTemplate
+		}
+		streamRetrieveAndGenerate(w, r, client, BedrockClient, router, cfg, request.KnowledgeBase, messages, retrieval, text, params)
+		return
+	}
+
+	// pop the last message as user question, a session keeps the context of
+	// follow-up questions and without one the question is rewritten into a
+	// standalone question
+	question := messageText(messages[len(messages)-1])
+
+	if request.SessionID == "" {
+		question = RewriteQuestion(r.Context(), BedrockClient, cfg, messages)
+	}
 
-	// invoke bedrock agent runtime to retrieve and generate
-	output, error := client.RetrieveAndGenerate(
-		context.TODO(),
-		&bedrockagentruntime.RetrieveAndGenerateInput{
+	bases, err := SelectKnowledgeBases(r.Context(), cfg, router, request.KnowledgeBase, question)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// bedrock answers from one knowledge base, the most relevant one
+	knowledgeBaseID := cfg.KnowledgeBaseRegistry()[bases[0]].ID
+	w.Header().Set("X-Knowledge-Bases", bases[0])
+
+	retrieveAndGenerate := func(question string, sessionID string) (*bedrockagentruntime.RetrieveAndGenerateOutput, error) {
+
+		input := &bedrockagentruntime.RetrieveAndGenerateInput{
 			Input: &types.RetrieveAndGenerateInput{
-				Text: aws.String(userQuestion),
+				Text: aws.String(question),
 			},
 			RetrieveAndGenerateConfiguration: &types.RetrieveAndGenerateConfiguration{
 				Type: types.RetrieveAndGenerateTypeKnowledgeBase,
 				KnowledgeBaseConfiguration: &types.KnowledgeBaseRetrieveAndGenerateConfiguration{
-					KnowledgeBaseId: aws.String(KNOWLEDGE_BASE_ID),
-					ModelArn:        aws.String(KNOWLEDGE_BASE_MODEL_ID),
-					RetrievalConfiguration: &types.KnowledgeBaseRetrievalConfiguration{
-						VectorSearchConfiguration: &types.KnowledgeBaseVectorSearchConfiguration{
-							NumberOfResults: aws.Int32(KNOWLEDGE_BASE_NUMBER_OF_RESULT),
-						},
-					},
+					KnowledgeBaseId:         aws.String(knowledgeBaseID),
+					ModelArn:                aws.String(cfg.KnowledgeBaseModelID),
+					RetrievalConfiguration:  retrieval,
+					GenerationConfiguration: generationConfiguration(template, found, params),
 				},
 			},
-		},
-	)
+		}
 
-	if error != nil {
-		fmt.Println(error)
+		if sessionID != "" {
+			input.SessionId = aws.String(sessionID)
+		}
+
+		return client.RetrieveAndGenerate(r.Context(), input)
+	}
+
+	output, err := retrieveAndGenerate(question, request.SessionID)
+
+	if err != nil && request.SessionID != "" && unknownSession(err) {
+		fmt.Printf("session %s: %v, rewriting the question instead\n", request.SessionID, err)
+		output, err = retrieveAndGenerate(RewriteQuestion(r.Context(), BedrockClient, cfg, messages), "")
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	if output.SessionId != nil {
+		w.Header().Set("X-Session-Id", *output.SessionId)
 	}
 
 	// write output to client
+	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(output)
 
 }
+
+// whether bedrock rejected a request for an expired or unknown session,
+// other errors such as a bad filter or model arn are not about the session
+func unknownSession(err error) bool {
+
+	var notFound *types.ResourceNotFoundException
+	var validation *types.ValidationException
+
+	switch {
+	case errors.As(err, &notFound):
+		return strings.Contains(strings.ToLower(notFound.ErrorMessage()), "session")
+	case errors.As(err, &validation):
+		return strings.Contains(strings.ToLower(validation.ErrorMessage()), "session")
+	}
+
+	return false
+}
+
+// the last question of a conversation as a standalone question, rewritten by
+// the default model from up to rewriteHistoryMessages prior messages
+//
+// the question is returned as is when there are no prior turns or the
+// rewrite fails, so retrieval still runs
+func RewriteQuestion(ctx context.Context, BedrockClient ModelInvoker, cfg *Config, messages []Message) string {
+
+	question := strings.TrimSpace(messageText(messages[len(messages)-1]))
+	history := messages[:len(messages)-1]
+
+	if len(history) > rewriteHistoryMessages {
+		history = history[len(history)-rewriteHistoryMessages:]
+	}
+
+	if strings.TrimSpace(transcript(history)) == "" {
+		return question
+	}
+
+	info, adapter, err := cfg.ResolveModel("")
+
+	if err != nil {
+		fmt.Println(err)
+		return question
+	}
+
+	maxTokens := rewriteMaxTokens
+	prompt := fmt.Sprintf("Conversation:\n\n%sFollow-up question: %s", transcript(history), question)
+	params := InferenceParameters{System: rewriteSystemPrompt, MaxTokens: &maxTokens}
+
+	answer, err := generate(ctx, BedrockClient, info, adapter, []Message{{Role: "user", Content: []Content{{Type: "text", Text: prompt}}}}, params)
+
+	if rewritten := strings.TrimSpace(answer.Text); err == nil && rewritten != "" {
+		fmt.Printf("rewrote %q as %q\n", question, rewritten)
+		return rewritten
+	}
+
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	return question
+}
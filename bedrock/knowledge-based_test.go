@@ -0,0 +1,37 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
+)
+
+func TestUnknownSession(t *testing.T) {
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"expired session", &types.ValidationException{Message: aws.String("Session with Id 3f0c is not valid. Please check and try again.")}, true},
+		{"missing session", &types.ResourceNotFoundException{Message: aws.String("Session 3f0c not found")}, true},
+		{"wrapped", fmt.Errorf("operation error: %w", &types.ValidationException{Message: aws.String("invalid sessionId")}), true},
+		{"bad filter", &types.ValidationException{Message: aws.String("The filter value type provided is not supported")}, false},
+		{"bad model arn", &types.ValidationException{Message: aws.String("The provided model identifier is invalid.")}, false},
+		{"missing knowledge base", &types.ResourceNotFoundException{Message: aws.String("Knowledge base X3CHIODXQZ not found")}, false},
+		{"throttled", &types.ThrottlingException{Message: aws.String("Rate exceeded for session")}, false},
+		{"other", errors.New("session"), false},
+	}
+
+	for _, test := range tests {
+		if got := unknownSession(test.err); got != test.want {
+			t.Errorf("%s: unknownSession(%v) = %v, want %v", test.name, test.err, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
+)
+
+// name of the knowledge base of knowledgeBaseId in the registry
+const DefaultKnowledgeBase = "default"
+
+// routers of the config
+const (
+	RouterKeyword = "keyword"
+	RouterModel   = "model"
+)
+
+// the model router prompt
+const (
+	routerMaxTokens    = 64
+	routerSystemPrompt = "You route questions to knowledge bases. Answer with the names of the knowledge bases to search, separated by commas, or none. Answer with the names only."
+)
+
+// a knowledge base of the registry, Description is read by the model router
+// and Keywords are matched by the keyword router
+type KnowledgeBase struct {
+	ID          string   `json:"id" yaml:"id"`
+	Description string   `json:"description,omitempty" yaml:"description"`
+	Keywords    []string `json:"keywords,omitempty" yaml:"keywords"`
+}
+
+// the knowledge bases of the config by name, knowledgeBaseId is registered
+// as DefaultKnowledgeBase
+func (c *Config) KnowledgeBaseRegistry() map[string]KnowledgeBase {
+
+	registry := map[string]KnowledgeBase{DefaultKnowledgeBase: {ID: c.KnowledgeBaseID}}
+
+	for name, base := range c.KnowledgeBases {
+		registry[name] = base
+	}
+
+	return registry
+}
+
+// pick the knowledge bases to search for a question, most relevant first;
+// no names means the default knowledge base
+type KnowledgeBaseRouter interface {
+	Route(ctx context.Context, question string, bases map[string]KnowledgeBase) ([]string, error)
+}
+
+// the router selected by knowledgeBaseRouter, nil when routing is off
+func NewKnowledgeBaseRouter(cfg *Config, BedrockClient ModelInvoker) KnowledgeBaseRouter {
+	switch cfg.KnowledgeBaseRouter {
+	case RouterKeyword:
+		return KeywordRouter{}
+	case RouterModel:
+		return &ModelRouter{BedrockClient: BedrockClient, Config: cfg}
+	default:
+		return nil
+	}
+}
+
+// route to the knowledge bases whose keywords occur in the question, the
+// most matching first
+type KeywordRouter struct{}
+
+func (KeywordRouter) Route(ctx context.Context, question string, bases map[string]KnowledgeBase) ([]string, error) {
+
+	text := normalizeWords(question)
+	matches := map[string]int{}
+
+	for name, base := range bases {
+		for _, keyword := range base.Keywords {
+			if keyword := normalizeWords(keyword); keyword != "  " && strings.Contains(text, keyword) {
+				matches[name]++
+			}
+		}
+	}
+
+	names := make([]string, 0, len(matches))
+
+	for name := range matches {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		if matches[names[i]] != matches[names[j]] {
+			return matches[names[i]] > matches[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	return names, nil
+}
+
+// lower case words separated and surrounded by single spaces, so that
+// keywords match whole words only
+func normalizeWords(text string) string {
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	return " " + strings.Join(words, " ") + " "
+}
+
+// route by asking the default model which of the described knowledge bases
+// answer the question
+type ModelRouter struct {
+	BedrockClient ModelInvoker
+	Config        *Config
+}
+
+func (m *ModelRouter) Route(ctx context.Context, question string, bases map[string]KnowledgeBase) ([]string, error) {
+
+	var names []string
+
+	for name, base := range bases {
+		if base.Description != "" {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	sort.Strings(names)
+
+	var prompt strings.Builder
+
+	prompt.WriteString("Knowledge bases:\n\n")
+
+	for _, name := range names {
+		fmt.Fprintf(&prompt, "- %s: %s\n", name, bases[name].Description)
+	}
+
+	fmt.Fprintf(&prompt, "\nQuestion: %s", question)
+
+	info, adapter, err := m.Config.ResolveModel("")
+
+	if err != nil {
+		return nil, err
+	}
+
+	maxTokens := routerMaxTokens
+	params := InferenceParameters{System: routerSystemPrompt, MaxTokens: &maxTokens}
+
+	answer, err := generate(ctx, m.BedrockClient, info, adapter, []Message{{Role: "user", Content: []Content{{Type: "text", Text: prompt.String()}}}}, params)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// keep the known names in the order of the answer
+	var routed []string
+
+	for _, field := range strings.FieldsFunc(answer.Text, func(r rune) bool { return r == ',' || r == '\n' }) {
+		name := strings.Trim(field, " \t-*`'\".")
+		for _, known := range names {
+			if strings.EqualFold(name, known) && !containsString(routed, known) {
+				routed = append(routed, known)
+			}
+		}
+	}
+
+	return routed, nil
+}
+
+// the knowledge bases to search: the requested one, else those picked by the
+// router, else the default; a failing router falls back to the default
+func SelectKnowledgeBases(ctx context.Context, cfg *Config, router KnowledgeBaseRouter, requested string, question string) ([]string, error) {
+
+	registry := cfg.KnowledgeBaseRegistry()
+
+	if requested != "" {
+		if _, ok := registry[requested]; !ok {
+			return nil, fmt.Errorf("knowledge base %q is not configured", requested)
+		}
+		return []string{requested}, nil
+	}
+
+	if router != nil {
+
+		names, err := router.Route(ctx, question, registry)
+
+		if err != nil {
+			fmt.Printf("route knowledge bases: %v\n", err)
+		}
+
+		if err == nil && len(names) > 0 {
+			fmt.Printf("routed %q to %s\n", question, strings.Join(names, ", "))
+			return names, nil
+		}
+	}
+
+	return []string{DefaultKnowledgeBase}, nil
+}
+
+// retrieve from the knowledge bases concurrently, merge the results by
+// score and drop duplicate chunks, keeping at most the configured number
+// of results; failing knowledge bases are skipped unless all fail
+func RetrieveFromKnowledgeBases(ctx context.Context, client KnowledgeBaseClient, cfg *Config, names []string, query string, retrieval *types.KnowledgeBaseRetrievalConfiguration) (*bedrockagentruntime.RetrieveOutput, error) {
+
+	registry := cfg.KnowledgeBaseRegistry()
+
+	outputs := make([]*bedrockagentruntime.RetrieveOutput, len(names))
+	errs := make([]error, len(names))
+
+	var wg sync.WaitGroup
+
+	for k, name := range names {
+		wg.Add(1)
+		go func(k int, name string) {
+			defer wg.Done()
+			outputs[k], errs[k] = client.Retrieve(ctx, &bedrockagentruntime.RetrieveInput{
+				KnowledgeBaseId:        aws.String(registry[name].ID),
+				RetrievalQuery:         &types.KnowledgeBaseQuery{Text: aws.String(query)},
+				RetrievalConfiguration: retrieval,
+			})
+			if errs[k] != nil {
+				errs[k] = fmt.Errorf("knowledge base %s: %w", name, errs[k])
+			}
+		}(k, name)
+	}
+
+	wg.Wait()
+
+	if len(names) == 1 {
+		return outputs[0], errs[0]
+	}
+
+	var results []types.KnowledgeBaseRetrievalResult
+	failed := 0
+
+	for k := range names {
+		if errs[k] != nil {
+			fmt.Println(errs[k])
+			failed++
+			continue
+		}
+		results = append(results, outputs[k].RetrievalResults...)
+	}
+
+	if failed == len(names) {
+		return nil, errors.Join(errs...)
+	}
+
+	limit := cfg.KnowledgeBaseNumberOfResult
+
+	if retrieval != nil && retrieval.VectorSearchConfiguration != nil && retrieval.VectorSearchConfiguration.NumberOfResults != nil {
+		limit = int(*retrieval.VectorSearchConfiguration.NumberOfResults)
+	}
+
+	return &bedrockagentruntime.RetrieveOutput{RetrievalResults: mergeRetrievalResults(results, limit)}, nil
+}
+
+// results sorted by score, highest first, without repeated chunks
+func mergeRetrievalResults(results []types.KnowledgeBaseRetrievalResult, limit int) []types.KnowledgeBaseRetrievalResult {
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return aws.ToFloat64(results[i].Score) > aws.ToFloat64(results[j].Score)
+	})
+
+	seen := map[string]bool{}
+	merged := []types.KnowledgeBaseRetrievalResult{}
+
+	for _, result := range results {
+
+		var key strings.Builder
+
+		if result.Location != nil && result.Location.S3Location != nil {
+			key.WriteString(aws.ToString(result.Location.S3Location.Uri))
+		}
+
+		key.WriteString("\x00")
+
+		if result.Content != nil {
+			key.WriteString(strings.TrimSpace(aws.ToString(result.Content.Text)))
+		}
+
+		if seen[key.String()] {
+			continue
+		}
+
+		seen[key.String()] = true
+		merged = append(merged, result)
+
+		if len(merged) == limit {
+			break
+		}
+	}
+
+	return merged
+}
@@ -0,0 +1,239 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
+)
+
+func TestKeywordRouter(t *testing.T) {
+
+	bases := map[string]KnowledgeBase{
+		DefaultKnowledgeBase: {ID: "KB0"},
+		"hr":                 {ID: "KB1", Keywords: []string{"leave", "Payroll", "free tier"}},
+		"it":                 {ID: "KB2", Keywords: []string{"laptop", "vpn", "payroll"}},
+		"blank":              {ID: "KB3", Keywords: []string{"", " - "}},
+	}
+
+	tests := []struct {
+		question string
+		want     []string
+	}{
+		{"how do I connect to the VPN?", []string{"it"}},
+		{"no match here", []string{}},
+		{"", []string{}},
+		// whole words only
+		{"my laptops and leaves", []string{}},
+		{"free-tier limits", []string{"hr"}},
+		{"free tiers", []string{}},
+		// the most matching first, then by name
+		{"payroll", []string{"hr", "it"}},
+		{"payroll on leave", []string{"hr", "it"}},
+		{"payroll on my laptop over vpn", []string{"it", "hr"}},
+	}
+
+	for _, test := range tests {
+
+		got, err := KeywordRouter{}.Route(context.Background(), test.question, bases)
+
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %q, %v, want %q", test.question, got, err, test.want)
+		}
+	}
+}
+
+func TestModelRouter(t *testing.T) {
+
+	bases := map[string]KnowledgeBase{
+		DefaultKnowledgeBase: {ID: "KB0"},
+		"hr":                 {ID: "KB1", Description: "human resources"},
+		"it":                 {ID: "KB2", Description: "laptops and networks"},
+		"legal":              {ID: "KB3"},
+	}
+
+	tests := []struct {
+		name   string
+		answer string
+		want   []string
+	}{
+		{name: "names", answer: "hr, it", want: []string{"hr", "it"}},
+		{name: "order of the answer", answer: "it,hr", want: []string{"it", "hr"}},
+		{name: "list", answer: "- `IT`\n- \"hr\".", want: []string{"it", "hr"}},
+		{name: "unknown name", answer: "finance, hr", want: []string{"hr"}},
+		{name: "duplicate names", answer: "hr, HR, it, hr", want: []string{"hr", "it"}},
+		// only described knowledge bases are routed to
+		{name: "undescribed names", answer: "legal, default"},
+		{name: "none", answer: "none"},
+		{name: "empty answer", answer: ""},
+		{name: "white space", answer: " ,\n, "},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			cfg := DefaultConfig()
+			client := &FakeModelInvoker{Deltas: []string{test.answer}}
+
+			got, err := (&ModelRouter{BedrockClient: client, Config: &cfg}).Route(context.Background(), "where is my laptop?", bases)
+
+			if err != nil || !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, %v, want %q", got, err, test.want)
+			}
+
+			var request RequestBodyClaude3
+			decodeBody(t, client.Bodies()[0], &request)
+
+			want := "Knowledge bases:\n\n- hr: human resources\n- it: laptops and networks\n\nQuestion: where is my laptop?"
+
+			if request.System != routerSystemPrompt || request.MaxTokensToSample != routerMaxTokens || len(request.Messages) != 1 || request.Messages[0].Content[0].Text != want {
+				t.Errorf("got request %+v", request)
+			}
+		})
+	}
+
+	cfg := DefaultConfig()
+
+	// without descriptions the model is not asked
+	client := &FakeModelInvoker{Deltas: []string{"default"}}
+
+	if got, err := (&ModelRouter{BedrockClient: client, Config: &cfg}).Route(context.Background(), "hi", map[string]KnowledgeBase{"legal": {ID: "KB3"}}); got != nil || err != nil || len(client.Bodies()) != 0 {
+		t.Errorf("got %q, %v and %d calls without descriptions", got, err, len(client.Bodies()))
+	}
+
+	client = &FakeModelInvoker{Err: errors.New("throttled")}
+
+	if _, err := (&ModelRouter{BedrockClient: client, Config: &cfg}).Route(context.Background(), "hi", bases); err == nil || err.Error() != "throttled" {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestSelectKnowledgeBases(t *testing.T) {
+
+	cfg := DefaultConfig()
+	cfg.KnowledgeBases = map[string]KnowledgeBase{"it": {ID: "KB2", Keywords: []string{"vpn"}}}
+
+	tests := []struct {
+		name      string
+		router    KnowledgeBaseRouter
+		requested string
+		want      []string
+		err       string
+	}{
+		{name: "no router", want: []string{DefaultKnowledgeBase}},
+		{name: "requested", router: KeywordRouter{}, requested: "it", want: []string{"it"}},
+		{name: "requested default", router: KeywordRouter{}, requested: DefaultKnowledgeBase, want: []string{DefaultKnowledgeBase}},
+		{name: "unknown", requested: "hr", err: `knowledge base "hr" is not configured`},
+		{name: "routed", router: KeywordRouter{}, want: []string{"it"}},
+		{name: "failing router", router: &ModelRouter{BedrockClient: &FakeModelInvoker{Err: errors.New("throttled")}, Config: &cfg}, want: []string{DefaultKnowledgeBase}},
+	}
+
+	for _, test := range tests {
+
+		got, err := SelectKnowledgeBases(context.Background(), &cfg, test.router, test.requested, "is the vpn down?")
+
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+}
+
+// a retrieval result of a chunk of a document with a score
+func retrievalResult(uri, text string, score float64) types.KnowledgeBaseRetrievalResult {
+	return types.KnowledgeBaseRetrievalResult{
+		Content:  &types.RetrievalResultContent{Text: aws.String(text)},
+		Location: &types.RetrievalResultLocation{S3Location: &types.RetrievalResultS3Location{Uri: aws.String(uri)}},
+		Score:    aws.Float64(score),
+	}
+}
+
+// results as uri, text and score, for comparing
+func retrievalResultStrings(results []types.KnowledgeBaseRetrievalResult) []string {
+
+	strs := make([]string, 0, len(results))
+
+	for _, result := range results {
+		strs = append(strs, fmt.Sprintf("%s %s %.1f", aws.ToString(result.Location.S3Location.Uri), strings.TrimSpace(aws.ToString(result.Content.Text)), aws.ToFloat64(result.Score)))
+	}
+
+	return strs
+}
+
+func TestMergeRetrievalResults(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		results []types.KnowledgeBaseRetrievalResult
+		limit   int
+		want    []string
+	}{
+		{name: "none", limit: 5, want: []string{}},
+		{
+			name:    "by score",
+			results: []types.KnowledgeBaseRetrievalResult{retrievalResult("s3://a", "a", 0.2), retrievalResult("s3://b", "b", 0.9), retrievalResult("s3://c", "c", 0.5)},
+			limit:   5,
+			want:    []string{"s3://b b 0.9", "s3://c c 0.5", "s3://a a 0.2"},
+		},
+		{
+			name:    "equal scores keep their order",
+			results: []types.KnowledgeBaseRetrievalResult{retrievalResult("s3://b", "b", 0.5), retrievalResult("s3://a", "a", 0.5), retrievalResult("s3://c", "c", 0.5)},
+			limit:   5,
+			want:    []string{"s3://b b 0.5", "s3://a a 0.5", "s3://c c 0.5"},
+		},
+		{
+			// the same chunk from two knowledge bases, kept with its best score
+			name:    "duplicates",
+			results: []types.KnowledgeBaseRetrievalResult{retrievalResult("s3://a", "chunk", 0.4), retrievalResult("s3://b", "other", 0.6), retrievalResult("s3://a", " chunk\n", 0.8)},
+			limit:   5,
+			want:    []string{"s3://a chunk 0.8", "s3://b other 0.6"},
+		},
+		{
+			name:    "same text of other documents",
+			results: []types.KnowledgeBaseRetrievalResult{retrievalResult("s3://a", "chunk", 0.4), retrievalResult("s3://b", "chunk", 0.6)},
+			limit:   5,
+			want:    []string{"s3://b chunk 0.6", "s3://a chunk 0.4"},
+		},
+		{
+			name:    "limit",
+			results: []types.KnowledgeBaseRetrievalResult{retrievalResult("s3://a", "a", 0.1), retrievalResult("s3://b", "b", 0.9), retrievalResult("s3://c", "c", 0.5)},
+			limit:   2,
+			want:    []string{"s3://b b 0.9", "s3://c c 0.5"},
+		},
+		{
+			// duplicates do not count towards the limit
+			name:    "limit after duplicates",
+			results: []types.KnowledgeBaseRetrievalResult{retrievalResult("s3://a", "a", 0.9), retrievalResult("s3://a", "a", 0.8), retrievalResult("s3://b", "b", 0.7), retrievalResult("s3://c", "c", 0.6)},
+			limit:   2,
+			want:    []string{"s3://a a 0.9", "s3://b b 0.7"},
+		},
+	}
+
+	for _, test := range tests {
+
+		got := retrievalResultStrings(mergeRetrievalResults(test.results, test.limit))
+
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	// results without a location or content are merged too
+	if got := mergeRetrievalResults([]types.KnowledgeBaseRetrievalResult{{}, {}, {Score: aws.Float64(1)}}, 5); len(got) != 1 {
+		t.Errorf("got %d results without location or content, want 1", len(got))
+	}
+}
@@ -0,0 +1,619 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ledongthuc/pdf"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// formats of loaded files
+const (
+	FormatPDF      = "pdf"
+	FormatMarkdown = "markdown"
+	FormatHTML     = "html"
+	FormatDOCX     = "docx"
+	FormatText     = "text"
+)
+
+// largest multipart upload, all files together
+const maxUploadBody = 64 << 20
+
+// largest uncompressed part of a docx file and largest text of a pdf, a few
+// megabytes of deflated zeros would otherwise fill the memory
+const maxLoadedText = 32 << 20
+
+// the text and metadata read from a file, Title falls back to the file name
+type LoadedDocument struct {
+	Name     string            `json:"name"`
+	Format   string            `json:"format"`
+	Title    string            `json:"title"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Text     string            `json:"-"`
+}
+
+// the note of a loaded document, linked to link or else to its file name;
+// its id hashes the link with the file name and text, as the files of one
+// upload share a link and files of the same name in other folders a name
+func (d LoadedDocument) IndexItem(link string) IndexItem {
+
+	if link == "" {
+		link = d.Name
+	}
+
+	sum := sha256.Sum256([]byte(link + "\x00" + d.Name + "\x00" + d.Text))
+
+	return IndexItem{ID: hex.EncodeToString(sum[:8]), Title: d.Title, Link: link, Text: d.Text}
+}
+
+// loaders by file extension, each reads the text of a file into a document
+// and fills its title and metadata
+var loaders = map[string]struct {
+	format string
+	load   func(data []byte, document *LoadedDocument) error
+}{
+	".pdf":      {FormatPDF, loadPDF},
+	".md":       {FormatMarkdown, loadMarkdown},
+	".markdown": {FormatMarkdown, loadMarkdown},
+	".html":     {FormatHTML, loadHTML},
+	".htm":      {FormatHTML, loadHTML},
+	".docx":     {FormatDOCX, loadDOCX},
+	".txt":      {FormatText, loadText},
+}
+
+// a file of a format with a loader
+func IsLoadable(name string) bool {
+	_, ok := loaders[strings.ToLower(filepath.Ext(name))]
+	return ok
+}
+
+// read the text, title and metadata of a file, the format is given by the
+// extension of its name
+func LoadFile(name string, data []byte) (document LoadedDocument, err error) {
+
+	loader, ok := loaders[strings.ToLower(filepath.Ext(name))]
+
+	if !ok {
+		return LoadedDocument{}, fmt.Errorf("%s: unsupported file type, want pdf, md, html, docx or txt", name)
+	}
+
+	document = LoadedDocument{Name: filepath.Base(name), Format: loader.format, Metadata: map[string]string{}}
+
+	// the pdf reader panics on some malformed files
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s: unreadable %s: %v", name, loader.format, r)
+		}
+	}()
+
+	if err := loader.load(data, &document); err != nil {
+		return LoadedDocument{}, fmt.Errorf("%s: %w", name, err)
+	}
+
+	document.Text = cleanText(document.Text)
+	document.Title = strings.Join(strings.Fields(document.Title), " ")
+
+	if document.Title == "" {
+		document.Title = strings.TrimSuffix(document.Name, filepath.Ext(document.Name))
+	}
+
+	if document.Text == "" {
+		return LoadedDocument{}, fmt.Errorf("%s: no text found", name)
+	}
+
+	return document, nil
+}
+
+var (
+	blankLines  = regexp.MustCompile(`\n{3,}`)
+	lineSpacing = regexp.MustCompile(`[ \t\f\v\x{00a0}]+`)
+)
+
+// single spaces within lines, at most one blank line between paragraphs
+func cleanText(text string) string {
+
+	text = strings.ReplaceAll(strings.ToValidUTF8(text, ""), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+
+	lines := strings.Split(text, "\n")
+
+	for k, line := range lines {
+		lines[k] = strings.TrimSpace(lineSpacing.ReplaceAllString(line, " "))
+	}
+
+	return strings.TrimSpace(blankLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
+
+func loadText(data []byte, document *LoadedDocument) error {
+	document.Text = string(data)
+	return nil
+}
+
+var (
+	frontMatter     = regexp.MustCompile(`(?s)\A---\r?\n(.*?)\r?\n---\r?\n`)
+	frontMatterLine = regexp.MustCompile(`^([A-Za-z_][\w-]*):\s*(.*?)\s*$`)
+	markdownImage   = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	markdownLink    = regexp.MustCompile(`\[([^\]]+)\]\([^)]*\)`)
+	markdownTitle   = regexp.MustCompile(`(?m)^#[ \t]+(.+?)[ \t#]*$`)
+)
+
+// markdown keeps its headings for the markdown chunking strategy, links and
+// images are reduced to their text and the front matter becomes metadata
+func loadMarkdown(data []byte, document *LoadedDocument) error {
+
+	text := string(data)
+
+	if match := frontMatter.FindStringSubmatch(text); match != nil {
+		for _, line := range strings.Split(match[1], "\n") {
+			if field := frontMatterLine.FindStringSubmatch(line); field != nil && field[2] != "" {
+				document.Metadata[strings.ToLower(field[1])] = strings.Trim(field[2], `"'`)
+			}
+		}
+		text = text[len(match[0]):]
+	}
+
+	text = markdownImage.ReplaceAllString(text, "$1")
+	text = markdownLink.ReplaceAllString(text, "$1")
+
+	document.Title = document.Metadata["title"]
+	delete(document.Metadata, "title")
+
+	if match := markdownTitle.FindStringSubmatch(text); document.Title == "" && match != nil {
+		document.Title = match[1]
+	}
+
+	document.Text = text
+
+	return nil
+}
+
+// html elements whose text is not content
+var skippedElements = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Noscript: true,
+	atom.Template: true,
+	atom.Head:     true,
+	atom.Nav:      true,
+	atom.Svg:      true,
+	atom.Iframe:   true,
+}
+
+// html elements ending a line of text
+var blockElements = map[atom.Atom]bool{
+	atom.P: true, atom.Div: true, atom.Br: true, atom.Li: true, atom.Tr: true,
+	atom.Section: true, atom.Article: true, atom.Header: true, atom.Footer: true,
+	atom.Blockquote: true, atom.Pre: true, atom.Table: true, atom.Ul: true, atom.Ol: true,
+	atom.Dl: true, atom.Dt: true, atom.Dd: true, atom.Hr: true, atom.Figcaption: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+}
+
+var htmlSpace = regexp.MustCompile(`[ \t\r\n\f]+`)
+
+var headingLevels = map[atom.Atom]int{atom.H1: 1, atom.H2: 2, atom.H3: 3, atom.H4: 4, atom.H5: 5, atom.H6: 6}
+
+// the text of the body, headings written as markdown headings so the
+// markdown chunking strategy can use them; title and meta description,
+// author and keywords become the title and metadata
+func loadHTML(data []byte, document *LoadedDocument) error {
+
+	root, err := html.Parse(bytes.NewReader(data))
+
+	if err != nil {
+		return err
+	}
+
+	var text strings.Builder
+	var h1 string
+	pre := 0
+
+	var walk func(n *html.Node)
+
+	walk = func(n *html.Node) {
+
+		if n.Type == html.ElementNode {
+			switch n.DataAtom {
+			case atom.Title:
+				if document.Title == "" {
+					document.Title = nodeText(n)
+				}
+				return
+			case atom.Meta:
+				name, content := strings.ToLower(attribute(n, "name")), attribute(n, "content")
+				if (name == "description" || name == "author" || name == "keywords") && content != "" {
+					document.Metadata[name] = content
+				}
+				return
+			}
+			if skippedElements[n.DataAtom] {
+				// the head is skipped for its text, not for its title and meta
+				if n.DataAtom == atom.Head {
+					for c := n.FirstChild; c != nil; c = c.NextSibling {
+						if c.DataAtom == atom.Title || c.DataAtom == atom.Meta {
+							walk(c)
+						}
+					}
+				}
+				return
+			}
+			if level, ok := headingLevels[n.DataAtom]; ok {
+				heading := strings.Join(strings.Fields(nodeText(n)), " ")
+				if h1 == "" && level == 1 {
+					h1 = heading
+				}
+				fmt.Fprintf(&text, "\n\n%s %s\n\n", strings.Repeat("#", level), heading)
+				return
+			}
+		}
+
+		// white space is collapsed as browsers do, except in pre
+		if n.Type == html.TextNode && pre > 0 {
+			text.WriteString(n.Data)
+		} else if n.Type == html.TextNode {
+			text.WriteString(htmlSpace.ReplaceAllString(n.Data, " "))
+		}
+
+		if n.DataAtom == atom.Pre {
+			pre++
+			defer func() { pre-- }()
+		}
+
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+
+		if n.Type == html.ElementNode && blockElements[n.DataAtom] {
+			text.WriteString("\n\n")
+		}
+	}
+
+	walk(root)
+
+	if document.Title == "" {
+		document.Title = h1
+	}
+
+	document.Text = text.String()
+
+	return nil
+}
+
+func nodeText(n *html.Node) string {
+
+	var text strings.Builder
+
+	var walk func(n *html.Node)
+
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			text.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+
+	walk(n)
+
+	return text.String()
+}
+
+func attribute(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if strings.EqualFold(a.Key, key) {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// the text of the pages separated by blank lines, title, author and subject
+// from the document information
+func loadPDF(data []byte, document *LoadedDocument) error {
+
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+
+	if err != nil {
+		return err
+	}
+
+	info := reader.Trailer().Key("Info")
+
+	document.Title = info.Key("Title").Text()
+
+	for _, key := range []string{"Author", "Subject", "Keywords"} {
+		if value := strings.TrimSpace(info.Key(key).Text()); value != "" {
+			document.Metadata[strings.ToLower(key)] = value
+		}
+	}
+
+	document.Metadata["pages"] = strconv.Itoa(reader.NumPage())
+
+	var text strings.Builder
+
+	// the fonts are shared by pages, reading them once is faster
+	fonts := map[string]*pdf.Font{}
+
+	for k := 1; k <= reader.NumPage(); k++ {
+
+		page := reader.Page(k)
+
+		if page.V.IsNull() {
+			continue
+		}
+
+		for _, name := range page.Fonts() {
+			if _, ok := fonts[name]; !ok {
+				font := page.Font(name)
+				fonts[name] = &font
+			}
+		}
+
+		content, err := page.GetPlainText(fonts)
+
+		if err != nil {
+			return fmt.Errorf("page %d: %w", k, err)
+		}
+
+		text.WriteString(content)
+		text.WriteString("\n\n")
+
+		if text.Len() > maxLoadedText {
+			return fmt.Errorf("text is larger than %d bytes at page %d", maxLoadedText, k)
+		}
+	}
+
+	document.Text = text.String()
+
+	return nil
+}
+
+// the paragraphs of word/document.xml, title, creator and subject from
+// docProps/core.xml
+func loadDOCX(data []byte, document *LoadedDocument) error {
+
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+
+	if err != nil {
+		return err
+	}
+
+	var body, core *zip.File
+
+	for _, file := range archive.File {
+		switch file.Name {
+		case "word/document.xml":
+			body = file
+		case "docProps/core.xml":
+			core = file
+		}
+	}
+
+	if body == nil {
+		return errors.New("word/document.xml is missing")
+	}
+
+	if core != nil {
+		if err := readDOCXProperties(core, document); err != nil {
+			return err
+		}
+	}
+
+	content, err := readZipFile(body)
+
+	if err != nil {
+		return err
+	}
+
+	var text strings.Builder
+
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	inText := false
+
+	for {
+		token, err := decoder.Token()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab":
+				text.WriteString("\t")
+			case "br", "cr":
+				text.WriteString("\n")
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				text.WriteString("\n\n")
+			}
+		case xml.CharData:
+			if inText {
+				text.Write(t)
+			}
+		}
+	}
+
+	document.Text = text.String()
+
+	return nil
+}
+
+func readDOCXProperties(file *zip.File, document *LoadedDocument) error {
+
+	content, err := readZipFile(file)
+
+	if err != nil {
+		return err
+	}
+
+	var properties struct {
+		Title       string `xml:"title"`
+		Creator     string `xml:"creator"`
+		Subject     string `xml:"subject"`
+		Description string `xml:"description"`
+		Keywords    string `xml:"keywords"`
+	}
+
+	if err := xml.NewDecoder(bytes.NewReader(content)).Decode(&properties); err != nil {
+		return fmt.Errorf("docProps/core.xml: %w", err)
+	}
+
+	document.Title = properties.Title
+
+	for key, value := range map[string]string{
+		"author":      properties.Creator,
+		"subject":     properties.Subject,
+		"description": properties.Description,
+		"keywords":    properties.Keywords,
+	} {
+		if value = strings.TrimSpace(value); value != "" {
+			document.Metadata[key] = value
+		}
+	}
+
+	return nil
+}
+
+// the uncompressed content of a file of a zip archive, failing when it is
+// larger than maxLoadedText whatever size its header claims
+func readZipFile(file *zip.File) ([]byte, error) {
+
+	content, err := file.Open()
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer content.Close()
+
+	data, err := io.ReadAll(io.LimitReader(content, maxLoadedText+1))
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file.Name, err)
+	}
+
+	if len(data) > maxLoadedText {
+		return nil, fmt.Errorf("%s is larger than %d bytes uncompressed", file.Name, maxLoadedText)
+	}
+
+	return data, nil
+}
+
+// a file of an upload and what became of it
+type UploadedFile struct {
+	LoadedDocument
+	Characters int    `json:"characters,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// index uploaded files, each file becomes a note which is split into chunks
+// like any other
+//
+//	POST /aoss-upload  multipart/form-data with one or more file fields
+//
+// a link field links the notes to a url instead of their file names, files
+// which cannot be read are listed with their error and left out
+func HandleAOSSUpload(w http.ResponseWriter, r *http.Request, AOSSClient VectorStore, BedrockClient ModelInvoker, cfg *Config) {
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadBody)
+
+	if err := r.ParseMultipartForm(8 << 20); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	defer r.MultipartForm.RemoveAll()
+
+	headers := r.MultipartForm.File["file"]
+
+	if len(headers) == 0 {
+		http.Error(w, "no file uploaded, send files in file fields", http.StatusBadRequest)
+		return
+	}
+
+	link := r.FormValue("link")
+
+	var files []UploadedFile
+	var items []IndexItem
+
+	for _, header := range headers {
+
+		file := UploadedFile{LoadedDocument: LoadedDocument{Name: header.Filename}}
+
+		document, err := loadUpload(header)
+
+		if err != nil {
+			file.Error = err.Error()
+			files = append(files, file)
+			continue
+		}
+
+		file.LoadedDocument = document
+		file.Characters = len([]rune(document.Text))
+		files = append(files, file)
+		items = append(items, document.IndexItem(link))
+	}
+
+	if len(items) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"files": files})
+		return
+	}
+
+	report := Ingest(r.Context(), AOSSClient, BedrockClient, cfg, items)
+
+	fmt.Printf("upload: %d files, %d indexed, %d failed\n", len(files), report.Indexed, report.Failed)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"files": files, "report": report})
+}
+
+func loadUpload(header *multipart.FileHeader) (LoadedDocument, error) {
+
+	file, err := header.Open()
+
+	if err != nil {
+		return LoadedDocument{}, err
+	}
+
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+
+	if err != nil {
+		return LoadedDocument{}, err
+	}
+
+	return LoadFile(header.Filename, data)
+}
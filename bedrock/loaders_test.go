@@ -0,0 +1,174 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadedDocumentIndexItem(t *testing.T) {
+
+	faq := LoadedDocument{Name: "faq.md", Title: "FAQ", Text: "questions"}
+	handbook := LoadedDocument{Name: "handbook.pdf", Title: "Handbook", Text: "rules"}
+
+	// README.md of two folders
+	readme := LoadedDocument{Name: "README.md", Title: "README", Text: "one"}
+	other := LoadedDocument{Name: "README.md", Title: "README", Text: "two"}
+
+	tests := []struct {
+		name string
+		a, b IndexItem
+		same bool
+	}{
+		{"files of one upload", faq.IndexItem("https://example.com"), handbook.IndexItem("https://example.com"), false},
+		{"same name without link", readme.IndexItem(""), other.IndexItem(""), false},
+		{"same file and link", faq.IndexItem("https://example.com"), faq.IndexItem("https://example.com"), true},
+		{"same file, other link", faq.IndexItem("https://a.example"), faq.IndexItem("https://b.example"), false},
+	}
+
+	cfg := DefaultConfig()
+
+	for _, test := range tests {
+
+		a, b := DocumentID(test.a), DocumentID(test.b)
+
+		if (a == b) != test.same {
+			t.Errorf("%s: ids %s and %s, want same %v", test.name, a, b, test.same)
+		}
+
+		chunks := ChunkItem(test.a, cfg.ChunkOptions())
+
+		if len(chunks) == 0 {
+			t.Fatalf("%s: no chunks", test.name)
+		}
+
+		for _, chunk := range chunks {
+			if chunk.ParentID != a {
+				t.Errorf("%s: chunk parent_id %s, want %s", test.name, chunk.ParentID, a)
+			}
+		}
+	}
+
+	if item := faq.IndexItem(""); item.Link != "faq.md" {
+		t.Errorf("link %q, want the file name", item.Link)
+	}
+}
+
+// a zip archive of the files in order, each a name and the readers of its
+// content
+func zipFile(t *testing.T, files ...interface{}) []byte {
+
+	t.Helper()
+
+	var data bytes.Buffer
+
+	archive := zip.NewWriter(&data)
+
+	for k := 0; k < len(files); k += 2 {
+
+		file, err := archive.Create(files[k].(string))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := io.Copy(file, files[k+1].(io.Reader)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return data.Bytes()
+}
+
+func TestLoadDOCX(t *testing.T) {
+
+	const (
+		body = `<w:document xmlns:w="w"><w:body><w:p><w:r><w:t>First</w:t><w:tab/><w:t>line</w:t><w:br/><w:t>second line</w:t></w:r></w:p><w:p><w:r><w:t>Next paragraph</w:t></w:r></w:p></w:body></w:document>`
+		core = `<cp:coreProperties xmlns:cp="cp" xmlns:dc="dc"><dc:title>Handbook</dc:title><dc:creator>HR</dc:creator><cp:keywords> leave </cp:keywords></cp:coreProperties>`
+	)
+
+	// more than maxLoadedText bytes once inflated, a few kilobytes deflated
+	huge := func(prefix, suffix string) io.Reader {
+		return io.MultiReader(strings.NewReader(prefix), io.LimitReader(zeros{}, maxLoadedText), strings.NewReader(suffix))
+	}
+
+	tests := []struct {
+		name     string
+		data     []byte
+		text     string
+		title    string
+		metadata map[string]string
+		err      string
+	}{
+		{
+			name:     "document",
+			data:     zipFile(t, "word/document.xml", strings.NewReader(body), "docProps/core.xml", strings.NewReader(core)),
+			text:     "First line\nsecond line\n\nNext paragraph",
+			title:    "Handbook",
+			metadata: map[string]string{"author": "HR", "keywords": "leave"},
+		},
+		{
+			name:     "no properties",
+			data:     zipFile(t, "word/document.xml", strings.NewReader(body)),
+			text:     "First line\nsecond line\n\nNext paragraph",
+			title:    "handbook",
+			metadata: map[string]string{},
+		},
+		{name: "no document", data: zipFile(t, "docProps/core.xml", strings.NewReader(core)), err: "docs/handbook.docx: word/document.xml is missing"},
+		{name: "not a zip", data: []byte("plain text"), err: "docs/handbook.docx: zip: not a valid zip file"},
+		{name: "bad properties", data: zipFile(t, "word/document.xml", strings.NewReader(body), "docProps/core.xml", strings.NewReader("<cp:coreProperties>")), err: "docs/handbook.docx: docProps/core.xml: XML syntax error on line 1: unexpected EOF"},
+		{
+			name: "oversized document",
+			data: zipFile(t, "word/document.xml", huge(`<w:document xmlns:w="w"><w:body><w:p><w:r><w:t>`, `</w:t></w:r></w:p></w:body></w:document>`)),
+			err:  fmt.Sprintf("docs/handbook.docx: word/document.xml is larger than %d bytes uncompressed", maxLoadedText),
+		},
+		{
+			name: "oversized properties",
+			data: zipFile(t, "word/document.xml", strings.NewReader(body), "docProps/core.xml", huge(`<cp:coreProperties xmlns:cp="cp"><cp:keywords>`, `</cp:keywords></cp:coreProperties>`)),
+			err:  fmt.Sprintf("docs/handbook.docx: docProps/core.xml is larger than %d bytes uncompressed", maxLoadedText),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			document, err := LoadFile("docs/handbook.docx", test.data)
+
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if document.Name != "handbook.docx" || document.Format != FormatDOCX || document.Text != test.text || document.Title != test.title || !reflect.DeepEqual(document.Metadata, test.metadata) {
+				t.Errorf("got %+v %q", document, document.Text)
+			}
+		})
+	}
+}
+
+// an endless reader of the character 0
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for k := range p {
+		p[k] = '0'
+	}
+	return len(p), nil
+}
@@ -0,0 +1,242 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// capabilities of a model as served by this application
+type ModelInfo struct {
+	ID              string `json:"id"`
+	Family          string `json:"family"`
+	Vision          bool   `json:"vision"`
+	Streaming       bool   `json:"streaming"`
+	MaxContext      int    `json:"maxContext"`
+	MaxOutputTokens int    `json:"maxOutputTokens"`
+	Default         bool   `json:"default"`
+	Converse        bool   `json:"converse"`
+}
+
+// one parsed chunk or response of any model family, fields the model did
+// not report are left zero
+type ModelChunk struct {
+	Text         string
+	StopReason   string
+	InputTokens  int
+	OutputTokens int
+}
+
+// build request bodies and parse responses of one model family
+type ModelAdapter interface {
+	// limits of the inference parameters shared by the family
+	Limits() ModelLimits
+
+	// request body for InvokeModel and InvokeModelWithResponseStream
+	BuildRequest(messages []Message, params InferenceParameters) ([]byte, error)
+
+	// parse one chunk of InvokeModelWithResponseStream
+	ParseChunk(chunk []byte) (ModelChunk, error)
+
+	// parse the body returned by InvokeModel
+	ParseResponse(body []byte) (ModelChunk, error)
+}
+
+// adapters by family, the family is the provider part of the model id
+var (
+	modelAdaptersMu sync.RWMutex
+	modelAdapters   = map[string]ModelAdapter{
+		"anthropic":    claude3Adapter{},
+		"meta":         llamaAdapter{},
+		"mistral":      mistralAdapter{},
+		"amazon.titan": titanTextAdapter{},
+		"amazon.nova":  novaAdapter{},
+		"cohere":       cohereAdapter{},
+	}
+)
+
+// register an adapter for a model family such as anthropic or amazon.nova,
+// replacing any adapter already registered for it
+func RegisterModelAdapter(family string, adapter ModelAdapter) {
+	modelAdaptersMu.Lock()
+	defer modelAdaptersMu.Unlock()
+	modelAdapters[family] = adapter
+}
+
+// family of a model id, the longest registered family prefix wins so that
+// amazon.nova and amazon.titan are told apart
+func ModelFamily(modelID string) string {
+
+	modelID = BaseModelID(modelID)
+
+	modelAdaptersMu.RLock()
+	defer modelAdaptersMu.RUnlock()
+
+	best := ""
+
+	for family := range modelAdapters {
+		if (modelID == family || strings.HasPrefix(modelID, family+".") || strings.HasPrefix(modelID, family+"-")) && len(family) > len(best) {
+			best = family
+		}
+	}
+
+	return best
+}
+
+// adapter for a model id
+func AdapterForModel(modelID string) (ModelAdapter, error) {
+
+	family := ModelFamily(modelID)
+
+	modelAdaptersMu.RLock()
+	defer modelAdaptersMu.RUnlock()
+
+	adapter, ok := modelAdapters[family]
+
+	if !ok {
+		return nil, fmt.Errorf("no adapter for model %q", modelID)
+	}
+
+	return adapter, nil
+}
+
+// capabilities of known models by base model id prefix, longest prefix wins
+var modelCatalogue = map[string]ModelInfo{
+	"anthropic.claude-3-haiku":    {Vision: true, Streaming: true, MaxContext: 200000, MaxOutputTokens: 4096},
+	"anthropic.claude-3-sonnet":   {Vision: true, Streaming: true, MaxContext: 200000, MaxOutputTokens: 4096},
+	"anthropic.claude-3-opus":     {Vision: true, Streaming: true, MaxContext: 200000, MaxOutputTokens: 4096},
+	"anthropic.claude-3-5-haiku":  {Vision: false, Streaming: true, MaxContext: 200000, MaxOutputTokens: 8192},
+	"anthropic.claude-3-5-sonnet": {Vision: true, Streaming: true, MaxContext: 200000, MaxOutputTokens: 8192},
+	"anthropic.claude-3-7-sonnet": {Vision: true, Streaming: true, MaxContext: 200000, MaxOutputTokens: 64000},
+	"meta.llama3":                 {Vision: false, Streaming: true, MaxContext: 8192, MaxOutputTokens: 2048},
+	"meta.llama3-1":               {Vision: false, Streaming: true, MaxContext: 128000, MaxOutputTokens: 2048},
+	"meta.llama3-2":               {Vision: false, Streaming: true, MaxContext: 128000, MaxOutputTokens: 2048},
+	"meta.llama3-3":               {Vision: false, Streaming: true, MaxContext: 128000, MaxOutputTokens: 2048},
+	"mistral.mistral-7b":          {Vision: false, Streaming: true, MaxContext: 32000, MaxOutputTokens: 8192},
+	"mistral.mixtral-8x7b":        {Vision: false, Streaming: true, MaxContext: 32000, MaxOutputTokens: 4096},
+	"mistral.mistral-large":       {Vision: false, Streaming: true, MaxContext: 128000, MaxOutputTokens: 8192},
+	"mistral.mistral-small":       {Vision: false, Streaming: true, MaxContext: 32000, MaxOutputTokens: 8192},
+	"amazon.titan-text-lite":      {Vision: false, Streaming: true, MaxContext: 4096, MaxOutputTokens: 4096},
+	"amazon.titan-text-express":   {Vision: false, Streaming: true, MaxContext: 8192, MaxOutputTokens: 8192},
+	"amazon.titan-text-premier":   {Vision: false, Streaming: true, MaxContext: 32000, MaxOutputTokens: 3072},
+	"amazon.nova-micro":           {Vision: false, Streaming: true, MaxContext: 128000, MaxOutputTokens: 5000},
+	"amazon.nova-lite":            {Vision: true, Streaming: true, MaxContext: 300000, MaxOutputTokens: 5000},
+	"amazon.nova-pro":             {Vision: true, Streaming: true, MaxContext: 300000, MaxOutputTokens: 5000},
+	"cohere.command-r":            {Vision: false, Streaming: true, MaxContext: 128000, MaxOutputTokens: 4096},
+	"cohere.command-r-plus":       {Vision: false, Streaming: true, MaxContext: 128000, MaxOutputTokens: 4096},
+}
+
+// capabilities of a model, models missing from the catalogue get the limits
+// of their family and no vision
+func ModelInfoFor(modelID string) ModelInfo {
+
+	base := BaseModelID(modelID)
+	best := ""
+
+	for prefix := range modelCatalogue {
+		if strings.HasPrefix(base, prefix) && len(prefix) > len(best) {
+			best = prefix
+		}
+	}
+
+	info := ModelInfo{Streaming: true, MaxContext: 8192}
+
+	if best != "" {
+		info = modelCatalogue[best]
+	} else if adapter, err := AdapterForModel(modelID); err == nil {
+		info.MaxOutputTokens = adapter.Limits().MaxTokens
+	}
+
+	info.ID = modelID
+	info.Family = ModelFamily(modelID)
+
+	return info
+}
+
+// resolve the model of a request, an empty id selects cfg.ModelID and any
+// other id must be cfg.ModelID, cfg.ImageModelID or listed in cfg.Models
+//
+// the adapter is nil for a converse model of a family without adapter
+func (c *Config) ResolveModel(requested string) (ModelInfo, ModelAdapter, error) {
+
+	modelID := requested
+
+	if modelID == "" {
+		modelID = c.ModelID
+	}
+
+	if modelID != c.ModelID && modelID != c.ImageModelID && !containsString(c.Models, modelID) {
+		return ModelInfo{}, nil, fmt.Errorf("model %q is not configured", modelID)
+	}
+
+	converse := c.UsesConverse(modelID)
+
+	adapter, err := AdapterForModel(modelID)
+
+	if err != nil && !converse {
+		return ModelInfo{}, nil, err
+	}
+
+	info := ModelInfoFor(modelID)
+	info.Default = modelID == c.ModelID
+	info.Converse = converse
+
+	return info, adapter, nil
+}
+
+// report whether a model is invoked through the converse api
+func (c *Config) UsesConverse(modelID string) bool {
+	return containsString(c.ConverseModels, modelID)
+}
+
+// capabilities of the default model followed by the other configured models
+// and the image model
+func (c *Config) ModelInfos() []ModelInfo {
+
+	ids := []string{c.ModelID}
+
+	others := append([]string(nil), c.Models...)
+	if c.ImageModelID != "" {
+		others = append(others, c.ImageModelID)
+	}
+	sort.Strings(others)
+
+	for _, id := range others {
+		if !containsString(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+
+	infos := make([]ModelInfo, 0, len(ids))
+
+	for _, id := range ids {
+		if info, _, err := c.ResolveModel(id); err == nil {
+			infos = append(infos, info)
+		}
+	}
+
+	return infos
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// list the configured models and their capabilities
+func HandleListModels(w http.ResponseWriter, r *http.Request, cfg *Config) {
+
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"models": cfg.ModelInfos()})
+}
@@ -0,0 +1,148 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"testing"
+)
+
+func TestModelFamily(t *testing.T) {
+
+	// a family nested in amazon.nova, the longest prefix must win
+	RegisterModelAdapter("amazon.nova-canvas", novaAdapter{})
+
+	t.Cleanup(func() {
+		modelAdaptersMu.Lock()
+		defer modelAdaptersMu.Unlock()
+		delete(modelAdapters, "amazon.nova-canvas")
+	})
+
+	tests := []struct {
+		modelID string
+		want    string
+	}{
+		{"anthropic.claude-3-haiku-20240307-v1:0", "anthropic"},
+		{"us.anthropic.claude-3-5-haiku-20241022-v1:0", "anthropic"},
+		{"global.anthropic.claude-3-7-sonnet-20250219-v1:0", "anthropic"},
+		{"meta.llama3-1-70b-instruct-v1:0", "meta"},
+		{"mistral.mistral-large-2402-v1:0", "mistral"},
+		{"amazon.titan-text-express-v1", "amazon.titan"},
+		{"amazon.titan", "amazon.titan"},
+		{"amazon.nova-pro-v1:0", "amazon.nova"},
+		{"eu.amazon.nova-lite-v1:0", "amazon.nova"},
+		{"amazon.nova-canvas-v1:0", "amazon.nova-canvas"},
+		{"cohere.command-r-plus-v1:0", "cohere"},
+		{"amazon.other-v1", ""},
+		{"metallica.model", ""},
+		{"ai21.j2-ultra-v1", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		if got := ModelFamily(test.modelID); got != test.want {
+			t.Errorf("ModelFamily(%q) = %q, want %q", test.modelID, got, test.want)
+		}
+	}
+}
+
+func TestModelInfoFor(t *testing.T) {
+
+	tests := []struct {
+		modelID string
+		want    ModelInfo
+	}{
+		{
+			"anthropic.claude-3-haiku-20240307-v1:0",
+			ModelInfo{ID: "anthropic.claude-3-haiku-20240307-v1:0", Family: "anthropic", Vision: true, Streaming: true, MaxContext: 200000, MaxOutputTokens: 4096},
+		},
+		{
+			"anthropic.claude-3-5-haiku-20241022-v1:0",
+			ModelInfo{ID: "anthropic.claude-3-5-haiku-20241022-v1:0", Family: "anthropic", Streaming: true, MaxContext: 200000, MaxOutputTokens: 8192},
+		},
+		{
+			// meta.llama3-1 is longer than meta.llama3
+			"meta.llama3-1-70b-instruct-v1:0",
+			ModelInfo{ID: "meta.llama3-1-70b-instruct-v1:0", Family: "meta", Streaming: true, MaxContext: 128000, MaxOutputTokens: 2048},
+		},
+		{
+			"meta.llama3-8b-instruct-v1:0",
+			ModelInfo{ID: "meta.llama3-8b-instruct-v1:0", Family: "meta", Streaming: true, MaxContext: 8192, MaxOutputTokens: 2048},
+		},
+		{
+			// the id keeps its inference profile prefix
+			"us.amazon.nova-lite-v1:0",
+			ModelInfo{ID: "us.amazon.nova-lite-v1:0", Family: "amazon.nova", Vision: true, Streaming: true, MaxContext: 300000, MaxOutputTokens: 5000},
+		},
+		{
+			"cohere.command-r-plus-v1:0",
+			ModelInfo{ID: "cohere.command-r-plus-v1:0", Family: "cohere", Streaming: true, MaxContext: 128000, MaxOutputTokens: 4096},
+		},
+		{
+			// missing from the catalogue, the limits of its family
+			"anthropic.claude-v2",
+			ModelInfo{ID: "anthropic.claude-v2", Family: "anthropic", Streaming: true, MaxContext: 8192, MaxOutputTokens: 4096},
+		},
+		{
+			"ai21.j2-ultra-v1",
+			ModelInfo{ID: "ai21.j2-ultra-v1", Streaming: true, MaxContext: 8192},
+		},
+	}
+
+	for _, test := range tests {
+		if got := ModelInfoFor(test.modelID); got != test.want {
+			t.Errorf("ModelInfoFor(%q) = %+v, want %+v", test.modelID, got, test.want)
+		}
+	}
+}
+
+func TestResolveModel(t *testing.T) {
+
+	cfg := DefaultConfig()
+	cfg.Models = []string{"meta.llama3-8b-instruct-v1:0", "ai21.j2-ultra-v1", "ai21.jamba-instruct-v1:0"}
+	cfg.ConverseModels = []string{"ai21.jamba-instruct-v1:0", cfg.ImageModelID}
+
+	tests := []struct {
+		name      string
+		requested string
+		id        string
+		isDefault bool
+		converse  bool
+		adapter   ModelAdapter
+		err       string
+	}{
+		{name: "empty is the default", requested: "", id: cfg.ModelID, isDefault: true, adapter: claude3Adapter{}},
+		{name: "default", requested: cfg.ModelID, id: cfg.ModelID, isDefault: true, adapter: claude3Adapter{}},
+		{name: "image model", requested: cfg.ImageModelID, id: cfg.ImageModelID, converse: true, adapter: claude3Adapter{}},
+		{name: "listed", requested: "meta.llama3-8b-instruct-v1:0", id: "meta.llama3-8b-instruct-v1:0", adapter: llamaAdapter{}},
+		{name: "converse without adapter", requested: "ai21.jamba-instruct-v1:0", id: "ai21.jamba-instruct-v1:0", converse: true},
+		{name: "no adapter", requested: "ai21.j2-ultra-v1", err: `no adapter for model "ai21.j2-ultra-v1"`},
+		{name: "not configured", requested: "gpt-4o", err: `model "gpt-4o" is not configured`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			info, adapter, err := cfg.ResolveModel(test.requested)
+
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if info.ID != test.id || info.Default != test.isDefault || info.Converse != test.converse {
+				t.Errorf("got %+v, want id %q, default %v, converse %v", info, test.id, test.isDefault, test.converse)
+			}
+
+			if adapter != test.adapter {
+				t.Errorf("got adapter %T, want %T", adapter, test.adapter)
+			}
+		})
+	}
+}
@@ -0,0 +1,449 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+)
+
+// openai chat completions request data type
+type OpenAIChatRequest struct {
+	Model         string              `json:"model"`
+	Messages      []OpenAIMessage     `json:"messages"`
+	Temperature   *float64            `json:"temperature,omitempty"`
+	TopP          *float64            `json:"top_p,omitempty"`
+	MaxTokens     int                 `json:"max_tokens,omitempty"`
+	Stream        bool                `json:"stream,omitempty"`
+	Stop          OpenAIStop          `json:"stop,omitempty"`
+	StreamOptions *OpenAIStreamOption `json:"stream_options,omitempty"`
+}
+
+type OpenAIStreamOption struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// content is either a string or a list of text parts
+type OpenAIMessage struct {
+	Role    string        `json:"role"`
+	Content OpenAIContent `json:"content"`
+}
+
+type OpenAIContent string
+
+func (c *OpenAIContent) UnmarshalJSON(data []byte) error {
+
+	var text string
+
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = OpenAIContent(text)
+		return nil
+	}
+
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return fmt.Errorf("content must be a string or a list of parts")
+	}
+
+	var sb strings.Builder
+
+	for _, part := range parts {
+		if part.Type != "text" {
+			return fmt.Errorf("content part type %q is not supported", part.Type)
+		}
+		sb.WriteString(part.Text)
+	}
+
+	*c = OpenAIContent(sb.String())
+
+	return nil
+}
+
+// stop is either a string or a list of strings, null means no stop sequences
+type OpenAIStop []string
+
+func (s *OpenAIStop) UnmarshalJSON(data []byte) error {
+
+	if bytes.Equal(data, []byte("null")) {
+		*s = nil
+		return nil
+	}
+
+	var one string
+
+	if err := json.Unmarshal(data, &one); err == nil {
+		*s = OpenAIStop{one}
+		return nil
+	}
+
+	var many []string
+
+	if err := json.Unmarshal(data, &many); err != nil {
+		return fmt.Errorf("stop must be a string or a list of strings")
+	}
+
+	*s = many
+
+	return nil
+}
+
+// openai chat completions response data type
+type OpenAIChatResponse struct {
+	ID      string         `json:"id"`
+	Object  string         `json:"object"`
+	Created int64          `json:"created"`
+	Model   string         `json:"model"`
+	Choices []OpenAIChoice `json:"choices"`
+	Usage   *OpenAIUsage   `json:"usage,omitempty"`
+}
+
+type OpenAIChoice struct {
+	Index        int                  `json:"index"`
+	Message      *OpenAIChoiceMessage `json:"message,omitempty"`
+	Delta        *OpenAIChoiceMessage `json:"delta,omitempty"`
+	FinishReason *string              `json:"finish_reason"`
+}
+
+type OpenAIChoiceMessage struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+type OpenAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type OpenAIError struct {
+	Error OpenAIErrorBody `json:"error"`
+}
+
+type OpenAIErrorBody struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+// write an error in the openai format
+func writeOpenAIError(w http.ResponseWriter, status int, errorType string, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(OpenAIError{Error: OpenAIErrorBody{Message: err.Error(), Type: errorType}})
+}
+
+// map the stop reasons of the model families to openai finish reasons
+func OpenAIFinishReason(stopReason string) string {
+	switch strings.ToLower(stopReason) {
+	case "max_tokens", "length", "max_length", "max_tokens_reached", "max_tokens_exceeded":
+		return "length"
+	case "tool_use", "tool_calls":
+		return "tool_calls"
+	case "content_filtered", "content_filter", "guardrail_intervened":
+		return "content_filter"
+	default:
+		return "stop"
+	}
+}
+
+// translate an openai request into messages and inference parameters
+//
+// system messages are joined into the system prompt and consecutive
+// messages of the same role are merged, as most models require alternating turns
+func OpenAIToMessages(request OpenAIChatRequest) ([]Message, InferenceParameters, error) {
+
+	params := InferenceParameters{
+		Temperature:   request.Temperature,
+		TopP:          request.TopP,
+		StopSequences: request.Stop,
+	}
+
+	if request.MaxTokens > 0 {
+		params.MaxTokens = &request.MaxTokens
+	}
+
+	var messages []Message
+	var system []string
+
+	for _, message := range request.Messages {
+		switch message.Role {
+		case "system", "developer":
+			system = append(system, string(message.Content))
+
+		case "user", "assistant":
+			content := Content{Type: "text", Text: string(message.Content)}
+			last := len(messages) - 1
+			if last >= 0 && messages[last].Role == message.Role {
+				messages[last].Content = append(messages[last].Content, content)
+			} else {
+				messages = append(messages, Message{Role: message.Role, Content: []Content{content}})
+			}
+
+		default:
+			return nil, InferenceParameters{}, fmt.Errorf("message role %q is not supported", message.Role)
+		}
+	}
+
+	if len(messages) == 0 {
+		return nil, InferenceParameters{}, errors.New("messages must contain at least one user message")
+	}
+
+	params.System = strings.Join(system, "\n\n")
+
+	return messages, params, nil
+}
+
+func newCompletionID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "chatcmpl-" + hex.EncodeToString(b)
+}
+
+// openai compatible chat completions backed by the models on bedrock
+//
+// the model field of the request is used when it names a configured model,
+// any other name such as gpt-4o falls back to the default model
+func HandleOpenAIChatCompletions(w http.ResponseWriter, r *http.Request, BedrockClient ModelInvoker, cfg *Config) {
+
+	var request OpenAIChatRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", err)
+		return
+	}
+
+	info, adapter, err := cfg.ResolveModel(request.Model)
+
+	if err != nil {
+		info, adapter, err = cfg.ResolveModel("")
+	}
+
+	if err != nil {
+		writeOpenAIError(w, http.StatusInternalServerError, "server_error", err)
+		return
+	}
+
+	messages, params, err := OpenAIToMessages(request)
+
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", err)
+		return
+	}
+
+	if err := params.Validate(LimitsForModel(info.ID)); err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", err)
+		return
+	}
+
+	// converse models share one request shape, other models need their adapter
+	var converse ConverseRequest
+	var payloadBytes []byte
+
+	if info.Converse {
+		converse, err = NewConverseRequest(info.ID, messages, params)
+	} else {
+		payloadBytes, err = adapter.BuildRequest(messages, params)
+	}
+
+	if err != nil {
+		writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", err)
+		return
+	}
+
+	includeUsage := request.StreamOptions != nil && request.StreamOptions.IncludeUsage
+
+	if request.Stream && info.Converse {
+		chunks, closeStream, err := ConverseStream(r.Context(), BedrockClient, info.ID, converse)
+		if err != nil {
+			fmt.Println(err)
+			writeOpenAIError(w, http.StatusBadGateway, "api_error", err)
+			return
+		}
+		defer closeStream()
+		streamOpenAIChat(w, chunks, info.ID, includeUsage)
+		return
+	}
+
+	if request.Stream {
+		stream, err := BedrockClient.InvokeModelWithResponseStream(
+			r.Context(),
+			&bedrockruntime.InvokeModelWithResponseStreamInput{
+				Body:        payloadBytes,
+				ModelId:     aws.String(info.ID),
+				ContentType: aws.String("application/json"),
+				Accept:      aws.String("application/json"),
+			},
+		)
+		if err != nil {
+			fmt.Println(err)
+			writeOpenAIError(w, http.StatusBadGateway, "api_error", err)
+			return
+		}
+		defer stream.Close()
+		streamOpenAIChat(w, AdapterChunks(stream, adapter), info.ID, includeUsage)
+		return
+	}
+
+	var response ModelChunk
+
+	if info.Converse {
+		response, err = Converse(r.Context(), BedrockClient, info.ID, converse)
+	} else {
+		response, err = invokeModel(r.Context(), BedrockClient, adapter, info.ID, payloadBytes)
+	}
+
+	if err != nil {
+		fmt.Println(err)
+		writeOpenAIError(w, http.StatusBadGateway, "api_error", err)
+		return
+	}
+
+	finishReason := OpenAIFinishReason(response.StopReason)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(OpenAIChatResponse{
+		ID:      newCompletionID(),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   info.ID,
+		Choices: []OpenAIChoice{{
+			Index:        0,
+			Message:      &OpenAIChoiceMessage{Role: "assistant", Content: response.Text},
+			FinishReason: &finishReason,
+		}},
+		Usage: &OpenAIUsage{
+			PromptTokens:     response.InputTokens,
+			CompletionTokens: response.OutputTokens,
+			TotalTokens:      response.InputTokens + response.OutputTokens,
+		},
+	})
+}
+
+// invoke a model and parse its answer with the adapter of the model
+func invokeModel(ctx context.Context, client ModelInvoker, adapter ModelAdapter, modelID string, payloadBytes []byte) (ModelChunk, error) {
+
+	output, err := client.InvokeModel(
+		ctx,
+		&bedrockruntime.InvokeModelInput{
+			Body:        payloadBytes,
+			ModelId:     aws.String(modelID),
+			ContentType: aws.String("application/json"),
+			Accept:      aws.String("application/json"),
+		},
+	)
+
+	if err != nil {
+		return ModelChunk{}, err
+	}
+
+	return adapter.ParseResponse(output.Body)
+}
+
+// generate a whole answer with the converse api or the adapter of the model
+func generate(ctx context.Context, client ModelInvoker, info ModelInfo, adapter ModelAdapter, messages []Message, params InferenceParameters) (ModelChunk, error) {
+
+	if info.Converse {
+		request, err := NewConverseRequest(info.ID, messages, params)
+		if err != nil {
+			return ModelChunk{}, err
+		}
+		return Converse(ctx, client, info.ID, request)
+	}
+
+	payloadBytes, err := adapter.BuildRequest(messages, params)
+
+	if err != nil {
+		return ModelChunk{}, err
+	}
+
+	return invokeModel(ctx, client, adapter, info.ID, payloadBytes)
+}
+
+// stream model chunks as openai chat.completion.chunk events ending with [DONE]
+func streamOpenAIChat(w http.ResponseWriter, chunks ChunkReader, modelID string, includeUsage bool) {
+
+	sse := NewSSEWriter(w)
+
+	id := newCompletionID()
+	created := time.Now().Unix()
+
+	chunk := func(choices []OpenAIChoice, usage *OpenAIUsage) error {
+		data, err := json.Marshal(OpenAIChatResponse{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   modelID,
+			Choices: choices,
+			Usage:   usage,
+		})
+		if err != nil {
+			return err
+		}
+		return sse.Data(data)
+	}
+
+	var total ModelChunk
+	started := false
+
+	err := chunks(func(c ModelChunk) bool {
+
+		total = mergeChunk(total, c)
+
+		if !started {
+			started = true
+			if chunk([]OpenAIChoice{{Delta: &OpenAIChoiceMessage{Role: "assistant"}}}, nil) != nil {
+				return false
+			}
+		}
+
+		if c.Text != "" {
+			return chunk([]OpenAIChoice{{Delta: &OpenAIChoiceMessage{Content: c.Text}}}, nil) == nil
+		}
+
+		return true
+	})
+
+	if err != nil {
+		fmt.Println(err)
+		data, _ := json.Marshal(OpenAIError{Error: OpenAIErrorBody{Message: err.Error(), Type: "api_error"}})
+		sse.Data(data)
+		return
+	}
+
+	// the client went away
+	if sse.err != nil {
+		fmt.Println(sse.err)
+		return
+	}
+
+	finishReason := OpenAIFinishReason(total.StopReason)
+	chunk([]OpenAIChoice{{Delta: &OpenAIChoiceMessage{}, FinishReason: &finishReason}}, nil)
+
+	// usage arrives in a last chunk with no choices, as openai does
+	if includeUsage {
+		chunk([]OpenAIChoice{}, &OpenAIUsage{
+			PromptTokens:     total.InputTokens,
+			CompletionTokens: total.OutputTokens,
+			TotalTokens:      total.InputTokens + total.OutputTokens,
+		})
+	}
+
+	sse.Data([]byte("[DONE]"))
+}
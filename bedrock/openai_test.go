@@ -0,0 +1,343 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOpenAIChatRequestUnmarshal(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		body    string
+		stop    OpenAIStop
+		content OpenAIContent
+		err     string
+	}{
+		{name: "no stop", body: `{"messages": [{"role": "user", "content": "hi"}]}`, content: "hi"},
+		{name: "stop string", body: `{"stop": "END", "messages": [{"role": "user", "content": "hi"}]}`, stop: OpenAIStop{"END"}, content: "hi"},
+		{name: "stop array", body: `{"stop": ["END", "\n\n"], "messages": [{"role": "user", "content": "hi"}]}`, stop: OpenAIStop{"END", "\n\n"}, content: "hi"},
+		{name: "stop null", body: `{"stop": null, "messages": [{"role": "user", "content": "hi"}]}`, content: "hi"},
+		{name: "stop number", body: `{"stop": 1, "messages": [{"role": "user", "content": "hi"}]}`, err: "stop must be a string or a list of strings"},
+		{name: "content parts", body: `{"messages": [{"role": "user", "content": [{"type": "text", "text": "hello "}, {"type": "text", "text": "world"}]}]}`, content: "hello world"},
+		{name: "content null", body: `{"messages": [{"role": "assistant", "content": null}]}`, content: ""},
+		{name: "content image part", body: `{"messages": [{"role": "user", "content": [{"type": "image_url", "image_url": {"url": "https://example.com/a.png"}}]}]}`, err: `content part type "image_url" is not supported`},
+		{name: "content number", body: `{"messages": [{"role": "user", "content": 1}]}`, err: "content must be a string or a list of parts"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var request OpenAIChatRequest
+
+			err := json.Unmarshal([]byte(test.body), &request)
+
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(request.Stop, test.stop) {
+				t.Errorf("got stop %q, want %q", request.Stop, test.stop)
+			}
+
+			if request.Messages[0].Content != test.content {
+				t.Errorf("got content %q, want %q", request.Messages[0].Content, test.content)
+			}
+		})
+	}
+}
+
+func TestOpenAIToMessages(t *testing.T) {
+
+	temperature := 0.5
+
+	tests := []struct {
+		name     string
+		request  OpenAIChatRequest
+		messages []Message
+		system   string
+		err      string
+	}{
+		{
+			name:     "one user message",
+			request:  OpenAIChatRequest{Messages: []OpenAIMessage{{Role: "user", Content: "hi"}}},
+			messages: []Message{{Role: "user", Content: []Content{{Type: "text", Text: "hi"}}}},
+		},
+		{
+			name: "system and developer joined",
+			request: OpenAIChatRequest{Messages: []OpenAIMessage{
+				{Role: "system", Content: "be brief"},
+				{Role: "user", Content: "hi"},
+				{Role: "developer", Content: "answer in english"},
+			}},
+			messages: []Message{{Role: "user", Content: []Content{{Type: "text", Text: "hi"}}}},
+			system:   "be brief\n\nanswer in english",
+		},
+		{
+			name: "same roles merged",
+			request: OpenAIChatRequest{Messages: []OpenAIMessage{
+				{Role: "user", Content: "hi"},
+				{Role: "user", Content: "are you there?"},
+				{Role: "assistant", Content: "yes"},
+				{Role: "user", Content: "good"},
+			}},
+			messages: []Message{
+				{Role: "user", Content: []Content{{Type: "text", Text: "hi"}, {Type: "text", Text: "are you there?"}}},
+				{Role: "assistant", Content: []Content{{Type: "text", Text: "yes"}}},
+				{Role: "user", Content: []Content{{Type: "text", Text: "good"}}},
+			},
+		},
+		{
+			name:    "unknown role",
+			request: OpenAIChatRequest{Messages: []OpenAIMessage{{Role: "tool", Content: "42"}}},
+			err:     `message role "tool" is not supported`,
+		},
+		{
+			name:    "only system",
+			request: OpenAIChatRequest{Messages: []OpenAIMessage{{Role: "system", Content: "be brief"}}},
+			err:     "messages must contain at least one user message",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			messages, params, err := OpenAIToMessages(test.request)
+
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(messages, test.messages) {
+				t.Errorf("got messages %+v, want %+v", messages, test.messages)
+			}
+
+			if params.System != test.system {
+				t.Errorf("got system %q, want %q", params.System, test.system)
+			}
+		})
+	}
+
+	t.Run("parameters", func(t *testing.T) {
+
+		_, params, err := OpenAIToMessages(OpenAIChatRequest{
+			Messages:    []OpenAIMessage{{Role: "user", Content: "hi"}},
+			Temperature: &temperature,
+			MaxTokens:   64,
+			Stop:        OpenAIStop{"END"},
+		})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if params.Temperature == nil || *params.Temperature != temperature || params.MaxTokens == nil || *params.MaxTokens != 64 || !reflect.DeepEqual(params.StopSequences, []string{"END"}) {
+			t.Errorf("got parameters %+v", params)
+		}
+
+		// no max_tokens leaves the model default
+		if _, params, _ := OpenAIToMessages(OpenAIChatRequest{Messages: []OpenAIMessage{{Role: "user", Content: "hi"}}}); params.MaxTokens != nil {
+			t.Errorf("got max tokens %d, want none", *params.MaxTokens)
+		}
+	})
+}
+
+// post a chat completions request to the server
+func postOpenAIChat(t *testing.T, cfg *Config, models *FakeModelInvoker, body string) *httptest.ResponseRecorder {
+
+	t.Helper()
+
+	clients := testClients{models: models, knowledgeBases: &FakeKnowledgeBase{}, notes: &FakeVectorStore{}, conversations: NewMemoryConversationStore()}
+
+	response := httptest.NewRecorder()
+	newTestServer(cfg, clients).ServeHTTP(response, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+
+	return response
+}
+
+func TestOpenAIChatCompletionsModel(t *testing.T) {
+
+	const sonnet = "anthropic.claude-3-sonnet-20240229-v1:0"
+
+	cfg := DefaultConfig()
+	cfg.Models = []string{sonnet}
+
+	tests := []struct {
+		name  string
+		model string
+		want  string
+	}{
+		{"configured model", sonnet, sonnet},
+		{"default model", cfg.ModelID, cfg.ModelID},
+		{"unknown model falls back", "gpt-4o", cfg.ModelID},
+		{"no model falls back", "", cfg.ModelID},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			models := &FakeModelInvoker{Deltas: []string{"Hello"}}
+
+			response := postOpenAIChat(t, &cfg, models, `{"model": "`+test.model+`", "stop": null, "messages": [{"role": "user", "content": "hi"}]}`)
+
+			if response.Code != http.StatusOK {
+				t.Fatalf("status %d: %s", response.Code, response.Body)
+			}
+
+			var result OpenAIChatResponse
+			decodeBody(t, response.Body.Bytes(), &result)
+
+			if result.Model != test.want {
+				t.Errorf("got model %q, want %q", result.Model, test.want)
+			}
+
+			finishReason := "stop"
+
+			want := []OpenAIChoice{{Message: &OpenAIChoiceMessage{Role: "assistant", Content: "Hello"}, FinishReason: &finishReason}}
+
+			if !reflect.DeepEqual(result.Choices, want) {
+				t.Errorf("got choices %+v, want %+v", result.Choices, want)
+			}
+
+			if result.Usage == nil || result.Usage.CompletionTokens != 1 || result.Usage.TotalTokens != result.Usage.PromptTokens+1 {
+				t.Errorf("got usage %+v", result.Usage)
+			}
+
+			if bodies := models.Bodies(); len(bodies) != 1 || strings.Contains(string(bodies[0]), "stop_sequences") {
+				t.Errorf("model requests %s, want one without stop sequences", bodies)
+			}
+		})
+	}
+}
+
+// the chat.completion.chunk events of a stream, up to but not including
+// [DONE], which must end it
+func openAIChunks(t *testing.T, body string) []OpenAIChatResponse {
+
+	t.Helper()
+
+	frames := strings.Split(strings.TrimSuffix(body, "\n\n"), "\n\n")
+
+	if last := frames[len(frames)-1]; last != "data: [DONE]" {
+		t.Fatalf("stream ends with %q, want [DONE]", last)
+	}
+
+	var chunks []OpenAIChatResponse
+
+	for _, frame := range frames[:len(frames)-1] {
+		var chunk OpenAIChatResponse
+		decodeBody(t, []byte(strings.TrimPrefix(frame, "data: ")), &chunk)
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks
+}
+
+func TestOpenAIChatCompletionsStream(t *testing.T) {
+
+	cfg := DefaultConfig()
+	converseCfg := DefaultConfig()
+	converseCfg.ConverseModels = []string{converseCfg.ModelID}
+
+	tests := []struct {
+		name         string
+		cfg          *Config
+		includeUsage bool
+	}{
+		{"invoke model", &cfg, false},
+		{"invoke model with usage", &cfg, true},
+		{"converse", &converseCfg, false},
+		{"converse with usage", &converseCfg, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			models := &FakeModelInvoker{Deltas: []string{"Hello", " world"}}
+
+			body := `{"model": "gpt-4o", "stream": true, "messages": [{"role": "user", "content": "hi"}]}`
+			if test.includeUsage {
+				body = `{"model": "gpt-4o", "stream": true, "stream_options": {"include_usage": true}, "messages": [{"role": "user", "content": "hi"}]}`
+			}
+
+			response := postOpenAIChat(t, test.cfg, models, body)
+
+			if response.Code != http.StatusOK || response.Header().Get("Content-Type") != "text/event-stream" {
+				t.Fatalf("status %d, content type %q: %s", response.Code, response.Header().Get("Content-Type"), response.Body)
+			}
+
+			chunks := openAIChunks(t, response.Body.String())
+
+			// role, two deltas, finish reason and maybe usage
+			want := 4
+			if test.includeUsage {
+				want = 5
+			}
+
+			if len(chunks) != want {
+				t.Fatalf("got %d chunks, want %d: %s", len(chunks), want, response.Body)
+			}
+
+			for k, chunk := range chunks {
+				if chunk.Object != "chat.completion.chunk" || chunk.ID != chunks[0].ID || !strings.HasPrefix(chunk.ID, "chatcmpl-") || chunk.Created != chunks[0].Created || chunk.Model != cfg.ModelID {
+					t.Errorf("chunk %d: %+v", k, chunk)
+				}
+			}
+
+			var text strings.Builder
+
+			for k, chunk := range chunks[:4] {
+				if len(chunk.Choices) != 1 || chunk.Choices[0].Delta == nil || chunk.Choices[0].Message != nil || chunk.Usage != nil {
+					t.Fatalf("chunk %d: %+v", k, chunk)
+				}
+				text.WriteString(chunk.Choices[0].Delta.Content)
+			}
+
+			if role := chunks[0].Choices[0].Delta.Role; role != "assistant" {
+				t.Errorf("first chunk has role %q, want assistant", role)
+			}
+
+			if text.String() != "Hello world" {
+				t.Errorf("got text %q, want %q", text.String(), "Hello world")
+			}
+
+			for k, chunk := range chunks[:3] {
+				if chunk.Choices[0].FinishReason != nil {
+					t.Errorf("chunk %d has finish reason %q", k, *chunk.Choices[0].FinishReason)
+				}
+			}
+
+			if finishReason := chunks[3].Choices[0].FinishReason; finishReason == nil || *finishReason != "stop" {
+				t.Errorf("got finish reason %v, want stop", finishReason)
+			}
+
+			if test.includeUsage {
+				usage := chunks[4]
+				if len(usage.Choices) != 0 || usage.Usage == nil || usage.Usage.CompletionTokens != 2 || usage.Usage.TotalTokens != usage.Usage.PromptTokens+2 {
+					t.Errorf("usage chunk %+v", usage)
+				}
+			}
+		})
+	}
+}
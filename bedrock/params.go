@@ -0,0 +1,120 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// optional inference parameters of a frontend request, unset values fall
+// back to MAX_TOKENS_TO_SAMPLE and TEMPERATURE or the model defaults
+type InferenceParameters struct {
+	System        string   `json:"system,omitempty"`
+	MaxTokens     *int     `json:"max_tokens,omitempty"`
+	Temperature   *float64 `json:"temperature,omitempty"`
+	TopP          *float64 `json:"top_p,omitempty"`
+	TopK          *int     `json:"top_k,omitempty"`
+	StopSequences []string `json:"stop_sequences,omitempty"`
+}
+
+// limits of the inference parameters of a model, zero MaxTopK or
+// MaxStopSequences means the parameter is not supported
+type ModelLimits struct {
+	MaxTokens        int
+	MaxTemperature   float64
+	MaxTopK          int
+	MaxStopSequences int
+}
+
+// limits of a model, those of its family with the max output tokens of the
+// model catalogue, a cross region prefix such as us. is ignored
+func LimitsForModel(modelID string) ModelLimits {
+
+	limits := ModelLimits{MaxTokens: 4096, MaxTemperature: 1}
+
+	if adapter, err := AdapterForModel(modelID); err == nil {
+		limits = adapter.Limits()
+	}
+
+	if info := ModelInfoFor(modelID); info.MaxOutputTokens > 0 {
+		limits.MaxTokens = info.MaxOutputTokens
+	}
+
+	return limits
+}
+
+// prefixes of cross region inference profiles such as us.anthropic.claude...
+var inferenceProfilePrefixes = map[string]struct{}{
+	"us": {}, "eu": {}, "apac": {}, "us-gov": {}, "global": {},
+}
+
+// strip the cross region inference profile prefix of a model id
+func BaseModelID(modelID string) string {
+
+	if k := strings.Index(modelID, "."); k >= 0 {
+		if _, ok := inferenceProfilePrefixes[modelID[:k]]; ok {
+			return modelID[k+1:]
+		}
+	}
+
+	return modelID
+}
+
+// check the parameters against the limits of a model
+func (p InferenceParameters) Validate(limits ModelLimits) error {
+
+	var errs []error
+
+	if p.MaxTokens != nil && (*p.MaxTokens < 1 || *p.MaxTokens > limits.MaxTokens) {
+		errs = append(errs, fmt.Errorf("max_tokens must be between 1 and %d, got %d", limits.MaxTokens, *p.MaxTokens))
+	}
+
+	if p.Temperature != nil && (*p.Temperature < 0 || *p.Temperature > limits.MaxTemperature) {
+		errs = append(errs, fmt.Errorf("temperature must be between 0 and %g, got %g", limits.MaxTemperature, *p.Temperature))
+	}
+
+	if p.TopP != nil && (*p.TopP < 0 || *p.TopP > 1) {
+		errs = append(errs, fmt.Errorf("top_p must be between 0 and 1, got %g", *p.TopP))
+	}
+
+	if p.TopK != nil && limits.MaxTopK == 0 {
+		errs = append(errs, errors.New("top_k is not supported by this model"))
+	} else if p.TopK != nil && (*p.TopK < 0 || *p.TopK > limits.MaxTopK) {
+		errs = append(errs, fmt.Errorf("top_k must be between 0 and %d, got %d", limits.MaxTopK, *p.TopK))
+	}
+
+	if len(p.StopSequences) > 0 && limits.MaxStopSequences == 0 {
+		errs = append(errs, errors.New("stop_sequences is not supported by this model"))
+	} else if len(p.StopSequences) > limits.MaxStopSequences {
+		errs = append(errs, fmt.Errorf("stop_sequences accepts at most %d entries, got %d", limits.MaxStopSequences, len(p.StopSequences)))
+	}
+
+	for _, stop := range p.StopSequences {
+		if strings.TrimSpace(stop) == "" {
+			errs = append(errs, errors.New("stop_sequences must not contain blank entries"))
+			break
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// max tokens of the request or MAX_TOKENS_TO_SAMPLE
+func (p InferenceParameters) MaxTokensOrDefault() int {
+	if p.MaxTokens != nil {
+		return *p.MaxTokens
+	}
+	return MAX_TOKENS_TO_SAMPLE
+}
+
+// temperature of the request or TEMPERATURE
+func (p InferenceParameters) TemperatureOrDefault() *float64 {
+	if p.Temperature != nil {
+		return p.Temperature
+	}
+	temperature := float64(TEMPERATURE)
+	return &temperature
+}
@@ -0,0 +1,261 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
+)
+
+// placeholders of knowledge base prompt templates, bedrock replaces them
+// with the retrieved chunks, the question and its citation instructions
+const (
+	SearchResultsPlaceholder = "$search_results$"
+	QueryPlaceholder         = "$query$"
+	outputFormatPlaceholder  = "$output_format_instructions$"
+)
+
+// the prompt of streamed answers when no template is selected
+const defaultPromptTemplate = "Search results:\n\n" + SearchResultsPlaceholder + "\nQuestion: " + QueryPlaceholder
+
+// a named knowledge base prompt and the inference parameters used with it,
+// set in the promptTemplates of the config file
+type PromptTemplate struct {
+	Description   string   `json:"description,omitempty" yaml:"description"`
+	Template      string   `json:"template" yaml:"template"`
+	MaxTokens     *int     `json:"maxTokens,omitempty" yaml:"maxTokens"`
+	Temperature   *float64 `json:"temperature,omitempty" yaml:"temperature"`
+	TopP          *float64 `json:"topP,omitempty" yaml:"topP"`
+	StopSequences []string `json:"stopSequences,omitempty" yaml:"stopSequences"`
+}
+
+func (t PromptTemplate) validate() error {
+
+	var errs []error
+
+	if !strings.Contains(t.Template, SearchResultsPlaceholder) {
+		errs = append(errs, fmt.Errorf("template must contain %s", SearchResultsPlaceholder))
+	}
+
+	if t.MaxTokens != nil && *t.MaxTokens < 1 {
+		errs = append(errs, fmt.Errorf("maxTokens must be at least 1, got %d", *t.MaxTokens))
+	}
+
+	if t.Temperature != nil && (*t.Temperature < 0 || *t.Temperature > 1) {
+		errs = append(errs, fmt.Errorf("temperature must be between 0 and 1, got %g", *t.Temperature))
+	}
+
+	if t.TopP != nil && (*t.TopP < 0 || *t.TopP > 1) {
+		errs = append(errs, fmt.Errorf("topP must be between 0 and 1, got %g", *t.TopP))
+	}
+
+	return errors.Join(errs...)
+}
+
+// the inference parameters of the template overridden by those of a request
+func (t PromptTemplate) Parameters(request InferenceParameters) InferenceParameters {
+
+	params := InferenceParameters{
+		MaxTokens:     t.MaxTokens,
+		Temperature:   t.Temperature,
+		TopP:          t.TopP,
+		StopSequences: t.StopSequences,
+	}
+
+	if request.MaxTokens != nil {
+		params.MaxTokens = request.MaxTokens
+	}
+
+	if request.Temperature != nil {
+		params.Temperature = request.Temperature
+	}
+
+	if request.TopP != nil {
+		params.TopP = request.TopP
+	}
+
+	if request.StopSequences != nil {
+		params.StopSequences = request.StopSequences
+	}
+
+	return params
+}
+
+// the template of the given name, or of knowledgeBasePromptTemplate when the
+// name is empty; without either the zero template and false are returned
+func (c *Config) PromptTemplateFor(name string) (PromptTemplate, bool, error) {
+
+	if name == "" {
+		name = c.KnowledgeBasePromptTemplate
+	}
+
+	if name == "" {
+		return PromptTemplate{}, false, nil
+	}
+
+	template, ok := c.PromptTemplates[name]
+
+	if !ok {
+		return PromptTemplate{}, false, fmt.Errorf("prompt template %q is not configured", name)
+	}
+
+	return template, true, nil
+}
+
+// check the inference parameters of a knowledge base request, bedrock takes
+// no system prompt or top_k for them
+func validateKnowledgeBaseParameters(params InferenceParameters, modelID string) error {
+
+	var errs []error
+
+	if params.System != "" {
+		errs = append(errs, errors.New("system is not supported by knowledge base answers, use a prompt template"))
+	}
+
+	if params.TopK != nil {
+		errs = append(errs, errors.New("top_k is not supported by knowledge base answers"))
+	}
+
+	params.System, params.TopK = "", nil
+
+	if err := params.Validate(LimitsForModel(modelID)); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// the generation configuration of a template and inference parameters, nil
+// when neither is set so that the knowledge base defaults apply
+func generationConfiguration(template PromptTemplate, found bool, params InferenceParameters) *types.GenerationConfiguration {
+
+	var generation types.GenerationConfiguration
+
+	if found {
+		generation.PromptTemplate = &types.PromptTemplate{TextPromptTemplate: aws.String(template.Template)}
+	}
+
+	if params.MaxTokens != nil || params.Temperature != nil || params.TopP != nil || len(params.StopSequences) > 0 {
+
+		text := &types.TextInferenceConfig{StopSequences: params.StopSequences}
+
+		if params.MaxTokens != nil {
+			text.MaxTokens = aws.Int32(int32(*params.MaxTokens))
+		}
+
+		if params.Temperature != nil {
+			text.Temperature = aws.Float32(float32(*params.Temperature))
+		}
+
+		if params.TopP != nil {
+			text.TopP = aws.Float32(float32(*params.TopP))
+		}
+
+		generation.InferenceConfig = &types.InferenceConfig{TextInferenceConfig: text}
+	}
+
+	if generation.PromptTemplate == nil && generation.InferenceConfig == nil {
+		return nil
+	}
+
+	return &generation
+}
+
+// replace the placeholders of a template with numbered search results and
+// the query, citation instructions are left to the system prompt
+func RenderPrompt(template string, query string, references []Reference) string {
+
+	var results strings.Builder
+
+	for _, reference := range references {
+		fmt.Fprintf(&results, "[%d] %s\n%s\n\n", reference.Index, reference.URI, reference.Text)
+	}
+
+	return strings.NewReplacer(
+		SearchResultsPlaceholder, results.String(),
+		QueryPlaceholder, query,
+		outputFormatPlaceholder, "",
+	).Replace(template)
+}
+
+// a prompt template with its name, as listed by HandlePromptTemplates
+type NamedPromptTemplate struct {
+	Name    string `json:"name"`
+	Default bool   `json:"default"`
+	PromptTemplate
+}
+
+// list the prompt templates and preview a rendered template
+//
+//	GET  /prompt-templates          list the templates, sorted by name
+//	POST /prompt-templates/preview  render a template, {"promptTemplate": "...", "query": "...", "searchResults": ["..."]}
+//
+// the preview numbers the search results as streamed answers do, bedrock
+// formats them its own way when it renders the template
+func HandlePromptTemplates(w http.ResponseWriter, r *http.Request, cfg *Config) {
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/prompt-templates"), "/")
+
+	var result interface{}
+
+	switch {
+	case path == "" && r.Method == http.MethodGet:
+		templates := []NamedPromptTemplate{}
+		for name, template := range cfg.PromptTemplates {
+			templates = append(templates, NamedPromptTemplate{Name: name, Default: name == cfg.KnowledgeBasePromptTemplate, PromptTemplate: template})
+		}
+		sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+		result = map[string]interface{}{"templates": templates}
+
+	case path == "preview" && r.Method == http.MethodPost:
+
+		var request struct {
+			PromptTemplate string   `json:"promptTemplate"`
+			Query          string   `json:"query"`
+			SearchResults  []string `json:"searchResults"`
+			InferenceParameters
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		template, found, err := cfg.PromptTemplateFor(request.PromptTemplate)
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !found {
+			template.Template = defaultPromptTemplate
+		}
+
+		references := make([]Reference, len(request.SearchResults))
+
+		for k, text := range request.SearchResults {
+			references[k] = Reference{Index: k + 1, Text: text}
+		}
+
+		result = map[string]interface{}{
+			"prompt":              RenderPrompt(template.Template, request.Query, references),
+			"inferenceParameters": template.Parameters(request.InferenceParameters),
+		}
+
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
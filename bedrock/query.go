@@ -0,0 +1,140 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+)
+
+// field of the note index holding the embedding vector
+const VectorField = "vector_field"
+
+// the body of an opensearch _search request
+type SearchBody struct {
+	Size           *int                   `json:"size,omitempty"`
+	From           *int                   `json:"from,omitempty"`
+	Query          SearchQuery            `json:"query"`
+	Source         interface{}            `json:"_source,omitempty"`
+	Sort           []map[string]SortOrder `json:"sort,omitempty"`
+	SearchAfter    []interface{}          `json:"search_after,omitempty"`
+	TrackTotalHits bool                   `json:"track_total_hits,omitempty"`
+	Highlight      *Highlight             `json:"highlight,omitempty"`
+}
+
+// an opensearch query clause, exactly one field should be set
+type SearchQuery struct {
+	Knn        map[string]KnnQuery      `json:"knn,omitempty"`
+	MultiMatch *MultiMatchQuery         `json:"multi_match,omitempty"`
+	Bool       *BoolQuery               `json:"bool,omitempty"`
+	Term       map[string]interface{}   `json:"term,omitempty"`
+	Terms      map[string][]interface{} `json:"terms,omitempty"`
+	IDs        *IDsQuery                `json:"ids,omitempty"`
+	MatchAll   *struct{}                `json:"match_all,omitempty"`
+}
+
+// nearest neighbours of a vector, Filter narrows the candidates
+type KnnQuery struct {
+	Vector []float64    `json:"vector"`
+	K      int          `json:"k"`
+	Filter *SearchQuery `json:"filter,omitempty"`
+}
+
+// full text match of a query over fields
+type MultiMatchQuery struct {
+	Query  string   `json:"query"`
+	Fields []string `json:"fields"`
+	Type   string   `json:"type,omitempty"`
+}
+
+// clauses combined with bool logic, filter and must_not do not score
+type BoolQuery struct {
+	Must               []SearchQuery `json:"must,omitempty"`
+	Should             []SearchQuery `json:"should,omitempty"`
+	Filter             []SearchQuery `json:"filter,omitempty"`
+	MustNot            []SearchQuery `json:"must_not,omitempty"`
+	MinimumShouldMatch *int          `json:"minimum_should_match,omitempty"`
+}
+
+// documents of the given ids
+type IDsQuery struct {
+	Values []string `json:"values"`
+}
+
+// order of a sort field, Missing places documents without it
+type SortOrder struct {
+	Order   string `json:"order"`
+	Missing string `json:"missing,omitempty"`
+}
+
+// fragments of the matching text of fields, HighlightQuery highlights the
+// terms of another query than the one searched, such as a knn query
+type Highlight struct {
+	Fields         map[string]HighlightField `json:"fields"`
+	Encoder        string                    `json:"encoder,omitempty"`
+	HighlightQuery *SearchQuery              `json:"highlight_query,omitempty"`
+}
+
+// fragments of a field, NumberOfFragments 0 highlights the whole field
+type HighlightField struct {
+	FragmentSize      int  `json:"fragment_size,omitempty"`
+	NumberOfFragments *int `json:"number_of_fragments,omitempty"`
+}
+
+// k nearest neighbours of vector in field
+func KnnVectorQuery(field string, vector []float64, k int) SearchQuery {
+	return SearchQuery{Knn: map[string]KnnQuery{field: {Vector: vector, K: k}}}
+}
+
+// full text match of text over fields
+func MultiMatch(text string, fields ...string) SearchQuery {
+	return SearchQuery{MultiMatch: &MultiMatchQuery{Query: text, Fields: fields}}
+}
+
+// exact match of a keyword, number or boolean field
+func TermQuery(field string, value interface{}) SearchQuery {
+	return SearchQuery{Term: map[string]interface{}{field: value}}
+}
+
+// exact match of any of values
+func TermsQuery(field string, values ...interface{}) SearchQuery {
+	return SearchQuery{Terms: map[string][]interface{}{field: values}}
+}
+
+// the _source of search hits without the vectors
+func excludeVector() interface{} {
+	return map[string][]string{"excludes": {VectorField}}
+}
+
+// a chunk of a note in the note index, Start and End are the character
+// offsets of Text in the text of the note
+type IndexDocument struct {
+	Title      string    `json:"title"`
+	Link       string    `json:"link"`
+	Text       string    `json:"text"`
+	ParentID   string    `json:"parent_id,omitempty"`
+	ChunkIndex int       `json:"chunk_index"`
+	Start      int       `json:"start_offset"`
+	End        int       `json:"end_offset"`
+	Heading    string    `json:"heading,omitempty"`
+	Vector     []float64 `json:"vector_field,omitempty"`
+}
+
+// a request body encoding v as json, so values are escaped whatever they
+// contain
+func jsonBody(v interface{}) (io.Reader, error) {
+
+	body, err := json.Marshal(v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(body), nil
+}
+
+func intPtr(n int) *int {
+	return &n
+}
@@ -0,0 +1,176 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// titles and texts which break json built with string formatting
+var hostileInputs = []string{
+	`plain`,
+	`"quoted"`,
+	`back\slash \" \\"`,
+	"new\nline\r\ttab",
+	`"}`,
+	`"}, "query": {"match_all": {}}, "x": {"`,
+	`</script><script>alert(1)</script>`,
+	"nul \x00 and   separators  ",
+	`{{.Title}} %s %v %!`,
+	"emoji 😀 and accents é",
+	``,
+}
+
+func TestSearchBodyHostileInput(t *testing.T) {
+
+	for _, input := range hostileInputs {
+
+		bodies := map[string]SearchBody{
+			"multi_match": {Size: intPtr(10), Query: MultiMatch(input, "title", "text")},
+			"term":        {Query: filterOf(TermQuery("link", input))},
+			"terms":       {Query: TermsQuery("parent_id", input, input+"2")},
+			"ids":         {Query: SearchQuery{IDs: &IDsQuery{Values: []string{input}}}},
+			"title page":  titleSearchBody(input, SearchPage{Size: 5}),
+			"vector page": vectorSearchBody([]float64{0.1, -0.2, 3e-9}, input, SearchPage{Size: 5}, 0, nil),
+		}
+
+		for name, body := range bodies {
+
+			reader, err := jsonBody(body)
+
+			if err != nil {
+				t.Fatalf("%s %q: %v", name, input, err)
+			}
+
+			data, err := io.ReadAll(reader)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !json.Valid(data) {
+				t.Fatalf("%s %q: invalid json %s", name, input, data)
+			}
+
+			// html is escaped, so the body can never close a script tag
+			if strings.Contains(string(data), "</script>") {
+				t.Errorf("%s %q: unescaped </script> in %s", name, input, data)
+			}
+
+			var decoded SearchBody
+
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatalf("%s %q: %v", name, input, err)
+			}
+
+			// the input stays a value and never becomes part of the query
+			var generic map[string]interface{}
+			json.Unmarshal(data, &generic)
+
+			if _, ok := generic["x"]; ok {
+				t.Errorf("%s %q: input escaped its value: %s", name, input, data)
+			}
+
+			if query, _ := generic["query"].(map[string]interface{}); len(query) != 1 {
+				t.Errorf("%s %q: query has %d clauses, want 1: %s", name, input, len(query), data)
+			}
+
+			again, _ := json.Marshal(decoded)
+			first, _ := json.Marshal(body)
+
+			if string(again) != string(first) {
+				t.Errorf("%s %q: round trip changed the body\n got %s\nwant %s", name, input, again, first)
+			}
+		}
+	}
+}
+
+// a bool query of filters, for the tests
+func filterOf(filters ...SearchQuery) SearchQuery {
+	return SearchQuery{Bool: &BoolQuery{Filter: filters}}
+}
+
+func TestMultiMatchKeepsQuery(t *testing.T) {
+
+	for _, input := range hostileInputs {
+
+		var decoded SearchBody
+
+		data, _ := json.Marshal(SearchBody{Query: MultiMatch(input, "title")})
+
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+
+		if decoded.Query.MultiMatch == nil || decoded.Query.MultiMatch.Query != input {
+			t.Errorf("multi_match query %q came back as %+v", input, decoded.Query.MultiMatch)
+		}
+	}
+}
+
+func TestIndexDocumentHostileInput(t *testing.T) {
+
+	var documents []IndexDocument
+
+	for k, input := range hostileInputs {
+		documents = append(documents, IndexDocument{
+			Title:      input,
+			Link:       "https://example.com/?q=" + input,
+			Text:       input + "\n\n" + input,
+			ParentID:   input,
+			ChunkIndex: k,
+			Start:      k,
+			End:        k + len(input),
+			Heading:    input,
+			Vector:     []float64{float64(k), -1.5, 1e-7},
+		})
+	}
+
+	body, err := bulkBody(documents)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// _bulk is one json value per line, an action then its document
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+
+	if len(lines) != 2*len(documents) {
+		t.Fatalf("%d bulk lines for %d documents", len(lines), len(documents))
+	}
+
+	for k, document := range documents {
+
+		if lines[2*k] != `{"index":{}}` {
+			t.Errorf("action %d is %s", k, lines[2*k])
+		}
+
+		line := lines[2*k+1]
+
+		if strings.Contains(line, "</script>") {
+			t.Errorf("document %d: unescaped </script> in %s", k, line)
+		}
+
+		var decoded IndexDocument
+
+		if err := json.Unmarshal([]byte(line), &decoded); err != nil {
+			t.Fatalf("document %d: %v in %s", k, err, line)
+		}
+
+		if !reflect.DeepEqual(decoded, document) {
+			t.Errorf("document %d round trip\n got %+v\nwant %+v", k, decoded, document)
+		}
+	}
+}
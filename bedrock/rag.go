@@ -0,0 +1,358 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
+)
+
+// server-sent event name of a citation in a streamed knowledge base answer
+const EventCitation = "citation"
+
+// the prompt of streamed knowledge base answers, the model cites the search
+// results by number and the markers are turned into citation events
+const (
+	ragSystemPrompt = "You answer questions using only the numbered search results. After each sentence that uses a search result, cite it with its number in square brackets, for example [1] or [1][3]. If the search results do not contain the answer, say that you do not know."
+
+	// longest marker held back while waiting for its closing bracket
+	maxCitationMarker = 16
+)
+
+// a retrieved chunk the answer can cite, Index is the number the model
+// cites it by
+type Reference struct {
+	Index int     `json:"index"`
+	URI   string  `json:"uri"`
+	Text  string  `json:"text"`
+	Score float64 `json:"score"`
+}
+
+// character offsets of a part of the answer text, End is exclusive
+type Span struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// sse data of the citation event: a part of the answer and the references
+// supporting it
+type CitationEvent struct {
+	Span       Span        `json:"span"`
+	Text       string      `json:"text"`
+	References []Reference `json:"references"`
+}
+
+// the references of a retrieve output, numbered from 1
+func RetrievalReferences(output *bedrockagentruntime.RetrieveOutput) []Reference {
+
+	references := []Reference{}
+
+	for _, result := range output.RetrievalResults {
+
+		reference := Reference{Index: len(references) + 1, Score: aws.ToFloat64(result.Score)}
+
+		if result.Content != nil {
+			reference.Text = aws.ToString(result.Content.Text)
+		}
+
+		if result.Location != nil && result.Location.S3Location != nil {
+			reference.URI = aws.ToString(result.Location.S3Location.Uri)
+		}
+
+		references = append(references, reference)
+	}
+
+	return references
+}
+
+// strip [n] citation markers from streamed text and turn them into
+// citations of the text written since the previous citation
+//
+// markers may be split across deltas, so text starting with [ is held back
+// until it is known not to be a marker
+type CitationParser struct {
+	references []Reference
+
+	// runes of answer text written so far and where the current span starts
+	offset    int
+	spanStart int
+	span      strings.Builder
+
+	marker  strings.Builder
+	pending *CitationEvent
+}
+
+func NewCitationParser(references []Reference) *CitationParser {
+	return &CitationParser{references: references}
+}
+
+// the answer text of a delta without markers, and the citations completed
+// by it
+func (p *CitationParser) Write(delta string) (string, []CitationEvent) {
+
+	var text strings.Builder
+	var citations []CitationEvent
+
+	for _, r := range delta {
+
+		if p.marker.Len() > 0 {
+
+			p.marker.WriteRune(r)
+
+			if r == ']' {
+				p.closeMarker(&text)
+				continue
+			}
+
+			if (unicode.IsDigit(r) || r == ',' || r == ' ') && p.marker.Len() <= maxCitationMarker {
+				continue
+			}
+
+			// not a marker after all, write it out as text
+			held := p.marker.String()
+			p.marker.Reset()
+			citations = p.writeText(&text, held, citations)
+			continue
+		}
+
+		if r == '[' {
+			p.marker.WriteRune(r)
+			continue
+		}
+
+		citations = p.writeText(&text, string(r), citations)
+	}
+
+	return text.String(), citations
+}
+
+// the held back text and the last citation at the end of the answer
+func (p *CitationParser) Flush() (string, []CitationEvent) {
+
+	var text strings.Builder
+	var citations []CitationEvent
+
+	if p.marker.Len() > 0 {
+		held := p.marker.String()
+		p.marker.Reset()
+		citations = p.writeText(&text, held, citations)
+	}
+
+	if p.pending != nil {
+		citations = append(citations, *p.pending)
+		p.pending = nil
+	}
+
+	return text.String(), citations
+}
+
+// a complete marker cites the span written since the previous citation, a
+// marker right after another one adds to the same citation
+func (p *CitationParser) closeMarker(text *strings.Builder) {
+
+	marker := p.marker.String()
+	p.marker.Reset()
+
+	var references []Reference
+
+	for _, field := range strings.Split(strings.Trim(marker, "[]"), ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || n < 1 || n > len(p.references) {
+			continue
+		}
+		references = append(references, p.references[n-1])
+	}
+
+	if len(references) == 0 {
+		// [] or unknown numbers are answer text
+		p.writeRunes(text, marker)
+		return
+	}
+
+	if p.pending == nil {
+		p.pending = &CitationEvent{Span: Span{Start: p.spanStart, End: p.offset}, Text: p.span.String()}
+		p.spanStart = p.offset
+		p.span.Reset()
+	}
+
+	for _, reference := range references {
+		if !containsReference(p.pending.References, reference.Index) {
+			p.pending.References = append(p.pending.References, reference)
+		}
+	}
+}
+
+// write answer text, text other than white space after a marker completes
+// the pending citation
+func (p *CitationParser) writeText(text *strings.Builder, s string, citations []CitationEvent) []CitationEvent {
+
+	if p.pending != nil && strings.TrimSpace(s) != "" {
+		citations = append(citations, *p.pending)
+		p.pending = nil
+	}
+
+	p.writeRunes(text, s)
+
+	return citations
+}
+
+func (p *CitationParser) writeRunes(text *strings.Builder, s string) {
+	text.WriteString(s)
+	p.span.WriteString(s)
+	p.offset += utf8.RuneCountInString(s)
+}
+
+func containsReference(references []Reference, index int) bool {
+	for _, reference := range references {
+		if reference.Index == index {
+			return true
+		}
+	}
+	return false
+}
+
+// strip the citation markers from the text of chunks, each citation is
+// passed to cite after the text it covers and a false return stops reading
+func CitationChunks(chunks ChunkReader, parser *CitationParser, cite func(CitationEvent) bool) ChunkReader {
+
+	return func(yield func(ModelChunk) bool) error {
+
+		emit := func(chunk ModelChunk, citations []CitationEvent) bool {
+			if !yield(chunk) {
+				return false
+			}
+			for _, citation := range citations {
+				if !cite(citation) {
+					return false
+				}
+			}
+			return true
+		}
+
+		stopped := false
+
+		err := chunks(func(chunk ModelChunk) bool {
+			var citations []CitationEvent
+			chunk.Text, citations = parser.Write(chunk.Text)
+			stopped = !emit(chunk, citations)
+			return !stopped
+		})
+
+		if err != nil || stopped {
+			return err
+		}
+
+		text, citations := parser.Flush()
+
+		emit(ModelChunk{Text: text}, citations)
+
+		return nil
+	}
+}
+
+// the model of the knowledge base config, KnowledgeBaseModelID may be a
+// foundation model arn; models without an adapter use the converse api
+func KnowledgeBaseModel(cfg *Config) (ModelInfo, ModelAdapter) {
+
+	modelID := cfg.KnowledgeBaseModelID
+
+	if i := strings.LastIndex(modelID, "/"); i >= 0 {
+		modelID = modelID[i+1:]
+	}
+
+	adapter, err := AdapterForModel(modelID)
+
+	info := ModelInfoFor(modelID)
+	info.Converse = cfg.UsesConverse(modelID) || err != nil
+
+	return info, adapter
+}
+
+// the messages of a knowledge base answer: the prior turns followed by the
+// question rendered into the template with the numbered search results
+func ragMessages(messages []Message, question string, template string, references []Reference) []Message {
+
+	prompt := Message{Role: "user", Content: []Content{{Type: "text", Text: RenderPrompt(template, question, references)}}}
+
+	return append(append([]Message(nil), messages[:len(messages)-1]...), prompt)
+}
+
+// answer the last question of a conversation from the knowledge base as
+// server-sent events: retrieve the chunks, stream the answer of the
+// knowledge base model and emit a citation event after each cited part
+//
+// the prior turns are sent to the model, a follow-up question is rewritten
+// into a standalone question for routing and retrieval, and the question is
+// rendered into the prompt template with the chunks of all routed knowledge
+// bases
+func streamRetrieveAndGenerate(w http.ResponseWriter, r *http.Request, client KnowledgeBaseClient, BedrockClient ModelInvoker, router KnowledgeBaseRouter, cfg *Config, knowledgeBase string, messages []Message, retrieval *types.KnowledgeBaseRetrievalConfiguration, template string, params InferenceParameters) {
+
+	question := strings.TrimSpace(messageText(messages[len(messages)-1]))
+
+	query := RewriteQuestion(r.Context(), BedrockClient, cfg, messages)
+
+	bases, err := SelectKnowledgeBases(r.Context(), cfg, router, knowledgeBase, query)
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	output, err := RetrieveFromKnowledgeBases(r.Context(), client, cfg, bases, query, retrieval)
+
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("X-Knowledge-Bases", strings.Join(bases, ","))
+
+	references := RetrievalReferences(output)
+
+	info, adapter := KnowledgeBaseModel(cfg)
+
+	params.System = ragSystemPrompt
+	prompt := ragMessages(messages, question, template, references)
+
+	var converse ConverseRequest
+	var payloadBytes []byte
+
+	if info.Converse {
+		converse, err = NewConverseRequest(info.ID, prompt, params)
+	} else {
+		payloadBytes, err = adapter.BuildRequest(prompt, params)
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sse := NewSSEWriter(w)
+
+	chunks, closeStream, err := invokeStream(r.Context(), BedrockClient, info, adapter, converse, payloadBytes)
+
+	if err != nil {
+		fmt.Println(err)
+		sse.Error(err)
+		return
+	}
+
+	defer closeStream()
+
+	cite := func(citation CitationEvent) bool {
+		return sse.Event(EventCitation, citation) == nil
+	}
+
+	StreamEvents(sse, CitationChunks(chunks, NewCitationParser(references), cite), MessageStartEvent{Model: info.ID})
+}
@@ -0,0 +1,165 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
+)
+
+// a citation as span, text and the cited indexes, for comparing
+func citationString(citation CitationEvent) string {
+
+	indexes := make([]int, 0, len(citation.References))
+
+	for _, reference := range citation.References {
+		indexes = append(indexes, reference.Index)
+	}
+
+	return fmt.Sprintf("%d-%d %q %v", citation.Span.Start, citation.Span.End, citation.Text, indexes)
+}
+
+func TestCitationParser(t *testing.T) {
+
+	references := []Reference{{Index: 1, URI: "s3://a"}, {Index: 2, URI: "s3://b"}, {Index: 3, URI: "s3://c"}}
+
+	tests := []struct {
+		name      string
+		deltas    []string
+		text      string
+		citations []string
+	}{
+		{name: "no markers", deltas: []string{"Hello", " world"}, text: "Hello world"},
+		{name: "one marker", deltas: []string{"Lambda is serverless [1]. It scales."}, text: "Lambda is serverless . It scales.", citations: []string{`0-21 "Lambda is serverless " [1]`}},
+		{name: "marker split across deltas", deltas: []string{"Lambda runs [1", "] code."}, text: "Lambda runs  code.", citations: []string{`0-12 "Lambda runs " [1]`}},
+		{name: "marker split rune by rune", deltas: []string{"Lambda", "[", "2", "]", " ", "runs"}, text: "Lambda runs", citations: []string{`0-6 "Lambda" [2]`}},
+		{name: "adjacent markers", deltas: []string{"Lambda[1][3] runs"}, text: "Lambda runs", citations: []string{`0-6 "Lambda" [1 3]`}},
+		{name: "list marker", deltas: []string{"Lambda[1, 3] runs"}, text: "Lambda runs", citations: []string{`0-6 "Lambda" [1 3]`}},
+		{name: "repeated number", deltas: []string{"Lambda[2][2] runs"}, text: "Lambda runs", citations: []string{`0-6 "Lambda" [2]`}},
+		{name: "two citations", deltas: []string{"A [1]. B [2]."}, text: "A . B .", citations: []string{`0-2 "A " [1]`, `2-6 ". B " [2]`}},
+		{name: "empty brackets", deltas: []string{"a [] b"}, text: "a [] b"},
+		{name: "unknown number", deltas: []string{"a [7] b [0]"}, text: "a [7] b [0]"},
+		{name: "unknown and known number", deltas: []string{"a [7, 1] b"}, text: "a  b", citations: []string{`0-2 "a " [1]`}},
+		{name: "not a marker", deltas: []string{"x[i] = [a, b]"}, text: "x[i] = [a, b]"},
+		{name: "marker too long", deltas: []string{"a [" + strings.Repeat("1", 20) + "]"}, text: "a [" + strings.Repeat("1", 20) + "]"},
+		{name: "marker at the end", deltas: []string{"done [2]"}, text: "done ", citations: []string{`0-5 "done " [2]`}},
+		{name: "white space after the marker", deltas: []string{"done [2]", "  "}, text: "done   ", citations: []string{`0-5 "done " [2]`}},
+		{name: "unfinished marker at the end", deltas: []string{"see [1"}, text: "see [1"},
+		{name: "offsets in runes", deltas: []string{"héllo wörld [1] 😀 ok [2]"}, text: "héllo wörld  😀 ok ", citations: []string{`0-12 "héllo wörld " [1]`, `12-18 " 😀 ok " [2]`}},
+		{name: "rune split across deltas", deltas: []string{"caf", "é [3]"}, text: "café ", citations: []string{`0-5 "café " [3]`}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			parser := NewCitationParser(references)
+
+			var text strings.Builder
+			var citations []string
+
+			for _, delta := range test.deltas {
+				written, cited := parser.Write(delta)
+				text.WriteString(written)
+				for _, citation := range cited {
+					citations = append(citations, citationString(citation))
+				}
+			}
+
+			written, cited := parser.Flush()
+			text.WriteString(written)
+			for _, citation := range cited {
+				citations = append(citations, citationString(citation))
+			}
+
+			if text.String() != test.text {
+				t.Errorf("got text %q, want %q", text.String(), test.text)
+			}
+
+			if !reflect.DeepEqual(citations, test.citations) {
+				t.Errorf("got citations %q, want %q", citations, test.citations)
+			}
+		})
+	}
+}
+
+func TestStreamRetrieveAndGenerate(t *testing.T) {
+
+	question := `"messages": [{"role": "user", "content": [{"type": "text", "text": "what is lambda?"}]}]`
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		system string
+		err    string
+	}{
+		{name: "default system prompt", body: `{` + question + `}`, status: 200, system: ragSystemPrompt},
+		{name: "system prompt of the client", body: `{"system": "answer in french", ` + question + `}`, status: 400, err: "system is not supported by knowledge base answers, use a prompt template"},
+		{name: "session", body: `{"sessionId": "session-1", ` + question + `}`, status: 400, err: "sessionId is not supported for streamed answers, send the prior turns in messages"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			cfg := DefaultConfig()
+
+			clients := testClients{
+				models: &FakeModelInvoker{Deltas: []string{"Lambda is serverless [", "1].", " It scales."}},
+				knowledgeBases: &FakeKnowledgeBase{
+					RetrieveOutput: &bedrockagentruntime.RetrieveOutput{
+						RetrievalResults: []types.KnowledgeBaseRetrievalResult{{
+							Content:  &types.RetrievalResultContent{Text: aws.String("lambda is serverless")},
+							Location: &types.RetrievalResultLocation{S3Location: &types.RetrievalResultS3Location{Uri: aws.String("s3://docs/lambda.md")}},
+							Score:    aws.Float64(0.6),
+						}},
+					},
+				},
+				notes:         &FakeVectorStore{},
+				conversations: NewMemoryConversationStore(),
+			}
+
+			request := httptest.NewRequest("POST", "/knowledge-base-retrieve-and-generate", strings.NewReader(test.body))
+			request.Header.Set("Accept", "text/event-stream")
+
+			response := httptest.NewRecorder()
+			newTestServer(&cfg, clients).ServeHTTP(response, request)
+
+			if response.Code != test.status {
+				t.Fatalf("status %d, want %d: %s", response.Code, test.status, response.Body)
+			}
+
+			if test.status != http.StatusOK {
+				if got := strings.TrimSpace(response.Body.String()); got != test.err {
+					t.Errorf("body %q", got)
+				}
+				if len(clients.models.Bodies()) != 0 || len(clients.knowledgeBases.RetrieveInputs()) != 0 {
+					t.Error("a rejected request called a client")
+				}
+				return
+			}
+
+			var body RequestBodyClaude3
+			decodeBody(t, clients.models.Bodies()[0], &body)
+
+			if body.System != test.system {
+				t.Errorf("got system %q, want %q", body.System, test.system)
+			}
+
+			want := `event: citation
+data: {"span":{"start":0,"end":21},"text":"Lambda is serverless ","references":[{"index":1,"uri":"s3://docs/lambda.md","text":"lambda is serverless","score":0.6}]}`
+
+			if !strings.Contains(response.Body.String(), want) {
+				t.Errorf("no citation event in\n%s", response.Body)
+			}
+		})
+	}
+}
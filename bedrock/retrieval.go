@@ -0,0 +1,233 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/document"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
+)
+
+// bedrock returns at most this many results per retrieval
+const maxNumberOfResults = 100
+
+// retrieval options of a knowledge base request, zero values use the config
+// and the default search of the knowledge base
+type RetrievalOptions struct {
+	NumberOfResults    int             `json:"numberOfResults,omitempty"`
+	OverrideSearchType string          `json:"overrideSearchType,omitempty"`
+	Filter             *MetadataFilter `json:"filter,omitempty"`
+}
+
+// a metadata filter expression with exactly one operator set, for example
+//
+//	{"andAll": [
+//	  {"equals": {"key": "team", "value": "hr"}},
+//	  {"greaterThan": {"key": "year", "value": 2022}}
+//	]}
+type MetadataFilter struct {
+	Equals              *FilterCondition `json:"equals,omitempty"`
+	NotEquals           *FilterCondition `json:"notEquals,omitempty"`
+	GreaterThan         *FilterCondition `json:"greaterThan,omitempty"`
+	GreaterThanOrEquals *FilterCondition `json:"greaterThanOrEquals,omitempty"`
+	LessThan            *FilterCondition `json:"lessThan,omitempty"`
+	LessThanOrEquals    *FilterCondition `json:"lessThanOrEquals,omitempty"`
+	In                  *FilterCondition `json:"in,omitempty"`
+	NotIn               *FilterCondition `json:"notIn,omitempty"`
+	StartsWith          *FilterCondition `json:"startsWith,omitempty"`
+	AndAll              []MetadataFilter `json:"andAll,omitempty"`
+	OrAll               []MetadataFilter `json:"orAll,omitempty"`
+}
+
+// a metadata key and the value it is compared with, as decoded from json
+type FilterCondition struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+// check the options, the filter is checked by translating it
+func (o RetrievalOptions) Validate() error {
+
+	var errs []error
+
+	if o.NumberOfResults < 0 || o.NumberOfResults > maxNumberOfResults {
+		errs = append(errs, fmt.Errorf("numberOfResults must be between 0 and %d (0 for the default), got %d", maxNumberOfResults, o.NumberOfResults))
+	}
+
+	switch types.SearchType(o.OverrideSearchType) {
+	case "", types.SearchTypeHybrid, types.SearchTypeSemantic:
+	default:
+		errs = append(errs, fmt.Errorf("overrideSearchType must be %s or %s, got %q", types.SearchTypeHybrid, types.SearchTypeSemantic, o.OverrideSearchType))
+	}
+
+	if o.Filter != nil {
+		if _, err := o.Filter.RetrievalFilter(); err != nil {
+			errs = append(errs, fmt.Errorf("filter: %w", err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// vector search of the knowledge base with the options of a request,
+// numberOfResults defaults to the config
+func retrievalConfiguration(cfg *Config, options RetrievalOptions) (*types.KnowledgeBaseRetrievalConfiguration, error) {
+
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	numberOfResults := cfg.KnowledgeBaseNumberOfResult
+
+	if options.NumberOfResults > 0 {
+		numberOfResults = options.NumberOfResults
+	}
+
+	search := &types.KnowledgeBaseVectorSearchConfiguration{
+		NumberOfResults:    aws.Int32(int32(numberOfResults)),
+		OverrideSearchType: types.SearchType(options.OverrideSearchType),
+	}
+
+	if options.Filter != nil {
+		search.Filter, _ = options.Filter.RetrievalFilter()
+	}
+
+	return &types.KnowledgeBaseRetrievalConfiguration{VectorSearchConfiguration: search}, nil
+}
+
+// translate the expression to the bedrock filter union
+func (f MetadataFilter) RetrievalFilter() (types.RetrievalFilter, error) {
+
+	var filters []types.RetrievalFilter
+	var errs []error
+
+	add := func(name string, condition *FilterCondition, check func(value interface{}) bool, want string, member func(types.FilterAttribute) types.RetrievalFilter) {
+
+		if condition == nil {
+			return
+		}
+
+		if strings.TrimSpace(condition.Key) == "" {
+			errs = append(errs, fmt.Errorf("%s: key is required", name))
+			return
+		}
+
+		if !check(condition.Value) {
+			errs = append(errs, fmt.Errorf("%s %s: value must be %s, got %v", name, condition.Key, want, condition.Value))
+			return
+		}
+
+		filters = append(filters, member(types.FilterAttribute{
+			Key:   aws.String(condition.Key),
+			Value: document.NewLazyDocument(condition.Value),
+		}))
+	}
+
+	add("equals", f.Equals, isScalar, "a string, number or boolean", func(a types.FilterAttribute) types.RetrievalFilter {
+		return &types.RetrievalFilterMemberEquals{Value: a}
+	})
+	add("notEquals", f.NotEquals, isScalar, "a string, number or boolean", func(a types.FilterAttribute) types.RetrievalFilter {
+		return &types.RetrievalFilterMemberNotEquals{Value: a}
+	})
+	add("greaterThan", f.GreaterThan, isNumber, "a number", func(a types.FilterAttribute) types.RetrievalFilter {
+		return &types.RetrievalFilterMemberGreaterThan{Value: a}
+	})
+	add("greaterThanOrEquals", f.GreaterThanOrEquals, isNumber, "a number", func(a types.FilterAttribute) types.RetrievalFilter {
+		return &types.RetrievalFilterMemberGreaterThanOrEquals{Value: a}
+	})
+	add("lessThan", f.LessThan, isNumber, "a number", func(a types.FilterAttribute) types.RetrievalFilter {
+		return &types.RetrievalFilterMemberLessThan{Value: a}
+	})
+	add("lessThanOrEquals", f.LessThanOrEquals, isNumber, "a number", func(a types.FilterAttribute) types.RetrievalFilter {
+		return &types.RetrievalFilterMemberLessThanOrEquals{Value: a}
+	})
+	add("in", f.In, isScalarList, "a non-empty list of strings or numbers", func(a types.FilterAttribute) types.RetrievalFilter {
+		return &types.RetrievalFilterMemberIn{Value: a}
+	})
+	add("notIn", f.NotIn, isScalarList, "a non-empty list of strings or numbers", func(a types.FilterAttribute) types.RetrievalFilter {
+		return &types.RetrievalFilterMemberNotIn{Value: a}
+	})
+	add("startsWith", f.StartsWith, isString, "a string", func(a types.FilterAttribute) types.RetrievalFilter {
+		return &types.RetrievalFilterMemberStartsWith{Value: a}
+	})
+
+	group := func(name string, members []MetadataFilter, wrap func([]types.RetrievalFilter) types.RetrievalFilter) {
+
+		if members == nil {
+			return
+		}
+
+		// bedrock rejects groups of fewer than two filters
+		if len(members) < 2 {
+			errs = append(errs, fmt.Errorf("%s needs at least 2 filters, got %d", name, len(members)))
+			return
+		}
+
+		var translated []types.RetrievalFilter
+
+		for k, member := range members {
+			filter, err := member.RetrievalFilter()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s[%d]: %w", name, k, err))
+				continue
+			}
+			translated = append(translated, filter)
+		}
+
+		filters = append(filters, wrap(translated))
+	}
+
+	group("andAll", f.AndAll, func(members []types.RetrievalFilter) types.RetrievalFilter {
+		return &types.RetrievalFilterMemberAndAll{Value: members}
+	})
+	group("orAll", f.OrAll, func(members []types.RetrievalFilter) types.RetrievalFilter {
+		return &types.RetrievalFilterMemberOrAll{Value: members}
+	})
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	if len(filters) != 1 {
+		return nil, fmt.Errorf("a filter needs exactly one operator, got %d", len(filters))
+	}
+
+	return filters[0], nil
+}
+
+func isString(value interface{}) bool {
+	_, ok := value.(string)
+	return ok
+}
+
+func isNumber(value interface{}) bool {
+	_, ok := value.(float64)
+	return ok
+}
+
+func isScalar(value interface{}) bool {
+	_, ok := value.(bool)
+	return ok || isString(value) || isNumber(value)
+}
+
+func isScalarList(value interface{}) bool {
+
+	values, ok := value.([]interface{})
+
+	if !ok || len(values) == 0 {
+		return false
+	}
+
+	for _, v := range values {
+		if !isString(v) && !isNumber(v) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,161 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/document"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime/types"
+)
+
+// a filter attribute of a key and a value as decoded from json
+func filterAttribute(key string, value interface{}) types.FilterAttribute {
+	return types.FilterAttribute{Key: aws.String(key), Value: document.NewLazyDocument(value)}
+}
+
+func TestMetadataFilterRetrievalFilter(t *testing.T) {
+
+	team := &types.RetrievalFilterMemberEquals{Value: filterAttribute("team", "hr")}
+	year := &types.RetrievalFilterMemberGreaterThan{Value: filterAttribute("year", 2022.0)}
+
+	tests := []struct {
+		name   string
+		filter string
+		want   types.RetrievalFilter
+		err    string
+	}{
+		{name: "equals string", filter: `{"equals": {"key": "team", "value": "hr"}}`, want: team},
+		{name: "equals number", filter: `{"equals": {"key": "year", "value": 2022}}`, want: &types.RetrievalFilterMemberEquals{Value: filterAttribute("year", 2022.0)}},
+		{name: "equals boolean", filter: `{"equals": {"key": "public", "value": true}}`, want: &types.RetrievalFilterMemberEquals{Value: filterAttribute("public", true)}},
+		{name: "not equals", filter: `{"notEquals": {"key": "team", "value": "hr"}}`, want: &types.RetrievalFilterMemberNotEquals{Value: filterAttribute("team", "hr")}},
+		{name: "greater than", filter: `{"greaterThan": {"key": "year", "value": 2022}}`, want: year},
+		{name: "greater than or equals", filter: `{"greaterThanOrEquals": {"key": "year", "value": 2022.5}}`, want: &types.RetrievalFilterMemberGreaterThanOrEquals{Value: filterAttribute("year", 2022.5)}},
+		{name: "less than", filter: `{"lessThan": {"key": "year", "value": -1}}`, want: &types.RetrievalFilterMemberLessThan{Value: filterAttribute("year", -1.0)}},
+		{name: "less than or equals", filter: `{"lessThanOrEquals": {"key": "year", "value": 0}}`, want: &types.RetrievalFilterMemberLessThanOrEquals{Value: filterAttribute("year", 0.0)}},
+		{name: "in", filter: `{"in": {"key": "team", "value": ["hr", 7]}}`, want: &types.RetrievalFilterMemberIn{Value: filterAttribute("team", []interface{}{"hr", 7.0})}},
+		{name: "not in", filter: `{"notIn": {"key": "team", "value": ["it"]}}`, want: &types.RetrievalFilterMemberNotIn{Value: filterAttribute("team", []interface{}{"it"})}},
+		{name: "starts with", filter: `{"startsWith": {"key": "path", "value": "policies/"}}`, want: &types.RetrievalFilterMemberStartsWith{Value: filterAttribute("path", "policies/")}},
+		{
+			name:   "and all",
+			filter: `{"andAll": [{"equals": {"key": "team", "value": "hr"}}, {"greaterThan": {"key": "year", "value": 2022}}]}`,
+			want:   &types.RetrievalFilterMemberAndAll{Value: []types.RetrievalFilter{team, year}},
+		},
+		{
+			name:   "or all in and all",
+			filter: `{"andAll": [{"orAll": [{"equals": {"key": "team", "value": "hr"}}, {"startsWith": {"key": "path", "value": "hr/"}}]}, {"greaterThan": {"key": "year", "value": 2022}}]}`,
+			want: &types.RetrievalFilterMemberAndAll{Value: []types.RetrievalFilter{
+				&types.RetrievalFilterMemberOrAll{Value: []types.RetrievalFilter{team, &types.RetrievalFilterMemberStartsWith{Value: filterAttribute("path", "hr/")}}},
+				year,
+			}},
+		},
+
+		{name: "no operator", filter: `{}`, err: "a filter needs exactly one operator, got 0"},
+		{name: "two operators", filter: `{"equals": {"key": "team", "value": "hr"}, "greaterThan": {"key": "year", "value": 2022}}`, err: "a filter needs exactly one operator, got 2"},
+		{name: "no key", filter: `{"equals": {"key": " ", "value": "hr"}}`, err: "equals: key is required"},
+		{name: "null value", filter: `{"equals": {"key": "team", "value": null}}`, err: "equals team: value must be a string, number or boolean, got <nil>"},
+		{name: "list for equals", filter: `{"equals": {"key": "team", "value": ["hr"]}}`, err: "equals team: value must be a string, number or boolean, got [hr]"},
+		{name: "string for greater than", filter: `{"greaterThan": {"key": "year", "value": "2022"}}`, err: "greaterThan year: value must be a number, got 2022"},
+		{name: "boolean for less than", filter: `{"lessThan": {"key": "year", "value": true}}`, err: "lessThan year: value must be a number, got true"},
+		{name: "empty in", filter: `{"in": {"key": "team", "value": []}}`, err: "in team: value must be a non-empty list of strings or numbers, got []"},
+		{name: "boolean in", filter: `{"notIn": {"key": "team", "value": [true]}}`, err: "notIn team: value must be a non-empty list of strings or numbers, got [true]"},
+		{name: "number for starts with", filter: `{"startsWith": {"key": "path", "value": 1}}`, err: "startsWith path: value must be a string, got 1"},
+		{name: "group of one", filter: `{"andAll": [{"equals": {"key": "team", "value": "hr"}}]}`, err: "andAll needs at least 2 filters, got 1"},
+		{name: "empty group", filter: `{"orAll": []}`, err: "orAll needs at least 2 filters, got 0"},
+		{
+			name:   "nested error",
+			filter: `{"andAll": [{"equals": {"key": "team", "value": "hr"}}, {"orAll": [{"equals": {"key": "team", "value": "it"}}, {"lessThan": {"key": "year", "value": "x"}}]}]}`,
+			err:    "andAll[1]: orAll[1]: lessThan year: value must be a number, got x",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			var filter MetadataFilter
+
+			if err := json.Unmarshal([]byte(test.filter), &filter); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := filter.RetrievalFilter()
+
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRetrievalConfiguration(t *testing.T) {
+
+	cfg := DefaultConfig()
+	cfg.KnowledgeBaseNumberOfResult = 7
+
+	tests := []struct {
+		name            string
+		options         RetrievalOptions
+		numberOfResults int32
+		searchType      types.SearchType
+		err             string
+	}{
+		{name: "defaults", numberOfResults: 7},
+		{name: "number of results", options: RetrievalOptions{NumberOfResults: 100, OverrideSearchType: "HYBRID"}, numberOfResults: 100, searchType: types.SearchTypeHybrid},
+		{name: "one result", options: RetrievalOptions{NumberOfResults: 1, OverrideSearchType: "SEMANTIC"}, numberOfResults: 1, searchType: types.SearchTypeSemantic},
+		{name: "negative", options: RetrievalOptions{NumberOfResults: -1}, err: "numberOfResults must be between 0 and 100 (0 for the default), got -1"},
+		{name: "too many", options: RetrievalOptions{NumberOfResults: 101}, err: "numberOfResults must be between 0 and 100 (0 for the default), got 101"},
+		{name: "search type", options: RetrievalOptions{OverrideSearchType: "hybrid"}, err: `overrideSearchType must be HYBRID or SEMANTIC, got "hybrid"`},
+		{name: "filter", options: RetrievalOptions{Filter: &MetadataFilter{}}, err: "filter: a filter needs exactly one operator, got 0"},
+		{
+			name:    "every error",
+			options: RetrievalOptions{NumberOfResults: 101, OverrideSearchType: "x", Filter: &MetadataFilter{}},
+			err:     "numberOfResults must be between 0 and 100 (0 for the default), got 101\noverrideSearchType must be HYBRID or SEMANTIC, got \"x\"\nfilter: a filter needs exactly one operator, got 0",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			retrieval, err := retrievalConfiguration(&cfg, test.options)
+
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			search := retrieval.VectorSearchConfiguration
+
+			if aws.ToInt32(search.NumberOfResults) != test.numberOfResults || search.OverrideSearchType != test.searchType || search.Filter != nil {
+				t.Errorf("got %+v", search)
+			}
+		})
+	}
+
+	// the filter is translated into the configuration
+	retrieval, err := retrievalConfiguration(&cfg, RetrievalOptions{Filter: &MetadataFilter{Equals: &FilterCondition{Key: "team", Value: "hr"}}})
+
+	if err != nil || !reflect.DeepEqual(retrieval.VectorSearchConfiguration.Filter, &types.RetrievalFilterMemberEquals{Value: filterAttribute("team", "hr")}) {
+		t.Errorf("got filter %#v, %v", retrieval.VectorSearchConfiguration.Filter, err)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// the clients and settings behind the pages and endpoints of the server
+type Routes struct {
+	AOSSClient          VectorStore
+	BedrockClient       ModelInvoker
+	KnowledgeBaseClient KnowledgeBaseClient
+	KnowledgeBaseRouter KnowledgeBaseRouter
+	Tools               *ToolRegistry
+	Conversations       ConversationStore
+	Config              *Config
+
+	// folder of the html pages, ./static when empty
+	StaticDir string
+}
+
+// register the pages and endpoints of the server on a new mux
+func NewServeMux(routes Routes) *http.ServeMux {
+
+	cfg := routes.Config
+
+	staticDir := routes.StaticDir
+	if staticDir == "" {
+		staticDir = "./static"
+	}
+
+	// a page of the static folder
+	page := func(name string) func(w http.ResponseWriter, r *http.Request) {
+		return func(w http.ResponseWriter, r *http.Request) {
+			content, error := os.ReadFile(filepath.Join(staticDir, name))
+			if error != nil {
+				fmt.Println(error)
+			}
+			w.Write(content)
+		}
+	}
+
+	// create handler multiplexer
+	mux := http.NewServeMux()
+
+	// frontend claude haiku
+	mux.HandleFunc("/", page("chat.html"))
+
+	// backend claude haiku
+	mux.HandleFunc("/bedrock-haiku", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			HandleChat(w, r, routes.BedrockClient, cfg, routes.Tools, routes.Conversations)
+		}
+	})
+
+	// chat sessions
+	conversations := func(w http.ResponseWriter, r *http.Request) {
+		HandleConversations(w, r, routes.Conversations)
+	}
+	mux.HandleFunc("/conversations", conversations)
+	mux.HandleFunc("/conversations/", conversations)
+
+	// openai compatible chat completions backed by bedrock
+	mux.HandleFunc("/v1/chat/completions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			HandleOpenAIChatCompletions(w, r, routes.BedrockClient, cfg)
+		}
+	})
+
+	// configured models and their capabilities
+	mux.HandleFunc("/models", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			HandleListModels(w, r, cfg)
+		}
+	})
+
+	// bedrock frontend for image analyzer
+	mux.HandleFunc("/image", page("image.html"))
+
+	// bedrock backend to analyze image
+	mux.HandleFunc("/claude-haiku-image", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			HandleImageAnalyzer(w, r, routes.BedrockClient, cfg)
+		}
+	})
+
+	// magic mirror frontend
+	mux.HandleFunc("/mirror", page("mirror.html"))
+
+	// knowledge based retrieve frontend
+	mux.HandleFunc("/retrieve", page("retrieve.html"))
+
+	// knowledge based retrieve backend
+	mux.HandleFunc("/knowledge-base-retrieve", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			HandleRetrieve(w, r, routes.KnowledgeBaseClient, routes.KnowledgeBaseRouter, cfg)
+		}
+	})
+
+	// knowledge based retrieve and generate frontend
+	mux.HandleFunc("/retrieve-generate", page("retrieve-and-generate.html"))
+
+	// knowledge based retrieve and generate backend
+	mux.HandleFunc("/knowledge-base-retrieve-and-generate", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			HandleRetrieveAndGenerate(w, r, routes.KnowledgeBaseClient, routes.BedrockClient, routes.KnowledgeBaseRouter, cfg)
+		}
+	})
+
+	// knowledge base prompt templates and their preview
+	promptTemplates := func(w http.ResponseWriter, r *http.Request) {
+		HandlePromptTemplates(w, r, cfg)
+	}
+	mux.HandleFunc("/prompt-templates", promptTemplates)
+	mux.HandleFunc("/prompt-templates/", promptTemplates)
+
+	// handle aoss index frontend
+	mux.HandleFunc("/aoss-index", page("aoss-index.html"))
+
+	// handle index to aoss
+	mux.HandleFunc("/aoss-index-backend", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			HandleAOSSIndex(w, r, routes.AOSSClient, routes.BedrockClient, cfg)
+		}
+	})
+
+	// handle bulk index of json lines or csv to aoss
+	mux.HandleFunc("/aoss-bulk-index", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			HandleAOSSBulkIndex(w, r, routes.AOSSClient, routes.BedrockClient, cfg)
+		}
+	})
+
+	// handle upload of pdf, markdown, html, docx and text files to aoss
+	mux.HandleFunc("/aoss-upload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			HandleAOSSUpload(w, r, routes.AOSSClient, routes.BedrockClient, cfg)
+		}
+	})
+
+	// handle hybrid search of aoss by meaning and by words
+	mux.HandleFunc("/aoss-hybrid-search", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			HandleAOSSHybridSearch(w, r, routes.AOSSClient, routes.BedrockClient, cfg)
+		}
+	})
+
+	// handle search of aoss by meaning, or for notes like another
+	mux.HandleFunc("/aoss-vector-search", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			HandleAOSSQueryByVector(w, r, routes.AOSSClient, routes.BedrockClient, cfg)
+		}
+	})
+
+	// handle aoss query frontend
+	mux.HandleFunc("/aoss-query", page("aoss-query.html"))
+
+	// handle query to aoss backend
+	mux.HandleFunc("/aoss-query-backend", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			HandleAOSSQueryByTitle(w, r, routes.AOSSClient, routes.BedrockClient, cfg)
+		}
+	})
+
+	// note index administration, off unless adminToken is set
+	indexAdmin := func(w http.ResponseWriter, r *http.Request) {
+		HandleIndexAdmin(w, r, routes.AOSSClient, routes.BedrockClient, cfg)
+	}
+	mux.HandleFunc("/admin/index", indexAdmin)
+	mux.HandleFunc("/admin/index/", indexAdmin)
+
+	return mux
+}
@@ -0,0 +1,329 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/opensearch-project/opensearch-go/v2/opensearchapi"
+)
+
+const (
+	// largest page of search results
+	maxSearchSize = 100
+
+	// deepest hit reachable with from and size, the max_result_window of
+	// the index
+	maxSearchWindow = 10000
+
+	// nearest neighbours a vector search ranks by default, pages past them
+	// are empty
+	vectorSearchK = 100
+
+	// most nearest neighbours a vector search ranks
+	maxVectorSearchK = 10000
+
+	// characters of the text of a hit shown when no fragment matched
+	snippetLength = 200
+)
+
+// a document id is not in the note index
+var ErrDocumentNotFound = errors.New("document does not exist")
+
+// a page of search results, Size hits from From, or the Size hits after
+// SearchAfter, the next of a previous page
+type SearchPage struct {
+	From        int           `json:"from,omitempty"`
+	Size        int           `json:"size,omitempty"`
+	SearchAfter []interface{} `json:"searchAfter,omitempty"`
+}
+
+// the page with size defaulting to size, checked
+func (p SearchPage) withSize(size int) (SearchPage, error) {
+
+	if p.Size == 0 {
+		p.Size = size
+	}
+
+	var errs []error
+
+	if p.Size < 1 || p.Size > maxSearchSize {
+		errs = append(errs, fmt.Errorf("size must be between 1 and %d, got %d", maxSearchSize, p.Size))
+	}
+
+	if p.From < 0 {
+		errs = append(errs, fmt.Errorf("from must not be negative, got %d", p.From))
+	}
+
+	if p.From+p.Size > maxSearchWindow {
+		errs = append(errs, fmt.Errorf("from + size must be at most %d, page with searchAfter instead", maxSearchWindow))
+	}
+
+	if p.From > 0 && len(p.SearchAfter) > 0 {
+		errs = append(errs, errors.New("from and searchAfter cannot both be set"))
+	}
+
+	return p, errors.Join(errs...)
+}
+
+// set the paging, sort and highlighting of a search of the notes for text
+func (p SearchPage) apply(body *SearchBody, text string) {
+
+	body.Size = intPtr(p.Size)
+
+	if p.From > 0 {
+		body.From = intPtr(p.From)
+	}
+
+	// a unique sort, so that search_after resumes where the page ended
+	body.Sort = []map[string]SortOrder{
+		{"_score": {Order: "desc"}},
+		{"parent_id": {Order: "asc", Missing: "_last"}},
+		{"chunk_index": {Order: "asc"}},
+	}
+
+	body.SearchAfter = p.SearchAfter
+	body.TrackTotalHits = true
+	body.Source = excludeVector()
+
+	// the whole title and the best three fragments of the text, html escaped
+	// but for the <em> tags around the matching words
+	whole, fragments := 0, 3
+
+	body.Highlight = &Highlight{
+		Fields: map[string]HighlightField{
+			"title": {NumberOfFragments: &whole},
+			"text":  {FragmentSize: 150, NumberOfFragments: &fragments},
+		},
+		Encoder: "html",
+	}
+
+	// a knn query has no words to highlight, nor has a search for documents
+	// like another
+	if body.Query.Knn != nil && text != "" {
+		query := MultiMatch(text, "title", "text")
+		body.Highlight.HighlightQuery = &query
+	}
+}
+
+// the search body of the k notes closest in meaning to text, whose vector is
+// vec, among those matching filter when not nil; k of 0 ranks vectorSearchK
+// notes or the whole page when more
+func vectorSearchBody(vec []float64, text string, page SearchPage, k int, filter *SearchQuery) SearchBody {
+
+	if k == 0 {
+		k = max(page.From+page.Size, vectorSearchK)
+	}
+
+	query := KnnVectorQuery(VectorField, vec, k)
+
+	if filter != nil {
+		knn := query.Knn[VectorField]
+		knn.Filter = filter
+		query.Knn[VectorField] = knn
+	}
+
+	body := SearchBody{Query: query}
+	page.apply(&body, text)
+
+	return body
+}
+
+// fields of the note index a vector search filters by, keywords and numbers
+var filterFields = map[string]bool{"link": true, "parent_id": true, "chunk_index": true}
+
+// the filter of a vector search, exact matches of the given fields, any of
+// the values when a list, all of the fields; exclude leaves out documents
+// matching any of its clauses, nil when there is nothing to filter
+func knnFilter(fields map[string]interface{}, exclude ...SearchQuery) (*SearchQuery, error) {
+
+	var filters []SearchQuery
+
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+
+	for _, field := range names {
+
+		value := fields[field]
+
+		if !filterFields[field] {
+			return nil, fmt.Errorf("filter field %q is not link, parent_id or chunk_index", field)
+		}
+
+		switch value := value.(type) {
+		case string, float64, bool:
+			filters = append(filters, TermQuery(field, value))
+		case []interface{}:
+			filters = append(filters, TermsQuery(field, value...))
+		default:
+			return nil, fmt.Errorf("filter field %q must be a value or a list of values", field)
+		}
+	}
+
+	if len(filters) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+
+	return &SearchQuery{Bool: &BoolQuery{Filter: filters, MustNot: exclude}}, nil
+}
+
+// the stored chunk of a document id of the note index, with its vector
+func documentVector(ctx context.Context, AOSSClient VectorStore, cfg *Config, id string) (IndexDocument, error) {
+
+	data, err := searchNotes(ctx, AOSSClient, cfg, SearchBody{
+		Size:  intPtr(1),
+		Query: SearchQuery{IDs: &IDsQuery{Values: []string{id}}},
+	})
+
+	if err != nil {
+		return IndexDocument{}, err
+	}
+
+	var response AossResponse
+
+	if err := json.Unmarshal(data, &response); err != nil {
+		return IndexDocument{}, err
+	}
+
+	if len(response.Hits.Hits) == 0 {
+		return IndexDocument{}, fmt.Errorf("document %q: %w", id, ErrDocumentNotFound)
+	}
+
+	document := response.Hits.Hits[0].Source
+
+	if len(document.Vector) == 0 {
+		return IndexDocument{}, fmt.Errorf("document %q has no %s", id, VectorField)
+	}
+
+	return document, nil
+}
+
+// the search body of the notes whose title matches text
+func titleSearchBody(text string, page SearchPage) SearchBody {
+
+	body := SearchBody{Query: MultiMatch(text, "title")}
+	page.apply(&body, text)
+
+	return body
+}
+
+// a note found by a search; Snippet is html, the best matching fragment of
+// the text or its beginning, and Highlights the matching fragments by field
+type SearchHit struct {
+	ID         string              `json:"id"`
+	Score      float64             `json:"score"`
+	Title      string              `json:"title"`
+	Link       string              `json:"link"`
+	ParentID   string              `json:"parent_id,omitempty"`
+	Snippet    string              `json:"snippet"`
+	Highlights map[string][]string `json:"highlights,omitempty"`
+}
+
+// a page of search results, Next is the searchAfter of the page after it
+// and is left out on the last page
+type SearchResults struct {
+	Total int           `json:"total"`
+	From  int           `json:"from"`
+	Size  int           `json:"size"`
+	Hits  []SearchHit   `json:"hits"`
+	Next  []interface{} `json:"next,omitempty"`
+}
+
+// the results of a search response for a page, without the vectors
+func DecodeSearchResults(body io.Reader, page SearchPage) (SearchResults, error) {
+
+	var response AossResponse
+
+	if err := json.NewDecoder(body).Decode(&response); err != nil {
+		return SearchResults{}, err
+	}
+
+	results := SearchResults{
+		Total: response.Hits.Total.Value,
+		From:  page.From,
+		Size:  page.Size,
+		Hits:  []SearchHit{},
+	}
+
+	for _, hit := range response.Hits.Hits {
+		results.Hits = append(results.Hits, SearchHit{
+			ID:         hit.ID,
+			Score:      hit.Score,
+			Title:      hit.Source.Title,
+			Link:       hit.Source.Link,
+			ParentID:   hit.Source.ParentID,
+			Snippet:    snippet(hit),
+			Highlights: hit.Highlight,
+		})
+	}
+
+	// a full page may not be the last
+	if hits := response.Hits.Hits; len(hits) == page.Size && len(hits) > 0 {
+		results.Next = hits[len(hits)-1].Sort
+	}
+
+	return results, nil
+}
+
+// the first matching fragment of the text, else the beginning of the text cut
+// at a word
+func snippet(hit AossHit) string {
+
+	if fragments := hit.Highlight["text"]; len(fragments) > 0 {
+		return fragments[0]
+	}
+
+	text := []rune(strings.TrimSpace(hit.Source.Text))
+
+	if len(text) <= snippetLength {
+		return html.EscapeString(string(text))
+	}
+
+	cut := snippetLength
+
+	for cut > snippetLength/2 && !unicode.IsSpace(text[cut]) {
+		cut--
+	}
+
+	if cut == snippetLength/2 {
+		cut = snippetLength
+	}
+
+	return html.EscapeString(strings.TrimSpace(string(text[:cut]))) + " …"
+}
+
+// run a search of the note index and read its response
+func searchNotes(ctx context.Context, AOSSClient VectorStore, cfg *Config, body SearchBody) ([]byte, error) {
+
+	content, err := jsonBody(body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := opensearchapi.SearchRequest{Index: []string{cfg.AOSSNoteAppIndexName}, Body: content}.Do(ctx, AOSSClient)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer response.Body.Close()
+
+	if err := responseError("search "+cfg.AOSSNoteAppIndexName, response); err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(response.Body)
+}
@@ -0,0 +1,156 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSearchPageWithSize(t *testing.T) {
+
+	tests := []struct {
+		name string
+		page SearchPage
+		want SearchPage
+		err  string
+	}{
+		{name: "default size", want: SearchPage{Size: 10}},
+		{name: "page", page: SearchPage{From: 20, Size: 100}, want: SearchPage{From: 20, Size: 100}},
+		{name: "search after", page: SearchPage{Size: 5, SearchAfter: []interface{}{1.5, "p1", 0.0}}, want: SearchPage{Size: 5, SearchAfter: []interface{}{1.5, "p1", 0.0}}},
+		{name: "last page of the window", page: SearchPage{From: 9990}, want: SearchPage{From: 9990, Size: 10}},
+		{name: "negative size", page: SearchPage{Size: -1}, err: "size must be between 1 and 100, got -1"},
+		{name: "size above 100", page: SearchPage{Size: 101}, err: "size must be between 1 and 100, got 101"},
+		{name: "negative from", page: SearchPage{From: -1}, err: "from must not be negative, got -1"},
+		{name: "past the window", page: SearchPage{From: 9991}, err: "from + size must be at most 10000, page with searchAfter instead"},
+		{name: "from and search after", page: SearchPage{From: 10, SearchAfter: []interface{}{1.5}}, err: "from and searchAfter cannot both be set"},
+		{
+			name: "every error", page: SearchPage{From: 10000, Size: 101, SearchAfter: []interface{}{1.5}},
+			err: "size must be between 1 and 100, got 101\nfrom + size must be at most 10000, page with searchAfter instead\nfrom and searchAfter cannot both be set",
+		},
+	}
+
+	for _, test := range tests {
+
+		got, err := test.page.withSize(10)
+
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+
+		if err != nil || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, %v, want %+v", test.name, got, err, test.want)
+		}
+	}
+}
+
+// a search response of n hits, each with a vector and sort values, and a
+// total of total
+func searchHits(n int, total int) string {
+
+	hits := make([]string, n)
+
+	for k := range hits {
+		hits[k] = fmt.Sprintf(`{"_id": "c%d", "_score": %d, "_source": {"title": "note %d", "link": "https://example.com/%d", "text": "text %d", "parent_id": "p%d", "vector_field": [0.25, 0.5]}, "sort": [%d, "p%d", 0]}`, k, n-k, k, k, k, k, n-k, k)
+	}
+
+	return fmt.Sprintf(`{"hits": {"total": {"value": %d}, "hits": [%s]}}`, total, strings.Join(hits, ", "))
+}
+
+func TestDecodeSearchResults(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		body  string
+		page  SearchPage
+		total int
+		hits  int
+		next  []interface{}
+	}{
+		{name: "full page", body: searchHits(3, 10), page: SearchPage{Size: 3}, total: 10, hits: 3, next: []interface{}{1.0, "p2", 0.0}},
+		{name: "last page", body: searchHits(2, 5), page: SearchPage{From: 3, Size: 3}, total: 5, hits: 2},
+		{name: "no hits", body: searchHits(0, 0), page: SearchPage{Size: 3}},
+		// a page of exactly the remaining hits gets a next, which finds nothing
+		{name: "full last page", body: searchHits(3, 3), page: SearchPage{Size: 3}, total: 3, hits: 3, next: []interface{}{1.0, "p2", 0.0}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			results, err := DecodeSearchResults(strings.NewReader(test.body), test.page)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if results.Total != test.total || results.From != test.page.From || results.Size != test.page.Size || len(results.Hits) != test.hits || results.Hits == nil {
+				t.Errorf("got %+v", results)
+			}
+
+			if !reflect.DeepEqual(results.Next, test.next) {
+				t.Errorf("got next %v, want %v", results.Next, test.next)
+			}
+
+			for k, hit := range results.Hits {
+				if want := (SearchHit{ID: fmt.Sprintf("c%d", k), Score: float64(test.hits - k), Title: fmt.Sprintf("note %d", k), Link: fmt.Sprintf("https://example.com/%d", k), ParentID: fmt.Sprintf("p%d", k), Snippet: fmt.Sprintf("text %d", k)}); !reflect.DeepEqual(hit, want) {
+					t.Errorf("got hit %+v, want %+v", hit, want)
+				}
+			}
+
+			data, err := json.Marshal(results)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.Contains(string(data), "vector") || strings.Contains(string(data), "0.25") {
+				t.Errorf("vectors in the results %s", data)
+			}
+		})
+	}
+
+	if _, err := DecodeSearchResults(strings.NewReader(`{"hits": [`), SearchPage{Size: 3}); err == nil {
+		t.Error("no error for a truncated response")
+	}
+}
+
+func TestSnippet(t *testing.T) {
+
+	// words of 5 runes and a space, 2 bytes each
+	words := strings.Repeat("ééééé ", 50)
+
+	tests := []struct {
+		name      string
+		text      string
+		highlight map[string][]string
+		want      string
+	}{
+		{name: "short", text: "  cold starts  ", want: "cold starts"},
+		{name: "escaped", text: `<b>"bold"</b> & more`, want: "&lt;b&gt;&#34;bold&#34;&lt;/b&gt; &amp; more"},
+		{name: "fragment", text: "cold starts", highlight: map[string][]string{"text": {"<em>cold</em> starts", "other"}}, want: "<em>cold</em> starts"},
+		{name: "title fragment only", text: "cold starts", highlight: map[string][]string{"title": {"<em>Lambda</em>"}}, want: "cold starts"},
+		{name: "exactly the length", text: strings.Repeat("x", snippetLength), want: strings.Repeat("x", snippetLength)},
+		// the space before rune 200 is at 197, the bytes are far past it
+		{name: "cut at a word", text: words, want: strings.Repeat("ééééé ", 32) + "ééééé …"},
+		{name: "cut without spaces", text: strings.Repeat("é", 300), want: strings.Repeat("é", snippetLength) + " …"},
+		// a space in the first half is too early to cut at
+		{name: "space too early", text: "a " + strings.Repeat("x", 300), want: "a " + strings.Repeat("x", snippetLength-2) + " …"},
+		{name: "cut escaped", text: strings.Repeat("<", 300), want: strings.Repeat("&lt;", snippetLength) + " …"},
+	}
+
+	for _, test := range tests {
+
+		got := snippet(AossHit{Source: IndexDocument{Text: test.text}, Highlight: test.highlight})
+
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
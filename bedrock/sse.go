@@ -0,0 +1,132 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// server-sent event names emitted by the streaming handlers
+const (
+	EventMessageStart      = "message_start"
+	EventContentBlockDelta = "content_block_delta"
+	EventMessageDelta      = "message_delta"
+	EventError             = "error"
+	EventDone              = "done"
+)
+
+// sse data of the message_start event, Context reports the turns left out
+// to fit the context window
+type MessageStartEvent struct {
+	Model   string      `json:"model"`
+	Usage   Usage       `json:"usage"`
+	Context *TrimReport `json:"context,omitempty"`
+}
+
+// sse data of the content_block_delta event
+type ContentBlockDeltaEvent struct {
+	Index int    `json:"index"`
+	Text  string `json:"text"`
+}
+
+// sse data of the message_delta event
+type MessageDeltaEvent struct {
+	StopReason   string `json:"stop_reason"`
+	StopSequence string `json:"stop_sequence,omitempty"`
+	Usage        Usage  `json:"usage"`
+}
+
+// sse data of the error event
+type ErrorEvent struct {
+	Message string `json:"message"`
+}
+
+// report whether the client asked for text/event-stream in the Accept header
+func WantsEventStream(r *http.Request) bool {
+
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err == nil && mediaType == "text/event-stream" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// write server-sent events and flush each one to the client
+//
+// once a write fails or panics every later event returns the same error
+type SSEWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	err     error
+}
+
+// set the event stream headers, they are sent with the first event
+func NewSSEWriter(w http.ResponseWriter) *SSEWriter {
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	flusher, _ := w.(http.Flusher)
+
+	return &SSEWriter{w: w, flusher: flusher}
+}
+
+// write one event with data encoded as a single line of json
+func (s *SSEWriter) Event(name string, data interface{}) error {
+
+	payload, err := json.Marshal(data)
+
+	if err != nil {
+		return err
+	}
+
+	return s.write(fmt.Sprintf("event: %s\ndata: %s\n\n", name, payload))
+}
+
+// write an unnamed event whose data is payload as is
+func (s *SSEWriter) Data(payload []byte) error {
+	return s.write(fmt.Sprintf("data: %s\n\n", payload))
+}
+
+func (s *SSEWriter) write(frame string) (err error) {
+
+	if s.err != nil {
+		return s.err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("sse writer: %v", r)
+		}
+		if err != nil {
+			s.err = err
+		}
+	}()
+
+	if _, err := io.WriteString(s.w, frame); err != nil {
+		return err
+	}
+
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+
+	return nil
+}
+
+// write an error event followed by done
+func (s *SSEWriter) Error(err error) {
+	s.Event(EventError, ErrorEvent{Message: err.Error()})
+	s.Event(EventDone, struct{}{})
+}
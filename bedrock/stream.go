@@ -0,0 +1,149 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// largest piece written to the client in one call, huge deltas are split
+const maxStreamWrite = 32 * 1024
+
+// write model output deltas to a client as they arrive
+type StreamWriter interface {
+	WriteDelta(text string) error
+	Close() error
+}
+
+// write deltas verbatim as plain text, or html escaped when EscapeHTML is set
+//
+// model output is never interpreted: a rune split across two deltas is held
+// back until it is complete so escaping never sees half a character, invalid
+// utf-8 is written as U+FFFD, and once a write fails or panics every later
+// call returns the same error
+type TextStreamWriter struct {
+	EscapeHTML bool
+
+	w       io.Writer
+	flusher http.Flusher
+	pending []byte
+	err     error
+}
+
+// set the content type for the chosen mode, plain text is marked nosniff so
+// browsers never render model output as html
+func NewTextStreamWriter(w http.ResponseWriter, escapeHTML bool) *TextStreamWriter {
+
+	if escapeHTML {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+
+	flusher, _ := w.(http.Flusher)
+
+	return &TextStreamWriter{EscapeHTML: escapeHTML, w: w, flusher: flusher}
+}
+
+func (s *TextStreamWriter) WriteDelta(text string) error {
+
+	if s.err != nil {
+		return s.err
+	}
+
+	s.pending = append(s.pending, text...)
+
+	// keep an incomplete trailing rune for the next delta
+	n := completePrefix(s.pending)
+
+	if n == 0 {
+		return nil
+	}
+
+	out := string(s.pending[:n])
+	s.pending = append(s.pending[:0], s.pending[n:]...)
+
+	return s.write(out)
+}
+
+// write whatever is still pending, an unfinished rune becomes U+FFFD
+func (s *TextStreamWriter) Close() error {
+
+	if s.err != nil {
+		return s.err
+	}
+
+	if len(s.pending) == 0 {
+		return nil
+	}
+
+	// only the start of one rune is ever pending
+	s.pending = nil
+
+	return s.write(string(utf8.RuneError))
+}
+
+func (s *TextStreamWriter) write(text string) (err error) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("stream writer: %v", r)
+		}
+		if err != nil {
+			s.err = err
+		}
+	}()
+
+	// invalid bytes would leave no rune start to split the text at
+	text = strings.ToValidUTF8(text, string(utf8.RuneError))
+
+	if s.EscapeHTML {
+		text = html.EscapeString(text)
+	}
+
+	for len(text) > 0 {
+		size := len(text)
+		if size > maxStreamWrite {
+			// split between runes, so each write is valid utf-8
+			size = maxStreamWrite
+			for size > 0 && !utf8.RuneStart(text[size]) {
+				size--
+			}
+		}
+
+		if _, err := io.WriteString(s.w, text[:size]); err != nil {
+			return err
+		}
+
+		text = text[size:]
+	}
+
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+
+	return nil
+}
+
+// length of the longest prefix of b which does not end in the middle of a rune
+func completePrefix(b []byte) int {
+
+	// a rune is at most utf8.UTFMax bytes, so only the tail needs checking
+	for k := len(b) - 1; k >= 0 && k >= len(b)-utf8.UTFMax; k-- {
+		if utf8.RuneStart(b[k]) {
+			if utf8.FullRune(b[k:]) {
+				return len(b)
+			}
+			return k
+		}
+	}
+
+	return len(b)
+}
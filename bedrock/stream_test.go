@@ -0,0 +1,188 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// a ResponseWriter recording each write, failing or panicking from the
+// write numbered failAt when set
+type recordingWriter struct {
+	header  http.Header
+	writes  []string
+	failAt  int
+	panics  bool
+	flushes int
+}
+
+func (w *recordingWriter) Header() http.Header {
+	if w.header == nil {
+		w.header = http.Header{}
+	}
+	return w.header
+}
+
+func (w *recordingWriter) WriteHeader(status int) {}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.failAt > 0 && len(w.writes)+1 >= w.failAt {
+		if w.panics {
+			panic("connection reset")
+		}
+		return 0, errors.New("broken pipe")
+	}
+	w.writes = append(w.writes, string(b))
+	return len(b), nil
+}
+
+func (w *recordingWriter) Flush() {
+	w.flushes++
+}
+
+func TestTextStreamWriter(t *testing.T) {
+
+	smile := "😀"
+	huge := strings.Repeat("é<", maxStreamWrite)
+
+	tests := []struct {
+		name       string
+		escapeHTML bool
+		deltas     []string
+		want       string
+	}{
+		{"plain text", false, []string{"Hello", ", ", "world"}, "Hello, world"},
+		{"template syntax", false, []string{"{{.Secret}}", " {{template \"x\"}}", "{{"}, "{{.Secret}} {{template \"x\"}}{{"},
+		{"html verbatim", false, []string{"<script>alert(1)</script>"}, "<script>alert(1)</script>"},
+		{"html escaped", true, []string{"<b>", "&amp;", "\"'"}, "&lt;b&gt;&amp;amp;&#34;&#39;"},
+		{"two byte rune split", false, []string{"caf\xc3", "\xa9 au lait"}, "café au lait"},
+		{"four byte rune split one three", false, []string{smile[:1], smile[1:]}, smile},
+		{"four byte rune split byte by byte", true, []string{smile[:1], smile[1:2], smile[2:3], smile[3:], "<"}, smile + "&lt;"},
+		{"rune split and escaped", true, []string{"<\xc3", "\xa9>"}, "&lt;é&gt;"},
+		{"unfinished rune at close", false, []string{"ok", smile[:2]}, "ok�"},
+		{"empty deltas", false, []string{"", "a", "", ""}, "a"},
+		{"huge chunk", false, []string{huge}, huge},
+		{"huge chunk escaped", true, []string{huge}, strings.ReplaceAll(huge, "<", "&lt;")},
+		{"invalid utf-8", false, []string{"a\xffb", "\xc3", "c"}, "a�b�c"},
+		{"huge invalid utf-8", false, []string{strings.Repeat("\x80", 40000)}, "�"},
+		{"huge chunk with invalid utf-8", true, []string{huge + "\x80<" + huge}, strings.ReplaceAll(huge+"�<"+huge, "<", "&lt;")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			w := &recordingWriter{}
+			out := NewTextStreamWriter(w, test.escapeHTML)
+
+			for _, delta := range test.deltas {
+				if err := out.WriteDelta(delta); err != nil {
+					t.Fatalf("WriteDelta(%q): %v", delta, err)
+				}
+			}
+
+			if err := out.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			if got := strings.Join(w.writes, ""); got != test.want {
+				t.Errorf("wrote %q, want %q", abbreviate(got), abbreviate(test.want))
+			}
+
+			for k, write := range w.writes {
+				if len(write) > maxStreamWrite {
+					t.Errorf("write %d has %d bytes, more than %d", k, len(write), maxStreamWrite)
+				}
+				if !utf8.ValidString(write) {
+					t.Errorf("write %d is not valid utf-8: %q", k, abbreviate(write))
+				}
+			}
+
+			if len(w.writes) > 0 && w.flushes == 0 {
+				t.Error("stream was never flushed")
+			}
+		})
+	}
+}
+
+func TestTextStreamWriterContentType(t *testing.T) {
+
+	tests := []struct {
+		escapeHTML  bool
+		contentType string
+		nosniff     string
+	}{
+		{false, "text/plain; charset=utf-8", "nosniff"},
+		{true, "text/html; charset=utf-8", ""},
+	}
+
+	for _, test := range tests {
+
+		w := httptest.NewRecorder()
+		NewTextStreamWriter(w, test.escapeHTML)
+
+		if got := w.Header().Get("Content-Type"); got != test.contentType {
+			t.Errorf("escapeHTML %v: Content-Type %q, want %q", test.escapeHTML, got, test.contentType)
+		}
+
+		if got := w.Header().Get("X-Content-Type-Options"); got != test.nosniff {
+			t.Errorf("escapeHTML %v: X-Content-Type-Options %q, want %q", test.escapeHTML, got, test.nosniff)
+		}
+	}
+}
+
+func TestTextStreamWriterFailingWriter(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		panics bool
+		want   string
+	}{
+		{"write error", false, "broken pipe"},
+		{"write panic", true, "stream writer: connection reset"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			w := &recordingWriter{failAt: 2, panics: test.panics}
+			out := NewTextStreamWriter(w, false)
+
+			if err := out.WriteDelta("first"); err != nil {
+				t.Fatalf("first WriteDelta: %v", err)
+			}
+
+			err := out.WriteDelta("second")
+
+			if err == nil || err.Error() != test.want {
+				t.Fatalf("second WriteDelta returned %v, want %q", err, test.want)
+			}
+
+			// the writer stays failed and writes nothing more
+			if later := out.WriteDelta("third"); later != err {
+				t.Errorf("later WriteDelta returned %v, want %v", later, err)
+			}
+
+			if closed := out.Close(); closed != err {
+				t.Errorf("Close returned %v, want %v", closed, err)
+			}
+
+			if len(w.writes) != 1 || w.writes[0] != "first" {
+				t.Errorf("writes %q, want only the first", w.writes)
+			}
+		})
+	}
+}
+
+// the first and last bytes of long strings, for readable failures
+func abbreviate(s string) string {
+	if len(s) <= 80 {
+		return s
+	}
+	return s[:40] + "..." + s[len(s)-40:]
+}
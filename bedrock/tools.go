@@ -0,0 +1,274 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// a function the chat assistant can call
+type Tool interface {
+	// unique name the model uses to call the tool
+	Name() string
+
+	// what the tool does and when to use it, read by the model
+	Description() string
+
+	// json schema of the input object
+	InputSchema() json.RawMessage
+
+	// run the tool on an input matching the schema, the result is sent
+	// back to the model as text
+	Run(ctx context.Context, input json.RawMessage) (string, error)
+}
+
+// claude3 tool definition
+type ToolDefinition struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+// tools by name, safe for concurrent use
+type ToolRegistry struct {
+	mu    sync.RWMutex
+	tools map[string]Tool
+}
+
+func NewToolRegistry(tools ...Tool) *ToolRegistry {
+
+	registry := &ToolRegistry{tools: map[string]Tool{}}
+
+	for _, tool := range tools {
+		registry.Register(tool)
+	}
+
+	return registry
+}
+
+// register a tool, replacing any tool of the same name
+func (r *ToolRegistry) Register(tool Tool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tools[tool.Name()] = tool
+}
+
+func (r *ToolRegistry) Get(name string) (Tool, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	tool, ok := r.tools[name]
+	return tool, ok
+}
+
+// names of the registered tools, sorted
+func (r *ToolRegistry) Names() []string {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.tools))
+
+	for name := range r.tools {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// the tools of the given names, an unknown name is an error
+func (r *ToolRegistry) Select(names []string) ([]Tool, error) {
+
+	tools := make([]Tool, 0, len(names))
+
+	for _, name := range names {
+		tool, ok := r.Get(name)
+		if !ok {
+			return nil, fmt.Errorf("tool %q is not registered", name)
+		}
+		tools = append(tools, tool)
+	}
+
+	return tools, nil
+}
+
+// claude3 definitions of tools
+func ToolDefinitions(tools []Tool) []ToolDefinition {
+
+	definitions := make([]ToolDefinition, 0, len(tools))
+
+	for _, tool := range tools {
+		definitions = append(definitions, ToolDefinition{
+			Name:        tool.Name(),
+			Description: tool.Description(),
+			InputSchema: tool.InputSchema(),
+		})
+	}
+
+	return definitions
+}
+
+// a tool backed by a function, for example a ticket lookup
+type FuncTool struct {
+	ToolName        string
+	ToolDescription string
+	Schema          json.RawMessage
+	Func            func(ctx context.Context, input json.RawMessage) (string, error)
+}
+
+func (t FuncTool) Name() string                 { return t.ToolName }
+func (t FuncTool) Description() string          { return t.ToolDescription }
+func (t FuncTool) InputSchema() json.RawMessage { return t.Schema }
+
+func (t FuncTool) Run(ctx context.Context, input json.RawMessage) (string, error) {
+	return t.Func(ctx, input)
+}
+
+// add, subtract, multiply or divide two numbers
+type CalculatorTool struct{}
+
+func (CalculatorTool) Name() string { return "calculator" }
+
+func (CalculatorTool) Description() string {
+	return "Add, subtract, multiply or divide two numbers. Use it for any arithmetic instead of computing the result yourself."
+}
+
+func (CalculatorTool) InputSchema() json.RawMessage {
+	return json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"operation": {"type": "string", "enum": ["add", "subtract", "multiply", "divide"]},
+			"a": {"type": "number"},
+			"b": {"type": "number"}
+		},
+		"required": ["operation", "a", "b"]
+	}`)
+}
+
+func (CalculatorTool) Run(ctx context.Context, input json.RawMessage) (string, error) {
+
+	var args struct {
+		Operation string   `json:"operation"`
+		A         *float64 `json:"a"`
+		B         *float64 `json:"b"`
+	}
+
+	if err := json.Unmarshal(input, &args); err != nil {
+		return "", err
+	}
+
+	if args.A == nil || args.B == nil {
+		return "", errors.New("a and b are required")
+	}
+
+	a, b := *args.A, *args.B
+
+	switch args.Operation {
+	case "add":
+		return fmt.Sprint(a + b), nil
+	case "subtract":
+		return fmt.Sprint(a - b), nil
+	case "multiply":
+		return fmt.Sprint(a * b), nil
+	case "divide":
+		if b == 0 {
+			return "", errors.New("division by zero")
+		}
+		return fmt.Sprint(a / b), nil
+	default:
+		return "", fmt.Errorf("unknown operation %q", args.Operation)
+	}
+}
+
+// semantic search of the notes in the aoss index
+type AOSSSearchTool struct {
+	AOSSClient    VectorStore
+	BedrockClient ModelInvoker
+	Config        *Config
+}
+
+func (t *AOSSSearchTool) Name() string { return "search_notes" }
+
+func (t *AOSSSearchTool) Description() string {
+	return "Search the indexed notes by meaning and return the closest notes with their title, link and text."
+}
+
+func (t *AOSSSearchTool) InputSchema() json.RawMessage {
+	return json.RawMessage(`{
+		"type": "object",
+		"properties": {
+			"query": {"type": "string", "description": "what to search for"}
+		},
+		"required": ["query"]
+	}`)
+}
+
+func (t *AOSSSearchTool) Run(ctx context.Context, input json.RawMessage) (string, error) {
+
+	var args struct {
+		Query string `json:"query"`
+	}
+
+	if err := json.Unmarshal(input, &args); err != nil {
+		return "", err
+	}
+
+	if args.Query == "" {
+		return "", errors.New("query is required")
+	}
+
+	vec, err := EmbedText(ctx, args.Query, t.BedrockClient, t.Config)
+
+	if err != nil {
+		return "", err
+	}
+
+	response, err := QueryAOSSByVector(ctx, vec, t.AOSSClient, t.Config.AOSSNoteAppIndexName)
+
+	if err != nil {
+		return "", err
+	}
+
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+
+	if err != nil {
+		return "", err
+	}
+
+	if response.IsError() {
+		return "", fmt.Errorf("aoss search: %s", body)
+	}
+
+	hits, err := DecodeChunkHits(bytes.NewReader(body))
+
+	if err != nil {
+		return "", err
+	}
+
+	// return the notes of the closest chunks, without their vectors
+	notes := []IndexItem{}
+
+	for _, document := range GroupByParent(hits) {
+		texts := make([]string, len(document.Chunks))
+		for k, chunk := range document.Chunks {
+			texts[k] = chunk.Text
+		}
+		notes = append(notes, IndexItem{Title: document.Title, Link: document.Link, Text: strings.Join(texts, "\n...\n")})
+	}
+
+	out, err := json.Marshal(notes)
+
+	return string(out), err
+}
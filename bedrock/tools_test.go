@@ -0,0 +1,77 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package bedrock
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCalculatorTool(t *testing.T) {
+
+	tests := []struct {
+		input string
+		want  string
+		err   string // prefix of the error
+	}{
+		{`{"operation": "add", "a": 2, "b": 2}`, "4", ""},
+		{`{"operation": "subtract", "a": 2, "b": 5}`, "-3", ""},
+		{`{"operation": "multiply", "a": 1.5, "b": 4}`, "6", ""},
+		{`{"operation": "divide", "a": 1, "b": 4}`, "0.25", ""},
+		{`{"operation": "divide", "a": 0, "b": 4}`, "0", ""},
+		{`{"operation": "add", "a": 0, "b": 0}`, "0", ""},
+		{`{"operation": "divide", "a": 1, "b": 0}`, "", "division by zero"},
+		{`{"operation": "power", "a": 2, "b": 3}`, "", `unknown operation "power"`},
+		{`{"operation": "add", "a": 2}`, "", "a and b are required"},
+		{`{}`, "", "a and b are required"},
+		{`{"operation": "add", "a": "2", "b": 2}`, "", "json: cannot unmarshal string"},
+		{`[1, 2]`, "", "json: cannot unmarshal array"},
+	}
+
+	for _, test := range tests {
+
+		got, err := CalculatorTool{}.Run(context.Background(), json.RawMessage(test.input))
+
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %q", test.input, err, test.err)
+			}
+			continue
+		}
+
+		if err != nil || got != test.want {
+			t.Errorf("%s: got %q, %v, want %q", test.input, got, err, test.want)
+		}
+	}
+}
+
+func TestToolRegistry(t *testing.T) {
+
+	lookup := FuncTool{ToolName: "lookup", Func: func(ctx context.Context, input json.RawMessage) (string, error) { return "", nil }}
+
+	registry := NewToolRegistry(CalculatorTool{}, lookup)
+
+	if names := registry.Names(); !reflect.DeepEqual(names, []string{"calculator", "lookup"}) {
+		t.Errorf("got names %q", names)
+	}
+
+	tools, err := registry.Select([]string{"lookup", "calculator"})
+
+	if err != nil || len(tools) != 2 || tools[0].Name() != "lookup" || tools[1].Name() != "calculator" {
+		t.Errorf("got tools %v, %v", tools, err)
+	}
+
+	if _, err := registry.Select([]string{"calculator", "weather"}); err == nil || err.Error() != `tool "weather" is not registered` {
+		t.Errorf("got error %v for an unknown tool", err)
+	}
+
+	definitions := ToolDefinitions([]Tool{CalculatorTool{}})
+
+	if len(definitions) != 1 || definitions[0].Name != "calculator" || !json.Valid(definitions[0].InputSchema) {
+		t.Errorf("got definitions %+v", definitions)
+	}
+}
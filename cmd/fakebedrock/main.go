@@ -0,0 +1,36 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+// fakebedrock serves an emulated bedrock runtime for offline development
+//
+//	go run ./cmd/fakebedrock -addr :4000
+//	BEDROCK_ENDPOINT=http://localhost:4000 AWS_ACCESS_KEY_ID=fake AWS_SECRET_ACCESS_KEY=fake go run main.go
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+
+	"entest/gobedrock/fakebedrock"
+)
+
+func main() {
+
+	addr := flag.String("addr", ":4000", "address to listen on")
+	dimension := flag.Int("dimension", 0, "size of every titan embedding vector, the size of each model when 0")
+	reply := flag.String("reply", "", "scripted claude answer streamed word by word, echoes the user when empty")
+	flag.Parse()
+
+	server := fakebedrock.New()
+	server.Dimension = *dimension
+
+	if *reply != "" {
+		server.Script = strings.SplitAfter(*reply, " ")
+	}
+
+	log.Printf("fake bedrock runtime listening on %s", *addr)
+
+	log.Fatal(http.ListenAndServe(*addr, server))
+}
@@ -0,0 +1,155 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+// ingest embeds notes from json lines or csv files, and pdf, markdown, html,
+// docx and text files, and writes them to the aoss note index in bulk,
+// reading json lines or csv from standard input when no file is given
+//
+//	go run ./cmd/ingest -config config.yaml notes.jsonl more-notes.csv
+//	go run ./cmd/ingest handbook.pdf docs/*.md
+//	cat notes.jsonl | go run ./cmd/ingest -report report.json
+package main
+
+import (
+	"context"
+	"encoding/json"
+	gobedrock "entest/gobedrock/bedrock"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+)
+
+func main() {
+
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "path to a yaml or json config file")
+	format := flag.String("format", "", "format of json lines or csv input, by default from the file extension")
+	workers := flag.Int("workers", 0, "concurrent embedding requests, ingestWorkers of the config when 0")
+	batchSize := flag.Int("batch-size", 0, "documents per _bulk request, ingestBatchSize of the config when 0")
+	reportFile := flag.String("report", "", "write the per document report to this file")
+	flag.Parse()
+
+	// the config file and environment variables still apply
+	var args []string
+	if *configFile != "" {
+		args = []string{"-config", *configFile}
+	}
+
+	cfg, err := gobedrock.LoadConfig(args)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *workers > 0 {
+		cfg.IngestWorkers = *workers
+	}
+
+	if *batchSize > 0 {
+		cfg.IngestBatchSize = *batchSize
+	}
+
+	if err := cfg.Validate(); err != nil {
+		log.Fatal(err)
+	}
+
+	var items []gobedrock.IndexItem
+
+	if flag.NArg() == 0 {
+		items, err = readItems(os.Stdin, "stdin", *format)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for _, name := range flag.Args() {
+
+		// pdf, markdown, html, docx and text files are notes of their own
+		if gobedrock.IsLoadable(name) && *format == "" {
+
+			data, err := os.ReadFile(name)
+
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			document, err := gobedrock.LoadFile(name, data)
+
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			items = append(items, document.IndexItem(""))
+			continue
+		}
+
+		file, err := os.Open(name)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		read, err := readItems(file, name, *format)
+		file.Close()
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		items = append(items, read...)
+	}
+
+	clients, err := gobedrock.NewAWSClients(context.Background(), &cfg)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// stop queueing documents on ctrl-c, the report still lists them
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	report := gobedrock.Ingest(ctx, clients.AOSS, gobedrock.NewModelInvoker(clients.Bedrock), &cfg, items)
+
+	for _, item := range report.Items {
+		if !item.Indexed {
+			fmt.Printf("%d %q: %s\n", item.Index, item.Title, item.Error)
+		}
+	}
+
+	fmt.Printf("%d documents, %d indexed, %d failed\n", report.Total, report.Indexed, report.Failed)
+
+	if *reportFile != "" {
+
+		data, err := json.MarshalIndent(report, "", "  ")
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := os.WriteFile(*reportFile, data, 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func readItems(r io.Reader, name string, format string) ([]gobedrock.IndexItem, error) {
+
+	if format == "" {
+		format = gobedrock.IngestFormat(name)
+	}
+
+	items, err := gobedrock.ReadIndexItems(r, format)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return items, nil
+}
@@ -0,0 +1,542 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+// package fakebedrock emulates the bedrock runtime wire protocol so the real
+// sdk clients can run offline by pointing their BaseEndpoint at this server
+//
+// supported operations
+//
+//	POST /model/{modelId}/invoke                      titan embeddings and claude3 messages
+//	POST /model/{modelId}/invoke-with-response-stream claude3 messages as an aws event stream
+//	POST /model/{modelId}/converse                    converse messages of any model
+//	POST /model/{modelId}/converse-stream             converse messages as an aws event stream
+package fakebedrock
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws/protocol/eventstream"
+)
+
+// default embedding size of amazon.titan-embed-text-v1, and of titan
+// embedding models the server does not know
+const DefaultDimension = 1536
+
+// an embedding model, dimensions lists the sizes a request may ask for,
+// none when the model takes no dimensions
+type embeddingModel struct {
+	dimension  int
+	dimensions []int
+}
+
+var embeddingModels = map[string]embeddingModel{
+	"amazon.titan-embed-text-v1":    {dimension: 1536},
+	"amazon.titan-embed-g1-text-02": {dimension: 1536},
+	"amazon.titan-embed-text-v2:0":  {dimension: 1024, dimensions: []int{256, 512, 1024}},
+}
+
+// an emulated bedrock runtime
+type Server struct {
+	// deltas streamed back for every claude request, when empty the server
+	// echoes the text of the last user message word by word
+	Script []string
+
+	// embedding size returned for every titan model when set, by default
+	// each model answers with its own size, or the dimensions it is asked for
+	Dimension int
+
+	mu       sync.Mutex
+	requests []Request
+}
+
+// a request received by the server
+type Request struct {
+	Operation string
+	ModelID   string
+	Body      []byte
+}
+
+func New() *Server {
+	return &Server{}
+}
+
+// requests received so far, in call order
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	// path is /model/{modelId}/{operation}, the model id is url encoded
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+
+	if r.Method != http.MethodPost || len(parts) != 3 || parts[0] != "model" {
+		writeError(w, http.StatusNotFound, "UnknownOperationException", "unknown operation "+r.Method+" "+r.URL.Path)
+		return
+	}
+
+	modelID, err := url.PathUnescape(parts[1])
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "ValidationException", "invalid model id")
+		return
+	}
+
+	var body bytes.Buffer
+
+	if _, err := body.ReadFrom(r.Body); err != nil {
+		writeError(w, http.StatusBadRequest, "ValidationException", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, Request{Operation: parts[2], ModelID: modelID, Body: body.Bytes()})
+	s.mu.Unlock()
+
+	switch {
+	case parts[2] == "invoke" && isEmbeddingModel(modelID):
+		s.invokeEmbedding(w, modelID, body.Bytes())
+	case parts[2] == "invoke" && isClaudeModel(modelID):
+		s.invokeClaude(w, body.Bytes())
+	case parts[2] == "invoke-with-response-stream" && isClaudeModel(modelID):
+		s.invokeClaudeStream(w, body.Bytes())
+	case parts[2] == "converse":
+		s.converse(w, body.Bytes())
+	case parts[2] == "converse-stream":
+		s.converseStream(w, body.Bytes())
+	default:
+		writeError(w, http.StatusBadRequest, "ValidationException", fmt.Sprintf("model %s does not support %s", modelID, parts[2]))
+	}
+}
+
+func isEmbeddingModel(modelID string) bool {
+	return strings.HasPrefix(modelID, "amazon.titan-embed")
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func isClaudeModel(modelID string) bool {
+	return strings.HasPrefix(modelID, "anthropic.claude-3") || strings.Contains(modelID, ".anthropic.claude-3")
+}
+
+// error body in the shape returned by bedrock
+func writeError(w http.ResponseWriter, status int, errorType string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Amzn-ErrorType", errorType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+func (s *Server) invokeEmbedding(w http.ResponseWriter, modelID string, body []byte) {
+
+	var request struct {
+		InputText  string `json:"inputText"`
+		Dimensions int    `json:"dimensions"`
+	}
+
+	if err := json.Unmarshal(body, &request); err != nil || request.InputText == "" {
+		writeError(w, http.StatusBadRequest, "ValidationException", "inputText is required")
+		return
+	}
+
+	model, ok := embeddingModels[modelID]
+
+	if !ok {
+		model = embeddingModel{dimension: DefaultDimension}
+	}
+
+	dimension := model.dimension
+
+	// as bedrock, models without dimensions reject the key
+	if request.Dimensions != 0 {
+
+		if !containsInt(model.dimensions, request.Dimensions) {
+			writeError(w, http.StatusBadRequest, "ValidationException", fmt.Sprintf("Malformed input request: %s does not support %d dimensions", modelID, request.Dimensions))
+			return
+		}
+
+		dimension = request.Dimensions
+	}
+
+	if s.Dimension > 0 {
+		dimension = s.Dimension
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"embedding":           Embedding(request.InputText, dimension),
+		"inputTextTokenCount": len(strings.Fields(request.InputText)),
+	})
+}
+
+// deterministic unit vector for a text, equal texts give equal vectors
+func Embedding(text string, dimension int) []float64 {
+
+	h := fnv.New64a()
+	h.Write([]byte(text))
+
+	rng := rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(h.Sum(nil)))))
+
+	vec := make([]float64, dimension)
+	norm := 0.0
+
+	for k := range vec {
+		vec[k] = rng.NormFloat64()
+		norm += vec[k] * vec[k]
+	}
+
+	norm = math.Sqrt(norm)
+
+	for k := range vec {
+		vec[k] /= norm
+	}
+
+	return vec
+}
+
+// claude3 messages request, only the fields the emulator reads
+type claudeRequest struct {
+	Messages []struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	} `json:"messages"`
+}
+
+// the deltas to stream for a claude request
+func (s *Server) deltas(body []byte) ([]string, error) {
+
+	var request claudeRequest
+
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, err
+	}
+
+	if len(request.Messages) == 0 {
+		return nil, fmt.Errorf("messages must not be empty")
+	}
+
+	if len(s.Script) > 0 {
+		return s.Script, nil
+	}
+
+	// echo the text blocks of the last message
+	var blocks []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+
+	last := request.Messages[len(request.Messages)-1].Content
+
+	if err := json.Unmarshal(last, &blocks); err != nil {
+		var text string
+		if err := json.Unmarshal(last, &text); err != nil {
+			return nil, fmt.Errorf("invalid content")
+		}
+		blocks = append(blocks, struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		}{"text", text})
+	}
+
+	var text strings.Builder
+
+	for _, block := range blocks {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+
+	return echo(text.String()), nil
+}
+
+// the words of a text, each with its trailing space
+func echo(text string) []string {
+
+	var deltas []string
+
+	for _, word := range strings.SplitAfter(text, " ") {
+		if word != "" {
+			deltas = append(deltas, word)
+		}
+	}
+
+	return deltas
+}
+
+func (s *Server) invokeClaude(w http.ResponseWriter, body []byte) {
+
+	deltas, err := s.deltas(body)
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "ValidationException", err.Error())
+		return
+	}
+
+	text := strings.Join(deltas, "")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":            "msg_fake",
+		"type":          "message",
+		"role":          "assistant",
+		"content":       []map[string]string{{"type": "text", "text": text}},
+		"stop_reason":   "end_turn",
+		"stop_sequence": nil,
+		"usage": map[string]int{
+			"input_tokens":  len(strings.Fields(string(body))),
+			"output_tokens": len(deltas),
+		},
+	})
+}
+
+// the claude3 chunks of a streamed answer, in the order bedrock sends them
+func claudeChunks(deltas []string, inputTokens int) []interface{} {
+
+	chunks := []interface{}{
+		map[string]interface{}{
+			"type": "message_start",
+			"message": map[string]interface{}{
+				"id":      "msg_fake",
+				"type":    "message",
+				"role":    "assistant",
+				"content": []interface{}{},
+				"usage":   map[string]int{"input_tokens": inputTokens, "output_tokens": 1},
+			},
+		},
+		map[string]interface{}{
+			"type":          "content_block_start",
+			"index":         0,
+			"content_block": map[string]string{"type": "text", "text": ""},
+		},
+	}
+
+	for _, text := range deltas {
+		chunks = append(chunks, map[string]interface{}{
+			"type":  "content_block_delta",
+			"index": 0,
+			"delta": map[string]string{"type": "text_delta", "text": text},
+		})
+	}
+
+	chunks = append(chunks,
+		map[string]interface{}{
+			"type":  "content_block_stop",
+			"index": 0,
+		},
+		map[string]interface{}{
+			"type":  "message_delta",
+			"delta": map[string]interface{}{"stop_reason": "end_turn", "stop_sequence": nil},
+			"usage": map[string]int{"output_tokens": len(deltas)},
+		},
+		map[string]interface{}{
+			"type": "message_stop",
+			"amazon-bedrock-invocationMetrics": map[string]int{
+				"inputTokenCount":   inputTokens,
+				"outputTokenCount":  len(deltas),
+				"invocationLatency": 0,
+				"firstByteLatency":  0,
+			},
+		},
+	)
+
+	return chunks
+}
+
+func (s *Server) invokeClaudeStream(w http.ResponseWriter, body []byte) {
+
+	deltas, err := s.deltas(body)
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "ValidationException", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+	w.Header().Set("X-Amzn-Bedrock-Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := eventstream.NewEncoder()
+
+	for _, chunk := range claudeChunks(deltas, len(strings.Fields(string(body)))) {
+
+		message, err := chunkMessage(chunk)
+
+		if err != nil {
+			return
+		}
+
+		if err := encoder.Encode(w, message); err != nil {
+			return
+		}
+
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+// converse request, only the fields the emulator reads
+type converseRequest struct {
+	Messages []struct {
+		Role    string `json:"role"`
+		Content []struct {
+			Text *string `json:"text"`
+		} `json:"content"`
+	} `json:"messages"`
+}
+
+// the deltas to stream for a converse request and its number of input tokens
+func (s *Server) converseDeltas(body []byte) ([]string, int, error) {
+
+	var request converseRequest
+
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, 0, err
+	}
+
+	if len(request.Messages) == 0 {
+		return nil, 0, fmt.Errorf("messages must not be empty")
+	}
+
+	inputTokens := len(strings.Fields(string(body)))
+
+	if len(s.Script) > 0 {
+		return s.Script, inputTokens, nil
+	}
+
+	var text strings.Builder
+
+	for _, block := range request.Messages[len(request.Messages)-1].Content {
+		if block.Text != nil {
+			text.WriteString(*block.Text)
+		}
+	}
+
+	return echo(text.String()), inputTokens, nil
+}
+
+func converseUsage(inputTokens int, outputTokens int) map[string]int {
+	return map[string]int{"inputTokens": inputTokens, "outputTokens": outputTokens, "totalTokens": inputTokens + outputTokens}
+}
+
+func (s *Server) converse(w http.ResponseWriter, body []byte) {
+
+	deltas, inputTokens, err := s.converseDeltas(body)
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "ValidationException", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"output": map[string]interface{}{
+			"message": map[string]interface{}{
+				"role":    "assistant",
+				"content": []map[string]string{{"text": strings.Join(deltas, "")}},
+			},
+		},
+		"stopReason": "end_turn",
+		"usage":      converseUsage(inputTokens, len(deltas)),
+		"metrics":    map[string]int{"latencyMs": 0},
+	})
+}
+
+func (s *Server) converseStream(w http.ResponseWriter, body []byte) {
+
+	deltas, inputTokens, err := s.converseDeltas(body)
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "ValidationException", err.Error())
+		return
+	}
+
+	// converse events are sent as is, named by the event-type header
+	type event struct {
+		name    string
+		payload interface{}
+	}
+
+	events := []event{{"messageStart", map[string]string{"role": "assistant"}}}
+
+	for _, text := range deltas {
+		events = append(events, event{"contentBlockDelta", map[string]interface{}{"contentBlockIndex": 0, "delta": map[string]string{"text": text}}})
+	}
+
+	events = append(events,
+		event{"contentBlockStop", map[string]int{"contentBlockIndex": 0}},
+		event{"messageStop", map[string]string{"stopReason": "end_turn"}},
+		event{"metadata", map[string]interface{}{"usage": converseUsage(inputTokens, len(deltas)), "metrics": map[string]int{"latencyMs": 0}}},
+	)
+
+	w.Header().Set("Content-Type", "application/vnd.amazon.eventstream")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := eventstream.NewEncoder()
+
+	for _, e := range events {
+
+		payload, err := json.Marshal(e.payload)
+
+		if err != nil {
+			return
+		}
+
+		var headers eventstream.Headers
+		headers.Set(":event-type", eventstream.StringValue(e.name))
+		headers.Set(":content-type", eventstream.StringValue("application/json"))
+		headers.Set(":message-type", eventstream.StringValue("event"))
+
+		if err := encoder.Encode(w, eventstream.Message{Headers: headers, Payload: payload}); err != nil {
+			return
+		}
+
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+// frame a chunk as a bedrock event stream message, the chunk json is base64
+// encoded into the bytes field of a PayloadPart
+func chunkMessage(chunk interface{}) (eventstream.Message, error) {
+
+	chunkBytes, err := json.Marshal(chunk)
+
+	if err != nil {
+		return eventstream.Message{}, err
+	}
+
+	// []byte is marshalled as base64
+	payload, err := json.Marshal(map[string]interface{}{"bytes": chunkBytes})
+
+	if err != nil {
+		return eventstream.Message{}, err
+	}
+
+	var headers eventstream.Headers
+	headers.Set(":event-type", eventstream.StringValue("chunk"))
+	headers.Set(":content-type", eventstream.StringValue("application/json"))
+	headers.Set(":message-type", eventstream.StringValue("event"))
+
+	return eventstream.Message{Headers: headers, Payload: payload}, nil
+}
@@ -0,0 +1,308 @@
+// Copyright Amazon.com, Inc. or its affiliates. All Rights Reserved.
+// SPDX-License-Identifier: MIT-0
+
+package fakebedrock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
+	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime/types"
+)
+
+// a real bedrock runtime client of the emulator
+func newClient(t *testing.T, server *Server) *bedrockruntime.Client {
+
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	return bedrockruntime.New(bedrockruntime.Options{
+		Region:           "us-west-2",
+		BaseEndpoint:     aws.String(httpServer.URL),
+		Credentials:      credentials.NewStaticCredentialsProvider("fake", "fake", ""),
+		RetryMaxAttempts: 1,
+	})
+}
+
+func TestInvokeModelEmbedding(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		modelID   string
+		body      string
+		dimension int // of the server
+		want      int
+		err       string
+	}{
+		{"titan v1", "amazon.titan-embed-text-v1", `{"inputText": "hello"}`, 0, 1536, ""},
+		{"titan g1", "amazon.titan-embed-g1-text-02", `{"inputText": "hello"}`, 0, 1536, ""},
+		{"titan v2", "amazon.titan-embed-text-v2:0", `{"inputText": "hello"}`, 0, 1024, ""},
+		{"titan v2 dimensions", "amazon.titan-embed-text-v2:0", `{"inputText": "hello", "dimensions": 256}`, 0, 256, ""},
+		{"unsupported dimensions", "amazon.titan-embed-text-v2:0", `{"inputText": "hello", "dimensions": 300}`, 0, 0, "does not support 300 dimensions"},
+		{"v1 takes no dimensions", "amazon.titan-embed-text-v1", `{"inputText": "hello", "dimensions": 256}`, 0, 0, "does not support 256 dimensions"},
+		{"unknown titan model", "amazon.titan-embed-next", `{"inputText": "hello"}`, 0, DefaultDimension, ""},
+		{"server dimension", "amazon.titan-embed-text-v2:0", `{"inputText": "hello"}`, 8, 8, ""},
+		{"no text", "amazon.titan-embed-text-v1", `{}`, 0, 0, "inputText is required"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+
+			server := New()
+			server.Dimension = test.dimension
+
+			output, err := newClient(t, server).InvokeModel(context.Background(), &bedrockruntime.InvokeModelInput{
+				ModelId:     aws.String(test.modelID),
+				Body:        []byte(test.body),
+				ContentType: aws.String("application/json"),
+			})
+
+			if test.err != "" {
+				var validation *types.ValidationException
+				if !errors.As(err, &validation) || !strings.Contains(validation.ErrorMessage(), test.err) {
+					t.Fatalf("error %v, want a ValidationException saying %q", err, test.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var response struct {
+				Embedding []float64 `json:"embedding"`
+			}
+
+			if err := json.Unmarshal(output.Body, &response); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(response.Embedding) != test.want {
+				t.Errorf("%d dimensions, want %d", len(response.Embedding), test.want)
+			}
+
+			if requests := server.Requests(); len(requests) != 1 || requests[0].Operation != "invoke" || requests[0].ModelID != test.modelID {
+				t.Errorf("requests %+v", requests)
+			}
+		})
+	}
+}
+
+func TestEmbedding(t *testing.T) {
+
+	a, b, c := Embedding("hello", 64), Embedding("hello", 64), Embedding("world", 64)
+
+	if !reflect.DeepEqual(a, b) {
+		t.Error("equal texts gave different vectors")
+	}
+
+	if reflect.DeepEqual(a, c) {
+		t.Error("different texts gave equal vectors")
+	}
+
+	norm := 0.0
+	for _, x := range a {
+		norm += x * x
+	}
+
+	if math.Abs(norm-1) > 1e-9 {
+		t.Errorf("norm %g, want 1", norm)
+	}
+}
+
+func TestInvokeModelClaude(t *testing.T) {
+
+	server := New()
+
+	output, err := newClient(t, server).InvokeModel(context.Background(), &bedrockruntime.InvokeModelInput{
+		ModelId:     aws.String("anthropic.claude-3-haiku-20240307-v1:0"),
+		Body:        []byte(`{"anthropic_version": "bedrock-2023-05-31", "max_tokens": 100, "messages": [{"role": "user", "content": [{"type": "text", "text": "hello there"}]}]}`),
+		ContentType: aws.String("application/json"),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response struct {
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+		StopReason string `json:"stop_reason"`
+		Usage      struct {
+			OutputTokens int `json:"output_tokens"`
+		} `json:"usage"`
+	}
+
+	if err := json.Unmarshal(output.Body, &response); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(response.Content) != 1 || response.Content[0].Text != "hello there" || response.StopReason != "end_turn" || response.Usage.OutputTokens != 2 {
+		t.Errorf("response %s", output.Body)
+	}
+}
+
+func TestInvokeModelWithResponseStream(t *testing.T) {
+
+	server := New()
+	server.Script = []string{"Hello", " world"}
+
+	output, err := newClient(t, server).InvokeModelWithResponseStream(context.Background(), &bedrockruntime.InvokeModelWithResponseStreamInput{
+		ModelId:     aws.String("anthropic.claude-3-haiku-20240307-v1:0"),
+		Body:        []byte(`{"anthropic_version": "bedrock-2023-05-31", "max_tokens": 100, "messages": [{"role": "user", "content": "hi"}]}`),
+		ContentType: aws.String("application/json"),
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := output.GetStream()
+	defer stream.Close()
+
+	var kinds []string
+	var text strings.Builder
+
+	for event := range stream.Events() {
+
+		chunk, ok := event.(*types.ResponseStreamMemberChunk)
+
+		if !ok {
+			t.Fatalf("event %T", event)
+		}
+
+		var payload struct {
+			Type  string `json:"type"`
+			Delta struct {
+				Text string `json:"text"`
+			} `json:"delta"`
+		}
+
+		if err := json.Unmarshal(chunk.Value.Bytes, &payload); err != nil {
+			t.Fatal(err)
+		}
+
+		kinds = append(kinds, payload.Type)
+
+		if payload.Type == "content_block_delta" {
+			text.WriteString(payload.Delta.Text)
+		}
+	}
+
+	if err := stream.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"message_start", "content_block_start", "content_block_delta", "content_block_delta", "content_block_stop", "message_delta", "message_stop"}
+
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("chunks %v, want %v", kinds, want)
+	}
+
+	if text.String() != "Hello world" {
+		t.Errorf("text %q", text.String())
+	}
+}
+
+func TestConverse(t *testing.T) {
+
+	output, err := newClient(t, New()).Converse(context.Background(), &bedrockruntime.ConverseInput{
+		ModelId:  aws.String("amazon.nova-lite-v1:0"),
+		Messages: []types.Message{{Role: types.ConversationRoleUser, Content: []types.ContentBlock{&types.ContentBlockMemberText{Value: "echo me"}}}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message, ok := output.Output.(*types.ConverseOutputMemberMessage)
+
+	if !ok || len(message.Value.Content) != 1 {
+		t.Fatalf("output %+v", output.Output)
+	}
+
+	if text, ok := message.Value.Content[0].(*types.ContentBlockMemberText); !ok || text.Value != "echo me" {
+		t.Errorf("content %+v", message.Value.Content[0])
+	}
+
+	if output.StopReason != types.StopReasonEndTurn || aws.ToInt32(output.Usage.OutputTokens) != 2 {
+		t.Errorf("stop reason %s, usage %+v", output.StopReason, output.Usage)
+	}
+}
+
+func TestConverseStream(t *testing.T) {
+
+	server := New()
+	server.Script = []string{"one ", "two"}
+
+	output, err := newClient(t, server).ConverseStream(context.Background(), &bedrockruntime.ConverseStreamInput{
+		ModelId:  aws.String("amazon.nova-lite-v1:0"),
+		Messages: []types.Message{{Role: types.ConversationRoleUser, Content: []types.ContentBlock{&types.ContentBlockMemberText{Value: "count"}}}},
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream := output.GetStream()
+	defer stream.Close()
+
+	var text strings.Builder
+	var stop types.StopReason
+	var usage *types.TokenUsage
+	started := false
+
+	for event := range stream.Events() {
+		switch event := event.(type) {
+		case *types.ConverseStreamOutputMemberMessageStart:
+			started = event.Value.Role == types.ConversationRoleAssistant
+		case *types.ConverseStreamOutputMemberContentBlockDelta:
+			if delta, ok := event.Value.Delta.(*types.ContentBlockDeltaMemberText); ok {
+				text.WriteString(delta.Value)
+			}
+		case *types.ConverseStreamOutputMemberMessageStop:
+			stop = event.Value.StopReason
+		case *types.ConverseStreamOutputMemberMetadata:
+			usage = event.Value.Usage
+		}
+	}
+
+	if err := stream.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !started || text.String() != "one two" || stop != types.StopReasonEndTurn || usage == nil || aws.ToInt32(usage.OutputTokens) != 2 {
+		t.Errorf("started %v, text %q, stop %s, usage %+v", started, text.String(), stop, usage)
+	}
+
+	if requests := server.Requests(); len(requests) != 1 || requests[0].Operation != "converse-stream" {
+		t.Errorf("requests %+v", requests)
+	}
+}
+
+func TestUnsupportedOperation(t *testing.T) {
+
+	// titan embedding models do not stream
+	_, err := newClient(t, New()).InvokeModelWithResponseStream(context.Background(), &bedrockruntime.InvokeModelWithResponseStreamInput{
+		ModelId:     aws.String("amazon.titan-embed-text-v1"),
+		Body:        []byte(`{"inputText": "hello"}`),
+		ContentType: aws.String("application/json"),
+	})
+
+	var validation *types.ValidationException
+
+	if !errors.As(err, &validation) || !strings.Contains(validation.ErrorMessage(), "does not support invoke-with-response-stream") {
+		t.Errorf("error %v", err)
+	}
+}
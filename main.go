@@ -12,11 +12,9 @@ import (
 	"os"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockagentruntime"
 	"github.com/aws/aws-sdk-go-v2/service/bedrockruntime"
 	opensearch "github.com/opensearch-project/opensearch-go/v2"
-	requestsigner "github.com/opensearch-project/opensearch-go/v2/signer/awsv2"
 	"github.com/rs/cors"
 )
 
@@ -29,166 +27,83 @@ var BedrockClient *bedrockruntime.Client
 // bedrock agent runtime client
 var BedrockAgentRuntimeClient *bedrockagentruntime.Client
 
-// create an init function to initializing opensearch client
-func init() {
+// bedrock runtime client behind the ModelInvoker interface used by handlers
+var BedrockInvoker gobedrock.ModelInvoker
 
-	//
-	fmt.Println("init and create an opensearch client")
+// runtime configuration
+var Config gobedrock.Config
 
-	// load aws credentials from profile demo using config
-	awsCfg1, err := config.LoadDefaultConfig(context.Background(),
-		config.WithRegion(gobedrock.BEDROCK_REGION),
-	)
+// tools the chat assistant may call
+var Tools *gobedrock.ToolRegistry
 
-	if err != nil {
-		log.Fatal(err)
-	}
+// chat sessions
+var Conversations gobedrock.ConversationStore
 
-	awsCfg2, err := config.LoadDefaultConfig(context.Background(),
-		config.WithRegion(gobedrock.AOSS_REGION),
-	)
+// picks the knowledge bases of requests naming none, nil when routing is off
+var KnowledgeBaseRouter gobedrock.KnowledgeBaseRouter
 
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// create a aws request signer using requestsigner
-	signer, err := requestsigner.NewSignerWithService(awsCfg2, "aoss")
+// create aws clients from the runtime configuration
+func initClients(cfg gobedrock.Config) {
 
-	if err != nil {
-		log.Fatal(err)
-	}
+	fmt.Println("init and create an opensearch client")
 
-	// create an opensearch client using opensearch package
-	AOSSClient, err = opensearch.NewClient(opensearch.Config{
-		Addresses: []string{gobedrock.AOSS_ENDPOINT},
-		Signer:    signer,
-	})
+	clients, err := gobedrock.NewAWSClients(context.Background(), &cfg)
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// create bedrock runtime client
-	BedrockClient = bedrockruntime.NewFromConfig(awsCfg1)
-
-	// create bedrock agent runtime client
-	BedrockAgentRuntimeClient = bedrockagentruntime.NewFromConfig(awsCfg1)
-
+	AOSSClient = clients.AOSS
+	BedrockClient = clients.Bedrock
+	BedrockInvoker = gobedrock.NewModelInvoker(clients.Bedrock)
+	BedrockAgentRuntimeClient = clients.KnowledgeBase
 }
 
 func main() {
 
-	// create handler multiplexer
-	mux := http.NewServeMux()
-
-	// frontend claude haiku
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		content, error := os.ReadFile("./static/chat.html")
-		if error != nil {
-			fmt.Println(error)
-		}
-		w.Write(content)
-	})
-
-	// backend claude haiku
-	mux.HandleFunc("/bedrock-haiku", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "POST" {
-			gobedrock.HandleChat(w, r, BedrockClient)
-		}
-	})
-
-	// bedrock frontend for image analyzer
-	mux.HandleFunc("/image", func(w http.ResponseWriter, r *http.Request) {
-		content, error := os.ReadFile("./static/image.html")
-		if error != nil {
-			fmt.Println(error)
-		}
-		w.Write(content)
-	})
-
-	// bedrock backend to analyze image
-	mux.HandleFunc("/claude-haiku-image", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "POST" {
-			gobedrock.HandleImageAnalyzer(w, r, BedrockClient)
-		}
-	})
+	// load config from file, environment variables and flags
+	cfg, err := gobedrock.LoadConfig(os.Args[1:])
 
-	// magic mirror frontend
-	mux.HandleFunc("/mirror", func(w http.ResponseWriter, r *http.Request) {
-		content, error := os.ReadFile("./static/mirror.html")
-		if error != nil {
-			fmt.Println(error)
-		}
-		w.Write(content)
-	})
-
-	// knowledge based retrieve frontend
-	mux.HandleFunc("/retrieve", func(w http.ResponseWriter, r *http.Request) {
-		content, error := os.ReadFile("./static/retrieve.html")
-		if error != nil {
-			fmt.Println(error)
-		}
-		w.Write(content)
-	})
-
-	// knowledge based retrieve backend
-	mux.HandleFunc("/knowledge-base-retrieve", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "POST" {
-			gobedrock.HandleRetrieve(w, r, BedrockAgentRuntimeClient)
-		}
-	})
-
-	// knowledge based retrieve frontend
-	mux.HandleFunc("/retrieve-generate", func(w http.ResponseWriter, r *http.Request) {
-		content, error := os.ReadFile("./static/retrieve-and-generate.html")
-		if error != nil {
-			fmt.Println(error)
-		}
-		w.Write(content)
-
-	})
-
-	// knowledge based retrieve backend
-	mux.HandleFunc("/knowledge-base-retrieve-and-generate", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "POST" {
-			gobedrock.HandleRetrieveAndGenerate(w, r, BedrockAgentRuntimeClient)
-		}
-	})
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// handle aoss index frontend
-	mux.HandleFunc("/aoss-index", func(w http.ResponseWriter, r *http.Request) {
-		content, error := os.ReadFile("./static/aoss-index.html")
-		if error != nil {
-			fmt.Println(error)
-		}
-		w.Write(content)
+	Config = cfg
 
-	})
+	initClients(Config)
 
-	// handle index to aoss
-	mux.HandleFunc("/aoss-index-backend", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "POST" {
-			gobedrock.HandleAOSSIndex(w, r, AOSSClient, BedrockClient)
-		}
+	Conversations, err = gobedrock.OpenConversationStore(&Config)
 
-	})
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	// handle aoss query frontend
-	mux.HandleFunc("/aoss-query", func(w http.ResponseWriter, r *http.Request) {
-		content, error := os.ReadFile("./static/aoss-query.html")
-		if error != nil {
-			fmt.Println(error)
-		}
-		w.Write(content)
+	Tools = gobedrock.NewToolRegistry(
+		gobedrock.CalculatorTool{},
+		&gobedrock.AOSSSearchTool{AOSSClient: AOSSClient, BedrockClient: BedrockInvoker, Config: &Config},
+	)
 
-	})
+	KnowledgeBaseRouter = gobedrock.NewKnowledgeBaseRouter(&Config, BedrockInvoker)
 
-	// handle query to aoss backend
-	mux.HandleFunc("/aoss-query-backend", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == "POST" {
-			gobedrock.HandleAOSSQueryByTitle(w, r, AOSSClient, BedrockClient)
+	// check the note index mapping, and create the index when createIndex is
+	// set, without holding up the server
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := gobedrock.EnsureIndex(ctx, AOSSClient, &Config); err != nil {
+			fmt.Println(err)
 		}
+	}()
+
+	// pages and endpoints
+	mux := gobedrock.NewServeMux(gobedrock.Routes{
+		AOSSClient:          AOSSClient,
+		BedrockClient:       BedrockInvoker,
+		KnowledgeBaseClient: BedrockAgentRuntimeClient,
+		KnowledgeBaseRouter: KnowledgeBaseRouter,
+		Tools:               Tools,
+		Conversations:       Conversations,
+		Config:              &Config,
 	})
 
 	// allow cors